@@ -0,0 +1,166 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyTolerance is how far the smoothed latency may rise above the best seen
+	// before the limiter backs off.
+	latencyTolerance = 2.0
+	// latencySmoothing weights each new latency in the moving average.
+	latencySmoothing = 0.2
+)
+
+// ConcurrencyStats reports what an adaptive limiter settled on.
+type ConcurrencyStats struct {
+	Initial     int
+	Final       int
+	Peak        int
+	Average     float64 // time-weighted operations in flight
+	Increases   int
+	Decreases   int
+	Throttled   int // operations that hit a 429 or RESOURCE_EXHAUSTED
+	SlowBackoff int // decreases caused by latency rather than throttling
+}
+
+// adaptiveLimiter tunes how many operations run at once instead of a fixed worker
+// count: it adds a slot after a full window of healthy operations, halves on a rate
+// limit, and drops a slot when latency climbs past latencyTolerance times the best
+// smoothed latency seen. After a change it waits a window before changing again, so a
+// burst of 429s from operations already in flight only halves once.
+type adaptiveLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	max      int
+	inFlight int
+
+	sinceChange int
+	ewma        time.Duration
+	best        time.Duration
+
+	stats      ConcurrencyStats
+	lastChange time.Time
+	busyTime   float64 // integral of inFlight over time, in operation-seconds
+	started    time.Time
+}
+
+func newAdaptiveLimiter(initial, ceiling int) *adaptiveLimiter {
+	initial = min(max(initial, 1), ceiling)
+	now := time.Now()
+	l := &adaptiveLimiter{limit: initial, max: ceiling, started: now, lastChange: now}
+	l.cond = sync.NewCond(&l.mu)
+	l.stats = ConcurrencyStats{Initial: initial, Peak: initial}
+	return l
+}
+
+// acquire waits for a free slot, or returns the context's error once it is done.
+func (l *adaptiveLimiter) acquire(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= l.limit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.cond.Wait()
+	}
+	l.account()
+	l.inFlight++
+	return nil
+}
+
+// release frees the slot and feeds the operation's outcome to the controller.
+func (l *adaptiveLimiter) release(latency time.Duration, throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.account()
+	l.inFlight--
+	l.sinceChange++
+
+	if !throttled {
+		if l.ewma == 0 {
+			l.ewma = latency
+		} else {
+			l.ewma += time.Duration(latencySmoothing * float64(latency-l.ewma))
+		}
+		if l.best == 0 || l.ewma < l.best {
+			l.best = l.ewma
+		}
+	}
+
+	settled := l.sinceChange >= l.limit
+	switch {
+	case throttled:
+		l.stats.Throttled++
+		if settled {
+			l.resize(l.limit / 2)
+		}
+	case settled && float64(l.ewma) > latencyTolerance*float64(l.best):
+		if l.limit > 1 {
+			l.stats.SlowBackoff++
+		}
+		l.resize(l.limit - 1)
+	case settled:
+		l.resize(l.limit + 1)
+	}
+	l.cond.Broadcast()
+}
+
+// resize must be called with mu held.
+func (l *adaptiveLimiter) resize(limit int) {
+	limit = min(max(limit, 1), l.max)
+	switch {
+	case limit > l.limit:
+		l.stats.Increases++
+	case limit < l.limit:
+		l.stats.Decreases++
+	default:
+		return
+	}
+	l.limit = limit
+	l.sinceChange = 0
+	l.stats.Peak = max(l.stats.Peak, limit)
+}
+
+// account must be called with mu held, before inFlight changes.
+func (l *adaptiveLimiter) account() {
+	now := time.Now()
+	l.busyTime += float64(l.inFlight) * now.Sub(l.lastChange).Seconds()
+	l.lastChange = now
+}
+
+func (l *adaptiveLimiter) Stats() ConcurrencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.account()
+	stats := l.stats
+	stats.Final = l.limit
+	if elapsed := time.Since(l.started).Seconds(); elapsed > 0 {
+		stats.Average = l.busyTime / elapsed
+	}
+	return stats
+}
+
+// wantsAdaptive reports whether the query parameter key asks for an adaptive limit.
+func wantsAdaptive(r *http.Request, key string) bool {
+	return r.URL.Query().Get(key) == "auto"
+}
+
+func printConcurrencyStats(w http.ResponseWriter, stats ConcurrencyStats) {
+	fmt.Fprintf(w, "| Concurrency: adaptive, started at %d, settled at %d, peak %d, average %.1f in flight\n",
+		stats.Initial, stats.Final, stats.Peak, stats.Average)
+	fmt.Fprintf(w, "| Adjustments: %d up, %d down (%d for latency), %d throttled operations\n",
+		stats.Increases, stats.Decreases, stats.SlowBackoff, stats.Throttled)
+}
@@ -0,0 +1,150 @@
+package gcf
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorReason is what the catalog knows about one API reason string. The explanation
+// lives in the message catalogs under "reason.<name>" so it can be translated.
+type errorReason struct {
+	Category string
+	Doc      string
+}
+
+// reasonCatalog covers the reasons the checks commonly run into. Reasons from both the
+// JSON APIs (googleapi.Error) and gRPC ErrorInfo details are listed.
+var reasonCatalog = map[string]errorReason{
+	"userProjectMissing":        {Category: "userProject", Doc: "https://cloud.google.com/storage/docs/requester-pays"},
+	"userProjectAccountProblem": {Category: "userProject", Doc: "https://cloud.google.com/storage/docs/requester-pays"},
+	"retentionPolicyNotMet":     {Category: "forbidden", Doc: "https://cloud.google.com/storage/docs/bucket-lock"},
+	"objectNotFound":            {Category: "notFound", Doc: "https://cloud.google.com/storage/docs/json_api/v1/status-codes#404-not-found"},
+	"bucketNotFound":            {Category: "notFound", Doc: "https://cloud.google.com/storage/docs/json_api/v1/status-codes#404-not-found"},
+	"notFound":                  {Category: "notFound", Doc: "https://cloud.google.com/storage/docs/json_api/v1/status-codes#404-not-found"},
+	"forbidden":                 {Category: "forbidden", Doc: "https://cloud.google.com/storage/docs/access-control/iam-permissions"},
+	"insufficientPermissions":   {Category: "forbidden", Doc: "https://cloud.google.com/storage/docs/access-control/iam-permissions"},
+	"IAM_PERMISSION_DENIED":     {Category: "forbidden", Doc: "https://cloud.google.com/iam/docs/troubleshooting-access"},
+	"conditionNotMet":           {Category: "precondition", Doc: "https://cloud.google.com/storage/docs/request-preconditions"},
+	"rateLimitExceeded":         {Category: "rateLimited", Doc: "https://cloud.google.com/storage/quotas"},
+	"userRateLimitExceeded":     {Category: "rateLimited", Doc: "https://cloud.google.com/storage/quotas"},
+	"quotaExceeded":             {Category: "rateLimited", Doc: "https://cloud.google.com/docs/quotas"},
+	"RATE_LIMIT_EXCEEDED":       {Category: "rateLimited", Doc: "https://cloud.google.com/docs/quotas"},
+	"accessNotConfigured":       {Category: "apiDisabled", Doc: "https://cloud.google.com/service-usage/docs/enable-disable"},
+	"SERVICE_DISABLED":          {Category: "apiDisabled", Doc: "https://cloud.google.com/service-usage/docs/enable-disable"},
+	"accountDisabled":           {Category: "forbidden", Doc: "https://cloud.google.com/iam/docs/service-accounts-disable-enable"},
+}
+
+// DecodedError is an API error reduced to a category, HTTP status and known reasons.
+type DecodedError struct {
+	Category string
+	Code     int
+	Message  string
+	Reasons  []string
+}
+
+// Doc returns the documentation link for the first reason the catalog knows.
+func (d DecodedError) Doc() string {
+	for _, reason := range d.Reasons {
+		if entry, ok := reasonCatalog[reason]; ok {
+			return entry.Doc
+		}
+	}
+	return ""
+}
+
+// decodeError understands storage sentinel errors, googleapi errors from the JSON APIs
+// and gRPC statuses, so every check explains failures the same way.
+func decodeError(err error) DecodedError {
+	decoded := DecodedError{Category: "unknown"}
+	if err == nil {
+		return decoded
+	}
+	decoded.Message = err.Error()
+
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		decoded.Category, decoded.Code, decoded.Reasons = "notFound", http.StatusNotFound, []string{"objectNotFound"}
+		return decoded
+	case errors.Is(err, storage.ErrBucketNotExist):
+		decoded.Category, decoded.Code, decoded.Reasons = "notFound", http.StatusNotFound, []string{"bucketNotFound"}
+		return decoded
+	}
+
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		decoded.Code = gErr.Code
+		decoded.Message = gErr.Message
+		for _, detail := range gErr.Errors {
+			decoded.Reasons = append(decoded.Reasons, detail.Reason)
+			if detail.Reason == "required" && strings.Contains(detail.Message, "requester pays") {
+				decoded.Reasons = append(decoded.Reasons, "userProjectMissing")
+			}
+		}
+		decoded.Category = categoryFor(decoded.Reasons, httpCategory(gErr.Code))
+		return decoded
+	}
+
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		decoded.Message = st.Message()
+		for _, detail := range st.Details() {
+			if info, ok := detail.(*errdetails.ErrorInfo); ok {
+				decoded.Reasons = append(decoded.Reasons, info.GetReason())
+			}
+		}
+		decoded.Category = categoryFor(decoded.Reasons, grpcCategory(st.Code()))
+	}
+	return decoded
+}
+
+// categoryFor prefers the first catalogued reason over the status code's category.
+func categoryFor(reasons []string, fallback string) string {
+	for _, reason := range reasons {
+		if entry, ok := reasonCatalog[reason]; ok {
+			return entry.Category
+		}
+	}
+	return fallback
+}
+
+func httpCategory(code int) string {
+	switch code {
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "notFound"
+	case http.StatusPreconditionFailed:
+		return "precondition"
+	case http.StatusTooManyRequests:
+		return "rateLimited"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	return "unknown"
+}
+
+func grpcCategory(code codes.Code) string {
+	switch code {
+	case codes.Unauthenticated:
+		return "unauthorized"
+	case codes.PermissionDenied:
+		return "forbidden"
+	case codes.NotFound:
+		return "notFound"
+	case codes.FailedPrecondition:
+		return "precondition"
+	case codes.ResourceExhausted:
+		return "rateLimited"
+	case codes.Unavailable:
+		return "unavailable"
+	}
+	return "unknown"
+}
@@ -0,0 +1,18 @@
+package gcf
+
+import "testing"
+
+func TestReasonCategoriesHaveMessages(t *testing.T) {
+	for reason, entry := range reasonCatalog {
+		for lang, catalog := range messageCatalogs {
+			for _, key := range []string{"explain." + entry.Category, "remediation." + entry.Category} {
+				if _, ok := catalog[key]; !ok {
+					t.Errorf("%s catalog lacks %s, which reason %s needs", lang, key, reason)
+				}
+			}
+		}
+		if _, ok := messageCatalogs[defaultLang]["reason."+reason]; !ok {
+			t.Errorf("%s catalog lacks reason.%s", defaultLang, reason)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Load test baseline modes, from ?baseline=.
+const (
+	BaselineSave    = "save"
+	BaselineCompare = "compare"
+)
+
+var baselineNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// BenchmarkBaseline is a load test run stored for later runs to compare against.
+type BenchmarkBaseline struct {
+	Bucket     string        `json:"bucket"`
+	Operation  string        `json:"operation"`
+	Workers    int           `json:"workers"`
+	Operations int           `json:"operations"`
+	SavedAt    time.Time     `json:"savedAt"`
+	Throughput float64       `json:"throughput"`
+	ErrorRate  float64       `json:"errorRate"`
+	P50        time.Duration `json:"p50"`
+	P90        time.Duration `json:"p90"`
+	P99        time.Duration `json:"p99"`
+	Max        time.Duration `json:"max"`
+}
+
+// BaselineDelta is one metric compared with the baseline. Change is the relative change
+// in percent; Regressed is set when it moved the wrong way by more than the threshold.
+type BaselineDelta struct {
+	Metric    string
+	Baseline  string
+	Current   string
+	Change    float64
+	Regressed bool
+}
+
+func newBenchmarkBaseline(bucket string, result LoadTestResult) BenchmarkBaseline {
+	b := BenchmarkBaseline{
+		Bucket:     bucket,
+		Operation:  result.Operation,
+		Workers:    result.Workers,
+		Operations: result.Operations,
+		SavedAt:    time.Now().UTC(),
+		Throughput: result.Throughput,
+		P50:        result.P50,
+		P90:        result.P90,
+		P99:        result.P99,
+		Max:        result.Max,
+	}
+	if result.Operations > 0 {
+		b.ErrorRate = float64(result.Operations-result.Succeeded) / float64(result.Operations)
+	}
+	return b
+}
+
+// baselineObjectName keeps one baseline per bucket, operation and optional name next to
+// the listing snapshots, e.g. gcf-list-buckets/baselines/my-bucket/read-nightly.json.
+func baselineObjectName(cfg *GCloudFunctionConfig, op, name string) string {
+	object := op
+	if baselineNamePattern.MatchString(name) {
+		object += "-" + name
+	}
+	return cfg.BaselinePrefix + cfg.BucketName + "/" + object + ".json"
+}
+
+// runBaseline saves current as the baseline, or compares it with the stored one.
+// Thresholds are percentages from ?latencyThreshold= and ?throughputThreshold=, falling
+// back to BASELINE_LATENCY_THRESHOLD and BASELINE_THROUGHPUT_THRESHOLD.
+func runBaseline(ctx context.Context, w http.ResponseWriter, r *http.Request, cfg *GCloudFunctionConfig, obj *storage.ObjectHandle, mode string, current BenchmarkBaseline) {
+	if mode == BaselineSave {
+		if err := saveBaseline(ctx, obj, current); err != nil {
+			fmt.Fprintf(w, "Error saving baseline: %v\n", err)
+			return
+		}
+		fmt.Fprintf(w, "Saved baseline gs://%s/%s\n", obj.BucketName(), obj.ObjectName())
+		return
+	}
+
+	previous, err := loadBaseline(ctx, obj)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		fmt.Fprintf(w, "No baseline at gs://%s/%s; save one with POST ?baseline=save.\n", obj.BucketName(), obj.ObjectName())
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(w, "Error reading baseline: %v\n", err)
+		return
+	}
+
+	latencyThreshold := queryPercent(r, "latencyThreshold", cfg.BaselineLatencyThreshold)
+	throughputThreshold := queryPercent(r, "throughputThreshold", cfg.BaselineThroughputThreshold)
+	deltas := compareBaseline(*previous, current, latencyThreshold, throughputThreshold)
+
+	status := "ok"
+	for _, d := range deltas {
+		if d.Regressed {
+			status = "regressed"
+		}
+	}
+	w.Header().Set("X-Benchmark-Status", status)
+	printBaselineDeltas(w, *previous, deltas, latencyThreshold, throughputThreshold)
+}
+
+func compareBaseline(previous, current BenchmarkBaseline, latencyThreshold, throughputThreshold float64) []BaselineDelta {
+	latency := func(metric string, before, after time.Duration) BaselineDelta {
+		change := percentChange(float64(before), float64(after))
+		return BaselineDelta{
+			Metric:    metric,
+			Baseline:  before.Round(time.Millisecond).String(),
+			Current:   after.Round(time.Millisecond).String(),
+			Change:    change,
+			Regressed: change > latencyThreshold,
+		}
+	}
+	throughput := percentChange(previous.Throughput, current.Throughput)
+	return []BaselineDelta{
+		{
+			Metric:    "throughput",
+			Baseline:  fmt.Sprintf("%.1f ops/s", previous.Throughput),
+			Current:   fmt.Sprintf("%.1f ops/s", current.Throughput),
+			Change:    throughput,
+			Regressed: -throughput > throughputThreshold,
+		},
+		latency("p50", previous.P50, current.P50),
+		latency("p90", previous.P90, current.P90),
+		latency("p99", previous.P99, current.P99),
+		{
+			Metric:   "errors",
+			Baseline: fmt.Sprintf("%.1f%%", previous.ErrorRate*100),
+			Current:  fmt.Sprintf("%.1f%%", current.ErrorRate*100),
+			Change:   (current.ErrorRate - previous.ErrorRate) * 100,
+			// Any new errors count, since the baseline is expected to be clean.
+			Regressed: current.ErrorRate > previous.ErrorRate,
+		},
+	}
+}
+
+func percentChange(before, after float64) float64 {
+	if before == 0 {
+		return 0
+	}
+	return (after - before) / before * 100
+}
+
+func queryPercent(r *http.Request, key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(r.URL.Query().Get(key), 64); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+func saveBaseline(ctx context.Context, obj *storage.ObjectHandle, baseline BenchmarkBaseline) error {
+	wc := obj.NewWriter(ctx)
+	wc.ContentType = "application/json"
+	if err := json.NewEncoder(wc).Encode(baseline); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+func loadBaseline(ctx context.Context, obj *storage.ObjectHandle) (*BenchmarkBaseline, error) {
+	rc, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var baseline BenchmarkBaseline
+	if err := json.NewDecoder(rc).Decode(&baseline); err != nil {
+		return nil, fmt.Errorf("corrupt baseline: %v", err)
+	}
+	return &baseline, nil
+}
+
+func printBaselineDeltas(w http.ResponseWriter, previous BenchmarkBaseline, deltas []BaselineDelta, latencyThreshold, throughputThreshold float64) {
+	fmt.Fprintf(w, "Baseline Comparison (saved %s, %d workers x %d ops):\n",
+		previous.SavedAt.Format(time.RFC3339), previous.Workers, previous.Operations)
+	for _, d := range deltas {
+		fmt.Fprintf(w, "| %s: %s -> %s (%+.1f%%)", d.Metric, d.Baseline, d.Current, d.Change)
+		if d.Regressed {
+			fmt.Fprint(w, " REGRESSION")
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "| Thresholds: latency +%.0f%%, throughput -%.0f%%\n", latencyThreshold, throughputThreshold)
+}
@@ -0,0 +1,244 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchConcurrency = 4
+	maxBatchConcurrency     = 16
+	maxBatchResources       = 200
+	maxManifestBytes        = 1 << 20
+)
+
+type ManifestResource struct {
+	Bucket       string `json:"bucket"`
+	Project      string `json:"project,omitempty"`
+	Topic        string `json:"topic,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+}
+
+// runConfig is the resource as the RunConfig that would point a run at it.
+func (resource ManifestResource) runConfig() RunConfig {
+	return RunConfig{Bucket: resource.Bucket, Project: resource.Project, Topic: resource.Topic, Subscription: resource.Subscription}
+}
+
+type Manifest struct {
+	Resources []ManifestResource `json:"resources"`
+}
+
+type batchResult struct {
+	Resource ManifestResource
+	Report   string
+	Checks   []CheckResult
+}
+
+// batchHandler runs the full suite against every resource in a manifest, given as the
+// JSON request body or as ?manifest=gs://bucket/object.json, with bounded concurrency.
+// Resources other than the deployment's, and manifests read from other buckets, need
+// ALLOW_CONFIG_OVERRIDE=true, as for posted run configs.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	base, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	if location := r.URL.Query().Get("manifest"); location != "" && !base.AllowConfigOverride {
+		bucket, _, _ := strings.Cut(strings.TrimPrefix(location, "gs://"), "/")
+		if bucket != base.BucketName {
+			http.Error(w, "reading a manifest from another bucket is disabled; set ALLOW_CONFIG_OVERRIDE=true to allow it", http.StatusForbidden)
+			return
+		}
+	}
+
+	manifest, err := loadManifest(ctx, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid manifest: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(manifest.Resources) == 0 {
+		http.Error(w, "Manifest lists no resources", http.StatusBadRequest)
+		return
+	}
+	if len(manifest.Resources) > maxBatchResources {
+		http.Error(w, fmt.Sprintf("Manifest lists more than %d resources", maxBatchResources), http.StatusBadRequest)
+		return
+	}
+	if !base.AllowConfigOverride {
+		for _, resource := range manifest.Resources {
+			if overridesConfig(resource.runConfig(), base) {
+				http.Error(w, fmt.Sprintf("running against %s is disabled; set ALLOW_CONFIG_OVERRIDE=true to allow it", describeResource(resource)), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	// ?concurrency=auto lets an adaptive limiter find the concurrency the projects'
+	// quotas allow instead of a fixed number.
+	concurrency := queryInt(r, "concurrency", defaultBatchConcurrency, maxBatchConcurrency)
+	var limiter *adaptiveLimiter
+	if wantsAdaptive(r, "concurrency") {
+		limiter = newAdaptiveLimiter(defaultBatchConcurrency, maxBatchConcurrency)
+		concurrency = maxBatchConcurrency
+	}
+	detail := requestDetail(r)
+	results := make([]batchResult, len(manifest.Resources))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, resource := range manifest.Resources {
+		wg.Add(1)
+		go func(i int, resource ManifestResource) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if limiter != nil {
+				if err := limiter.acquire(ctx); err != nil {
+					results[i] = batchResult{Resource: resource, Report: fmt.Sprintf("Not run: %v\n", err)}
+					return
+				}
+			}
+
+			cfg := *base
+			cfg.BucketName = resource.Bucket
+			if resource.Project != "" {
+				cfg.ComputeProjectId = resource.Project
+			}
+			if resource.Topic != "" {
+				cfg.PubSubTopicId = resource.Topic
+			}
+			if resource.Subscription != "" {
+				cfg.PubSubSubscriptionId = resource.Subscription
+			}
+
+			start := time.Now()
+			rec := httptest.NewRecorder()
+			rw := newReportWriter(rec, detail)
+			runDiagnosticsWithConfig(rw, r, &cfg)
+			results[i] = batchResult{Resource: resource, Report: rec.Body.String(), Checks: rw.Checks()}
+			if limiter != nil {
+				limiter.release(time.Since(start), anyRateLimited(results[i].Checks))
+			}
+		}(i, resource)
+	}
+	wg.Wait()
+
+	var allChecks []CheckResult
+	for _, result := range results {
+		allChecks = append(allChecks, result.Checks...)
+	}
+	failed := failedCheckNames(allChecks)
+	w.Header().Set("X-Diag-Status", diagStatus(ranChecks(allChecks), len(failed)))
+	if len(failed) > 0 {
+		w.Header().Set("X-Diag-Failed-Checks", strings.Join(uniqueStrings(failed), ","))
+	}
+
+	fmt.Fprintf(w, "Batch Summary (%d resources):\n", len(results))
+	for i, result := range results {
+		failed := failedCheckNames(result.Checks)
+		status := CheckPass
+		if len(failed) > 0 {
+			status = CheckFail + " " + strings.Join(failed, ",")
+		}
+		fmt.Fprintf(w, "| %d. %s: %s\n", i+1, describeResource(result.Resource), status)
+	}
+	if limiter != nil {
+		printConcurrencyStats(w, limiter.Stats())
+	}
+	for i, result := range results {
+		fmt.Fprintf(w, "\n=== %d. %s ===\n%s", i+1, describeResource(result.Resource), result.Report)
+	}
+}
+
+func loadManifest(ctx context.Context, r *http.Request) (*Manifest, error) {
+	var data []byte
+	if location := r.URL.Query().Get("manifest"); location != "" {
+		bucket, object, ok := strings.Cut(strings.TrimPrefix(location, "gs://"), "/")
+		if !ok || !strings.HasPrefix(location, "gs://") {
+			return nil, fmt.Errorf("manifest must be a gs://bucket/object URI")
+		}
+		client, err := createStorageClientWithOAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+		rc, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest %s: %v", location, err)
+		}
+		defer rc.Close()
+		if data, err = io.ReadAll(io.LimitReader(rc, maxManifestBytes)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = io.ReadAll(io.LimitReader(r.Body, maxManifestBytes)); err != nil {
+			return nil, err
+		}
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	for i, resource := range manifest.Resources {
+		if resource.Bucket == "" {
+			return nil, fmt.Errorf("resource %d has no bucket", i+1)
+		}
+	}
+	return &manifest, nil
+}
+
+func failedCheckNames(checks []CheckResult) []string {
+	var failed []string
+	for _, c := range checks {
+		if c.Status == CheckFail {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+// anyRateLimited reports whether a check failed on a rate limit or exhausted quota.
+func anyRateLimited(checks []CheckResult) bool {
+	for _, c := range checks {
+		if c.Status == CheckFail && c.Category == "rateLimited" {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+func describeResource(resource ManifestResource) string {
+	parts := []string{"bucket=" + resource.Bucket}
+	if resource.Project != "" {
+		parts = append(parts, "project="+resource.Project)
+	}
+	if resource.Topic != "" {
+		parts = append(parts, "topic="+resource.Topic)
+	}
+	if resource.Subscription != "" {
+		parts = append(parts, "subscription="+resource.Subscription)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,176 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	bigquery "google.golang.org/api/bigquery/v2"
+	bigqueryconnection "google.golang.org/api/bigqueryconnection/v1"
+)
+
+type BigQueryCheckResult struct {
+	Table          string
+	SourceURIs     []string
+	Connection     string
+	ConnectionSA   string
+	Bucket         string
+	ConnectionRole []string
+	BytesProcessed int64
+	DryRunError    string
+	AccessError    string
+	Error          string
+}
+
+// Err summarizes the outcome as an error for the check matrix.
+func (r BigQueryCheckResult) Err() error {
+	switch {
+	case r.Error != "":
+		return errors.New(r.Error)
+	case r.DryRunError != "":
+		return errors.New(r.DryRunError)
+	case r.Bucket != "" && r.ConnectionSA != "" && r.AccessError == "" && len(r.ConnectionRole) == 0:
+		return fmt.Errorf("connection service account %s has no role on gs://%s", r.ConnectionSA, r.Bucket)
+	}
+	return nil
+}
+
+// checkBigQueryExternalTable dry-runs a query against an external or BigLake table
+// backed by the bucket and checks the second hop: BigLake tables read objects as the
+// connection's service account, not as the function.
+func checkBigQueryExternalTable(ctx context.Context, table, defaultProject string) BigQueryCheckResult {
+	result := BigQueryCheckResult{Table: table}
+
+	project, dataset, tableID, err := parseBigQueryTable(table, defaultProject)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	svc, err := bigquery.NewService(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create BigQuery client: %v", err)
+		return result
+	}
+	meta, err := svc.Tables.Get(project, dataset, tableID).Context(ctx).Do()
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to get table: %v", err)
+		return result
+	}
+	switch {
+	case meta.ExternalDataConfiguration != nil:
+		result.SourceURIs = meta.ExternalDataConfiguration.SourceUris
+		result.Connection = meta.ExternalDataConfiguration.ConnectionId
+	case meta.BiglakeConfiguration != nil:
+		result.SourceURIs = []string{meta.BiglakeConfiguration.StorageUri}
+		result.Connection = meta.BiglakeConfiguration.ConnectionId
+	default:
+		result.Error = fmt.Sprintf("%s is a %s table, not backed by Cloud Storage", table, meta.Type)
+		return result
+	}
+
+	useLegacySQL := false
+	resp, err := svc.Jobs.Query(project, &bigquery.QueryRequest{
+		Query:        fmt.Sprintf("SELECT * FROM `%s.%s.%s` LIMIT 1", project, dataset, tableID),
+		DryRun:       true,
+		UseLegacySql: &useLegacySQL,
+		Location:     meta.Location,
+	}).Context(ctx).Do()
+	if err != nil {
+		result.DryRunError = err.Error()
+	} else {
+		result.BytesProcessed = resp.TotalBytesProcessed
+	}
+
+	if result.Connection == "" {
+		return result
+	}
+	result.ConnectionSA, err = connectionServiceAccount(ctx, result.Connection)
+	if err != nil {
+		result.AccessError = err.Error()
+		return result
+	}
+	for _, uri := range result.SourceURIs {
+		if strings.HasPrefix(uri, "gs://") {
+			result.Bucket, _, _ = strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+			break
+		}
+	}
+	if result.Bucket != "" {
+		result.ConnectionRole, result.AccessError = bucketRolesFor(ctx, result.Bucket, "serviceAccount:"+result.ConnectionSA)
+	}
+	return result
+}
+
+// parseBigQueryTable accepts project.dataset.table or dataset.table.
+func parseBigQueryTable(table, defaultProject string) (project, dataset, tableID string, err error) {
+	parts := strings.Split(strings.ReplaceAll(table, ":", "."), ".")
+	switch len(parts) {
+	case 3:
+		return parts[0], parts[1], parts[2], nil
+	case 2:
+		return defaultProject, parts[0], parts[1], nil
+	}
+	return "", "", "", fmt.Errorf("invalid table %q, expected project.dataset.table", table)
+}
+
+// connectionServiceAccount resolves a connection ID in either the
+// project.location.connection or the resource name form.
+func connectionServiceAccount(ctx context.Context, connectionID string) (string, error) {
+	name := connectionID
+	if !strings.HasPrefix(name, "projects/") {
+		parts := strings.Split(connectionID, ".")
+		if len(parts) != 3 {
+			return "", fmt.Errorf("invalid connection ID %q", connectionID)
+		}
+		name = fmt.Sprintf("projects/%s/locations/%s/connections/%s", parts[0], parts[1], parts[2])
+	}
+
+	svc, err := bigqueryconnection.NewService(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create BigQuery Connection client: %v", err)
+	}
+	conn, err := svc.Projects.Locations.Connections.Get(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get connection: %v", err)
+	}
+	if conn.CloudResource == nil || conn.CloudResource.ServiceAccountId == "" {
+		return "", fmt.Errorf("connection %s is not a Cloud Resource connection", connectionID)
+	}
+	return conn.CloudResource.ServiceAccountId, nil
+}
+
+func printBigQueryCheck(w http.ResponseWriter, result BigQueryCheckResult) {
+	fmt.Fprintf(w, "BigQuery External Table (%s):\n", result.Table)
+	if result.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", result.Error)
+		return
+	}
+	for _, uri := range result.SourceURIs {
+		fmt.Fprintf(w, "| Source: %s\n", uri)
+	}
+	if result.DryRunError != "" {
+		fmt.Fprintf(w, "| Dry Run: FAILED (%s)\n", result.DryRunError)
+	} else {
+		fmt.Fprintf(w, "| Dry Run: OK (%d bytes would be processed)\n", result.BytesProcessed)
+	}
+
+	if result.Connection == "" {
+		fmt.Fprintln(w, "| Connection: none, objects are read with the querying identity")
+		return
+	}
+	fmt.Fprintf(w, "| Connection: %s\n", result.Connection)
+	if result.ConnectionSA != "" {
+		fmt.Fprintf(w, "| Connection Service Account: %s\n", result.ConnectionSA)
+	}
+	switch {
+	case result.AccessError != "":
+		fmt.Fprintf(w, "| Connection Access: unknown (%s)\n", result.AccessError)
+	case len(result.ConnectionRole) > 0:
+		fmt.Fprintf(w, "| Connection Access to gs://%s: %s\n", result.Bucket, strings.Join(result.ConnectionRole, ", "))
+	case result.Bucket != "":
+		fmt.Fprintf(w, "| Connection Access to gs://%s: MISSING, grant roles/storage.objectViewer to the connection service account\n", result.Bucket)
+	}
+}
@@ -0,0 +1,78 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/cloudbilling/v1"
+)
+
+// BillingCheck is whether the project requests are billed to can be billed at all.
+type BillingCheck struct {
+	Project        string
+	BillingEnabled bool
+	Account        string
+	// AccountOpen is nil when the account could not be read, which needs
+	// billing.accounts.get on the account and is often not granted.
+	AccountOpen *bool
+	Error       string
+}
+
+func (b BillingCheck) Err() error {
+	switch {
+	case b.Error != "":
+		return errors.New(b.Error)
+	case !b.BillingEnabled:
+		return fmt.Errorf("billing is disabled on project %s", b.Project)
+	case b.AccountOpen != nil && !*b.AccountOpen:
+		return fmt.Errorf("billing account %s of project %s is closed", b.Account, b.Project)
+	}
+	return nil
+}
+
+// checkBilling reads the project's billing linkage. Requester-pays reads and most API
+// calls billed to a project without active billing fail with errors that rarely say so.
+func checkBilling(ctx context.Context, project string) BillingCheck {
+	check := BillingCheck{Project: project}
+	svc, err := cloudbilling.NewService(ctx)
+	if err != nil {
+		check.Error = fmt.Sprintf("failed to create Cloud Billing client: %v", err)
+		return check
+	}
+	info, err := svc.Projects.GetBillingInfo("projects/" + project).Context(ctx).Do()
+	if err != nil {
+		check.Error = fmt.Sprintf("failed to read billing info: %v", err)
+		return check
+	}
+	check.BillingEnabled = info.BillingEnabled
+	check.Account = info.BillingAccountName
+	if check.Account == "" {
+		return check
+	}
+	if account, err := svc.BillingAccounts.Get(check.Account).Context(ctx).Do(); err == nil {
+		check.AccountOpen = &account.Open
+	}
+	return check
+}
+
+func printBillingCheck(w http.ResponseWriter, check BillingCheck) {
+	fmt.Fprintf(w, "Billing (%s):\n", check.Project)
+	if check.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", check.Error)
+		return
+	}
+	account := check.Account
+	if account == "" {
+		account = "(none linked)"
+	}
+	fmt.Fprintf(w, "| Billing Enabled: %t\n", check.BillingEnabled)
+	fmt.Fprintf(w, "| Billing Account: %s\n", account)
+	if check.AccountOpen != nil {
+		fmt.Fprintf(w, "| Account Open: %t\n", *check.AccountOpen)
+	}
+	if !check.BillingEnabled {
+		fmt.Fprintf(w, "| Requester-pays reads billed to %s will fail until billing is linked: gcloud billing projects link %s --billing-account=ACCOUNT_ID\n", check.Project, check.Project)
+	}
+}
@@ -0,0 +1,100 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v3"
+)
+
+// bucketCreatePermission is what creating a bucket in a project needs. It is granted on
+// the project, so it can be tested there without creating anything.
+const bucketCreatePermission = "storage.buckets.create"
+
+// Bucket name availability, as far as a GET on the name can tell.
+const (
+	BucketNameAvailable = "available"
+	BucketNameOwned     = "exists (visible to this identity)"
+	BucketNameTaken     = "taken (exists, not visible to this identity)"
+)
+
+// BucketCreateProbe is whether the function could create a bucket in Project, found
+// without creating one.
+type BucketCreateProbe struct {
+	Project   string
+	CanCreate bool
+	// Name is the reserved bucket name checked for availability; empty skips it.
+	Name      string
+	NameState string
+	Error     string
+}
+
+func (p BucketCreateProbe) Err() error {
+	switch {
+	case p.Error != "":
+		return errors.New(p.Error)
+	case !p.CanCreate:
+		return fmt.Errorf("missing %s on project %s", bucketCreatePermission, p.Project)
+	case p.NameState != "" && p.NameState != BucketNameAvailable:
+		return fmt.Errorf("bucket name %s is %s", p.Name, p.NameState)
+	}
+	return nil
+}
+
+// probeBucketCreate tests storage.buckets.create on the project and, when name is set,
+// whether that name is still free. Bucket names are global, so a 403 on the name means
+// another project already holds it.
+func probeBucketCreate(ctx context.Context, client *storage.Client, project, name string) BucketCreateProbe {
+	probe := BucketCreateProbe{Project: project, Name: name}
+	svc, err := cloudresourcemanager.NewService(ctx)
+	if err != nil {
+		probe.Error = fmt.Sprintf("failed to create Resource Manager client: %v", err)
+		return probe
+	}
+	resp, err := svc.Projects.TestIamPermissions("projects/"+project, &cloudresourcemanager.TestIamPermissionsRequest{
+		Permissions: []string{bucketCreatePermission},
+	}).Context(ctx).Do()
+	if err != nil {
+		probe.Error = fmt.Sprintf("failed to test permissions: %v", err)
+		return probe
+	}
+	probe.CanCreate = containsString(resp.Permissions, bucketCreatePermission)
+
+	if name == "" {
+		return probe
+	}
+	_, err = client.Bucket(name).Attrs(ctx)
+	switch {
+	case err == nil:
+		probe.NameState = BucketNameOwned
+	case errors.Is(err, storage.ErrBucketNotExist):
+		probe.NameState = BucketNameAvailable
+	case decodeError(err).Category == "forbidden":
+		probe.NameState = BucketNameTaken
+	default:
+		probe.Error = fmt.Sprintf("failed to check bucket name %s: %v", name, err)
+	}
+	return probe
+}
+
+func printBucketCreateProbe(w http.ResponseWriter, probe BucketCreateProbe) {
+	fmt.Fprintf(w, "Bucket Create Probe (%s):\n", probe.Project)
+	if probe.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", probe.Error)
+		return
+	}
+	fmt.Fprintf(w, "| %s: %t\n", bucketCreatePermission, probe.CanCreate)
+	if probe.Name != "" {
+		fmt.Fprintf(w, "| Name %s: %s\n", probe.Name, probe.NameState)
+	}
+	if !probe.CanCreate {
+		fmt.Fprintf(w, "| Grant roles/storage.admin, or a custom role with %s, on %s.\n", bucketCreatePermission, probe.Project)
+	}
+	if strings.HasPrefix(probe.NameState, "taken") {
+		fmt.Fprintln(w, "| Bucket names are global; pick another name.")
+	}
+}
@@ -0,0 +1,551 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	maxBucketRequestBytes = 64 << 10
+	maxBucketLabels       = 64
+	maxLifecycleRules     = 100
+)
+
+// bucketStorageClasses are the classes a bucket can be created with or moved to.
+var bucketStorageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+// BucketCreateRequest is a bucket to create in COMPUTE_PROJECT_ID. Location and
+// StorageClass default to the API's own defaults, US and STANDARD; UniformAccess
+// defaults to true, as fine-grained ACLs are no longer recommended.
+type BucketCreateRequest struct {
+	Name          string            `json:"name"`
+	Location      string            `json:"location"`
+	StorageClass  string            `json:"storageClass"`
+	UniformAccess *bool             `json:"uniformAccess"`
+	RequesterPays bool              `json:"requesterPays"`
+	Labels        map[string]string `json:"labels"`
+}
+
+// BucketUpdateRequest changes only what it sets. A null label removes that label, and
+// a lifecycle of [] removes every rule.
+type BucketUpdateRequest struct {
+	Labels        map[string]*string     `json:"labels"`
+	Lifecycle     *[]BucketLifecycleRule `json:"lifecycle"`
+	StorageClass  string                 `json:"storageClass"`
+	UniformAccess *bool                  `json:"uniformAccess"`
+	RequesterPays *bool                  `json:"requesterPays"`
+	Versioning    *bool                  `json:"versioning"`
+}
+
+// BucketLifecycleRule is one lifecycle rule: an action and the conditions, all of
+// which must hold, for applying it. Action is Delete, SetStorageClass (with
+// StorageClass) or AbortIncompleteMultipartUpload; CreatedBefore is a date,
+// 2006-01-02.
+type BucketLifecycleRule struct {
+	Action                  string   `json:"action"`
+	StorageClass            string   `json:"storageClass,omitempty"`
+	Age                     int64    `json:"age,omitempty"`
+	CreatedBefore           string   `json:"createdBefore,omitempty"`
+	IsLive                  *bool    `json:"isLive,omitempty"`
+	NumNewerVersions        int64    `json:"numNewerVersions,omitempty"`
+	DaysSinceNoncurrentTime int64    `json:"daysSinceNoncurrentTime,omitempty"`
+	MatchesStorageClass     []string `json:"matchesStorageClass,omitempty"`
+	MatchesPrefix           []string `json:"matchesPrefix,omitempty"`
+	MatchesSuffix           []string `json:"matchesSuffix,omitempty"`
+}
+
+// BucketInfo is a bucket's attributes as /buckets lists them or returns them after a
+// change.
+type BucketInfo struct {
+	Name           string                `json:"name"`
+	Location       string                `json:"location"`
+	StorageClass   string                `json:"storageClass"`
+	UniformAccess  bool                  `json:"uniformAccess"`
+	RequesterPays  bool                  `json:"requesterPays"`
+	Versioning     bool                  `json:"versioning"`
+	Labels         map[string]string     `json:"labels,omitempty"`
+	Lifecycle      []BucketLifecycleRule `json:"lifecycle,omitempty"`
+	Created        time.Time             `json:"created"`
+	Metageneration int64                 `json:"metageneration"`
+}
+
+// bucketsHandler lists and manages buckets in COMPUTE_PROJECT_ID:
+//
+//	GET /buckets?project=p&prefix=logs-&maxResults=100&pageToken=...
+//	POST /buckets {"name":"b","location":"EU","storageClass":"NEARLINE","requesterPays":true}
+//	PATCH /buckets?name=b {"labels":{"team":"data","old":null},"lifecycle":[{"action":"Delete","age":30}]}
+//	DELETE /buckets?name=b
+//
+// GET may name another project, but PATCH and DELETE only touch buckets in
+// COMPUTE_PROJECT_ID. PATCH takes ?metageneration= to only apply over the attributes
+// the caller last saw, and DELETE only removes empty buckets, never one the deployment
+// itself uses (see protectedBuckets). Everything but GET needs
+// ALLOW_BUCKET_MANAGEMENT=true.
+func bucketsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, POST, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet {
+		listBucketsHandler(w, r.WithContext(ctx), cfg)
+		return
+	}
+	if !cfg.AllowBucketManagement {
+		http.Error(w, "bucket management is disabled; set ALLOW_BUCKET_MANAGEMENT=true to allow it", http.StatusForbidden)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if r.Method != http.MethodPost && !bucketNamePattern.MatchString(name) {
+		http.Error(w, "name must be a bucket name", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if setting, ok := protectedBuckets()[name]; ok {
+			http.Error(w, fmt.Sprintf("%s is %s, which the function uses; it is never deleted here", name, setting), http.StatusConflict)
+			return
+		}
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating storage client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	if r.Method != http.MethodPost {
+		if !bucketInProject(w, ctx, client, name, cfg.ComputeProjectId) {
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req BucketCreateRequest
+		if err := decodeBucketRequest(r, &req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid bucket: %v", err), http.StatusBadRequest)
+			return
+		}
+		attrs, err := newBucketAttrs(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid bucket: %v", err), http.StatusBadRequest)
+			return
+		}
+		bucket := client.Bucket(req.Name)
+		if err := bucket.Create(ctx, cfg.ComputeProjectId, attrs); err != nil {
+			bucketError(w, "create", req.Name, err)
+			return
+		}
+		log.Printf("Created bucket %s in %s\n", req.Name, cfg.ComputeProjectId)
+		created, err := bucket.UserProject(cfg.ComputeProjectId).Attrs(ctx)
+		if err != nil {
+			bucketError(w, "read back created", req.Name, err)
+			return
+		}
+		w.Header().Set("Location", "gs://"+req.Name)
+		writeBucketInfo(w, http.StatusCreated, created)
+
+	case http.MethodPatch:
+		var req BucketUpdateRequest
+		if err := decodeBucketRequest(r, &req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid update: %v", err), http.StatusBadRequest)
+			return
+		}
+		update, err := bucketUpdate(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid update: %v", err), http.StatusBadRequest)
+			return
+		}
+		bucket := client.Bucket(name).UserProject(cfg.ComputeProjectId)
+		if v := r.URL.Query().Get("metageneration"); v != "" {
+			metageneration, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || metageneration <= 0 {
+				http.Error(w, "metageneration must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			bucket = bucket.If(storage.BucketConditions{MetagenerationMatch: metageneration})
+		}
+		updated, err := bucket.Update(ctx, update)
+		if err != nil {
+			bucketError(w, "update", name, err)
+			return
+		}
+		log.Printf("Updated bucket %s to metageneration %d\n", name, updated.MetaGeneration)
+		writeBucketInfo(w, http.StatusOK, updated)
+
+	case http.MethodDelete:
+		if err := client.Bucket(name).UserProject(cfg.ComputeProjectId).Delete(ctx); err != nil {
+			bucketError(w, "delete", name, err)
+			return
+		}
+		log.Printf("Deleted bucket %s\n", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// bucketInProject answers the request with 403 unless bucket belongs to project, so
+// PATCH and DELETE can't reach buckets elsewhere that the identity happens to manage.
+// The project's number comes from its GCS service agent, service-NUMBER@....
+func bucketInProject(w http.ResponseWriter, ctx context.Context, client *storage.Client, bucket, project string) bool {
+	agent, err := client.ServiceAccount(ctx, project)
+	if err != nil {
+		log.Printf("Failed to look up project %s: %v\n", project, err)
+		http.Error(w, fmt.Sprintf("Failed to look up project %s: %v", project, err), apiErrorStatus(err))
+		return false
+	}
+	number := projectNumberFromAgent(agent)
+	if number == "" {
+		http.Error(w, fmt.Sprintf("Failed to look up project %s: unexpected service agent %s", project, agent), http.StatusBadGateway)
+		return false
+	}
+	attrs, err := client.Bucket(bucket).UserProject(project).Attrs(ctx)
+	if err != nil {
+		bucketError(w, "read", bucket, err)
+		return false
+	}
+	if strconv.FormatUint(attrs.ProjectNumber, 10) != number {
+		http.Error(w, fmt.Sprintf("bucket %s is not in %s; only its buckets are managed here", bucket, project), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// protectedBuckets maps each bucket the deployment reads or writes to the setting that
+// names it. They come from the environment rather than the request's configuration,
+// so a profile or config.* override can't lift the protection.
+func protectedBuckets() map[string]string {
+	cfg := NewGCloudFunctionConfig()
+	protected := map[string]string{}
+	add := func(setting, bucket string) {
+		if _, ok := protected[bucket]; bucket != "" && !ok {
+			protected[bucket] = setting
+		}
+	}
+	add("BUCKET_NAME", cfg.BucketName)
+	add("SNAPSHOT_BUCKET", cfg.SnapshotBucket)
+	add("DUAL_WRITE_BUCKET", cfg.DualWriteBucket)
+	if rest, ok := strings.CutPrefix(cfg.DownloadDestination, "gs://"); ok {
+		bucket, _, _ := strings.Cut(rest, "/")
+		add("DOWNLOAD_DESTINATION", bucket)
+	}
+	return protected
+}
+
+// BucketList is one page of a project's buckets. NextPageToken is set when there are
+// more.
+type BucketList struct {
+	Project       string       `json:"project"`
+	Buckets       []BucketInfo `json:"buckets"`
+	NextPageToken string       `json:"nextPageToken,omitempty"`
+}
+
+func listBucketsHandler(w http.ResponseWriter, r *http.Request, cfg *GCloudFunctionConfig) {
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		project = cfg.ComputeProjectId
+	}
+	if !projectIDPattern.MatchString(project) {
+		http.Error(w, "project must be a project ID", http.StatusBadRequest)
+		return
+	}
+	opts, err := requestListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating storage client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	buckets, next, err := ListBuckets(ctx, client, project, opts)
+	if err != nil {
+		log.Printf("Failed to list buckets in %s: %v\n", project, err)
+		if next != "" {
+			w.Header().Set(resumePageTokenHeader, next)
+		}
+		http.Error(w, fmt.Sprintf("Failed to list buckets in %s: %v", project, err), apiErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(BucketList{Project: project, Buckets: buckets, NextPageToken: next})
+}
+
+// ListBuckets lists the project's buckets whose names start with opts.Prefix: all of
+// them, or one page of opts.MaxResults from opts.PageToken, returning the token for the
+// next page. When a rate limit or the time budget stops it, the token is the page to
+// resume from.
+func ListBuckets(ctx context.Context, client *storage.Client, projectID string, opts ListOptions) ([]BucketInfo, string, error) {
+	it := client.Buckets(ctx, projectID)
+	it.Prefix = opts.Prefix
+	buckets := []BucketInfo{}
+
+	if opts.MaxResults > 0 {
+		var page []*storage.BucketAttrs
+		next, err := iterator.NewPager(it, opts.MaxResults, opts.PageToken).NextPage(&page)
+		if err != nil {
+			if resumableListError(ctx, err) {
+				return nil, opts.PageToken, err
+			}
+			return nil, "", err
+		}
+		for _, attrs := range page {
+			buckets = append(buckets, bucketInfo(attrs))
+		}
+		return buckets, next, nil
+	}
+
+	it.PageInfo().Token = opts.PageToken
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return buckets, "", nil
+		}
+		if err != nil {
+			if resumableListError(ctx, err) {
+				// A failed page fetch leaves the token at that page.
+				return nil, it.PageInfo().Token, err
+			}
+			return nil, "", err
+		}
+		buckets = append(buckets, bucketInfo(attrs))
+	}
+}
+
+func decodeBucketRequest(r *http.Request, v any) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBucketRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("body must be a JSON object: %v", err)
+	}
+	return nil
+}
+
+// newBucketAttrs checks a create request and turns it into the bucket's attributes.
+func newBucketAttrs(req BucketCreateRequest) (*storage.BucketAttrs, error) {
+	if !bucketNamePattern.MatchString(req.Name) {
+		return nil, fmt.Errorf("invalid bucket name %q", req.Name)
+	}
+	if req.StorageClass != "" && !containsString(bucketStorageClasses, req.StorageClass) {
+		return nil, fmt.Errorf("storageClass must be one of %v", bucketStorageClasses)
+	}
+	if err := validateBucketLabels(req.Labels); err != nil {
+		return nil, err
+	}
+	uniform := req.UniformAccess == nil || *req.UniformAccess
+	return &storage.BucketAttrs{
+		Location:                 req.Location,
+		StorageClass:             req.StorageClass,
+		UniformBucketLevelAccess: storage.UniformBucketLevelAccess{Enabled: uniform},
+		RequesterPays:            req.RequesterPays,
+		Labels:                   req.Labels,
+	}, nil
+}
+
+// bucketUpdate checks an update request and turns it into the fields to change.
+func bucketUpdate(req BucketUpdateRequest) (storage.BucketAttrsToUpdate, error) {
+	var update storage.BucketAttrsToUpdate
+	changed := false
+	if req.StorageClass != "" {
+		if !containsString(bucketStorageClasses, req.StorageClass) {
+			return update, fmt.Errorf("storageClass must be one of %v", bucketStorageClasses)
+		}
+		update.StorageClass, changed = req.StorageClass, true
+	}
+	if req.UniformAccess != nil {
+		update.UniformBucketLevelAccess, changed = &storage.UniformBucketLevelAccess{Enabled: *req.UniformAccess}, true
+	}
+	if req.RequesterPays != nil {
+		update.RequesterPays, changed = *req.RequesterPays, true
+	}
+	if req.Versioning != nil {
+		update.VersioningEnabled, changed = *req.Versioning, true
+	}
+	if req.Lifecycle != nil {
+		lifecycle, err := bucketLifecycle(*req.Lifecycle)
+		if err != nil {
+			return update, err
+		}
+		update.Lifecycle, changed = &lifecycle, true
+	}
+	if len(req.Labels) > 0 {
+		labels := map[string]string{}
+		for key, value := range req.Labels {
+			labels[key] = ""
+			if value != nil {
+				labels[key] = *value
+			}
+		}
+		if err := validateBucketLabels(labels); err != nil {
+			return update, err
+		}
+		for key, value := range req.Labels {
+			if value == nil {
+				update.DeleteLabel(key)
+			} else {
+				update.SetLabel(key, *value)
+			}
+		}
+		changed = true
+	}
+	if !changed {
+		return update, errors.New("nothing to change; set labels, lifecycle, storageClass, uniformAccess, requesterPays or versioning")
+	}
+	return update, nil
+}
+
+// validateBucketLabels applies the same rules as run labels, which are GCS's own.
+func validateBucketLabels(labels map[string]string) error {
+	if len(labels) > maxBucketLabels {
+		return fmt.Errorf("at most %d labels", maxBucketLabels)
+	}
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label key %q: lowercase letters, digits, _ and -, starting with a letter", key)
+		}
+		if !labelValuePattern.MatchString(value) {
+			return fmt.Errorf("invalid value for label %s: at most 63 lowercase letters, digits, _ and -", key)
+		}
+	}
+	return nil
+}
+
+// bucketLifecycle turns rules as /buckets takes them into the client's lifecycle.
+func bucketLifecycle(rules []BucketLifecycleRule) (storage.Lifecycle, error) {
+	var lifecycle storage.Lifecycle
+	if len(rules) > maxLifecycleRules {
+		return lifecycle, fmt.Errorf("at most %d lifecycle rules", maxLifecycleRules)
+	}
+	for i, rule := range rules {
+		action := storage.LifecycleAction{Type: rule.Action}
+		switch rule.Action {
+		case storage.DeleteAction, storage.AbortIncompleteMPUAction:
+		case storage.SetStorageClassAction:
+			if !containsString(bucketStorageClasses, rule.StorageClass) {
+				return lifecycle, fmt.Errorf("lifecycle rule %d: SetStorageClass needs a storageClass, one of %v", i, bucketStorageClasses)
+			}
+			action.StorageClass = rule.StorageClass
+		default:
+			return lifecycle, fmt.Errorf("lifecycle rule %d: action must be Delete, SetStorageClass or AbortIncompleteMultipartUpload", i)
+		}
+
+		cond := storage.LifecycleCondition{
+			AgeInDays:               rule.Age,
+			NumNewerVersions:        rule.NumNewerVersions,
+			DaysSinceNoncurrentTime: rule.DaysSinceNoncurrentTime,
+			MatchesStorageClasses:   rule.MatchesStorageClass,
+			MatchesPrefix:           rule.MatchesPrefix,
+			MatchesSuffix:           rule.MatchesSuffix,
+		}
+		if rule.CreatedBefore != "" {
+			created, err := time.Parse(time.DateOnly, rule.CreatedBefore)
+			if err != nil {
+				return lifecycle, fmt.Errorf("lifecycle rule %d: createdBefore must be a date like 2006-01-02", i)
+			}
+			cond.CreatedBefore = created
+		}
+		if rule.IsLive != nil {
+			cond.Liveness = storage.Archived
+			if *rule.IsLive {
+				cond.Liveness = storage.Live
+			}
+		}
+		if rule.Age < 0 || rule.NumNewerVersions < 0 || rule.DaysSinceNoncurrentTime < 0 {
+			return lifecycle, fmt.Errorf("lifecycle rule %d: ages and counts can't be negative", i)
+		}
+		if cond.AgeInDays == 0 && cond.CreatedBefore.IsZero() && rule.IsLive == nil && cond.NumNewerVersions == 0 &&
+			cond.DaysSinceNoncurrentTime == 0 && len(cond.MatchesStorageClasses) == 0 && len(cond.MatchesPrefix) == 0 && len(cond.MatchesSuffix) == 0 {
+			return lifecycle, fmt.Errorf("lifecycle rule %d: needs at least one condition", i)
+		}
+		lifecycle.Rules = append(lifecycle.Rules, storage.LifecycleRule{Action: action, Condition: cond})
+	}
+	return lifecycle, nil
+}
+
+func bucketInfo(attrs *storage.BucketAttrs) BucketInfo {
+	info := BucketInfo{
+		Name:           attrs.Name,
+		Location:       attrs.Location,
+		StorageClass:   attrs.StorageClass,
+		UniformAccess:  attrs.UniformBucketLevelAccess.Enabled,
+		RequesterPays:  attrs.RequesterPays,
+		Versioning:     attrs.VersioningEnabled,
+		Labels:         attrs.Labels,
+		Created:        attrs.Created,
+		Metageneration: attrs.MetaGeneration,
+	}
+	for _, rule := range attrs.Lifecycle.Rules {
+		cond := rule.Condition
+		out := BucketLifecycleRule{
+			Action:                  rule.Action.Type,
+			StorageClass:            rule.Action.StorageClass,
+			Age:                     cond.AgeInDays,
+			NumNewerVersions:        cond.NumNewerVersions,
+			DaysSinceNoncurrentTime: cond.DaysSinceNoncurrentTime,
+			MatchesStorageClass:     cond.MatchesStorageClasses,
+			MatchesPrefix:           cond.MatchesPrefix,
+			MatchesSuffix:           cond.MatchesSuffix,
+		}
+		if !cond.CreatedBefore.IsZero() {
+			out.CreatedBefore = cond.CreatedBefore.Format(time.DateOnly)
+		}
+		if cond.Liveness != storage.LiveAndArchived {
+			live := cond.Liveness == storage.Live
+			out.IsLive = &live
+		}
+		info.Lifecycle = append(info.Lifecycle, out)
+	}
+	return info
+}
+
+func writeBucketInfo(w http.ResponseWriter, status int, attrs *storage.BucketAttrs) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(bucketInfo(attrs))
+}
+
+// bucketError answers with the status apiErrorStatus picks for err.
+func bucketError(w http.ResponseWriter, action, name string, err error) {
+	log.Printf("Failed to %s bucket %s: %v\n", action, name, err)
+	http.Error(w, fmt.Sprintf("Failed to %s bucket %s: %v", action, name, err), apiErrorStatus(err))
+}
+
+// apiErrorStatus is the status to answer a failed GCS call with, keeping the API's own
+// where the caller can act on it: 404, 403, 409 for a name that's taken or a bucket
+// that isn't empty, and 412 for a stale generation or metageneration. Anything else is
+// the API failing, a 502.
+func apiErrorStatus(err error) int {
+	decoded := decodeError(err)
+	switch {
+	case decoded.Code == http.StatusConflict:
+		return http.StatusConflict
+	case decoded.Category == "notFound":
+		return http.StatusNotFound
+	case decoded.Category == "forbidden" || decoded.Category == "unauthorized":
+		return http.StatusForbidden
+	case decoded.Category == "precondition":
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusBadGateway
+}
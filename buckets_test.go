@@ -0,0 +1,218 @@
+package gcf
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBucketsManagementThroughDoIt(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		bucket := map[string]any{"name": "new-bucket", "location": "EU", "storageClass": "NEARLINE", "metageneration": "2", "projectNumber": "123"}
+		switch {
+		case r.URL.Path == "/storage/v1/projects/diag-project/serviceAccount":
+			writeFakeJSON(w, http.StatusOK, map[string]any{"email_address": "service-123@gs-project-accounts.iam.gserviceaccount.com"})
+		case r.Method == http.MethodPost && r.URL.Path == "/storage/v1/b":
+			body, _ := io.ReadAll(r.Body)
+			if !strings.Contains(string(body), `"new-bucket"`) {
+				t.Errorf("insert body = %s", body)
+			}
+			writeFakeJSON(w, http.StatusOK, bucket)
+		case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/new-bucket":
+			writeFakeJSON(w, http.StatusOK, bucket)
+		case r.Method == http.MethodPatch && r.URL.Path == "/storage/v1/b/new-bucket":
+			writeFakeJSON(w, http.StatusOK, bucket)
+		case r.Method == http.MethodDelete && r.URL.Path == "/storage/v1/b/new-bucket":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	setTestEnv(t, map[string]string{"ALLOW_BUCKET_MANAGEMENT": "true"})
+
+	tests := []struct {
+		method, target, body string
+		wantStatus           int
+		wantCall             string
+	}{
+		{http.MethodPost, "/buckets", `{"name":"new-bucket","location":"EU","storageClass":"NEARLINE"}`, http.StatusCreated, "POST /storage/v1/b"},
+		{http.MethodPatch, "/buckets?name=new-bucket", `{"labels":{"team":"data"}}`, http.StatusOK, "PATCH /storage/v1/b/new-bucket"},
+		{http.MethodDelete, "/buckets?name=new-bucket", "", http.StatusNoContent, "DELETE /storage/v1/b/new-bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			mu.Lock()
+			calls = nil
+			mu.Unlock()
+			w := httptest.NewRecorder()
+			DoIt(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body:\n%s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.method != http.MethodDelete {
+				var info BucketInfo
+				if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.Name != "new-bucket" {
+					t.Fatalf("body = %s, want the bucket as JSON (%v)", w.Body, err)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Contains(calls, tt.wantCall) {
+				t.Errorf("API calls = %v, want %s", calls, tt.wantCall)
+			}
+		})
+	}
+}
+
+func TestBucketsManagementDisabledThroughDoIt(t *testing.T) {
+	setTestEnv(t, nil)
+	for _, method := range []string{http.MethodPost, http.MethodPatch, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		DoIt(w, httptest.NewRequest(method, "/buckets?name=new-bucket", strings.NewReader(`{}`)))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "ALLOW_BUCKET_MANAGEMENT") {
+			t.Errorf("%s /buckets = %d %q, want 403 naming ALLOW_BUCKET_MANAGEMENT", method, w.Code, w.Body)
+		}
+	}
+}
+
+func TestBucketChecksRoute(t *testing.T) {
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		writeFakeJSON(w, http.StatusOK, map[string]any{"name": "diag-bucket", "location": "US"})
+	})
+	setTestEnv(t, nil)
+	w := httptest.NewRecorder()
+	DoIt(w, httptest.NewRequest(http.MethodGet, "/checks/buckets", nil))
+	for _, want := range []string{"storage_client", "bucket_access", "Bucket Name: diag-bucket"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/checks/buckets report lacks %q:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestListBucketsThroughDoIt(t *testing.T) {
+	var query string
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/storage/v1/b" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.RawQuery
+		writeFakeJSON(w, http.StatusOK, map[string]any{
+			"items": []map[string]any{
+				{"name": "logs-a", "location": "EU", "storageClass": "STANDARD", "billing": map[string]any{"requesterPays": true}},
+				{"name": "logs-b", "location": "US", "storageClass": "COLDLINE"},
+			},
+			"nextPageToken": "page-2",
+		})
+	})
+	setTestEnv(t, nil)
+
+	w := httptest.NewRecorder()
+	DoIt(w, httptest.NewRequest(http.MethodGet, "/buckets?project=other-project&prefix=logs-&maxResults=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; body:\n%s", w.Code, w.Body)
+	}
+	var list BucketList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("body isn't a bucket list: %v\n%s", err, w.Body)
+	}
+	if list.Project != "other-project" || list.NextPageToken != "page-2" || len(list.Buckets) != 2 {
+		t.Fatalf("list = %+v", list)
+	}
+	if b := list.Buckets[0]; b.Name != "logs-a" || b.Location != "EU" || b.StorageClass != "STANDARD" || !b.RequesterPays {
+		t.Errorf("first bucket = %+v", b)
+	}
+	for _, want := range []string{"project=other-project", "prefix=logs-", "maxResults=2"} {
+		if !strings.Contains(query, want) {
+			t.Errorf("list query %q lacks %s", query, want)
+		}
+	}
+}
+
+func TestBucketsDeleteRefusesProtectedBuckets(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		http.NotFound(w, r)
+	})
+	setTestEnv(t, map[string]string{
+		"ALLOW_BUCKET_MANAGEMENT": "true",
+		"SNAPSHOT_BUCKET":         "diag-snapshots",
+		"DUAL_WRITE_BUCKET":       "diag-dr",
+		"DOWNLOAD_DESTINATION":    "gs://diag-copies/downloads",
+	})
+	setTestProfiles(t, map[string]map[string]string{"staging": {"BUCKET_NAME": "staging-bucket"}})
+
+	for _, target := range []string{
+		"/buckets?name=diag-bucket",
+		// The profile's BUCKET_NAME doesn't stop the deployment's from being protected.
+		"/buckets?name=diag-bucket&profile=staging",
+		"/buckets?name=diag-snapshots",
+		"/buckets?name=diag-dr",
+		"/buckets?name=diag-copies",
+	} {
+		mu.Lock()
+		calls = nil
+		mu.Unlock()
+		w := httptest.NewRecorder()
+		DoIt(w, httptest.NewRequest(http.MethodDelete, target, nil))
+		if w.Code != http.StatusConflict {
+			t.Errorf("DELETE %s = %d %q, want 409", target, w.Code, w.Body)
+		}
+		mu.Lock()
+		if len(calls) > 0 {
+			t.Errorf("DELETE %s made API calls %v", target, calls)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestBucketsManagementRefusesOtherProjects(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/storage/v1/projects/diag-project/serviceAccount":
+			writeFakeJSON(w, http.StatusOK, map[string]any{"email_address": "service-123@gs-project-accounts.iam.gserviceaccount.com"})
+		case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/elsewhere-bucket":
+			writeFakeJSON(w, http.StatusOK, map[string]any{"name": "elsewhere-bucket", "projectNumber": "999"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	setTestEnv(t, map[string]string{"ALLOW_BUCKET_MANAGEMENT": "true"})
+
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		mu.Lock()
+		calls = nil
+		mu.Unlock()
+		w := httptest.NewRecorder()
+		DoIt(w, httptest.NewRequest(method, "/buckets?name=elsewhere-bucket", strings.NewReader(`{"labels":{"team":"data"}}`)))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "not in diag-project") {
+			t.Errorf("%s of another project's bucket = %d %q, want 403", method, w.Code, w.Body)
+		}
+		mu.Lock()
+		for _, call := range calls {
+			if !strings.HasPrefix(call, "GET ") {
+				t.Errorf("%s of another project's bucket made %s", method, call)
+			}
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	requestTimeoutHeader = "X-Request-Timeout"
+	minTimeoutMargin     = 500 * time.Millisecond
+	maxTimeoutMargin     = 5 * time.Second
+)
+
+// timeBudget records the caller's timeout and how the run spent it.
+type timeBudget struct {
+	Requested time.Duration
+	Source    string
+	Margin    time.Duration
+	Start     time.Time
+	Deadline  time.Time
+}
+
+// requestTimeout reads the caller's own timeout from the X-Request-Timeout header or the
+// timeout query parameter, as a Go duration ("30s") or a number of seconds.
+func requestTimeout(r *http.Request) (time.Duration, string, error) {
+	value, source := r.Header.Get(requestTimeoutHeader), requestTimeoutHeader
+	if value == "" {
+		value, source = r.URL.Query().Get("timeout"), "timeout parameter"
+	}
+	if value == "" {
+		return 0, "", nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		secs, convErr := strconv.ParseFloat(value, 64)
+		if convErr != nil {
+			return 0, source, fmt.Errorf("invalid %s %q: use a duration like 30s or a number of seconds", source, value)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, source, fmt.Errorf("invalid %s %q: must be positive", source, value)
+	}
+	return d, source, nil
+}
+
+// withTimeBudget derives the run's deadline from the caller's timeout, keeping back a
+// safety margin of 10% (0.5s to 5s) so the report still reaches the caller in time.
+func withTimeBudget(ctx context.Context, requested time.Duration, source string) (context.Context, context.CancelFunc, *timeBudget) {
+	margin := min(max(requested/10, minTimeoutMargin), maxTimeoutMargin)
+	if margin >= requested {
+		margin = requested / 2
+	}
+	budget := &timeBudget{Requested: requested, Source: source, Margin: margin, Start: time.Now()}
+	budget.Deadline = budget.Start.Add(requested - margin)
+	ctx, cancel := context.WithDeadlineCause(ctx, budget.Deadline, errBudgetExhausted)
+	return ctx, cancel, budget
+}
+
+// printTimeBudget compares the run's wall-clock time with the budget. Independent checks
+// run in parallel, so their durations overlap; they are listed for reference but not
+// summed or counted against the budget.
+func printTimeBudget(w io.Writer, budget *timeBudget, checks []CheckResult) {
+	if budget == nil {
+		return
+	}
+	usable := budget.Requested - budget.Margin
+	elapsed := time.Since(budget.Start)
+
+	fmt.Fprintf(w, "Time Budget (%s from %s):\n", budget.Requested, budget.Source)
+	fmt.Fprintf(w, "| Safety Margin: %s\n", budget.Margin)
+	for _, c := range checks {
+		if c.Duration == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "| %-24s %8s\n", c.Name, c.Duration.Round(time.Millisecond))
+	}
+	status := "within budget"
+	if elapsed > usable {
+		status = "EXCEEDED, later checks were cut short"
+	}
+	fmt.Fprintf(w, "| Used: %s of %s, %d%% (%s)\n", elapsed.Round(time.Millisecond), usable, budgetShare(elapsed, usable), status)
+	if skipped := strings.Join(deadlineExceededChecks(checks), ", "); skipped != "" {
+		fmt.Fprintf(w, "| Hit Deadline: %s\n", skipped)
+	}
+}
+
+func budgetShare(d, total time.Duration) int {
+	if total <= 0 {
+		return 0
+	}
+	return int(d * 100 / total)
+}
+
+func deadlineExceededChecks(checks []CheckResult) []string {
+	var names []string
+	for _, c := range checks {
+		if c.Stop != nil && c.Stop.Cause == StopBudget {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,162 @@
+package gcf
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const recentLogLines = 500
+
+// recentLogs keeps the tail of the log output for support bundles; see logging.go.
+var recentLogs = &logRing{max: recentLogLines}
+
+type logRing struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		l.lines = append(l.lines, line)
+	}
+	if overflow := len(l.lines) - l.max; overflow > 0 {
+		l.lines = append([]string(nil), l.lines[overflow:]...)
+	}
+	return len(p), nil
+}
+
+func (l *logRing) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "")
+}
+
+// matching returns the lines that contain any of the non-empty keys, such as a run ID
+// or trace ID, so one caller's bundle doesn't carry other requests' logs.
+func (l *logRing) matching(keys ...string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b strings.Builder
+	for _, line := range l.lines {
+		for _, key := range keys {
+			if key != "" && strings.Contains(line, key) {
+				b.WriteString(line)
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// supportBundle runs the full diagnostics and returns them, together with the
+// sanitized environment, library versions and the run's logs, as a tar.gz download.
+// The report is the JSON one, and in demo mode every file is redacted like it.
+func supportBundle(w http.ResponseWriter, r *http.Request) {
+	cfg, _, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	report := httptest.NewRecorder()
+	rw := newReportWriter(report, requestDetail(r))
+	rw.reportJSON()
+	runDiagnosticsWithConfig(rw, r, cfg)
+	trace, _ := requestTrace(r)
+
+	created := time.Now().UTC()
+	files := []struct {
+		name string
+		data string
+	}{
+		{"report.json", report.Body.String()},
+		{"env.txt", sanitizedEnv()},
+		{"versions.txt", buildVersions()},
+		{"logs.txt", recentLogs.matching(rw.runID, trace)},
+	}
+	bucket := cfg.BucketName
+	// The run's redactor has also learned the object names it came across.
+	if rw.redactor != nil {
+		for i := range files {
+			files[i].data = string(rw.redactor.apply([]byte(files[i].data)))
+		}
+		bucket = string(rw.redactor.apply([]byte(bucket)))
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	bundleName := renderArtifactName("bundle", cfg.BundleNameTemplate, DefaultBundleNameTemplate, ArtifactName{
+		RunID:  rw.runID,
+		Time:   created,
+		Bucket: bucket,
+		Check:  "support-bundle",
+	})
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", bundleName))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    f.name,
+			Mode:    0o644,
+			Size:    int64(len(f.data)),
+			ModTime: created,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			log.Printf("Failed to write support bundle header for %s: %v\n", f.name, err)
+			return
+		}
+		if _, err := io.WriteString(tw, f.data); err != nil {
+			log.Printf("Failed to write support bundle file %s: %v\n", f.name, err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("Failed to finalize support bundle: %v\n", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		log.Printf("Failed to compress support bundle: %v\n", err)
+	}
+}
+
+var sensitiveEnvName = regexp.MustCompile(`(?i)(SECRET|TOKEN|PASSWORD|PASSWD|CREDENTIAL|PRIVATE|API_KEY)`)
+
+// sanitizedEnv lists the environment with the values of secrets, and of variables with
+// secret-looking names, redacted, and credentials in URLs removed as /config does.
+// List values are redacted item by item.
+func sanitizedEnv() string {
+	envVars := os.Environ()
+	sort.Strings(envVars)
+
+	var b strings.Builder
+	for _, envVar := range envVars {
+		name, value, _ := strings.Cut(envVar, "=")
+		if sensitiveEnvName.MatchString(name) || deploymentVarFor(name).Secret {
+			value = "[REDACTED]"
+		} else {
+			items := strings.Split(value, ",")
+			for i, item := range items {
+				items[i] = redactURLCredentials(item)
+			}
+			value = strings.Join(items, ",")
+		}
+		fmt.Fprintf(&b, "%s=%s\n", name, value)
+	}
+	return b.String()
+}
@@ -0,0 +1,104 @@
+package gcf
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+// forwardingHeaders are echoed back because they show what sits in front of the function.
+var forwardingHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"Forwarded",
+	"Via",
+	"X-Cloud-Trace-Context",
+	"X-Serverless-Authorization",
+}
+
+type CallerContext struct {
+	EndUser    string
+	Identity   string
+	Issuer     string
+	SourceIP   string
+	RemoteAddr string
+	UserAgent  string
+	Headers    map[string]string
+}
+
+// describeCaller extracts the inbound request attributes useful for debugging load
+// balancers and gateways. The ID token is decoded but not verified here: with IAM
+// authentication enabled the platform has already validated it.
+func describeCaller(r *http.Request) CallerContext {
+	caller := CallerContext{
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		Headers:    map[string]string{},
+	}
+	if user := endUserFromContext(r.Context()); user != nil {
+		caller.EndUser = user.String()
+	}
+
+	caller.SourceIP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		caller.SourceIP = host
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		first, _, _ := strings.Cut(xff, ",")
+		caller.SourceIP = strings.TrimSpace(first)
+	}
+
+	for _, name := range forwardingHeaders {
+		if value := r.Header.Get(name); value != "" {
+			caller.Headers[name] = value
+		}
+	}
+	// Don't echo credentials back.
+	if _, ok := caller.Headers["X-Serverless-Authorization"]; ok {
+		caller.Headers["X-Serverless-Authorization"] = "[present]"
+	}
+
+	if token := bearerToken(r); token != "" {
+		if payload, err := idtoken.ParsePayload(token); err == nil {
+			caller.Issuer = payload.Issuer
+			caller.Identity = payload.Subject
+			if email, ok := payload.Claims["email"].(string); ok && email != "" {
+				caller.Identity = email
+			}
+		}
+	}
+	return caller
+}
+
+func bearerToken(r *http.Request) string {
+	for _, header := range []string{"X-Serverless-Authorization", "Authorization"} {
+		if token, ok := strings.CutPrefix(r.Header.Get(header), "Bearer "); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+func printCallerContext(w http.ResponseWriter, caller CallerContext) {
+	fmt.Fprintln(w, "Caller:")
+	if caller.EndUser != "" {
+		fmt.Fprintf(w, "| End User: %s\n", caller.EndUser)
+	}
+	if caller.Identity != "" {
+		fmt.Fprintf(w, "| Identity: %s (issuer %s)\n", caller.Identity, caller.Issuer)
+	} else {
+		fmt.Fprintln(w, "| Identity: anonymous (no ID token)")
+	}
+	fmt.Fprintf(w, "| Source IP: %s\n", caller.SourceIP)
+	fmt.Fprintf(w, "| Remote Addr: %s\n", caller.RemoteAddr)
+	fmt.Fprintf(w, "| User Agent: %s\n", caller.UserAgent)
+	for _, name := range forwardingHeaders {
+		if value, ok := caller.Headers[name]; ok {
+			fmt.Fprintf(w, "| %s: %s\n", name, value)
+		}
+	}
+}
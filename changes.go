@@ -0,0 +1,189 @@
+package gcf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type SnapshotEntry struct {
+	Generation     int64 `json:"generation"`
+	Metageneration int64 `json:"metageneration"`
+	Size           int64 `json:"size"`
+}
+
+type ListingSnapshot struct {
+	Bucket  string                   `json:"bucket"`
+	Prefix  string                   `json:"prefix"`
+	TakenAt time.Time                `json:"takenAt"`
+	Labels  map[string]string        `json:"labels,omitempty"`
+	Objects map[string]SnapshotEntry `json:"objects"`
+}
+
+type ListingChanges struct {
+	Since    time.Time
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+// changesHandler compares the current listing of ?prefix= with the snapshot saved by
+// the previous call, reports what changed, and saves the new snapshot.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	ctx = withLang(ctx, requestLang(r))
+	prefix := r.URL.Query().Get("prefix")
+	labels, err := parseRunLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating storage client: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	skipPrefix := ""
+	if cfg.SnapshotBucket == cfg.BucketName {
+		skipPrefix = cfg.SnapshotPrefix
+	}
+	current, err := takeListingSnapshot(ctx, client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId), cfg.BucketName, prefix, skipPrefix)
+	if err != nil {
+		handleError(ctx, w, err)
+		fmt.Fprintf(w, "Error listing bucket objects: %v\n", err)
+		return
+	}
+
+	snapshotObject := client.Bucket(cfg.SnapshotBucket).UserProject(cfg.ComputeProjectId).Object(snapshotObjectName(cfg, cfg.BucketName, prefix))
+	previous, err := loadListingSnapshot(ctx, snapshotObject)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		fmt.Fprintf(w, "Error reading previous snapshot: %v\n", err)
+		return
+	}
+
+	if previous == nil {
+		fmt.Fprintf(w, "No previous snapshot for gs://%s/%s; saving a baseline of %d objects.\n", cfg.BucketName, prefix, len(current.Objects))
+	} else {
+		printListingChanges(w, diffListingSnapshots(previous, current), cfg.ObjectNameEncoding)
+	}
+
+	current.Labels = labels
+	if err := saveListingSnapshot(ctx, snapshotObject, current); err != nil {
+		fmt.Fprintf(w, "Error saving snapshot: %v\n", err)
+	}
+}
+
+// takeListingSnapshot lists prefix, skipping our own snapshot objects when they live in the same bucket.
+func takeListingSnapshot(ctx context.Context, bucket *storage.BucketHandle, bucketName, prefix, skipPrefix string) (*ListingSnapshot, error) {
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Generation", "Metageneration", "Size"}); err != nil {
+		return nil, err
+	}
+
+	snapshot := &ListingSnapshot{Bucket: bucketName, Prefix: prefix, TakenAt: time.Now().UTC(), Objects: map[string]SnapshotEntry{}}
+	it := bucket.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if skipPrefix != "" && strings.HasPrefix(attrs.Name, skipPrefix) {
+			continue
+		}
+		snapshot.Objects[attrs.Name] = SnapshotEntry{Generation: attrs.Generation, Metageneration: attrs.Metageneration, Size: attrs.Size}
+	}
+	return snapshot, nil
+}
+
+// snapshotObjectName names the snapshot for bucket/prefix with SNAPSHOT_NAME_TEMPLATE.
+// The name must come out the same on every run for changes to be detected.
+func snapshotObjectName(cfg *GCloudFunctionConfig, bucket, prefix string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + prefix))
+	return cfg.SnapshotPrefix + renderArtifactName("snapshot", cfg.SnapshotNameTemplate, DefaultSnapshotNameTemplate, ArtifactName{
+		Time:   time.Now().UTC(),
+		Bucket: bucket,
+		Prefix: prefix,
+		Check:  "changes",
+		Hash:   hex.EncodeToString(sum[:8]),
+	})
+}
+
+func loadListingSnapshot(ctx context.Context, obj *storage.ObjectHandle) (*ListingSnapshot, error) {
+	rc, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var snapshot ListingSnapshot
+	if err := json.NewDecoder(rc).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("corrupt snapshot: %v", err)
+	}
+	return &snapshot, nil
+}
+
+func saveListingSnapshot(ctx context.Context, obj *storage.ObjectHandle, snapshot *ListingSnapshot) error {
+	wc := obj.NewWriter(ctx)
+	wc.ContentType = "application/json"
+	if err := json.NewEncoder(wc).Encode(snapshot); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+func diffListingSnapshots(previous, current *ListingSnapshot) ListingChanges {
+	changes := ListingChanges{Since: previous.TakenAt}
+	for name, entry := range current.Objects {
+		old, ok := previous.Objects[name]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, name)
+		case old.Generation != entry.Generation || old.Metageneration != entry.Metageneration:
+			changes.Modified = append(changes.Modified, name)
+		}
+	}
+	for name := range previous.Objects {
+		if _, ok := current.Objects[name]; !ok {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Modified)
+	return changes
+}
+
+func printListingChanges(w http.ResponseWriter, changes ListingChanges, encoding string) {
+	fmt.Fprintf(w, "Changes since %s: %d added, %d removed, %d modified\n",
+		changes.Since.Format(time.RFC3339), len(changes.Added), len(changes.Removed), len(changes.Modified))
+	for _, name := range changes.Added {
+		fmt.Fprintf(w, "+ %s\n", encodeObjectName(name, encoding))
+	}
+	for _, name := range changes.Removed {
+		fmt.Fprintf(w, "- %s\n", encodeObjectName(name, encoding))
+	}
+	for _, name := range changes.Modified {
+		fmt.Fprintf(w, "~ %s\n", encodeObjectName(name, encoding))
+	}
+}
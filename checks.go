@@ -0,0 +1,126 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+// standaloneCheck runs one diagnostic in isolation, creating whatever clients it needs.
+type standaloneCheck func(ctx context.Context, cfg *GCloudFunctionConfig) error
+
+// standaloneChecks can be run on their own by /watch and similar endpoints.
+var standaloneChecks = map[string]standaloneCheck{
+	"bucket_access":     checkBucketAccessOnly,
+	"bucket_create":     checkBucketCreateOnly,
+	"dual_write":        checkDualWriteOnly,
+	"precondition_race": checkPreconditionRaceOnly,
+	"clock_skew":        checkClockSkewOnly,
+	"list_objects":      checkListObjectsOnly,
+	"pubsub_publish":    checkPublishOnly,
+	"kms_decrypt":       checkKMSDecryptOnly,
+}
+
+func standaloneCheckNames() []string {
+	names := make([]string, 0, len(standaloneChecks))
+	for name := range standaloneChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkBucketAccessOnly(ctx context.Context, cfg *GCloudFunctionConfig) error {
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId).Attrs(ctx)
+	return err
+}
+
+func checkBucketCreateOnly(ctx context.Context, cfg *GCloudFunctionConfig) error {
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return probeBucketCreate(ctx, client, cfg.ComputeProjectId, cfg.BucketCreateProbeName).Err()
+}
+
+func checkDualWriteOnly(ctx context.Context, cfg *GCloudFunctionConfig) error {
+	if cfg.DualWriteBucket == "" {
+		return errors.New("DUAL_WRITE_BUCKET is not set")
+	}
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	artifacts := cleanupFrom(ctx)
+	defer artifacts.finish(ctx, false)
+	object := cfg.ArtifactPrefix + artifacts.runID + "/dual-write-probe"
+	return checkDualWrite(withCleanup(ctx, artifacts), client, []string{cfg.BucketName, cfg.DualWriteBucket}, cfg.ComputeProjectId, object).Err()
+}
+
+func checkPreconditionRaceOnly(ctx context.Context, cfg *GCloudFunctionConfig) error {
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	artifacts := cleanupFrom(ctx)
+	defer artifacts.finish(ctx, false)
+	object := cfg.ArtifactPrefix + artifacts.runID + "/precondition-race"
+	return checkPreconditionRace(withCleanup(ctx, artifacts), client, cfg.BucketName, cfg.ComputeProjectId, object).Err()
+}
+
+func checkClockSkewOnly(ctx context.Context, cfg *GCloudFunctionConfig) error {
+	return checkClockSkew(ctx, cfg.ClockSkewThreshold).Err()
+}
+
+func checkListObjectsOnly(ctx context.Context, cfg *GCloudFunctionConfig) error {
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// A single-object page is enough to prove list permission.
+	it := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId).Objects(ctx, nil)
+	it.PageInfo().MaxSize = 1
+	if _, err := it.Next(); err != nil && err != iterator.Done {
+		return err
+	}
+	return nil
+}
+
+func checkPublishOnly(ctx context.Context, cfg *GCloudFunctionConfig) error {
+	client, err := newPubSubClient(ctx, cfg.ComputeProjectId)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	topic := client.Topic(cfg.PubSubTopicId)
+	defer topic.Stop()
+	_, err = topic.Publish(ctx, &pubsub.Message{
+		Data: []byte(fmt.Sprintf("Check message from Cloud Function at %s", time.Now().UTC().Format(time.RFC3339))),
+	}).Get(ctx)
+	return err
+}
+
+func checkKMSDecryptOnly(ctx context.Context, cfg *GCloudFunctionConfig) error {
+	_, err := decryptWithKMS(ctx, cfg.KmsKey, simulateEncryptedData())
+	return err
+}
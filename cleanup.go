@@ -0,0 +1,288 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Cleanup policies, from CLEANUP_POLICY or ?cleanup=.
+const (
+	CleanupAlways = "always"
+	// CleanupKeepOnFailure keeps what a failed run created, for inspecting afterwards.
+	CleanupKeepOnFailure = "keep-on-failure"
+	CleanupNever         = "never"
+)
+
+// artifactRunKey is set in the metadata of every object the function creates as a
+// by-product, so orphan cleanup never touches anything else under its prefixes.
+const artifactRunKey = "gcf-list-buckets-run"
+
+const defaultOrphanAge = time.Hour
+
+var cleanupPolicies = []string{CleanupAlways, CleanupKeepOnFailure, CleanupNever}
+
+// Artifact is something a run created and is responsible for removing.
+type Artifact struct {
+	Kind    string
+	Name    string
+	Deleted bool
+	Kept    bool
+	Error   string
+
+	remove  func(ctx context.Context) error
+	settled bool
+}
+
+// cleanupManager tracks the artifacts of one run and removes them per policy. Modes
+// that write register what they create as soon as it exists, so a run that fails half
+// way still cleans up.
+type cleanupManager struct {
+	runID  string
+	policy string
+
+	mu        sync.Mutex
+	artifacts []*Artifact
+}
+
+type cleanupKey struct{}
+
+func newCleanupManager(runID, policy string) *cleanupManager {
+	return &cleanupManager{runID: runID, policy: policy}
+}
+
+func withCleanup(ctx context.Context, m *cleanupManager) context.Context {
+	return context.WithValue(ctx, cleanupKey{}, m)
+}
+
+// cleanupFrom returns the run's manager, or one that removes everything at once for
+// callers outside a run.
+func cleanupFrom(ctx context.Context) *cleanupManager {
+	if m, ok := ctx.Value(cleanupKey{}).(*cleanupManager); ok {
+		return m
+	}
+	return newCleanupManager(newRunID(), CleanupAlways)
+}
+
+// requestCleanupPolicy reads ?cleanup=, falling back to CLEANUP_POLICY.
+func requestCleanupPolicy(r *http.Request, fallback string) (string, error) {
+	policy := r.URL.Query().Get("cleanup")
+	if policy == "" {
+		policy = fallback
+	}
+	if !containsString(cleanupPolicies, policy) {
+		return "", fmt.Errorf("cleanup must be one of %s", strings.Join(cleanupPolicies, ", "))
+	}
+	return policy, nil
+}
+
+// artifactMetadata marks an object as created by this run.
+func (m *cleanupManager) artifactMetadata() map[string]string {
+	return map[string]string{artifactRunKey: m.runID}
+}
+
+func (m *cleanupManager) track(kind, name string, remove func(ctx context.Context) error) *Artifact {
+	a := &Artifact{Kind: kind, Name: name, remove: remove}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.artifacts = append(m.artifacts, a)
+	return a
+}
+
+func (m *cleanupManager) trackObject(obj *storage.ObjectHandle) *Artifact {
+	return m.track("object", "gs://"+obj.BucketName()+"/"+obj.ObjectName(), func(ctx context.Context) error {
+		err := obj.Delete(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+// settle removes one artifact now rather than at the end of the run, e.g. a large
+// object that has served its purpose, unless the policy keeps it.
+func (m *cleanupManager) settle(ctx context.Context, a *Artifact, failed bool) {
+	m.mu.Lock()
+	if a.settled {
+		m.mu.Unlock()
+		return
+	}
+	a.settled = true
+	m.mu.Unlock()
+
+	if m.policy == CleanupNever || (failed && m.policy == CleanupKeepOnFailure) {
+		a.Kept = true
+		return
+	}
+	// Cleanup still runs once the request has been cancelled or timed out.
+	if err := a.remove(context.WithoutCancel(ctx)); err != nil {
+		a.Error = err.Error()
+		log.Printf("Failed to clean up %s %s: %v\n", a.Kind, a.Name, err)
+		return
+	}
+	a.Deleted = true
+}
+
+// finish settles every artifact not settled yet and returns what happened to each.
+func (m *cleanupManager) finish(ctx context.Context, failed bool) []Artifact {
+	m.mu.Lock()
+	artifacts := append([]*Artifact(nil), m.artifacts...)
+	m.mu.Unlock()
+
+	results := make([]Artifact, 0, len(artifacts))
+	for _, a := range artifacts {
+		m.settle(ctx, a, failed)
+		results = append(results, *a)
+	}
+	return results
+}
+
+func printCleanup(w http.ResponseWriter, policy string, artifacts []Artifact) {
+	if len(artifacts) == 0 {
+		return
+	}
+	deleted, kept := 0, 0
+	for _, a := range artifacts {
+		switch {
+		case a.Deleted:
+			deleted++
+		case a.Kept:
+			kept++
+		}
+	}
+	fmt.Fprintf(w, "Cleanup (%s): deleted %d/%d\n", policy, deleted, len(artifacts))
+	for _, a := range artifacts {
+		switch {
+		case a.Kept:
+			fmt.Fprintf(w, "| Kept %s %s\n", a.Kind, a.Name)
+		case a.Error != "":
+			fmt.Fprintf(w, "| FAILED %s %s: %s\n", a.Kind, a.Name, a.Error)
+		}
+	}
+	if kept > 0 {
+		fmt.Fprintln(w, "| Kept artifacts are removed by POST /cleanup once they are older than an hour.")
+	}
+}
+
+// Orphan is an artifact left behind by a crashed run or kept by policy.
+type Orphan struct {
+	Name       string
+	Generation int64
+	RunID      string
+	Created    time.Time
+	Size       int64
+	Deleted    bool
+	// Rewritten is set when the object changed after it was listed, so it was kept.
+	Rewritten bool
+	Error     string
+}
+
+// cleanupHandler finds objects under the artifact prefixes that a run created and never
+// removed. GET lists them; POST deletes them. Only objects older than ?olderThan=
+// (default 1h) count, so runs still in progress keep theirs.
+func cleanupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	olderThan := queryDuration(r, "olderThan", defaultOrphanAge)
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating storage client: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId)
+	prefixes := uniqueStrings([]string{cfg.ArtifactPrefix, cfg.SoakPrefix})
+	orphans, err := findOrphans(ctx, bucket, prefixes, time.Now().Add(-olderThan))
+	if err != nil {
+		fmt.Fprintf(w, "Error listing artifacts: %v\n", err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		for i := range orphans {
+			// Only the generation that was listed: a run may have rewritten the name since.
+			obj := bucket.Object(orphans[i].Name).If(storage.Conditions{GenerationMatch: orphans[i].Generation})
+			err := obj.Delete(ctx)
+			if decodeError(err).Code == http.StatusPreconditionFailed {
+				orphans[i].Rewritten = true
+				continue
+			}
+			if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				orphans[i].Error = err.Error()
+				continue
+			}
+			orphans[i].Deleted = true
+		}
+	}
+	printOrphans(w, cfg.BucketName, prefixes, olderThan, r.Method == http.MethodPost, orphans)
+}
+
+func findOrphans(ctx context.Context, bucket *storage.BucketHandle, prefixes []string, before time.Time) ([]Orphan, error) {
+	var orphans []Orphan
+	for _, prefix := range prefixes {
+		query := &storage.Query{Prefix: prefix}
+		if err := query.SetAttrSelection([]string{"Name", "Generation", "Size", "Created", "Metadata"}); err != nil {
+			return nil, err
+		}
+		it := bucket.Objects(ctx, query)
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return orphans, err
+			}
+			runID, ok := attrs.Metadata[artifactRunKey]
+			if !ok || !attrs.Created.Before(before) {
+				continue
+			}
+			orphans = append(orphans, Orphan{Name: attrs.Name, Generation: attrs.Generation, RunID: runID, Created: attrs.Created, Size: attrs.Size})
+		}
+	}
+	return orphans, nil
+}
+
+func printOrphans(w http.ResponseWriter, bucket string, prefixes []string, olderThan time.Duration, deleting bool, orphans []Orphan) {
+	fmt.Fprintf(w, "Orphaned Artifacts (gs://%s, %s, older than %s):\n", bucket, strings.Join(prefixes, ", "), olderThan)
+	if len(orphans) == 0 {
+		fmt.Fprintln(w, "| None")
+		return
+	}
+	deleted := 0
+	for _, o := range orphans {
+		fmt.Fprintf(w, "| %s (run %s, %s, created %s)", safeObjectName(o.Name), o.RunID, formatBytes(uint64(o.Size)), o.Created.Format(time.RFC3339))
+		switch {
+		case o.Error != "":
+			fmt.Fprintf(w, " FAILED: %s", o.Error)
+		case o.Rewritten:
+			fmt.Fprint(w, " kept: rewritten since it was listed")
+		case o.Deleted:
+			deleted++
+			fmt.Fprint(w, " deleted")
+		}
+		fmt.Fprintln(w)
+	}
+	if deleting {
+		fmt.Fprintf(w, "| Deleted %d/%d\n", deleted, len(orphans))
+	} else {
+		fmt.Fprintln(w, "| POST to delete them.")
+	}
+}
@@ -0,0 +1,252 @@
+package gcf
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2/google"
+	storagev1 "google.golang.org/api/storage/v1"
+)
+
+const (
+	tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+	// clockProbeURL answers unauthenticated requests quickly, with a Date header.
+	clockProbeURL = "https://storage.googleapis.com/storage/v1/"
+	// tokenExpiryMargin is how close to expiry a token is worth a warning: work started
+	// now with it, such as a long download or a URL signed with it, may outlive it.
+	tokenExpiryMargin = 5 * time.Minute
+	// dateResolution is the precision of the Date header, which has whole seconds.
+	dateResolution = time.Second
+)
+
+// ClockSample is the skew measured from one response's Date header; positive means
+// Google's clock is ahead of the local one.
+type ClockSample struct {
+	Source string
+	Skew   time.Duration
+	RTT    time.Duration
+	Error  string
+}
+
+// ClockCheck compares the local clock with Google's, and the function's tokens with both.
+type ClockCheck struct {
+	LocalTime time.Time
+	Samples   []ClockSample
+	// Skew is the sample with the shortest round trip, the most precise.
+	Skew      time.Duration
+	Threshold time.Duration
+
+	AccessTokenExpiry time.Time
+	// AccessTokenServerExpiry is the expiry tokeninfo reports, by Google's clock.
+	AccessTokenServerExpiry time.Time
+	IDTokenIssued           time.Time
+	IDTokenExpiry           time.Time
+	IDTokenNote             string
+	Warnings                []string
+	Error                   string
+}
+
+func (c ClockCheck) Err() error {
+	switch {
+	case c.Error != "":
+		return errors.New(c.Error)
+	case c.Skew.Abs() > c.Threshold:
+		return fmt.Errorf("local clock is %s off Google's, more than %s", c.Skew.Abs().Round(time.Millisecond), c.Threshold)
+	}
+	return nil
+}
+
+// checkClockSkew measures skew from the Date header of Google responses and reads the
+// issue and expiry times of the function's tokens. Signed URLs are dated by the local
+// clock and JWTs are checked against the verifier's, so skew shows up as URLs that are
+// not yet valid or already expired and as iat/exp rejections.
+func checkClockSkew(ctx context.Context, threshold time.Duration) ClockCheck {
+	check := ClockCheck{LocalTime: time.Now().UTC(), Threshold: threshold}
+
+	ts, err := google.DefaultTokenSource(ctx, storagev1.CloudPlatformScope)
+	if err != nil {
+		check.Error = fmt.Sprintf("failed to create token source: %v", err)
+		return check
+	}
+	token, err := ts.Token()
+	if err != nil {
+		check.Error = fmt.Sprintf("failed to get an access token: %v", err)
+		return check
+	}
+	check.AccessTokenExpiry = token.Expiry.UTC()
+
+	tokenSample, serverExpiry, err := readTokenInfo(ctx, token.AccessToken)
+	if err != nil {
+		tokenSample.Error = err.Error()
+	}
+	check.AccessTokenServerExpiry = serverExpiry
+	check.Samples = append(check.Samples, tokenSample)
+
+	probeSample := ClockSample{Source: clockProbeURL}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, clockProbeURL, nil)
+	if err == nil {
+		var resp *http.Response
+		resp, probeSample, err = dateSample(req, clockProbeURL)
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		probeSample.Error = err.Error()
+	}
+	check.Samples = append(check.Samples, probeSample)
+
+	best := -1
+	for i, s := range check.Samples {
+		if s.Error == "" && (best < 0 || s.RTT < check.Samples[best].RTT) {
+			best = i
+		}
+	}
+	if best < 0 {
+		check.Error = "no response carried a usable Date header"
+		return check
+	}
+	check.Skew = check.Samples[best].Skew
+
+	check.IDTokenIssued, check.IDTokenExpiry, check.IDTokenNote = readIDTokenTimes(ctx)
+
+	if remaining := time.Until(check.AccessTokenExpiry); !check.AccessTokenExpiry.IsZero() && remaining < tokenExpiryMargin {
+		check.Warnings = append(check.Warnings, fmt.Sprintf("access token expires in %s; it is refreshed on next use, but work already holding it may fail with 401", remaining.Round(time.Second)))
+	}
+	if !check.AccessTokenServerExpiry.IsZero() {
+		// The library dates Expiry by the local clock at fetch time, tokeninfo by Google's.
+		if d := check.AccessTokenServerExpiry.Sub(check.AccessTokenExpiry); d.Abs() > threshold {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("access token expiry differs by %s between the local clock and Google's", d.Round(time.Second)))
+		}
+	}
+	if !check.IDTokenIssued.IsZero() && check.IDTokenIssued.After(time.Now().Add(dateResolution)) {
+		check.Warnings = append(check.Warnings, fmt.Sprintf("ID token was issued %s in the local future; verifiers with a slow clock reject it as not yet valid", time.Until(check.IDTokenIssued).Round(time.Second)))
+	}
+	switch {
+	case check.Skew > threshold:
+		check.Warnings = append(check.Warnings, "local clock is behind: URLs signed here may already be expired for short expiries, and tokens look issued in the future")
+	case -check.Skew > threshold:
+		check.Warnings = append(check.Warnings, "local clock is ahead: URLs signed here may be rejected as not yet valid, and JWTs checked here expire early")
+	}
+	return check
+}
+
+// readTokenInfo asks tokeninfo for the token's expiry by Google's clock, taking a clock
+// sample from the same response. The token goes in the body, not the URL, so it stays
+// out of request logs.
+func readTokenInfo(ctx context.Context, accessToken string) (ClockSample, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenInfoURL, strings.NewReader(url.Values{"access_token": {accessToken}}.Encode()))
+	if err != nil {
+		return ClockSample{Source: tokenInfoURL}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, sample, err := dateSample(req, tokenInfoURL)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return sample, time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return sample, time.Time{}, fmt.Errorf("tokeninfo returned HTTP %d", resp.StatusCode)
+	}
+	var info struct {
+		Exp string `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return sample, time.Time{}, fmt.Errorf("failed to decode tokeninfo: %v", err)
+	}
+	exp, err := strconv.ParseInt(info.Exp, 10, 64)
+	if err != nil {
+		return sample, time.Time{}, fmt.Errorf("tokeninfo has no expiry")
+	}
+	return sample, time.Unix(exp, 0).UTC(), nil
+}
+
+// dateSample sends req and compares its Date header with the local time halfway
+// through the round trip. The caller closes the body.
+func dateSample(req *http.Request, source string) (*http.Response, ClockSample, error) {
+	sample := ClockSample{Source: source}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, sample, err
+	}
+	sample.RTT = time.Since(start)
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return resp, sample, fmt.Errorf("no usable Date header: %v", err)
+	}
+	// Date is truncated to the second, so on average it is half a second behind.
+	sample.Skew = date.Add(dateResolution / 2).Sub(start.Add(sample.RTT / 2))
+	return resp, sample, nil
+}
+
+// readIDTokenTimes reads iat and exp from an ID token minted by the metadata server.
+// The token is only decoded, never used or shown.
+func readIDTokenTimes(ctx context.Context) (issued, expiry time.Time, note string) {
+	if !metadata.OnGCE() {
+		return issued, expiry, "not on Google Cloud; ID tokens come from the metadata server"
+	}
+	token, err := metadata.GetWithContext(ctx, "instance/service-accounts/default/identity?audience="+url.QueryEscape(clockProbeURL))
+	if err != nil {
+		return issued, expiry, fmt.Sprintf("failed to mint an ID token: %v", err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return issued, expiry, "ID token is not a JWT"
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return issued, expiry, fmt.Sprintf("failed to decode ID token: %v", err)
+	}
+	var claims struct {
+		Iat int64 `json:"iat"`
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return issued, expiry, fmt.Sprintf("failed to decode ID token: %v", err)
+	}
+	return time.Unix(claims.Iat, 0).UTC(), time.Unix(claims.Exp, 0).UTC(), ""
+}
+
+func printClockCheck(w http.ResponseWriter, check ClockCheck) {
+	fmt.Fprintf(w, "Clock Skew (threshold %s):\n", check.Threshold)
+	if check.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", check.Error)
+		return
+	}
+	fmt.Fprintf(w, "| Local Time: %s\n", check.LocalTime.Format(time.RFC3339Nano))
+	for _, s := range check.Samples {
+		if s.Error != "" {
+			fmt.Fprintf(w, "| %s: FAILED - %s\n", s.Source, s.Error)
+			continue
+		}
+		fmt.Fprintf(w, "| %s: skew %s (round trip %s)\n", s.Source, s.Skew.Round(time.Millisecond), s.RTT.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "| Skew: %s, accurate to about ±%s\n", check.Skew.Round(time.Millisecond), dateResolution/2)
+	if !check.AccessTokenExpiry.IsZero() {
+		fmt.Fprintf(w, "| Access Token Expires: %s (in %s)", check.AccessTokenExpiry.Format(time.RFC3339), time.Until(check.AccessTokenExpiry).Round(time.Second))
+		if !check.AccessTokenServerExpiry.IsZero() {
+			fmt.Fprintf(w, ", %s by Google's clock", check.AccessTokenServerExpiry.Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+	}
+	if check.IDTokenNote != "" {
+		fmt.Fprintf(w, "| ID Token: %s\n", check.IDTokenNote)
+	} else {
+		fmt.Fprintf(w, "| ID Token: issued %s, expires %s\n", check.IDTokenIssued.Format(time.RFC3339), check.IDTokenExpiry.Format(time.RFC3339))
+	}
+	for _, warning := range check.Warnings {
+		fmt.Fprintf(w, "| WARNING: %s\n", warning)
+	}
+}
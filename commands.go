@@ -0,0 +1,317 @@
+package gcf
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"google.golang.org/grpc"
+)
+
+// maxCommandMessageBytes is the largest message body put on a publish command line.
+const maxCommandMessageBytes = 4 << 10
+
+// traceCommands reports whether a request asked for the commands trace, with
+// ?trace=commands, or TRACE_COMMANDS turns it on for every run.
+func traceCommands(r *http.Request, cfg *GCloudFunctionConfig) bool {
+	switch r.URL.Query().Get("trace") {
+	case "commands":
+		return true
+	case "none":
+		return false
+	}
+	return cfg.TraceCommands
+}
+
+// httpCommand is the gcloud command that makes the same Cloud Storage call as req, or
+// a curl command for calls gcloud has no equivalent of. Either runs with the user's
+// own credentials.
+func httpCommand(req *http.Request) string {
+	q := req.URL.Query()
+	var flags []string
+	if p := q.Get("userProject"); p != "" {
+		flags = append(flags, "--billing-project="+shellQuote(p))
+	}
+	if req.URL.Host == "storage.googleapis.com" {
+		if cmd := storageCommand(req, q); cmd != "" {
+			return strings.Join(append([]string{cmd}, flags...), " ")
+		}
+	}
+	return curlCommand(req)
+}
+
+var (
+	storageObjectPath  = regexp.MustCompile(`^/(?:download/)?storage/v1/b/([^/]+)/o/(.+)$`)
+	storageRewritePath = regexp.MustCompile(`^/storage/v1/b/([^/]+)/o/(.+)/(?:rewriteTo|copyTo)/b/([^/]+)/o/(.+)$`)
+)
+
+func storageCommand(req *http.Request, q url.Values) string {
+	path := req.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		if q.Get("upload_id") != "" {
+			return "# continues the upload above"
+		}
+		bucket := strings.TrimSuffix(strings.TrimPrefix(path, "/upload/storage/v1/b/"), "/o")
+		cmd := "gcloud storage cp FILE " + gsURL(bucket, q.Get("name"), "")
+		if g := q.Get("ifGenerationMatch"); g != "" {
+			cmd += " --if-generation-match=" + g
+		}
+		return cmd
+
+	case storageRewritePath.MatchString(path):
+		m := storageRewritePath.FindStringSubmatch(path)
+		return "gcloud storage cp " + gsURL(m[1], m[2], q.Get("sourceGeneration")) + " " + gsURL(m[3], m[4], "")
+
+	case strings.HasSuffix(path, "/iam/testPermissions"):
+		// gcloud has no command for testIamPermissions.
+		return ""
+
+	case storageObjectPath.MatchString(path):
+		m := storageObjectPath.FindStringSubmatch(path)
+		object := gsURL(m[1], m[2], q.Get("generation"))
+		switch {
+		case req.Method == http.MethodDelete:
+			return "gcloud storage rm " + object
+		case req.Method == http.MethodGet && (q.Get("alt") == "media" || strings.HasPrefix(path, "/download/")):
+			return catCommand(req, object)
+		case req.Method == http.MethodGet:
+			return "gcloud storage objects describe " + object
+		}
+		return ""
+
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		rest := strings.TrimPrefix(path, "/storage/v1/b/")
+		bucket, resource, _ := strings.Cut(rest, "/")
+		if req.Method != http.MethodGet {
+			return ""
+		}
+		switch resource {
+		case "":
+			return "gcloud storage buckets describe " + gsURL(bucket, "", "")
+		case "o":
+			return lsCommand(bucket, q)
+		case "iam":
+			return "gcloud storage buckets get-iam-policy " + gsURL(bucket, "", "")
+		case "notificationConfigs":
+			return "gcloud storage buckets notifications list " + gsURL(bucket, "", "")
+		}
+		return ""
+
+	case path == "/storage/v1/b" && req.Method == http.MethodGet:
+		return "gcloud storage buckets list --project=" + shellQuote(q.Get("project"))
+
+	case req.Method == http.MethodGet && !strings.HasPrefix(path, "/storage/"):
+		// Reads go to the XML API as /BUCKET/OBJECT.
+		bucket, object, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		if ok && object != "" {
+			return catCommand(req, gsURL(bucket, object, q.Get("generation")))
+		}
+	}
+	return ""
+}
+
+// lsCommand lists what an objects.list call with the same prefix, delimiter and
+// versions parameters returns.
+func lsCommand(bucket string, q url.Values) string {
+	cmd := "gcloud storage ls"
+	if q.Get("versions") == "true" {
+		cmd += " --all-versions"
+	}
+	if q.Get("delimiter") == "/" {
+		return cmd + " " + shellQuote("gs://"+bucket+"/"+q.Get("prefix"))
+	}
+	return cmd + " " + shellQuote("gs://"+bucket+"/"+q.Get("prefix")+"**")
+}
+
+// catCommand reads an object, with -r for ranged reads.
+func catCommand(req *http.Request, object string) string {
+	cmd := "gcloud storage cat"
+	if spec, ok := strings.CutPrefix(req.Header.Get("Range"), "bytes="); ok {
+		cmd += " -r " + shellQuote(spec)
+	}
+	return cmd + " " + object
+}
+
+func gsURL(bucket, object, generation string) string {
+	u := "gs://" + bucket
+	if object != "" {
+		u += "/" + object
+	}
+	if generation != "" {
+		u += "#" + generation
+	}
+	return shellQuote(u)
+}
+
+// curlCommand calls the same URL with a gcloud access token. Query parameters that
+// carry credentials or upload sessions are dropped, and request bodies aren't recorded.
+func curlCommand(req *http.Request) string {
+	u := *req.URL
+	q := u.Query()
+	for _, key := range []string{"access_token", "key", "upload_id"} {
+		q.Del(key)
+	}
+	u.RawQuery = q.Encode()
+
+	cmd := `curl -X ` + req.Method + ` -H "Authorization: Bearer $(gcloud auth print-access-token)"`
+	if req.Body != nil && req.ContentLength != 0 {
+		if ct := req.Header.Get("Content-Type"); ct != "" {
+			cmd += " -H " + shellQuote("Content-Type: "+ct)
+		}
+		cmd += " --data-binary @BODY_FILE"
+	}
+	return cmd + " " + shellQuote(u.String())
+}
+
+// grpcCommand is the gcloud command for a Pub/Sub or Cloud KMS RPC, or a note that
+// there is none.
+func grpcCommand(method string, req interface{}) string {
+	switch req := req.(type) {
+	case *pubsubpb.PublishRequest:
+		cmds := make([]string, 0, len(req.Messages))
+		for _, msg := range req.Messages {
+			cmds = append(cmds, publishCommand(req.Topic, msg))
+		}
+		return strings.Join(cmds, "\n")
+	case *pubsubpb.GetTopicRequest:
+		return "gcloud pubsub topics describe " + shellQuote(req.Topic)
+	case *pubsubpb.ListTopicSubscriptionsRequest:
+		return "gcloud pubsub topics list-subscriptions " + shellQuote(req.Topic)
+	case *pubsubpb.ListTopicsRequest:
+		return "gcloud pubsub topics list --project=" + shellQuote(strings.TrimPrefix(req.Project, "projects/"))
+	case *pubsubpb.GetSubscriptionRequest:
+		return "gcloud pubsub subscriptions describe " + shellQuote(req.Subscription)
+	case *pubsubpb.ListSubscriptionsRequest:
+		return "gcloud pubsub subscriptions list --project=" + shellQuote(strings.TrimPrefix(req.Project, "projects/"))
+	case *pubsubpb.DeleteSubscriptionRequest:
+		return "gcloud pubsub subscriptions delete " + shellQuote(req.Subscription)
+	case *pubsubpb.Subscription:
+		cmd := "gcloud pubsub subscriptions create " + shellQuote(req.Name) + " --topic=" + shellQuote(req.Topic)
+		if req.Filter != "" {
+			cmd += " --message-filter=" + shellQuote(req.Filter)
+		}
+		if req.AckDeadlineSeconds > 0 {
+			cmd += " --ack-deadline=" + strconv.Itoa(int(req.AckDeadlineSeconds))
+		}
+		return cmd
+	case *pubsubpb.PullRequest:
+		return fmt.Sprintf("gcloud pubsub subscriptions pull %s --limit=%d", shellQuote(req.Subscription), req.MaxMessages)
+	case *pubsubpb.StreamingPullRequest:
+		// Receive keeps one stream open; each pull returns what is available now.
+		return "gcloud pubsub subscriptions pull " + shellQuote(req.Subscription) + " --limit=100  # streaming pull"
+	case *pubsubpb.AcknowledgeRequest:
+		return "gcloud pubsub subscriptions ack " + shellQuote(req.Subscription) + " --ack-ids=" + shellQuote(strings.Join(req.AckIds, ","))
+	case *pubsubpb.ModifyAckDeadlineRequest:
+		return fmt.Sprintf("gcloud pubsub subscriptions modify-message-ack-deadline %s --ack-ids=%s --ack-deadline=%d",
+			shellQuote(req.Subscription), shellQuote(strings.Join(req.AckIds, ",")), req.AckDeadlineSeconds)
+	case *pubsubpb.SeekRequest:
+		if snapshot := req.GetSnapshot(); snapshot != "" {
+			return "gcloud pubsub subscriptions seek " + shellQuote(req.Subscription) + " --snapshot=" + shellQuote(snapshot)
+		}
+		if t := req.GetTime(); t != nil {
+			return "gcloud pubsub subscriptions seek " + shellQuote(req.Subscription) + " --time=" + t.AsTime().Format("2006-01-02T15:04:05.999999999Z")
+		}
+	case *kmspb.DecryptRequest:
+		return "gcloud kms decrypt --key=" + shellQuote(req.Name) + " --ciphertext-file=CIPHERTEXT_FILE --plaintext-file=-"
+	}
+	return "# no gcloud equivalent for " + method
+}
+
+// publishCommand publishes one message. Bodies that aren't short text are left out.
+func publishCommand(topic string, msg *pubsubpb.PubsubMessage) string {
+	cmd := "gcloud pubsub topics publish " + shellQuote(topic)
+	note := ""
+	if utf8.Valid(msg.Data) && len(msg.Data) <= maxCommandMessageBytes {
+		cmd += " --message=" + shellQuote(string(msg.Data))
+	} else {
+		cmd += " --message=MESSAGE"
+		note = fmt.Sprintf("  # %d-byte body not shown", len(msg.Data))
+	}
+	keys := make([]string, 0, len(msg.Attributes))
+	for k := range msg.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd += " --attribute=" + shellQuote(k+"="+msg.Attributes[k])
+	}
+	if msg.OrderingKey != "" {
+		cmd += " --ordering-key=" + shellQuote(msg.OrderingKey)
+	}
+	return cmd + note
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// commandStream records the command for a streaming RPC from its first request, which
+// is only sent after the stream is open.
+type commandStream struct {
+	grpc.ClientStream
+	recorder *apiCallRecorder
+	index    int
+	method   string
+	sent     bool
+}
+
+func (s *commandStream) SendMsg(m interface{}) error {
+	if !s.sent {
+		s.sent = true
+		s.recorder.setCommand(s.index, grpcCommand(s.method, m))
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+// commandLines returns the recorded commands in call order, folding repeats such as
+// list pages into one line.
+func commandLines(calls []APICall) []string {
+	var lines []string
+	var last string
+	repeats := 0
+	flush := func() {
+		if repeats > 1 {
+			lines[len(lines)-1] += fmt.Sprintf("  # %d calls", repeats)
+		}
+	}
+	for _, call := range calls {
+		if call.Command == "" {
+			continue
+		}
+		if call.Command == last {
+			repeats++
+			continue
+		}
+		flush()
+		lines = append(lines, strings.Split(call.Command, "\n")...)
+		last, repeats = call.Command, 1
+	}
+	flush()
+	return lines
+}
+
+func printCommands(w io.Writer, calls []APICall) {
+	lines := commandLines(calls)
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Commands:")
+	for _, line := range lines {
+		fmt.Fprintf(w, "| %s\n", line)
+	}
+}
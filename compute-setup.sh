@@ -157,6 +157,8 @@ deploy_cloud_function() {
     mkdir -p ./function
     cp "$GO_FUNC_FILE" ./function/main.go
     cp "$GO_MOD_FILE" ./function/go.mod
+    cp go.sum ./function/go.sum
+    find . -maxdepth 1 -name '*.go' ! -name "$(basename "$GO_FUNC_FILE")" -exec cp {} ./function/ \;
 
     SERVICE_ACCOUNT_EMAIL="$CLOUD_FUNCTION_SERVICE_ACCOUNT_NAME@$COMPUTE_PROJECT_ID.iam.gserviceaccount.com"
 
@@ -0,0 +1,308 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigProblem is an environment variable that is missing, can't be parsed, or is set
+// without what it depends on. Warnings don't stop the function from working.
+type ConfigProblem struct {
+	Var     string `json:"var"`
+	Value   string `json:"value,omitempty"`
+	Problem string `json:"problem"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+// ConfigErrors is every problem found in the environment, so they can be fixed in one
+// redeploy rather than one at a time.
+type ConfigErrors []ConfigProblem
+
+func (e ConfigErrors) Error() string {
+	problems := make([]string, 0, len(e))
+	for _, p := range e {
+		problems = append(problems, p.Var+": "+p.Problem)
+	}
+	return "invalid configuration: " + strings.Join(problems, "; ")
+}
+
+// errors leaves out the warnings.
+func (e ConfigErrors) errors() ConfigErrors {
+	var errs ConfigErrors
+	for _, p := range e {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	return errs
+}
+
+// configPatterns are the shapes of resource names, the same as a posted run config's.
+var configPatterns = map[string]*regexp.Regexp{
+	"BUCKET_NAME":             bucketNamePattern,
+	"SNAPSHOT_BUCKET":         bucketNamePattern,
+	"DUAL_WRITE_BUCKET":       bucketNamePattern,
+	"COMPUTE_PROJECT_ID":      projectIDPattern,
+	"ACCESS_CONTACTS_PROJECT": projectIDPattern,
+	"PUBSUB_TOPIC_ID":         pubsubIDPattern,
+	"PUBSUB_SUBSCRIPTION_ID":  pubsubIDPattern,
+	"PROGRESS_TOPIC":          pubsubIDPattern,
+	"KMS_KEY":                 cryptoKeyPattern,
+	"TINK_KEK":                cryptoKeyPattern,
+}
+
+// startupConfigErrors is what validateEnvironment found when the instance started.
+var startupConfigErrors ConfigErrors
+
+func init() {
+	startupConfigErrors = validateConfig()
+	for _, p := range startupConfigErrors {
+		level := slog.LevelError
+		if p.Warning {
+			level = slog.LevelWarn
+		}
+		slog.Log(context.Background(), level, "Invalid configuration: "+p.Var+": "+p.Problem, slog.String("component", "config"))
+	}
+}
+
+// LoadConfig is NewGCloudFunctionConfig that also reports what is wrong with the
+// environment and CONFIG_FILE instead of silently falling back, so a bad deployment fails at startup
+// rather than deep inside a GCS call. The config is returned either way.
+func LoadConfig() (*GCloudFunctionConfig, error) {
+	cfg := NewGCloudFunctionConfig()
+	if errs := validateConfig().errors(); len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// validateEnvironment checks every documented variable: required ones are set, values
+// parse as their kind, names have the right shape, and related settings agree.
+func validateEnvironment(getenv func(string) string) ConfigErrors {
+	var problems ConfigErrors
+	add := func(name, value, problem string, warning bool) {
+		if deploymentVarFor(name).Secret {
+			value = ""
+		}
+		problems = append(problems, ConfigProblem{Var: name, Value: value, Problem: problem, Warning: warning})
+	}
+
+	for _, v := range deploymentVars {
+		value := getenv(v.Name)
+		if value == "" {
+			if v.Required {
+				add(v.Name, "", "required but not set", false)
+			}
+			continue
+		}
+		if problem := checkVarKind(v, value); problem != "" {
+			add(v.Name, value, problem, false)
+			continue
+		}
+		if len(v.Enum) > 0 && !slices.Contains(v.Enum, value) {
+			add(v.Name, value, fmt.Sprintf("must be one of %s", strings.Join(v.Enum, ", ")), false)
+		}
+		if pattern, ok := configPatterns[v.Name]; ok && !pattern.MatchString(value) {
+			add(v.Name, value, "is not a valid name", false)
+		}
+		for _, dep := range v.Requires {
+			if getenv(dep) == "" || getenv(dep) == "false" {
+				add(v.Name, value, fmt.Sprintf("has no effect unless %s is set", dep), true)
+			}
+		}
+	}
+
+	if target := getenv("TARGET_SERVICE_ACCOUNT"); target != "" && !validServiceAccountEmail(target) {
+		add("TARGET_SERVICE_ACCOUNT", target, "must be a service account email, e.g. name@project.iam.gserviceaccount.com", false)
+	}
+	if audience := getenv("STORAGE_CLIENT_AUDIENCE"); audience != "" {
+		if u, err := url.Parse(audience); err != nil || u.Scheme != "https" || u.Host == "" {
+			add("STORAGE_CLIENT_AUDIENCE", audience, "must be an https URL", false)
+		}
+	}
+	pairs := []struct{ low, high string }{
+		{"RETRY_INITIAL_BACKOFF", "RETRY_MAX_BACKOFF"},
+		{"PUBSUB_MIN_EXTENSION_PERIOD", "PUBSUB_MAX_EXTENSION_PERIOD"},
+	}
+	for _, pair := range pairs {
+		low, errLow := time.ParseDuration(getenv(pair.low))
+		high, errHigh := time.ParseDuration(getenv(pair.high))
+		if errLow == nil && errHigh == nil && high > 0 && low > high {
+			add(pair.low, getenv(pair.low), fmt.Sprintf("is longer than %s (%s)", pair.high, high), false)
+		}
+	}
+	return problems
+}
+
+// checkVarKind says what is wrong with value for v's kind. The get* helpers fall back
+// to the default on bad values, so without this a typo silently changes behaviour.
+func checkVarKind(v deploymentVar, value string) string {
+	switch v.Kind {
+	case "bool":
+		if value != "true" && value != "false" {
+			return `must be "true" or "false"; anything else reads as false`
+		}
+	case "int":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Sprintf("must be a whole number; using %s instead", defaultOrUnset(v))
+		}
+		// configSource.int reads 0 as unset, so it only means 0 where that's the default.
+		if n == 0 && !zeroIsDefault(v) && !zeroIntVars[v.Name] {
+			return fmt.Sprintf("must be above 0; using %s instead", defaultOrUnset(v))
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(value, 64); err != nil || f < 0 {
+			return fmt.Sprintf("must be a non-negative number; using %s instead", defaultOrUnset(v))
+		}
+	case "duration":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Sprintf("must be a duration such as 30s or 5m; using %s instead", defaultOrUnset(v))
+		}
+		if d == 0 && !zeroIsDefault(v) {
+			return fmt.Sprintf("must be above 0; using %s instead", defaultOrUnset(v))
+		}
+	}
+	return ""
+}
+
+// zeroIntVars read 0 as a setting of its own, such as turning a cache off.
+var zeroIntVars = map[string]bool{"DOWNLOAD_CACHE_BYTES": true}
+
+// zeroIsDefault reports whether v is 0 when unset, so setting it to 0 changes nothing.
+func zeroIsDefault(v deploymentVar) bool {
+	switch v.Default {
+	case "", "0", "0s":
+		return true
+	}
+	return false
+}
+
+func defaultOrUnset(v deploymentVar) string {
+	if v.Default == "" {
+		return "the built-in default"
+	}
+	return v.Default
+}
+
+func deploymentVarFor(name string) deploymentVar {
+	for _, v := range deploymentVars {
+		if v.Name == name {
+			return v
+		}
+	}
+	return deploymentVar{Name: name}
+}
+
+// configBlocked answers with the configuration errors found at startup when
+// CONFIG_STRICT is set, leaving /config reachable to see them.
+func configBlocked(w http.ResponseWriter, r *http.Request) bool {
+	errs := startupConfigErrors.errors()
+	if !defaultConfigSource.bool("CONFIG_STRICT") || len(errs) == 0 || r.URL.Path == "/config" {
+		return false
+	}
+	http.Error(w, errs.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// configHandler shows the configuration the function is running with, after defaults,
+// and what is wrong with the environment. Secrets and credentials in URLs are redacted.
+// ?profile= shows a profile's configuration instead.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, _, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	fields := effectiveConfig(cfg)
+	problems := validateConfig()
+	profiles, err := configProfileNames(r.Context())
+	if err != nil {
+		problems = append(problems, ConfigProblem{Var: "CONFIG_PROFILES_SECRET", Value: os.Getenv("CONFIG_PROFILES_SECRET"), Problem: err.Error()})
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Config   map[string]string `json:"config"`
+			Profiles []string          `json:"profiles,omitempty"`
+			Problems ConfigErrors      `json:"problems"`
+		}{fields, profiles, problems})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "Configuration:")
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "| %s: %s\n", name, fields[name])
+	}
+	if len(profiles) > 0 {
+		fmt.Fprintf(w, "Profiles (%d):\n", len(profiles))
+		for _, name := range profiles {
+			fmt.Fprintf(w, "| %s\n", name)
+		}
+	}
+	fmt.Fprintf(w, "Problems (%d):\n", len(problems))
+	for _, p := range problems {
+		level := "ERROR"
+		if p.Warning {
+			level = "WARNING"
+		}
+		fmt.Fprintf(w, "| %s %s: %s\n", level, p.Var, p.Problem)
+	}
+}
+
+// effectiveConfig formats each config field. Secrets such as DEMO_MODE_SALT are read
+// where they are used and never reach the config; URLs lose any user:password.
+func effectiveConfig(cfg *GCloudFunctionConfig) map[string]string {
+	fields := map[string]string{}
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fields[field.Name] = redactURLCredentials(fmt.Sprint(v.Field(i).Interface()))
+	}
+	return fields
+}
+
+// redactURLCredentials replaces any user:pass@ in value, including in values too
+// malformed to parse as URLs, which still carry whatever credentials were typed.
+func redactURLCredentials(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		scheme, rest, ok := strings.Cut(value, "://")
+		authority, path, _ := strings.Cut(rest, "/")
+		if at := strings.LastIndex(authority, "@"); ok && at >= 0 {
+			value = scheme + "://REDACTED" + authority[at:]
+			if len(authority) < len(rest) {
+				value += "/" + path
+			}
+		}
+		return value
+	}
+	if u.User == nil || u.Host == "" {
+		return value
+	}
+	u.User = url.User("REDACTED")
+	return u.String()
+}
@@ -0,0 +1,52 @@
+package gcf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckVarKindZero(t *testing.T) {
+	tests := []struct {
+		name, value string
+		wantProblem bool
+	}{
+		{"RETRY_MAX_ATTEMPTS", "3", false},
+		{"RETRY_MAX_ATTEMPTS", "0", true},
+		{"RETRY_MAX_ATTEMPTS", "-1", true},
+		{"PUBSUB_RECEIVE_RETRIES", "0", false},
+		{"DOWNLOAD_CACHE_BYTES", "0", false},
+		{"STREAM_STALL_TIMEOUT", "0s", true},
+		{"STREAM_STALL_TIMEOUT", "5s", false},
+		{"REPORT_CACHE_TTL", "0s", false},
+		{"CHECK_TIMEOUT", "0s", false},
+	}
+	for _, tt := range tests {
+		problem := checkVarKind(deploymentVarFor(tt.name), tt.value)
+		if (problem != "") != tt.wantProblem {
+			t.Errorf("%s=%s: problem %q, want one: %t", tt.name, tt.value, problem, tt.wantProblem)
+		}
+	}
+}
+
+func TestConfigBlockedAfterFrontendAuth(t *testing.T) {
+	setTestEnv(t, map[string]string{"CONFIG_STRICT": "true", "FRONTEND_MODE": FrontendModeAPIGateway})
+	saved := startupConfigErrors
+	startupConfigErrors = ConfigErrors{{Var: "BUCKET_NAME", Value: "secret-looking-bucket", Problem: "is invalid"}}
+	t.Cleanup(func() { startupConfigErrors = saved })
+
+	w := httptest.NewRecorder()
+	DoIt(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), "BUCKET_NAME") {
+		t.Errorf("unauthenticated request = %d %q, want 401 without the config errors", w.Code, w.Body)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Apigateway-Api-Userinfo", "eyJlbWFpbCI6ImFAZXhhbXBsZS5jb20iLCJzdWIiOiIxIn0")
+	w = httptest.NewRecorder()
+	DoIt(w, r)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "BUCKET_NAME") {
+		t.Errorf("authenticated request = %d %q, want 503 with the config errors", w.Code, w.Body)
+	}
+}
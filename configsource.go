@@ -0,0 +1,225 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// configSource looks up a configuration variable by its environment variable name.
+type configSource func(key string) string
+
+// defaultConfigSource is the environment and, for what it leaves unset, CONFIG_FILE.
+var defaultConfigSource configSource = lookupConfig
+
+func lookupConfig(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	values, _ := loadConfigFile()
+	return values[key]
+}
+
+// with layers overrides over src.
+func (src configSource) with(overrides map[string]string) configSource {
+	return func(key string) string {
+		if value, ok := overrides[key]; ok {
+			return value
+		}
+		return src(key)
+	}
+}
+
+var configFile struct {
+	once     sync.Once
+	values   map[string]string
+	profiles map[string]map[string]string
+	err      error
+}
+
+// loadConfigFile reads CONFIG_FILE once: a JSON object keyed by environment variable
+// name, e.g. {"BUCKET_NAME": "my-bucket", "RETRY_MAX_ATTEMPTS": 5, "PROBE_ENDPOINTS":
+// ["https://a", "https://b"]}. Deploying it as a mounted secret keeps a large
+// configuration out of the function's environment. A "profiles" object holds named
+// sets of settings in the same form; see configProfile.
+func loadConfigFile() (map[string]string, error) {
+	configFile.once.Do(func() {
+		path := os.Getenv("CONFIG_FILE")
+		if path == "" {
+			return
+		}
+		configFile.values, configFile.profiles, configFile.err = parseConfigFile(path)
+		if configFile.err != nil {
+			configFile.err = fmt.Errorf("failed to read %s: %v", path, configFile.err)
+		}
+	})
+	return configFile.values, configFile.err
+}
+
+func parseConfigFile(path string) (map[string]string, map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var raw map[string]any
+	if err := decodeConfigJSON(data, &raw); err != nil {
+		return nil, nil, err
+	}
+	var profiles map[string]map[string]string
+	if p, ok := raw["profiles"]; ok {
+		delete(raw, "profiles")
+		if profiles, err = configProfiles(p); err != nil {
+			return nil, nil, err
+		}
+	}
+	values, err := configValues(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return values, profiles, nil
+}
+
+func decodeConfigJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// configValues flattens settings to the strings the environment would hold.
+func configValues(raw map[string]any) (map[string]string, error) {
+	values := map[string]string{}
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case json.Number:
+			values[key] = v.String()
+		case bool:
+			values[key] = fmt.Sprint(v)
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("%s must be a string, number, boolean or list", key)
+		}
+	}
+	return values, nil
+}
+
+// configFileProblems reports a CONFIG_FILE that can't be read, and keys in it the
+// function doesn't know, which are usually typos.
+func configFileProblems() ConfigErrors {
+	values, err := loadConfigFile()
+	if err != nil {
+		return ConfigErrors{{Var: "CONFIG_FILE", Value: os.Getenv("CONFIG_FILE"), Problem: err.Error()}}
+	}
+	var problems ConfigErrors
+	for key := range values {
+		if deploymentVarFor(key).Kind == "" {
+			problems = append(problems, ConfigProblem{Var: key, Problem: "is in CONFIG_FILE but is not a known setting", Warning: true})
+		}
+	}
+	problems = append(problems, profileProblems(configFile.profiles)...)
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Var < problems[j].Var })
+	return problems
+}
+
+// validateConfig checks the environment and CONFIG_FILE together.
+func validateConfig() ConfigErrors {
+	return append(configFileProblems(), validateEnvironment(defaultConfigSource)...)
+}
+
+var errConfigOverrideDisabled = errors.New("config overrides are disabled; set ALLOW_CONFIG_OVERRIDE=true to allow them")
+
+// requestConfig is the configuration for one request: NewGCloudFunctionConfig with the
+// ?profile= named and any config.NAME=value query parameters applied, for trying a
+// setting without a redeploy, e.g. ?config.RETRY_MAX_ATTEMPTS=1. Overrides need
+// ALLOW_CONFIG_OVERRIDE=true, must name documented variables that aren't Secret or
+// NoOverride, and must be valid.
+func requestConfig(r *http.Request) (*GCloudFunctionConfig, error) {
+	src := defaultConfigSource
+	profile := r.URL.Query().Get("profile")
+	if profile != "" {
+		settings, err := configProfile(r.Context(), profile)
+		if err != nil {
+			return nil, err
+		}
+		src = src.with(settings)
+	}
+
+	overrides := map[string]string{}
+	for key, values := range r.URL.Query() {
+		if name, ok := strings.CutPrefix(key, "config."); ok {
+			overrides[name] = values[len(values)-1]
+		}
+	}
+	if len(overrides) == 0 {
+		cfg := newConfig(src)
+		cfg.Profile = profile
+		return cfg, nil
+	}
+	if !defaultConfigSource.bool("ALLOW_CONFIG_OVERRIDE") {
+		return nil, errConfigOverrideDisabled
+	}
+
+	var names, problems []string
+	for name := range overrides {
+		names = append(names, name)
+		switch {
+		case strings.HasPrefix(name, "ALLOW_") || name == "CONFIG_FILE" || deploymentVarFor(name).Secret || deploymentVarFor(name).NoOverride:
+			// ALLOW_* gate what a caller may do, so a caller can't lift them, secrets
+			// are only read from the deployment, and identity, destinations and scope
+			// are the deployment's to choose.
+			problems = append(problems, name+" can't be overridden")
+		case deploymentVarFor(name).Kind == "":
+			problems = append(problems, name+" is not a known setting")
+		}
+	}
+	src = src.with(overrides)
+	for _, p := range validateEnvironment(src).errors() {
+		if _, ok := overrides[p.Var]; ok {
+			problems = append(problems, p.Var+": "+p.Problem)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	sort.Strings(names)
+	log.Printf("Running with config overrides of %s\n", strings.Join(names, ", "))
+	cfg := newConfig(src)
+	cfg.Profile = profile
+	return cfg, nil
+}
+
+// handlerConfig is requestConfig for a handler, answering the request itself when the
+// configuration can't be built: 403 when overrides are disabled, 404 for an unknown
+// profile and 400 for anything else. The returned context is the request's, set to
+// impersonate the configuration's TARGET_SERVICE_ACCOUNT, so clients created with it
+// act as the profile's or override's identity rather than the environment's.
+func handlerConfig(w http.ResponseWriter, r *http.Request) (*GCloudFunctionConfig, context.Context, bool) {
+	cfg, err := requestConfig(r)
+	switch {
+	case errors.Is(err, errConfigOverrideDisabled):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, nil, false
+	case errors.Is(err, errUnknownProfile):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, nil, false
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Invalid config: %v", err), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return cfg, withImpersonation(r.Context(), cfg.TargetServiceAccount), true
+}
@@ -0,0 +1,56 @@
+package gcf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConfigOverridesReachHandlers(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path+"?"+r.URL.RawQuery)
+		mu.Unlock()
+		writeFakeJSON(w, http.StatusOK, map[string]any{"kind": "storage#objects"})
+	})
+	setTestEnv(t, map[string]string{"ALLOW_CONFIG_OVERRIDE": "true"})
+
+	w := httptest.NewRecorder()
+	DoIt(w, httptest.NewRequest(http.MethodGet, "/config?config.LIST_FIELDS=full", nil))
+	if !strings.Contains(w.Body.String(), "ListFields: full") {
+		t.Fatalf("/config doesn't show the override:\n%s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	DoIt(w, httptest.NewRequest(http.MethodGet, "/objects?config.LIST_FIELDS=full", nil))
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) == 0 || !strings.Contains(paths[0], "projection=full") {
+		t.Errorf("API calls = %v, want a full projection listing; body:\n%s", paths, w.Body)
+	}
+}
+
+func TestRequestConfigRefusesGateOverrides(t *testing.T) {
+	setTestEnv(t, map[string]string{"ALLOW_CONFIG_OVERRIDE": "true"})
+	for _, name := range []string{"ALLOW_UPLOADS", "ALLOW_BUCKET_MANAGEMENT", "ALLOW_CONFIG_OVERRIDE", "CONFIG_FILE", "DEMO_MODE_SALT"} {
+		r := httptest.NewRequest(http.MethodGet, "/?config."+name+"=true", nil)
+		if _, err := requestConfig(r); err == nil || !strings.Contains(err.Error(), "can't be overridden") {
+			t.Errorf("config.%s: err = %v, want it refused", name, err)
+		}
+	}
+	for _, name := range []string{"TARGET_SERVICE_ACCOUNT", "DOWNLOAD_DESTINATION", "BUCKET_NAME", "COMPUTE_PROJECT_ID", "SNAPSHOT_BUCKET", "DUAL_WRITE_BUCKET"} {
+		w := httptest.NewRecorder()
+		DoIt(w, httptest.NewRequest(http.MethodGet, "/config?config."+name+"=elsewhere", nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), name+" can't be overridden") {
+			t.Errorf("config.%s: %d %q, want 400", name, w.Code, w.Body)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/?config.RETRY_MAX_ATTEMPTS=1", nil)
+	if cfg, err := requestConfig(r); err != nil || cfg.RetryMaxAttempts != 1 {
+		t.Errorf("config.RETRY_MAX_ATTEMPTS=1: cfg = %+v, err = %v", cfg, err)
+	}
+}
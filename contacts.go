@@ -0,0 +1,110 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/essentialcontacts/v1"
+)
+
+// accessContactCategories are the Essential Contacts categories whose members usually
+// manage access.
+var accessContactCategories = []string{"SECURITY", "TECHNICAL"}
+
+// AccessContacts are the people to ask for access to a project.
+type AccessContacts struct {
+	Project string
+	// Source is "essential contacts" or "project owners".
+	Source string
+	Emails []string
+	Error  string
+}
+
+// accessContactLookup looks up the contacts once per run, however many checks fail
+// with 403s.
+type accessContactLookup struct {
+	project string
+	once    sync.Once
+	result  AccessContacts
+}
+
+type accessContactsKey struct{}
+
+// withAccessContacts enables the "who to ask for access" hint on forbidden errors for
+// project. handleError only looks it up when a 403 is actually explained.
+func withAccessContacts(ctx context.Context, project string) context.Context {
+	return context.WithValue(ctx, accessContactsKey{}, &accessContactLookup{project: project})
+}
+
+func accessContactsFrom(ctx context.Context) (AccessContacts, bool) {
+	lookup, ok := ctx.Value(accessContactsKey{}).(*accessContactLookup)
+	if !ok || lookup.project == "" {
+		return AccessContacts{}, false
+	}
+	lookup.once.Do(func() {
+		lookup.result = findAccessContacts(context.WithoutCancel(ctx), lookup.project)
+	})
+	return lookup.result, true
+}
+
+// findAccessContacts prefers Essential Contacts, which includes contacts inherited from
+// the folder and organization, and falls back to the project's owners in its IAM policy.
+// Both need permissions the function may lack; the error says which.
+func findAccessContacts(ctx context.Context, project string) AccessContacts {
+	contacts := AccessContacts{Project: project}
+	var problems []string
+
+	if svc, err := essentialcontacts.NewService(ctx); err != nil {
+		problems = append(problems, fmt.Sprintf("essential contacts: %v", err))
+	} else if resp, err := svc.Projects.Contacts.Compute("projects/" + project).NotificationCategories(accessContactCategories...).Context(ctx).Do(); err != nil {
+		problems = append(problems, fmt.Sprintf("essential contacts: %s", decodeError(err).Message))
+	} else if len(resp.Contacts) > 0 {
+		contacts.Source = "essential contacts"
+		for _, c := range resp.Contacts {
+			contacts.Emails = append(contacts.Emails, c.Email)
+		}
+		contacts.Emails = uniqueStrings(contacts.Emails)
+		return contacts
+	}
+
+	if svc, err := cloudresourcemanager.NewService(ctx); err != nil {
+		problems = append(problems, fmt.Sprintf("project owners: %v", err))
+	} else if policy, err := svc.Projects.GetIamPolicy("projects/"+project, &cloudresourcemanager.GetIamPolicyRequest{}).Context(ctx).Do(); err != nil {
+		problems = append(problems, fmt.Sprintf("project owners: %s", decodeError(err).Message))
+	} else {
+		contacts.Source = "project owners"
+		for _, binding := range policy.Bindings {
+			if binding.Role != "roles/owner" {
+				continue
+			}
+			for _, member := range binding.Members {
+				// Service accounts can't grant access on request; people and groups can.
+				if kind, email, ok := strings.Cut(member, ":"); ok && (kind == "user" || kind == "group") {
+					contacts.Emails = append(contacts.Emails, email)
+				}
+			}
+		}
+		sort.Strings(contacts.Emails)
+		return contacts
+	}
+
+	contacts.Error = strings.Join(problems, "; ")
+	return contacts
+}
+
+func printAccessContacts(w http.ResponseWriter, lang string, contacts AccessContacts) {
+	label := localize(lang, "label.accessContacts")
+	switch {
+	case contacts.Error != "":
+		fmt.Fprintf(w, "%s: could not look up contacts for %s (%s)\n", label, contacts.Project, contacts.Error)
+	case len(contacts.Emails) == 0:
+		fmt.Fprintf(w, "%s: no %s found for %s\n", label, contacts.Source, contacts.Project)
+	default:
+		fmt.Fprintf(w, "%s (%s of %s): %s\n", label, contacts.Source, contacts.Project, strings.Join(contacts.Emails, ", "))
+	}
+}
@@ -0,0 +1,200 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	dataflow "google.golang.org/api/dataflow/v1b3"
+)
+
+const (
+	dataflowPollInterval = 10 * time.Second
+	defaultDataflowWait  = 5 * time.Minute
+)
+
+var dataflowTerminalStates = map[string]bool{
+	"JOB_STATE_DONE":      true,
+	"JOB_STATE_FAILED":    true,
+	"JOB_STATE_CANCELLED": true,
+	"JOB_STATE_UPDATED":   true,
+	"JOB_STATE_DRAINED":   true,
+}
+
+type DataflowLaunchResult struct {
+	Template   string
+	Flex       bool
+	Region     string
+	JobName    string
+	Parameters map[string]string
+	JobID      string
+	States     []DataflowStateChange
+	FinalState string
+	Error      string
+}
+
+type DataflowStateChange struct {
+	State   string
+	Elapsed time.Duration
+}
+
+// dataflowHandler launches a templated Dataflow job as the function's identity, e.g.
+// POST /dataflow?template=gs://bucket/templates/wordcount&param.inputFile=gs://...&wait=true.
+// Templates whose path ends in .json are launched as Flex Templates.
+func dataflowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "launching a Dataflow job requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+
+	template := query.Get("template")
+	if !strings.HasPrefix(template, "gs://") {
+		http.Error(w, "template must be a gs:// path", http.StatusBadRequest)
+		return
+	}
+	params := map[string]string{}
+	for key, values := range query {
+		if name, ok := strings.CutPrefix(key, "param."); ok && len(values) > 0 {
+			params[name] = values[0]
+		}
+	}
+
+	region := query.Get("region")
+	if region == "" {
+		region = cfg.DataflowRegion
+	}
+	jobName := query.Get("name")
+	if jobName == "" {
+		jobName = fmt.Sprintf("gcf-list-buckets-%d", time.Now().Unix())
+	}
+
+	result := launchDataflowTemplate(ctx, cfg.ComputeProjectId, region, template, jobName, params)
+	if result.Error == "" && query.Get("wait") == "true" {
+		maxWait := queryDuration(r, "max", defaultDataflowWait)
+		if maxWait > maxWatchDuration {
+			maxWait = maxWatchDuration
+		}
+		waitForDataflowJob(ctx, cfg.ComputeProjectId, &result, maxWait)
+	}
+	printDataflowLaunch(w, result)
+}
+
+func launchDataflowTemplate(ctx context.Context, project, region, template, jobName string, params map[string]string) DataflowLaunchResult {
+	result := DataflowLaunchResult{
+		Template:   template,
+		Flex:       strings.HasSuffix(template, ".json"),
+		Region:     region,
+		JobName:    jobName,
+		Parameters: params,
+	}
+
+	svc, err := dataflow.NewService(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create Dataflow client: %v", err)
+		return result
+	}
+
+	var job *dataflow.Job
+	if result.Flex {
+		var resp *dataflow.LaunchFlexTemplateResponse
+		resp, err = svc.Projects.Locations.FlexTemplates.Launch(project, region, &dataflow.LaunchFlexTemplateRequest{
+			LaunchParameter: &dataflow.LaunchFlexTemplateParameter{
+				ContainerSpecGcsPath: template,
+				JobName:              jobName,
+				Parameters:           params,
+			},
+		}).Context(ctx).Do()
+		if err == nil {
+			job = resp.Job
+		}
+	} else {
+		var resp *dataflow.LaunchTemplateResponse
+		resp, err = svc.Projects.Locations.Templates.Launch(project, region, &dataflow.LaunchTemplateParameters{
+			JobName:    jobName,
+			Parameters: params,
+		}).GcsPath(template).Context(ctx).Do()
+		if err == nil {
+			job = resp.Job
+		}
+	}
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to launch template: %v", err)
+		return result
+	}
+	if job == nil {
+		result.Error = "launch returned no job"
+		return result
+	}
+
+	result.JobID = job.Id
+	result.FinalState = job.CurrentState
+	result.States = append(result.States, DataflowStateChange{State: job.CurrentState})
+	return result
+}
+
+// waitForDataflowJob polls the job until it is running or finished, recording each state change.
+func waitForDataflowJob(ctx context.Context, project string, result *DataflowLaunchResult, maxWait time.Duration) {
+	svc, err := dataflow.NewService(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create Dataflow client: %v", err)
+		return
+	}
+
+	start := time.Now()
+	for {
+		if result.FinalState == "JOB_STATE_RUNNING" || dataflowTerminalStates[result.FinalState] {
+			return
+		}
+		if time.Since(start)+dataflowPollInterval > maxWait {
+			result.Error = fmt.Sprintf("job was still %s after %s", result.FinalState, maxWait)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dataflowPollInterval):
+		}
+
+		job, err := svc.Projects.Locations.Jobs.Get(project, result.Region, result.JobID).Context(ctx).Do()
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to get job: %v", err)
+			return
+		}
+		if job.CurrentState != result.FinalState {
+			result.FinalState = job.CurrentState
+			result.States = append(result.States, DataflowStateChange{State: job.CurrentState, Elapsed: time.Since(start)})
+		}
+	}
+}
+
+func printDataflowLaunch(w http.ResponseWriter, result DataflowLaunchResult) {
+	kind := "Classic"
+	if result.Flex {
+		kind = "Flex"
+	}
+	fmt.Fprintf(w, "Dataflow Launch (%s):\n", result.Template)
+	fmt.Fprintf(w, "| Template Type: %s\n", kind)
+	fmt.Fprintf(w, "| Region: %s\n", result.Region)
+	fmt.Fprintf(w, "| Job Name: %s\n", result.JobName)
+	for _, key := range sortedKeys(result.Parameters) {
+		fmt.Fprintf(w, "| Parameter %s: %s\n", key, result.Parameters[key])
+	}
+	if result.JobID != "" {
+		fmt.Fprintf(w, "| Job ID: %s\n", result.JobID)
+	}
+	for _, change := range result.States {
+		fmt.Fprintf(w, "| State at +%s: %s\n", change.Elapsed.Round(time.Second), change.State)
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", result.Error)
+	}
+}
@@ -0,0 +1,152 @@
+package gcf
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minRedactedLength keeps very short object names from replacing common words.
+const minRedactedLength = 3
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+`)
+
+	instanceDemoSaltOnce sync.Once
+	instanceDemoSalt     []byte
+)
+
+// demoSalt keys the pseudonyms. DEMO_MODE_SALT keeps them the same across instances and
+// deploys; otherwise they are stable for the instance's lifetime. Without a secret salt
+// a guessable name could be confirmed by hashing it.
+func demoSalt() []byte {
+	if salt := os.Getenv("DEMO_MODE_SALT"); salt != "" {
+		return []byte(salt)
+	}
+	instanceDemoSaltOnce.Do(func() {
+		instanceDemoSalt = make([]byte, 16)
+		rand.Read(instanceDemoSalt)
+	})
+	return instanceDemoSalt
+}
+
+// redactor swaps real names in a report for stable pseudonyms such as bucket-1a2b3c, so
+// reports and screenshots can be shared without naming infrastructure. Configured names
+// are known up front; object names are added as checks encounter them, and any other
+// email address is caught by pattern.
+type redactor struct {
+	salt  []byte
+	mu    sync.Mutex
+	names map[string]string // real -> pseudonym
+}
+
+type redactorKey struct{}
+
+func newRedactor(cfg *GCloudFunctionConfig) *redactor {
+	r := &redactor{salt: demoSalt(), names: map[string]string{}}
+	r.add("bucket", cfg.BucketName)
+	r.add("bucket", cfg.SnapshotBucket)
+	r.add("project", cfg.ComputeProjectId)
+	r.add("topic", cfg.PubSubTopicId)
+	r.add("topic", cfg.ProgressTopic)
+	r.add("subscription", cfg.PubSubSubscriptionId)
+	r.add("key", cfg.KmsKey)
+	r.add("key", cfg.TinkKEK)
+	r.add("table", cfg.BigQueryTable)
+	r.add("job", cfg.DiagnosticsJob)
+	// A KMS key path also names its project, key ring and key.
+	if parts := strings.Split(cfg.KmsKey, "/"); len(parts) == 8 {
+		r.add("project", parts[1])
+		r.add("keyring", parts[5])
+		r.add("key", parts[7])
+	}
+	return r
+}
+
+func withRedactor(ctx context.Context, r *redactor) context.Context {
+	return context.WithValue(ctx, redactorKey{}, r)
+}
+
+// noteObjectName registers an object name for redaction when the run is in demo mode,
+// in every form the report prints it.
+func noteObjectName(ctx context.Context, name, encoding string) {
+	r, ok := ctx.Value(redactorKey{}).(*redactor)
+	if !ok {
+		return
+	}
+	pseudonym := r.add("object", name)
+	r.alias(encodeObjectName(name, encoding), pseudonym)
+	r.alias(safeObjectName(name), pseudonym)
+}
+
+func (r *redactor) pseudonym(kind, value string) string {
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(value))
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// add registers value and returns its pseudonym.
+func (r *redactor) add(kind, value string) string {
+	if len(value) < minRedactedLength {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.names[value]; ok {
+		return p
+	}
+	p := r.pseudonym(kind, value)
+	r.names[value] = p
+	return p
+}
+
+func (r *redactor) alias(value, pseudonym string) {
+	if len(value) < minRedactedLength || pseudonym == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.names[value]; !ok {
+		r.names[value] = pseudonym
+	}
+}
+
+// apply redacts text. Longer names are replaced first so a project ID inside a key path
+// doesn't leave the rest of the path behind.
+func (r *redactor) apply(text []byte) []byte {
+	if r == nil {
+		return text
+	}
+	r.mu.Lock()
+	values := make([]string, 0, len(r.names))
+	for v := range r.names {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, r.names[v])
+	}
+	r.mu.Unlock()
+
+	out := strings.NewReplacer(pairs...).Replace(string(text))
+	out = emailPattern.ReplaceAllStringFunc(out, func(email string) string {
+		_, domain, _ := strings.Cut(email, "@")
+		if domain == "example.com" {
+			return email
+		}
+		// Keep service accounts recognizable as such.
+		if strings.HasSuffix(domain, ".gserviceaccount.com") {
+			return r.pseudonym("sa", email) + "@example.iam.gserviceaccount.com"
+		}
+		return r.pseudonym("user", email) + "@example.com"
+	})
+	return []byte(out)
+}
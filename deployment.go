@@ -0,0 +1,252 @@
+package gcf
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// deploymentVar documents one environment variable the function reads. Feature names
+// the optional capability it turns on, tying it to the roles and APIs that need.
+type deploymentVar struct {
+	Name        string
+	Kind        string
+	Default     string
+	Description string
+	Required    bool
+	Feature     string
+	Requires    []string
+	// Enum lists the accepted values of a string variable, when there are few.
+	Enum []string
+	// Secret keeps the value out of /config and startup logs.
+	Secret bool
+	// NoOverride keeps config.NAME from changing who the function acts as, where it
+	// writes or which project and buckets it manages; profiles may still set it.
+	NoOverride bool
+}
+
+// deploymentRequirement is a role or API the deployment needs, always or for a feature.
+type deploymentRequirement struct {
+	Name     string `json:"name"`
+	Resource string `json:"resource,omitempty"`
+	Reason   string `json:"reason"`
+	Feature  string `json:"feature,omitempty"`
+}
+
+var deploymentVars = []deploymentVar{
+	{Name: "BUCKET_NAME", Kind: "string", Description: "Bucket the checks read from.", Required: true, NoOverride: true},
+	{Name: "COMPUTE_PROJECT_ID", Kind: "string", Description: "Project that owns the clients and is billed for requester-pays buckets.", Required: true, NoOverride: true},
+	{Name: "PUBSUB_TOPIC_ID", Kind: "string", Description: "Topic the publish check writes to.", Required: true},
+	{Name: "PUBSUB_SUBSCRIPTION_ID", Kind: "string", Description: "Subscription the receive check pulls from.", Required: true},
+	{Name: "KMS_KEY", Kind: "string", Description: "Full resource name of the key used by the KMS decrypt check.", Required: true},
+	{Name: "DEBUG", Kind: "bool", Default: "false", Description: "Default to verbose reports, and log at debug level."},
+	{Name: "PROBE_ENDPOINTS", Kind: "list", Description: "Extra URLs to probe for reachability."},
+	{Name: "EGRESS_ECHO_URL", Kind: "string", Description: "Service that echoes the caller's egress IP, such as https://api.ipify.org, called on every run to infer the egress path; unset skips the egress IP check."},
+	{Name: "OBJECT_NAME_ENCODING", Kind: "string", Default: ObjectNameEncodingEscape, Description: "How object names are printed.", Enum: []string{ObjectNameEncodingEscape, ObjectNameEncodingBase64}},
+	{Name: "STREAM_STALL_TIMEOUT", Kind: "duration", Default: "10s", Description: "How long /stream waits on a stalled client."},
+	{Name: "SIGNED_URL_SELF_TEST", Kind: "bool", Default: "false", Description: "Run the signed URL check.", Feature: "signed_url"},
+	{Name: "SIGNED_URL_PROXY", Kind: "string", Description: "Proxy to fetch signed URLs through."},
+	{Name: "DISCOVER_SERVICE_AGENTS", Kind: "bool", Default: "false", Description: "List Google service agents in the identity report."},
+	{Name: "FRONTEND_MODE", Kind: "string", Description: "Frontend that authenticates callers, e.g. iap.", Enum: []string{FrontendModeIAP, FrontendModeAPIGateway}, NoOverride: true},
+	{Name: "IAP_AUDIENCE", Kind: "string", Description: "Expected audience of IAP-signed headers.", NoOverride: true},
+	{Name: "PROBE_CACHE_TTL", Kind: "duration", Default: "30s", Description: "How long /probe reuses its last outcome."},
+	{Name: "SNAPSHOT_BUCKET", Kind: "string", Description: "Bucket for listing snapshots and job results; defaults to BUCKET_NAME.", NoOverride: true},
+	{Name: "SNAPSHOT_PREFIX", Kind: "string", Default: "gcf-list-buckets/snapshots/", Description: "Prefix for listing snapshots."},
+	{Name: "VERIFY_DIGESTS", Kind: "list", Default: "crc32c,md5", Description: "Digests computed over downloads."},
+	{Name: "TINK_KEYSET_SECRET", Kind: "string", Description: "Secret Manager version holding an encrypted Tink keyset.", Feature: "tink_decrypt", Requires: []string{"TINK_KEK"}, NoOverride: true},
+	{Name: "TINK_KEK", Kind: "string", Description: "KMS key that wraps the Tink keyset."},
+	{Name: "TINK_OBJECT", Kind: "string", Description: "Object to decrypt; defaults to the first downloaded object."},
+	{Name: "TINK_ASSOCIATED_DATA", Kind: "string", Description: "Associated data used when the object was encrypted."},
+	{Name: "BIGQUERY_TABLE", Kind: "string", Description: "External or BigLake table to query over the bucket.", Feature: "bigquery_external_table"},
+	{Name: "DATAFLOW_REGION", Kind: "string", Default: "us-central1", Description: "Region for /dataflow launches.", Feature: "dataflow"},
+	{Name: "DIAGNOSTICS_JOB", Kind: "string", Description: "Cloud Run job launched by /job.", Feature: "job"},
+	{Name: "DOWNLOAD_SAMPLE", Kind: "int", Default: "1", Description: "How many listed objects to download."},
+	{Name: "PROGRESS_TOPIC", Kind: "string", Description: "Topic that receives run progress events.", Feature: "progress", NoOverride: true},
+	{Name: "SNAPSHOT_NAME_TEMPLATE", Kind: "string", Default: DefaultSnapshotNameTemplate, Description: "Template for snapshot object names."},
+	{Name: "JOB_RESULTS_TEMPLATE", Kind: "string", Default: DefaultJobResultsTemplate, Description: "Template for job result prefixes."},
+	{Name: "DOWNLOAD_PATH_TEMPLATE", Kind: "string", Default: DefaultDownloadPathTemplate, Description: "Template for the names of copies under DOWNLOAD_DESTINATION and DOWNLOAD_DIR."},
+	{Name: "DOWNLOAD_DESTINATION", Kind: "string", Description: "gs://bucket/prefix that downloaded objects are streamed into; unset only verifies them.", NoOverride: true},
+	{Name: "DOWNLOAD_DIR", Kind: "string", Description: "Local directory each run also streams downloaded objects into, under run-<id>, e.g. when running locally; runs older than an hour are swept. Unset keeps downloads off local disk.", NoOverride: true},
+	{Name: "DOWNLOAD_FLAT", Kind: "bool", Default: "false", Description: "Drop object directories from local download paths.", Requires: []string{"DOWNLOAD_DIR"}},
+	{Name: "DOWNLOAD_CONFLICT", Kind: "string", Default: ConflictOverwrite, Description: "What downloads do with existing local files: overwrite, skip or suffix.", Enum: []string{ConflictOverwrite, ConflictSkip, ConflictSuffix}, Requires: []string{"DOWNLOAD_DIR"}},
+	{Name: "DOWNLOAD_RANGE", Kind: "string", Description: "Byte range downloads read, e.g. bytes=0-1048575 or bytes=-1024; digests are only checked on whole objects."},
+	{Name: "BASELINE_PREFIX", Kind: "string", Default: "gcf-list-buckets/baselines/", Description: "Prefix in SNAPSHOT_BUCKET for /loadtest baselines."},
+	{Name: "BASELINE_LATENCY_THRESHOLD", Kind: "float", Default: "20", Description: "Percent a latency percentile may rise over the baseline before it is a regression."},
+	{Name: "BASELINE_THROUGHPUT_THRESHOLD", Kind: "float", Default: "20", Description: "Percent throughput may fall below the baseline before it is a regression."},
+	{Name: "DOWNLOAD_CACHE_BYTES", Kind: "int", Default: "33554432", Description: "Memory budget for reusing downloaded objects across runs on an instance; 0 disables it."},
+	{Name: "BUNDLE_NAME_TEMPLATE", Kind: "string", Default: DefaultBundleNameTemplate, Description: "Template for support bundle filenames."},
+	{Name: "PUBSUB_RECEIVE_WINDOW", Kind: "duration", Default: "10s", Description: "How long each receive attempt pulls."},
+	{Name: "PUBSUB_RECEIVE_RETRIES", Kind: "int", Default: "0", Description: "Extra receive attempts while the subscription is empty."},
+	{Name: "PUBSUB_MAX_EXTENSION", Kind: "duration", Default: "60m", Description: "Longest a received message's lease is extended."},
+	{Name: "PUBSUB_MAX_EXTENSION_PERIOD", Kind: "duration", Description: "Longest single lease extension."},
+	{Name: "PUBSUB_MIN_EXTENSION_PERIOD", Kind: "duration", Description: "Shortest single lease extension."},
+	{Name: "PUBSUB_BYTE_THRESHOLD", Kind: "int", Default: "1000000", Description: "Bytes /publish batches before sending."},
+	{Name: "PUBSUB_COUNT_THRESHOLD", Kind: "int", Default: "100", Description: "Messages /publish batches before sending."},
+	{Name: "PUBSUB_DELAY_THRESHOLD", Kind: "duration", Default: "10ms", Description: "Longest /publish holds a batch before sending."},
+	{Name: "PUBSUB_MAX_OUTSTANDING", Kind: "int", Default: "1000", Description: "Messages /publish lets wait for a publish result before blocking new ones."},
+	{Name: "DISABLE_GZIP", Kind: "bool", Default: "false", Description: "Never compress responses."},
+	{Name: "LIST_FIELDS", Kind: "string", Default: ListFieldsDefault, Description: "Object attributes listings fetch: names, default, full or attribute names."},
+	{Name: "ALLOW_CONFIG_OVERRIDE", Kind: "bool", Default: "false", Description: "Let callers POST a complete run config to /, or override settings with config.NAME=value query parameters."},
+	{Name: "ENABLE_PPROF", Kind: "bool", Default: "false", Description: "Serve net/http/pprof under /debug/pprof/."},
+	{Name: "CLOUD_PROFILER_SERVICE", Kind: "string", Description: "Service name to upload each run's CPU and heap profiles to Cloud Profiler under.", Feature: "profiler"},
+	{Name: "CHECK_SERVICE_USAGE", Kind: "bool", Default: "false", Description: "Check that the APIs the checks call are enabled before running them.", Feature: "service_usage"},
+	{Name: "CHECK_BUCKET_CREATE", Kind: "bool", Default: "false", Description: "Check that the function may create buckets in COMPUTE_PROJECT_ID, without creating one.", Feature: "bucket_create"},
+	{Name: "BUCKET_CREATE_PROBE_NAME", Kind: "string", Description: "Bucket name the create check confirms is still free.", Feature: "bucket_create", Requires: []string{"CHECK_BUCKET_CREATE"}},
+	{Name: "MESSAGE_OBJECT_SUBSCRIPTION", Kind: "string", Description: "Subscription pulled for a storage event whose object is then read.", Feature: "message_object"},
+	{Name: "MESSAGE_OBJECT_ACK", Kind: "bool", Default: "false", Description: "Ack the pulled event instead of handing it back to the pipeline.", Feature: "message_object", Requires: []string{"MESSAGE_OBJECT_SUBSCRIPTION"}},
+	{Name: "SOAK_PREFIX", Kind: "string", Default: "gcf-list-buckets/soak/", Description: "Prefix in BUCKET_NAME for /soak objects, which are deleted after each size.", Feature: "soak"},
+	{Name: "SOAK_MAX_BYTES", Kind: "int", Default: "67108864", Description: "Largest object size /soak writes unless ?max= asks for more (up to 1GiB).", Feature: "soak"},
+	{Name: "CLEANUP_POLICY", Kind: "string", Default: "always", Description: "When runs delete what they created: always, keep-on-failure or never. POST /cleanup removes leftovers."},
+	{Name: "ARTIFACT_PREFIX", Kind: "string", Default: "gcf-list-buckets/tmp/", Description: "Prefix in BUCKET_NAME for temporary objects written by runs."},
+	{Name: "ALLOW_UPLOADS", Kind: "bool", Default: "false", Description: "Enable /upload, which writes request bodies to BUCKET_NAME.", Feature: "upload"},
+	{Name: "UPLOAD_CHUNK_SIZE", Kind: "int", Default: "16777216", Description: "Resumable upload chunk size for /upload, a multiple of 256KiB.", Feature: "upload"},
+	{Name: "DUAL_WRITE_BUCKET", Kind: "string", Description: "Second bucket, e.g. a DR copy, written alongside BUCKET_NAME to check dual writes.", Feature: "dual_write", NoOverride: true},
+	{Name: "ROUTING_SUBSCRIPTIONS", Kind: "list", Description: "Subscriptions /routing pulls from by default, instead of every one on PUBSUB_TOPIC_ID.", Feature: "routing"},
+	{Name: "CHECK_CLOCK_SKEW", Kind: "bool", Default: "false", Description: "Check the local clock and token issue and expiry times against Google's.", Feature: "clock_skew"},
+	{Name: "CLOCK_SKEW_THRESHOLD", Kind: "duration", Default: "10s", Description: "How far the clock may drift before the clock check fails.", Feature: "clock_skew", Requires: []string{"CHECK_CLOCK_SKEW"}},
+	{Name: "RETRY_MAX_ATTEMPTS", Kind: "int", Default: "4", Description: "Attempts, including the first, for GCS and Pub/Sub calls failing with 429 or 5xx; 1 disables retries."},
+	{Name: "RETRY_ATTEMPTS", Kind: "list", Description: "Per-operation attempts, e.g. pubsub.publish=5,storage.objects.get=2; storage sets the client library's own retries."},
+	{Name: "RETRY_INITIAL_BACKOFF", Kind: "duration", Default: "1s", Description: "First retry backoff, before jitter, when the server gives no Retry-After."},
+	{Name: "RETRY_MAX_BACKOFF", Kind: "duration", Default: "30s", Description: "Longest wait between retries."},
+	{Name: "RETRY_MULTIPLIER", Kind: "float", Default: "2", Description: "Backoff growth per retry."},
+	{Name: "RETRY_DEADLINE", Kind: "duration", Default: "0s", Description: "How long into a request failures are still retried; 0 leaves it to the request's time budget."},
+	{Name: "LOG_LEVEL", Kind: "string", Default: "INFO", Description: "Minimum severity logged. Verbose runs log at DEBUG.", Enum: []string{"DEBUG", "INFO", "WARNING", "ERROR"}},
+	{Name: "LOG_FORMAT", Kind: "string", Default: "json", Description: "json for Cloud Logging structured logs, or text for reading locally.", Enum: []string{"json", "text"}},
+	{Name: "TRACE_COMMANDS", Kind: "bool", Default: "false", Description: "List the gcloud equivalent of every API call in each report, like ?trace=commands."},
+	{Name: "STORAGE_CLIENT_AUDIENCE", Kind: "string", Default: "https://storage.googleapis.com", Description: "Audience of the storage client's tokens, for private or regional endpoints.", NoOverride: true},
+	{Name: "CONFIG_STRICT", Kind: "bool", Default: "false", Description: "Answer every request except /config with 503 while the environment has configuration errors."},
+	{Name: "CONFIG_FILE", Kind: "string", Description: "JSON file of settings keyed by variable name, e.g. a mounted secret; the environment wins where both set one. A \"profiles\" object in it holds named settings selected with ?profile=."},
+	{Name: "CHECK_PRECONDITION_RACE", Kind: "bool", Default: "false", Description: "Race two ifGenerationMatch writes to one object and check exactly one wins.", Feature: "precondition_race"},
+	{Name: "TARGET_SERVICE_ACCOUNT", Kind: "string", Description: "Service account the storage and Pub/Sub clients impersonate, to test its access rather than the function's.", Feature: "impersonation", NoOverride: true},
+	{Name: "CONFIG_PROFILES_SECRET", Kind: "string", Description: "Secret Manager version holding named config profiles, selected per request with ?profile=.", Feature: "profiles", NoOverride: true},
+	{Name: "BUILD_MAX_AGE", Kind: "duration", Default: "2160h", Description: "How old a build /drift accepts before warning."},
+	{Name: "MIN_DEPENDENCY_VERSIONS", Kind: "list", Description: "module@version floors /drift checks the build against, e.g. cloud.google.com/go/storage@v1.43.0."},
+	{Name: "PROCESS_EVENTS", Kind: "bool", Default: "false", Description: "Download and verify the object each Eventarc event names, not only record the event.", Feature: "event_processing"},
+	{Name: "CHECK_TIMEOUT", Kind: "duration", Description: "Longest any one check may run, e.g. 20s; unset, checks are bounded only by the run's time budget."},
+	{Name: "ALLOW_BUCKET_MANAGEMENT", Kind: "bool", Default: "false", Description: "Enable /buckets, which creates, updates and deletes buckets in COMPUTE_PROJECT_ID.", Feature: "bucket_management"},
+	{Name: "PERSIST_REPORTS", Kind: "bool", Default: "false", Description: "Store every diagnostics run in SNAPSHOT_BUCKET, for /runs to list and fetch.", Feature: "run_history", NoOverride: true},
+	{Name: "REPORT_HISTORY_PREFIX", Kind: "string", Default: "gcf-list-buckets/runs/", Description: "Prefix in SNAPSHOT_BUCKET for stored runs; a lifecycle rule on it sets how long they are kept.", Feature: "run_history", Requires: []string{"PERSIST_REPORTS"}, NoOverride: true},
+	{Name: "CHECK_BILLING", Kind: "bool", Default: "false", Description: "Check that COMPUTE_PROJECT_ID has an active billing account.", Feature: "billing"},
+	{Name: "ACCESS_CONTACTS_PROJECT", Kind: "string", Description: "Project, usually the bucket's, whose Essential Contacts or owners are named on 403s.", Feature: "access_contacts"},
+	{Name: "DEMO_MODE", Kind: "bool", Default: "false", Description: "Replace real names in reports with stable pseudonyms; ?demo=true does it per request."},
+	{Name: "DEMO_MODE_SALT", Kind: "string", Description: "Secret that keeps demo pseudonyms the same across instances.", Secret: true},
+	{Name: "REPORT_CACHE_TTL", Kind: "duration", Default: "0s", Description: "How long reports are cached; 0 disables the cache."},
+}
+
+var deploymentRoles = []deploymentRequirement{
+	{Name: "roles/storage.objectViewer", Resource: "BUCKET_NAME", Reason: "List and download objects."},
+	{Name: "roles/serviceusage.serviceUsageConsumer", Resource: "COMPUTE_PROJECT_ID", Reason: "Bill requests to the project, including requester-pays reads."},
+	{Name: "roles/pubsub.publisher", Resource: "PUBSUB_TOPIC_ID", Reason: "Publish the test message and messages posted to /publish."},
+	{Name: "roles/pubsub.subscriber", Resource: "PUBSUB_SUBSCRIPTION_ID", Reason: "Receive the test message and pull messages for /pull."},
+	{Name: "roles/cloudkms.cryptoKeyDecrypter", Resource: "KMS_KEY", Reason: "Decrypt in the KMS check."},
+	{Name: "roles/logging.logWriter", Resource: "COMPUTE_PROJECT_ID", Reason: "Write function logs."},
+	{Name: "roles/iam.serviceAccountTokenCreator", Resource: "the function's service account", Reason: "Sign URLs without a key file, for the signed URL check and /signed-url."},
+	{Name: "roles/secretmanager.secretAccessor", Resource: "TINK_KEYSET_SECRET", Reason: "Read the encrypted keyset.", Feature: "tink_decrypt"},
+	{Name: "roles/cloudkms.cryptoKeyDecrypter", Resource: "TINK_KEK", Reason: "Unwrap the keyset.", Feature: "tink_decrypt"},
+	{Name: "roles/bigquery.metadataViewer", Resource: "BIGQUERY_TABLE", Reason: "Read the table definition.", Feature: "bigquery_external_table"},
+	{Name: "roles/bigquery.jobUser", Resource: "COMPUTE_PROJECT_ID", Reason: "Dry-run a query against the table.", Feature: "bigquery_external_table"},
+	{Name: "roles/dataflow.developer", Resource: "COMPUTE_PROJECT_ID", Reason: "Launch templates from /dataflow.", Feature: "dataflow"},
+	{Name: "roles/run.developer", Resource: "DIAGNOSTICS_JOB", Reason: "Run the job with overrides from /job.", Feature: "job"},
+	{Name: "roles/pubsub.publisher", Resource: "PROGRESS_TOPIC", Reason: "Publish progress events.", Feature: "progress"},
+	{Name: "roles/serviceusage.serviceUsageViewer", Resource: "COMPUTE_PROJECT_ID", Reason: "Read which APIs are enabled.", Feature: "service_usage"},
+	{Name: "roles/browser", Resource: "COMPUTE_PROJECT_ID", Reason: "Read the project's billing info.", Feature: "billing"},
+	{Name: "roles/pubsub.subscriber", Resource: "MESSAGE_OBJECT_SUBSCRIPTION", Reason: "Pull a storage event.", Feature: "message_object"},
+	{Name: "roles/storage.objectViewer", Resource: "buckets named by events", Reason: "Read the object an event references.", Feature: "message_object"},
+	{Name: "roles/storage.admin", Resource: "COMPUTE_PROJECT_ID", Reason: "Only if buckets are meant to be created; the check reports its absence.", Feature: "bucket_create"},
+	{Name: "roles/essentialcontacts.viewer", Resource: "ACCESS_CONTACTS_PROJECT", Reason: "Name who to ask for access on 403s.", Feature: "access_contacts"},
+	{Name: "roles/storage.objectUser", Resource: "BUCKET_NAME", Reason: "Write, read back and delete /soak objects.", Feature: "soak"},
+	{Name: "roles/storage.objectCreator", Resource: "BUCKET_NAME", Reason: "Write objects from /upload and signed PUT URLs; overwriting needs roles/storage.objectUser.", Feature: "upload"},
+	{Name: "roles/storage.objectUser", Resource: "BUCKET_NAME and DUAL_WRITE_BUCKET", Reason: "Write, read back and delete the dual-write probe.", Feature: "dual_write"},
+	{Name: "roles/pubsub.subscriber", Resource: "ROUTING_SUBSCRIPTIONS", Reason: "Pull routing test messages and read each subscription's filter.", Feature: "routing"},
+	{Name: "roles/pubsub.viewer", Resource: "PUBSUB_TOPIC_ID", Reason: "List the topic's subscriptions when ROUTING_SUBSCRIPTIONS is unset."},
+	{Name: "roles/storage.objectCreator", Resource: "DOWNLOAD_DESTINATION", Reason: "Write copies of downloaded objects."},
+	{Name: "roles/storage.objectUser", Resource: "BUCKET_NAME", Reason: "Create, replace and delete the precondition race probe.", Feature: "precondition_race"},
+	{Name: "roles/iam.serviceAccountTokenCreator", Resource: "TARGET_SERVICE_ACCOUNT", Reason: "Mint access tokens for the impersonated account and sign URLs as it.", Feature: "impersonation"},
+	{Name: "roles/storage.admin", Resource: "buckets polled by /operation", Reason: "Read bucket long-running operations (storage.bucketOperations.get)."},
+	{Name: "roles/secretmanager.secretAccessor", Resource: "CONFIG_PROFILES_SECRET", Reason: "Read config profiles.", Feature: "profiles"},
+	{Name: "roles/storage.objectViewer", Resource: "buckets named by events", Reason: "Download the object an event or push delivery names.", Feature: "event_processing"},
+	{Name: "roles/storage.admin", Resource: "COMPUTE_PROJECT_ID", Reason: "Create, update and delete buckets from /buckets.", Feature: "bucket_management"},
+	{Name: "roles/storage.objectUser", Resource: "SNAPSHOT_BUCKET", Reason: "Store runs and list and read them back from /runs.", Feature: "run_history"},
+	{Name: "roles/storage.bucketViewer", Resource: "projects listed by GET /buckets", Reason: "List buckets (storage.buckets.list)."},
+	{Name: "roles/storage.objectViewer", Resource: "buckets inspected by /object-attrs", Reason: "Read object metadata."},
+	{Name: "roles/storage.legacyObjectOwner", Resource: "buckets inspected by /object-attrs", Reason: "Only to read object ACLs (storage.objects.getIamPolicy); without it /object-attrs reports the ACL as unavailable."},
+	{Name: "roles/cloudprofiler.agent", Resource: "COMPUTE_PROJECT_ID", Reason: "Upload run profiles.", Feature: "profiler"},
+}
+
+var deploymentAPIs = []deploymentRequirement{
+	{Name: "storage.googleapis.com", Reason: "Bucket and object checks."},
+	{Name: "pubsub.googleapis.com", Reason: "Publish and receive checks."},
+	{Name: "cloudkms.googleapis.com", Reason: "KMS decrypt check."},
+	{Name: "iamcredentials.googleapis.com", Reason: "Sign URLs with the function's identity, for /signed-url and the signed URL check, and mint tokens for TARGET_SERVICE_ACCOUNT."},
+	{Name: "secretmanager.googleapis.com", Reason: "Read the Tink keyset and config profiles."},
+	{Name: "bigquery.googleapis.com", Reason: "External table check.", Feature: "bigquery_external_table"},
+	{Name: "bigqueryconnection.googleapis.com", Reason: "Resolve BigLake connection service accounts.", Feature: "bigquery_external_table"},
+	{Name: "dataflow.googleapis.com", Reason: "Template launches.", Feature: "dataflow"},
+	{Name: "run.googleapis.com", Reason: "Diagnostics job launches.", Feature: "job"},
+	{Name: "serviceusage.googleapis.com", Reason: "Required services check.", Feature: "service_usage"},
+	{Name: "cloudresourcemanager.googleapis.com", Reason: "Project permission test for bucket creation.", Feature: "bucket_create"},
+	{Name: "cloudbilling.googleapis.com", Reason: "Billing linkage check.", Feature: "billing"},
+	{Name: "essentialcontacts.googleapis.com", Reason: "Access contact lookup.", Feature: "access_contacts"},
+	{Name: "cloudprofiler.googleapis.com", Reason: "Run profile uploads.", Feature: "profiler"},
+}
+
+// deploymentSchemaHandler serves a JSON Schema for the function's environment, with the
+// IAM roles and APIs it needs under x-iam-roles and x-apis, so deployment tooling can
+// validate a configuration before any traffic is sent.
+func deploymentSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(deploymentSchema())
+}
+
+func deploymentSchema() map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	dependent := map[string][]string{}
+	for _, v := range deploymentVars {
+		prop := map[string]any{"type": "string", "description": v.Description}
+		switch v.Kind {
+		case "bool":
+			prop["enum"] = []string{"true", "false"}
+		case "int":
+			prop["pattern"] = `^[0-9]+$`
+		case "float":
+			prop["pattern"] = `^[0-9]+(\.[0-9]+)?$`
+		case "duration":
+			prop["pattern"] = durationPattern
+		case "list":
+			prop["description"] = v.Description + " Comma-separated."
+		}
+		if len(v.Enum) > 0 {
+			prop["enum"] = v.Enum
+		}
+		if v.Default != "" {
+			prop["default"] = v.Default
+		}
+		if v.Feature != "" {
+			prop["x-feature"] = v.Feature
+		}
+		properties[v.Name] = prop
+		if v.Required {
+			required = append(required, v.Name)
+		}
+		if len(v.Requires) > 0 {
+			dependent[v.Name] = v.Requires
+		}
+	}
+
+	return map[string]any{
+		"$schema":           "https://json-schema.org/draft/2020-12/schema",
+		"title":             "gcf-list-buckets environment",
+		"description":       "Environment variables read by the function. Roles and APIs marked with a feature are only needed when that feature's variable is set.",
+		"type":              "object",
+		"properties":        properties,
+		"required":          required,
+		"dependentRequired": dependent,
+		"x-iam-roles":       deploymentRoles,
+		"x-apis":            deploymentAPIs,
+		"x-build":           currentBuildInfo(),
+	}
+}
@@ -0,0 +1,452 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// newRunID identifies one diagnostics run across its logs, headers and artifacts.
+func newRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+const (
+	DetailSummary = "summary"
+	DetailNormal  = "normal"
+	DetailVerbose = "verbose"
+)
+
+const (
+	CheckPass = "PASS"
+	CheckFail = "FAIL"
+	// CheckSkip marks a check that did not run because a prerequisite did not pass.
+	CheckSkip = "SKIPPED"
+)
+
+type CheckResult struct {
+	Name     string
+	Status   string
+	Error    string
+	Duration time.Duration
+	// Category and Doc come from decodeError, so every failed check is explained alike.
+	Category string
+	Doc      string
+	// Stop says what cut the check short when a deadline or the caller ended it.
+	Stop *StopCause
+}
+
+// reportWriter wraps the response for a diagnostics run. It decides how much
+// narrative reaches the caller and collects the pass/fail matrix and API call trace.
+// The body is held back until finish so the outcome can be reported in headers.
+type reportWriter struct {
+	http.ResponseWriter
+
+	detail   string
+	mu       sync.Mutex
+	body     bytes.Buffer
+	status   int
+	checks   []CheckResult
+	started  map[string]time.Time
+	calls    *apiCallRecorder
+	labels   map[string]string
+	runID    string
+	progress *progressPublisher
+	budget   *timeBudget
+	// stop is why the run as a whole was cut short; nil when it wasn't.
+	stop *StopCause
+	// contexts are the running checks' contexts, so their failures can be placed.
+	contexts map[string]context.Context
+	// startedAt is when the run began; rendered is the text or JSON report as
+	// written, for the run history.
+	startedAt time.Time
+	rendered  []byte
+	// planned is the expected number of checks, for progress percentages.
+	planned int
+	// ndjson streams progress and checks as JSON lines instead of the text report.
+	ndjson    bool
+	streaming bool
+	// jsonReport collects a single JSON document instead of the text report; nil otherwise.
+	jsonReport *JSONReport
+	// order lists check names in report order; checks finish out of order when run in parallel.
+	order []string
+	// redactor replaces real names with pseudonyms in demo mode; nil otherwise.
+	redactor *redactor
+	// logger carries the run's trace and labels; nil means the default logger.
+	logger *slog.Logger
+}
+
+func newReportWriter(w http.ResponseWriter, detail string) *reportWriter {
+	return &reportWriter{
+		ResponseWriter: w,
+		detail:         detail,
+		started:        map[string]time.Time{},
+		contexts:       map[string]context.Context{},
+		startedAt:      time.Now(),
+		calls:          &apiCallRecorder{},
+		runID:          newRunID(),
+	}
+}
+
+// Write drops narrative in summary mode; Pub/Sub callbacks may write concurrently.
+func (rw *reportWriter) Write(p []byte) (int, error) {
+	if rw.detail == DetailSummary {
+		return len(p), nil
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.body.Write(p)
+}
+
+func (rw *reportWriter) WriteHeader(status int) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *reportWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// start marks the beginning of a check so its duration can be reported.
+func (rw *reportWriter) start(name string) {
+	rw.mu.Lock()
+	rw.started[name] = time.Now()
+	completed, failed := len(rw.checks), len(failedCheckNames(rw.checks))
+	rw.mu.Unlock()
+	rw.progress.publish(ProgressStarted, name, "", completed, failed)
+	rw.emitProgress(ProgressStarted, name, "", completed, failed)
+}
+
+// check records the outcome of a named check for the pass/fail matrix.
+func (rw *reportWriter) check(name string, err error) {
+	rw.mu.Lock()
+	result := CheckResult{Name: name, Status: CheckPass}
+	if started, ok := rw.started[name]; ok {
+		result.Duration = time.Since(started)
+	}
+	if err != nil {
+		decoded := decodeError(err)
+		result.Status = CheckFail
+		result.Error = err.Error()
+		result.Category = decoded.Category
+		result.Doc = decoded.Doc()
+		result.Stop = classifyStop(rw.contexts[name], err)
+	}
+	rw.checks = append(rw.checks, result)
+	completed, failed := len(rw.checks), len(failedCheckNames(rw.checks))
+	rw.mu.Unlock()
+	rw.progress.publish(ProgressCompleted, name, result.Status, completed, failed)
+	rw.emitCheck(result)
+	rw.emitProgress(ProgressCompleted, name, result.Status, completed, failed)
+}
+
+// skip records a check that was not run, with the reason in place of an error.
+func (rw *reportWriter) skip(name, reason string) {
+	rw.mu.Lock()
+	result := CheckResult{Name: name, Status: CheckSkip, Error: reason}
+	rw.checks = append(rw.checks, result)
+	completed, failed := len(rw.checks), len(failedCheckNames(rw.checks))
+	rw.mu.Unlock()
+	rw.progress.publish(ProgressCompleted, name, result.Status, completed, failed)
+	rw.emitCheck(result)
+	rw.emitProgress(ProgressCompleted, name, result.Status, completed, failed)
+}
+
+// setContext records the context a check runs with, for check to classify its failure.
+func (rw *reportWriter) setContext(name string, ctx context.Context) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.contexts[name] = ctx
+}
+
+func (rw *reportWriter) Checks() []CheckResult {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	checks := append([]CheckResult(nil), rw.checks...)
+	if len(rw.order) > 0 {
+		rank := func(name string) int {
+			if i := slices.Index(rw.order, name); i >= 0 {
+				return i
+			}
+			return len(rw.order)
+		}
+		slices.SortStableFunc(checks, func(a, b CheckResult) int { return rank(a.Name) - rank(b.Name) })
+	}
+	return checks
+}
+
+func (rw *reportWriter) setCheckOrder(names []string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.order = names
+}
+
+// finish sets the X-Diag-* outcome headers, then writes the buffered report, the API
+// call trace (verbose only) and the pass/fail matrix. An NDJSON report instead ends
+// with a finished progress line, as its headers have already been sent, and a JSON
+// report is written as one document.
+func (rw *reportWriter) finish() {
+	out := rw.ResponseWriter
+
+	checks := rw.Checks()
+	failed := failedCheckNames(checks)
+	status := diagStatus(ranChecks(checks), len(failed))
+	out.Header().Set("X-Diag-Run-Id", rw.runID)
+	out.Header().Set("X-Diag-Status", status)
+	if len(failed) > 0 {
+		out.Header().Set("X-Diag-Failed-Checks", strings.Join(failed, ","))
+	}
+	if rw.stop != nil {
+		out.Header().Set("X-Diag-Stop-Cause", rw.stop.Cause)
+	}
+	if len(rw.labels) > 0 {
+		out.Header().Set(runLabelsHeader, formatRunLabels(rw.labels))
+	}
+	rw.progress.publish(ProgressFinished, "", status, len(checks), len(failed))
+	rw.progress.close()
+
+	// One line per run, so log-based metrics can be sliced by label.
+	log.Printf("Diagnostics run %s %s: %d checks, failed [%s], labels [%s]\n", rw.runID, status, len(checks), strings.Join(failed, ","), formatRunLabels(rw.labels))
+
+	if rw.jsonReport != nil {
+		rw.writeJSON(status, checks)
+		return
+	}
+	if rw.ndjson {
+		if rw.status >= http.StatusBadRequest {
+			rw.emitLine(ReportLine{Type: "error", Message: strings.TrimSpace(rw.body.String())})
+		}
+		rw.emitProgress(ProgressFinished, "", status, len(checks), len(failed))
+		return
+	}
+	if rw.status != 0 {
+		out.WriteHeader(rw.status)
+	}
+	// The whole report is assembled first so demo mode can redact it in one pass.
+	var report bytes.Buffer
+	report.Write(rw.body.Bytes())
+
+	if rw.detail == DetailVerbose {
+		if calls := rw.calls.Calls(); len(calls) > 0 {
+			fmt.Fprintln(&report, "API Calls:")
+			for _, call := range calls {
+				fmt.Fprintf(&report, "| %s %s -> %s (%s)\n", call.Start.Format("15:04:05.000"), call.Method, call.Outcome, call.Duration.Round(time.Millisecond))
+			}
+		}
+	}
+
+	if rw.calls.commands {
+		printCommands(&report, rw.calls.Calls())
+	}
+
+	fmt.Fprintln(&report, "Checks:")
+	for _, c := range checks {
+		fmt.Fprintf(&report, "| %-16s %s", c.Name, c.Status)
+		if c.Duration > 0 {
+			fmt.Fprintf(&report, " (%s)", c.Duration.Round(time.Millisecond))
+		}
+		if c.Error != "" && rw.detail != DetailSummary {
+			fmt.Fprintf(&report, " - %s", c.Error)
+			if c.Doc != "" {
+				fmt.Fprintf(&report, " (see %s)", c.Doc)
+			}
+			if c.Stop != nil {
+				fmt.Fprintf(&report, " [stopped: %s]", c.Stop.Cause)
+			}
+		}
+		fmt.Fprintln(&report)
+	}
+	if rw.stop != nil {
+		fmt.Fprintf(&report, "Stopped: %s (%s)\n", rw.stop, rw.stop.Cause)
+	}
+	printTimeBudget(&report, rw.budget, checks)
+	rw.rendered = rw.redactor.apply(report.Bytes())
+	out.Write(rw.rendered)
+}
+
+// ranChecks counts the checks that actually ran, leaving out skipped ones.
+func ranChecks(checks []CheckResult) int {
+	ran := 0
+	for _, c := range checks {
+		if c.Status != CheckSkip {
+			ran++
+		}
+	}
+	return ran
+}
+
+// diagStatus is pass when every check passed, fail when none did, partial otherwise.
+func diagStatus(total, failed int) string {
+	switch {
+	case failed == 0:
+		return "pass"
+	case failed == total:
+		return "fail"
+	default:
+		return "partial"
+	}
+}
+
+// requestDetail reads ?detail=, defaulting to verbose when DEBUG=true for compatibility.
+func requestDetail(r *http.Request) string {
+	switch detail := r.URL.Query().Get("detail"); detail {
+	case DetailSummary, DetailNormal, DetailVerbose:
+		return detail
+	}
+	return defaultDetail()
+}
+
+func defaultDetail() string {
+	if os.Getenv("DEBUG") == "true" {
+		return DetailVerbose
+	}
+	return DetailNormal
+}
+
+// detailFor reports the detail level w was created with, or the default for plain writers.
+func detailFor(w http.ResponseWriter) string {
+	switch rw := w.(type) {
+	case *reportWriter:
+		return rw.detail
+	case *stepWriter:
+		return rw.detail
+	}
+	return defaultDetail()
+}
+
+type APICall struct {
+	Start    time.Time
+	Method   string
+	Outcome  string
+	Duration time.Duration
+	// Command is the equivalent gcloud command, recorded in the commands trace.
+	Command string
+}
+
+type apiCallRecorder struct {
+	mu    sync.Mutex
+	calls []APICall
+	// commands records each call's gcloud equivalent; see commands.go.
+	commands bool
+}
+
+// add records call and returns its index, for setCommand.
+func (a *apiCallRecorder) add(call APICall) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, call)
+	return len(a.calls) - 1
+}
+
+func (a *apiCallRecorder) setCommand(i int, command string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls[i].Command = command
+}
+
+func (a *apiCallRecorder) Calls() []APICall {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]APICall(nil), a.calls...)
+}
+
+type apiCallRecorderKey struct{}
+
+func withAPICallRecorder(ctx context.Context, recorder *apiCallRecorder) context.Context {
+	return context.WithValue(ctx, apiCallRecorderKey{}, recorder)
+}
+
+func apiCallRecorderFrom(ctx context.Context) *apiCallRecorder {
+	recorder, _ := ctx.Value(apiCallRecorderKey{}).(*apiCallRecorder)
+	return recorder
+}
+
+// apiTraceTransport times every HTTP API call made with a recorder in its context.
+type apiTraceTransport struct {
+	base http.RoundTripper
+}
+
+func (t *apiTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := apiCallRecorderFrom(req.Context())
+	if recorder == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	call := APICall{Start: start, Method: req.Method + " " + req.URL.Host + req.URL.Path, Duration: time.Since(start)}
+	if recorder.commands {
+		call.Command = httpCommand(req)
+	}
+	if err != nil {
+		call.Outcome = err.Error()
+	} else {
+		call.Outcome = resp.Status
+	}
+	recorder.add(call)
+	return resp, err
+}
+
+// grpcClientOptions wires the gRPC trace interceptors into a client constructor.
+func grpcClientOptions(recorder *apiCallRecorder) []option.ClientOption {
+	var opts []option.ClientOption
+	for _, dialOpt := range grpcTraceOptions(recorder) {
+		opts = append(opts, option.WithGRPCDialOption(dialOpt))
+	}
+	return opts
+}
+
+// grpcTraceOptions times gRPC calls. Pub/Sub issues some RPCs on its own background
+// contexts, so the recorder is bound to the client rather than looked up per call.
+func grpcTraceOptions(recorder *apiCallRecorder) []grpc.DialOption {
+	unary := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		call := APICall{Start: start, Method: method, Outcome: grpcOutcome(err), Duration: time.Since(start)}
+		if recorder.commands {
+			call.Command = grpcCommand(method, req)
+		}
+		recorder.add(call)
+		return err
+	}
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		i := recorder.add(APICall{Start: start, Method: method + " (stream open)", Outcome: grpcOutcome(err), Duration: time.Since(start)})
+		if err == nil && recorder.commands {
+			cs = &commandStream{ClientStream: cs, recorder: recorder, index: i, method: method}
+		}
+		return cs, err
+	}
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(unary),
+		grpc.WithChainStreamInterceptor(stream),
+	}
+}
+
+func grpcOutcome(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
@@ -0,0 +1,38 @@
+package gcf
+
+import (
+	"fmt"
+	"hash"
+	"net/http"
+
+	"github.com/andrew-woosnam/gcf-list-buckets/pkg/diag"
+)
+
+// RegisterDigest makes another algorithm (e.g. BLAKE3) selectable through VERIFY_DIGESTS.
+func RegisterDigest(name string, factory func() hash.Hash) {
+	diag.RegisterDigest(name, factory)
+}
+
+// DigestResult is one digest of a download, computed by pkg/diag so the package and the
+// function verify objects the same way.
+type DigestResult = diag.DigestResult
+
+func newDigestSet(names []string) *diag.DigestSet {
+	return diag.NewDigestSet(names)
+}
+
+func printVerification(w http.ResponseWriter, results []DigestResult) {
+	fmt.Fprintln(w, "Verification:")
+	for _, d := range results {
+		switch {
+		case d.Error != "":
+			fmt.Fprintf(w, "| %s: %s\n", d.Algorithm, d.Error)
+		case d.Expected == "":
+			fmt.Fprintf(w, "| %s: %s\n", d.Algorithm, d.Value)
+		case d.Matches():
+			fmt.Fprintf(w, "| %s: %s (matches GCS)\n", d.Algorithm, d.Value)
+		default:
+			fmt.Fprintf(w, "| %s: %s (MISMATCH, GCS has %s)\n", d.Algorithm, d.Value, d.Expected)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package gcf
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// downloadCache keeps verified object contents for the instance's lifetime, keyed by
+// content identity, so repeated runs against the same object skip the download. Least
+// recently used entries are evicted to stay within the byte budget.
+type downloadCache struct {
+	mu        sync.Mutex
+	budget    int64
+	size      int64
+	order     *list.List // front is most recently used
+	entries   map[string]*list.Element
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type downloadCacheEntry struct {
+	key  string
+	data []byte
+}
+
+// DownloadCacheUsage counts one run's lookups.
+type DownloadCacheUsage struct {
+	Hits   int
+	Misses int
+}
+
+var (
+	downloadsMu sync.Mutex
+	downloads   *downloadCache
+)
+
+// sharedDownloadCache returns the instance's cache, sized by the first caller's
+// DOWNLOAD_CACHE_BYTES, or nil when the budget is zero.
+func sharedDownloadCache(budget int64) *downloadCache {
+	if budget <= 0 {
+		return nil
+	}
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	if downloads == nil {
+		downloads = &downloadCache{budget: budget, order: list.New(), entries: map[string]*list.Element{}}
+	}
+	return downloads
+}
+
+// defaultDownloadCacheBytes fits comfortably in the smallest function instances.
+const defaultDownloadCacheBytes = 32 << 20
+
+// downloadCacheBudget reads DOWNLOAD_CACHE_BYTES, where 0 turns the cache off.
+func downloadCacheBudget(src configSource) int64 {
+	if src("DOWNLOAD_CACHE_BYTES") == "0" {
+		return 0
+	}
+	return int64(src.int("DOWNLOAD_CACHE_BYTES", defaultDownloadCacheBytes))
+}
+
+// downloadCacheKey identifies content by generation and CRC32C, so a rewritten object
+// never hits a stale entry.
+func downloadCacheKey(bucket string, attrs *storage.ObjectAttrs) string {
+	return fmt.Sprintf("%s/%s#%d/%08x", bucket, attrs.Name, attrs.Generation, attrs.CRC32C)
+}
+
+// cacheable reports whether an object of size bytes may be cached; one object may use
+// at most a quarter of the budget so a large file can't flush everything else.
+func (c *downloadCache) cacheable(size int64) bool {
+	return c != nil && size <= c.budget/4
+}
+
+func (c *downloadCache) get(key string, usage *DownloadCacheUsage) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		usage.Misses++
+		return nil, false
+	}
+	c.hits++
+	usage.Hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*downloadCacheEntry).data, true
+}
+
+func (c *downloadCache) put(key string, data []byte) {
+	if !c.cacheable(int64(len(data))) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&downloadCacheEntry{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.budget {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*downloadCacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.data))
+		c.evictions++
+	}
+}
+
+func printDownloadCache(w http.ResponseWriter, c *downloadCache, usage DownloadCacheUsage) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintln(w, "Download Cache:")
+	fmt.Fprintf(w, "| This Run: %d hits, %d misses\n", usage.Hits, usage.Misses)
+	fmt.Fprintf(w, "| Instance: %d hits, %d misses, %d evictions\n", c.hits, c.misses, c.evictions)
+	fmt.Fprintf(w, "| Holding: %d objects, %s of %s\n", len(c.entries), formatBytes(uint64(c.size)), formatBytes(uint64(c.budget)))
+}
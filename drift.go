@@ -0,0 +1,285 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// legacyStorageHost is the JSON API's old host. It still answers, but clients and
+// firewall rules pinned to it miss features that are only on storage.googleapis.com.
+const legacyStorageHost = "https://www.googleapis.com/storage/v1/"
+
+// dependencyAdvisories are notes on modules whose line of development has moved on,
+// whatever version is in the build.
+var dependencyAdvisories = map[string]string{
+	"cloud.google.com/go/pubsub": "superseded by cloud.google.com/go/pubsub/v2; v1 only gets fixes",
+}
+
+// DependencyVersion is a module in the build against the oldest version
+// MIN_DEPENDENCY_VERSIONS accepts for it.
+type DependencyVersion struct {
+	Module   string `json:"module"`
+	Version  string `json:"version"`
+	Minimum  string `json:"minimum,omitempty"`
+	Outdated bool   `json:"outdated,omitempty"`
+	Advisory string `json:"advisory,omitempty"`
+}
+
+// DriftProbe is a check for behavior Google has deprecated or advises against.
+type DriftProbe struct {
+	Name       string `json:"name"`
+	Result     string `json:"result"`
+	Deprecated bool   `json:"deprecated,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type DriftReport struct {
+	Build        BuildInfo           `json:"build"`
+	BuildAge     time.Duration       `json:"buildAge,omitempty"`
+	MaxAge       time.Duration       `json:"maxAge"`
+	Dependencies []DependencyVersion `json:"dependencies"`
+	Probes       []DriftProbe        `json:"probes"`
+	Warnings     []string            `json:"warnings"`
+}
+
+func (d DriftReport) Err() error {
+	if len(d.Warnings) > 0 {
+		return errors.New(strings.Join(d.Warnings, "; "))
+	}
+	return nil
+}
+
+// driftHandler reports how far the deployed build has drifted: the storage and Pub/Sub
+// module versions against MIN_DEPENDENCY_VERSIONS, the build's age against
+// BUILD_MAX_AGE, and probes for deprecated API behavior the function relies on.
+func driftHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	report := checkDrift(ctx, cfg, time.Now())
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	printDriftReport(w, report)
+}
+
+func checkDrift(ctx context.Context, cfg *GCloudFunctionConfig, now time.Time) DriftReport {
+	report := DriftReport{Build: currentBuildInfo(), MaxAge: cfg.BuildMaxAge, Warnings: []string{}}
+	warn := func(format string, args ...any) {
+		report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	if built, err := time.Parse(time.RFC3339, report.Build.BuildTime); err != nil {
+		warn("build time is unknown; set it with -ldflags -X ...buildTime=, or build from a git checkout")
+	} else {
+		report.BuildAge = now.Sub(built)
+		if report.BuildAge > cfg.BuildMaxAge {
+			warn("build is %d days old, more than BUILD_MAX_AGE (%d days)", int(report.BuildAge.Hours()/24), int(cfg.BuildMaxAge.Hours()/24))
+		}
+	}
+
+	minimums, err := parseMinDependencyVersions(cfg.MinDependencyVersions)
+	if err != nil {
+		warn("MIN_DEPENDENCY_VERSIONS: %v", err)
+	}
+	report.Dependencies = buildDependencies(minimums)
+	for _, dep := range report.Dependencies {
+		switch {
+		case dep.Version == "":
+			warn("%s is not in the build info", dep.Module)
+		case dep.Outdated:
+			warn("%s is %s, older than %s", dep.Module, dep.Version, dep.Minimum)
+		}
+		if dep.Advisory != "" {
+			warn("%s is %s", dep.Module, dep.Advisory)
+		}
+	}
+
+	report.Probes = append(report.Probes, probeStorageEndpoint(ctx, cfg.ComputeProjectId))
+	if cfg.BucketName != "" {
+		report.Probes = append(report.Probes, probeBucketACLMode(ctx, cfg.BucketName, cfg.ComputeProjectId))
+	}
+	for _, probe := range report.Probes {
+		if probe.Deprecated {
+			warn("%s: %s", probe.Name, probe.Result)
+		}
+	}
+	return report
+}
+
+// parseMinDependencyVersions reads module@version pairs.
+func parseMinDependencyVersions(items []string) (map[string]string, error) {
+	minimums := map[string]string{}
+	for _, item := range items {
+		module, version, ok := strings.Cut(item, "@")
+		if !ok || module == "" || !strings.HasPrefix(version, "v") {
+			return minimums, fmt.Errorf("%q is not module@vX.Y.Z", item)
+		}
+		minimums[module] = version
+	}
+	return minimums, nil
+}
+
+// buildDependencies lists keyDependencies and any module with a minimum, with the
+// version the binary was built with.
+func buildDependencies(minimums map[string]string) []DependencyVersion {
+	versions := map[string]string{}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			versions[dep.Path] = dep.Version
+		}
+	}
+	modules := append([]string{}, keyDependencies...)
+	for module := range minimums {
+		if !slices.Contains(modules, module) {
+			modules = append(modules, module)
+		}
+	}
+	sort.Strings(modules)
+
+	deps := make([]DependencyVersion, 0, len(modules))
+	for _, module := range modules {
+		dep := DependencyVersion{Module: module, Version: versions[module], Minimum: minimums[module], Advisory: dependencyAdvisories[module]}
+		dep.Outdated = dep.Version != "" && dep.Minimum != "" && compareVersions(dep.Version, dep.Minimum) < 0
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// compareVersions orders vMAJOR.MINOR.PATCH versions. A pre-release sorts before its
+// release; pre-releases of the same version are compared as strings.
+func compareVersions(a, b string) int {
+	coreA, preA, _ := strings.Cut(strings.TrimPrefix(a, "v"), "-")
+	coreB, preB, _ := strings.Cut(strings.TrimPrefix(b, "v"), "-")
+	partsA, partsB := strings.Split(coreA, "."), strings.Split(coreB, ".")
+	for i := 0; i < 3; i++ {
+		var x, y int
+		if i < len(partsA) {
+			x, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			y, _ = strconv.Atoi(partsB[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return strings.Compare(preA, preB)
+}
+
+// probeStorageEndpoint reports which JSON API host the storage client talks to, and
+// whether the legacy host still answers with the function's credentials.
+func probeStorageEndpoint(ctx context.Context, project string) DriftProbe {
+	probe := DriftProbe{Name: "Storage endpoint"}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		probe.Result = "STORAGE_EMULATOR_HOST sends storage calls to " + host
+		return probe
+	}
+
+	ts, err := clientTokenSource(ctx)
+	if err != nil {
+		probe.Error = fmt.Sprintf("failed to create token source: %v", err)
+		return probe
+	}
+	client := &http.Client{Transport: &oauth2.Transport{Source: ts}, Timeout: 10 * time.Second}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, legacyStorageHost+"b?project="+url.QueryEscape(project)+"&maxResults=1&fields=kind", nil)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		probe.Result = "the client uses storage.googleapis.com; the legacy www.googleapis.com host is unreachable from here"
+		probe.Error = err.Error()
+		return probe
+	}
+	resp.Body.Close()
+	probe.Result = fmt.Sprintf("the client uses storage.googleapis.com; the legacy www.googleapis.com host still answers (%s), so anything pinned to it keeps working for now", resp.Status)
+	return probe
+}
+
+// probeBucketACLMode flags buckets still on fine-grained ACLs, which Google recommends
+// replacing with uniform bucket-level access and IAM.
+func probeBucketACLMode(ctx context.Context, bucket, userProject string) DriftProbe {
+	probe := DriftProbe{Name: "Bucket access control"}
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		probe.Error = fmt.Sprintf("failed to create storage client: %v", err)
+		return probe
+	}
+	defer client.Close()
+	attrs, err := client.Bucket(bucket).UserProject(userProject).Attrs(ctx)
+	if err != nil {
+		probe.Error = fmt.Sprintf("failed to read %s: %v", bucket, err)
+		return probe
+	}
+	if attrs.UniformBucketLevelAccess.Enabled {
+		probe.Result = bucket + " uses uniform bucket-level access"
+		return probe
+	}
+	probe.Result = bucket + " uses fine-grained ACLs; uniform bucket-level access is recommended instead"
+	probe.Deprecated = true
+	return probe
+}
+
+func printDriftReport(w http.ResponseWriter, report DriftReport) {
+	fmt.Fprintf(w, "Build Drift (%s):\n", report.Build)
+	if report.BuildAge > 0 {
+		fmt.Fprintf(w, "| Build Age: %d days (max %d)\n", int(report.BuildAge.Hours()/24), int(report.MaxAge.Hours()/24))
+	}
+	for _, dep := range report.Dependencies {
+		line := dep.Version
+		if line == "" {
+			line = "not in build"
+		}
+		if dep.Minimum != "" {
+			line += ", minimum " + dep.Minimum
+		}
+		if dep.Outdated {
+			line += " - OUTDATED"
+		}
+		fmt.Fprintf(w, "| %s: %s\n", dep.Module, line)
+	}
+	for _, probe := range report.Probes {
+		result := probe.Result
+		if probe.Error != "" {
+			result = strings.TrimPrefix(result+"; ", "; ") + "FAILED - " + probe.Error
+		}
+		fmt.Fprintf(w, "| %s: %s\n", probe.Name, result)
+	}
+	fmt.Fprintf(w, "Drift Warnings (%d):\n", len(report.Warnings))
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(w, "| %s\n", warning)
+	}
+}
@@ -0,0 +1,145 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const dualWriteProbeBytes = 4 << 10
+
+// DualWriteTarget is the write and read-back of the probe in one bucket.
+type DualWriteTarget struct {
+	Bucket     string
+	Generation int64
+	CRC32C     uint32
+	Write      time.Duration
+	Read       time.Duration
+	ReadOK     bool
+	Error      string
+}
+
+// DualWriteCheck is the same probe object written to every bucket of a dual-write pair.
+type DualWriteCheck struct {
+	Object  string
+	Targets []DualWriteTarget
+	// Match is set when every bucket stored and returned the bytes that were written.
+	Match bool
+}
+
+func (c DualWriteCheck) Err() error {
+	var failed []string
+	for _, t := range c.Targets {
+		if t.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", t.Bucket, t.Error))
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		return errors.New(strings.Join(failed, "; "))
+	case !c.Match:
+		return fmt.Errorf("buckets returned different content for %s", c.Object)
+	}
+	return nil
+}
+
+// checkDualWrite writes one random probe to every bucket at once, as a dual-writing
+// application would, then reads each copy back and compares it with what was sent.
+// The probes are handed to the run's cleanup manager.
+func checkDualWrite(ctx context.Context, client *storage.Client, buckets []string, userProject, object string) DualWriteCheck {
+	check := DualWriteCheck{Object: object, Targets: make([]DualWriteTarget, len(buckets))}
+	payload := make([]byte, dualWriteProbeBytes)
+	rand.Read(payload)
+	want := crc32cOf(payload)
+	artifacts := cleanupFrom(ctx)
+
+	var wg sync.WaitGroup
+	for i, bucket := range buckets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			obj := client.Bucket(bucket).UserProject(userProject).Object(object)
+			check.Targets[i] = dualWriteOne(ctx, artifacts, obj, payload, want)
+		}()
+	}
+	wg.Wait()
+
+	check.Match = true
+	for _, t := range check.Targets {
+		if !t.ReadOK || t.CRC32C != want {
+			check.Match = false
+		}
+	}
+	return check
+}
+
+func dualWriteOne(ctx context.Context, artifacts *cleanupManager, obj *storage.ObjectHandle, payload []byte, want uint32) DualWriteTarget {
+	target := DualWriteTarget{Bucket: obj.BucketName()}
+
+	start := time.Now()
+	wc := obj.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	wc.Metadata = artifacts.artifactMetadata()
+	wc.SendCRC32C = true
+	wc.CRC32C = want
+	if _, err := wc.Write(payload); err != nil {
+		wc.Close()
+		target.Error = fmt.Sprintf("write: %v", err)
+		return target
+	}
+	if err := wc.Close(); err != nil {
+		target.Error = fmt.Sprintf("write: %v", err)
+		return target
+	}
+	artifacts.trackObject(obj)
+	target.Write = time.Since(start)
+	target.Generation = wc.Attrs().Generation
+	target.CRC32C = wc.Attrs().CRC32C
+
+	start = time.Now()
+	rc, err := obj.Generation(target.Generation).NewReader(ctx)
+	if err != nil {
+		target.Error = fmt.Sprintf("read: %v", err)
+		return target
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	target.Read = time.Since(start)
+	switch {
+	case err != nil:
+		target.Error = fmt.Sprintf("read: %v", err)
+	case !bytes.Equal(got, payload):
+		target.Error = "read back different bytes than were written"
+	default:
+		target.ReadOK = true
+	}
+	return target
+}
+
+func crc32cOf(data []byte) uint32 {
+	h := crc32.New(crc32cTable)
+	h.Write(data)
+	return h.Sum32()
+}
+
+func printDualWriteCheck(w http.ResponseWriter, check DualWriteCheck) {
+	fmt.Fprintf(w, "Dual Write (%s):\n", check.Object)
+	for _, t := range check.Targets {
+		if t.Error != "" {
+			fmt.Fprintf(w, "| %s: FAILED - %s\n", t.Bucket, t.Error)
+			continue
+		}
+		fmt.Fprintf(w, "| %s: generation %d, CRC32C %s, write %s, read %s\n",
+			t.Bucket, t.Generation, encodeCRC32C(t.CRC32C), t.Write.Round(time.Millisecond), t.Read.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "| Copies Match: %t\n", check.Match)
+}
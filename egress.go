@@ -0,0 +1,124 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+const egressEchoTimeout = 5 * time.Second
+
+type EgressReport struct {
+	OnGCE             bool
+	Region            string
+	NetworkInterfaces []string
+	// EgressChecked is false when no EGRESS_ECHO_URL is set to reflect the IP off.
+	EgressChecked   bool
+	EgressIP        string
+	EgressError     string
+	EgressIPPrivate bool
+	Path            string
+}
+
+// inspectEgress gathers what the metadata server knows about the instance's network
+// and reflects the source IP off an echo endpoint to infer how traffic leaves the function.
+// The echo endpoint is a third-party service, so it is only called when echoURL is set.
+func inspectEgress(ctx context.Context, echoURL string) EgressReport {
+	report := EgressReport{OnGCE: metadata.OnGCE()}
+
+	if report.OnGCE {
+		if region, err := metadata.GetWithContext(ctx, "instance/region"); err == nil {
+			report.Region = region[strings.LastIndex(region, "/")+1:]
+		}
+		// Only populated when the function uses Direct VPC egress.
+		if ifaces, err := metadata.GetWithContext(ctx, "instance/network-interfaces/"); err == nil {
+			for _, iface := range strings.Fields(ifaces) {
+				ip, err := metadata.GetWithContext(ctx, "instance/network-interfaces/"+iface+"ip")
+				if err != nil {
+					continue
+				}
+				network, _ := metadata.GetWithContext(ctx, "instance/network-interfaces/"+iface+"network")
+				report.NetworkInterfaces = append(report.NetworkInterfaces, fmt.Sprintf("%s (%s)", ip, network))
+			}
+		}
+	}
+
+	if echoURL != "" {
+		report.EgressChecked = true
+		ip, err := fetchEgressIP(ctx, echoURL)
+		if err != nil {
+			report.EgressError = err.Error()
+		} else {
+			report.EgressIP = ip
+			if parsed := net.ParseIP(ip); parsed != nil {
+				report.EgressIPPrivate = parsed.IsPrivate()
+			}
+		}
+	}
+
+	report.Path = inferEgressPath(report)
+	return report
+}
+
+func fetchEgressIP(ctx context.Context, echoURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, egressEchoTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, echoURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid echo URL %q: %v", echoURL, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("echo request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("echo endpoint returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", fmt.Errorf("failed to read echo response: %v", err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func inferEgressPath(report EgressReport) string {
+	switch {
+	case len(report.NetworkInterfaces) > 0:
+		return "Direct VPC egress"
+	case !report.EgressChecked:
+		return "Unknown (set EGRESS_ECHO_URL to infer it)"
+	case report.EgressError != "":
+		return "No internet egress (likely a VPC connector routing all traffic without Cloud NAT)"
+	case report.EgressIPPrivate:
+		return "VPC (egress IP is private, traffic is routed through a VPC connector)"
+	default:
+		return "Public internet (Google-managed egress or Cloud NAT behind a VPC connector)"
+	}
+}
+
+func printEgressReport(w http.ResponseWriter, report EgressReport) {
+	fmt.Fprintln(w, "Egress:")
+	if report.Region != "" {
+		fmt.Fprintf(w, "| Region: %s\n", report.Region)
+	}
+	for _, iface := range report.NetworkInterfaces {
+		fmt.Fprintf(w, "| VPC Interface: %s\n", iface)
+	}
+	if !report.EgressChecked {
+		fmt.Fprintln(w, "| Egress IP: not checked (EGRESS_ECHO_URL is unset)")
+	} else if report.EgressError != "" {
+		fmt.Fprintf(w, "| Egress IP: unknown (%s)\n", report.EgressError)
+	} else {
+		fmt.Fprintf(w, "| Egress IP: %s\n", report.EgressIP)
+	}
+	fmt.Fprintf(w, "| Egress Path: %s\n", report.Path)
+}
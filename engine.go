@@ -0,0 +1,215 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"runtime/pprof"
+	"slices"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// diagRun is what a check runs with: its own context, bounded by CHECK_TIMEOUT, and
+// the state the whole run shares.
+type diagRun struct {
+	ctx context.Context
+	cfg *GCloudFunctionConfig
+	rw  *reportWriter
+
+	*diagState
+}
+
+// diagState is the state one diagnostics run shares between its checks. A check only
+// reads what its prerequisites have set.
+type diagState struct {
+	gcsClient       *storage.Client
+	sampleNames     []string
+	firstObjectName string
+	pubsubClient    *pubsub.Client
+}
+
+func (run *diagRun) close() {
+	if run.gcsClient != nil {
+		run.gcsClient.Close()
+	}
+	if run.pubsubClient != nil {
+		run.pubsubClient.Close()
+	}
+}
+
+// checkDef registers one check of the full run. after names the checks it builds on;
+// enabled, when set, leaves the check out unless its configuration is present.
+type checkDef struct {
+	name    string
+	after   []string
+	enabled func(cfg *GCloudFunctionConfig) bool
+	run     func(run *diagRun, w http.ResponseWriter) error
+}
+
+// diagChecks is the registry of checks in report order. Storage and Pub/Sub checks are
+// independent and run side by side; within each chain a check waits for the one it
+// builds on.
+var diagChecks = []checkDef{
+	{name: "service_usage", run: (*diagRun).stepServiceUsage,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.CheckServiceUsage }},
+	{name: "billing", run: (*diagRun).stepBilling,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.CheckBilling }},
+	{name: "clock_skew", run: (*diagRun).stepClockSkew,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.CheckClockSkew }},
+	{name: "storage_client", run: (*diagRun).stepStorageClient},
+	{name: "bucket_create", after: []string{"storage_client"}, run: (*diagRun).stepBucketCreate,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.CheckBucketCreate }},
+	{name: "bucket_access", after: []string{"storage_client"}, run: (*diagRun).stepBucketAccess},
+	{name: "dual_write", after: []string{"storage_client"}, run: (*diagRun).stepDualWrite,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.DualWriteBucket != "" }},
+	{name: "precondition_race", after: []string{"storage_client"}, run: (*diagRun).stepPreconditionRace,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.CheckPreconditionRace }},
+	{name: "list_objects", after: []string{"bucket_access"}, run: (*diagRun).stepListObjects},
+	{name: "download", after: []string{"list_objects"}, run: (*diagRun).stepDownload},
+	{name: "signed_url", after: []string{"download"}, run: (*diagRun).stepSignedURL,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.SignedURLSelfTest }},
+	{name: "tink_decrypt", after: []string{"download"}, run: (*diagRun).stepTinkDecrypt,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.TinkKeysetSecret != "" }},
+	{name: "bigquery_external_table", run: (*diagRun).stepBigQueryExternalTable,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.BigQueryTable != "" }},
+	{name: "pubsub_client", run: (*diagRun).stepPubSubClient},
+	{name: "pubsub_publish", after: []string{"pubsub_client"}, run: (*diagRun).stepPubSubPublish},
+	{name: "pubsub_receive", after: []string{"pubsub_publish"}, run: (*diagRun).stepPubSubReceive},
+	{name: "message_object", after: []string{"storage_client", "pubsub_client"}, run: (*diagRun).stepMessageObject,
+		enabled: func(cfg *GCloudFunctionConfig) bool { return cfg.MessageObjectSubscription != "" }},
+	{name: "kms_decrypt", run: (*diagRun).stepKMSDecrypt},
+}
+
+// bindSteps turns the selected checks into steps bound to run.
+func bindSteps(run *diagRun, defs []checkDef) []diagStep {
+	var steps []diagStep
+	for _, def := range defs {
+		steps = append(steps, diagStep{name: def.name, after: def.after, run: func(w http.ResponseWriter) error {
+			ctx, cancel := withCheckTimeout(run.ctx, def.name, run.cfg.CheckTimeout)
+			defer cancel()
+			run.rw.setContext(def.name, ctx)
+			step := *run
+			step.ctx = ctx
+			return def.run(&step, w)
+		}})
+	}
+	return steps
+}
+
+// diagStep is one check of a diagnostics run. It starts once every step named in after
+// has succeeded, and returns an error when its dependents can't go on. Steps record
+// their own check results, since a step may fail its check yet still let others run.
+type diagStep struct {
+	name  string
+	after []string
+	run   func(w http.ResponseWriter) error
+}
+
+// stepWriter holds one step's narrative while steps run concurrently, so the report
+// still reads in step order. Headers and the status code are held too, since steps
+// calling http.Error side by side would otherwise write the same header map; runSteps
+// merges them into the report once every step is done.
+type stepWriter struct {
+	*reportWriter
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	header http.Header
+	status int
+	// logger is the run's logger with the step as its component.
+	logger *slog.Logger
+}
+
+func (sw *stepWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.buf.Write(p)
+}
+
+func (sw *stepWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *stepWriter) WriteHeader(status int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.status == 0 {
+		sw.status = status
+	}
+}
+
+// runSteps runs independent steps in parallel and writes their output in the order the
+// steps were given. after may only name earlier steps; the checks matrix follows the
+// same order. A step whose prerequisite did not succeed is recorded as skipped rather
+// than run against missing state.
+func runSteps(rw *reportWriter, steps []diagStep) {
+	type stepState struct {
+		done chan struct{}
+		ok   bool
+		out  *stepWriter
+	}
+	states := map[string]*stepState{}
+	names := make([]string, 0, len(steps))
+	for _, step := range steps {
+		states[step.name] = &stepState{done: make(chan struct{}), out: &stepWriter{reportWriter: rw, header: http.Header{}, logger: loggerFor(rw).With(slog.String("component", step.name))}}
+		names = append(names, step.name)
+	}
+	rw.setCheckOrder(names)
+
+	var g errgroup.Group
+	for i, step := range steps {
+		state := states[step.name]
+		g.Go(func() error {
+			defer close(state.done)
+			for _, dep := range step.after {
+				prereq, ok := states[dep]
+				if !ok || slices.Index(names, dep) >= i {
+					log.Printf("Step %s depends on unknown or later step %s\n", step.name, dep)
+					rw.skip(step.name, fmt.Sprintf("dependency %s is not part of this run", dep))
+					return nil
+				}
+				<-prereq.done
+				if !prereq.ok {
+					rw.skip(step.name, fmt.Sprintf("dependency %s did not pass", dep))
+					return nil
+				}
+			}
+			rw.start(step.name)
+			// The label lets CPU and goroutine profiles from /debug/pprof/ attribute samples to checks.
+			pprof.Do(context.Background(), pprof.Labels("check", step.name), func(context.Context) {
+				state.ok = step.run(state.out) == nil
+			})
+			return nil
+		})
+	}
+	g.Wait()
+
+	for _, step := range steps {
+		out := states[step.name].out
+		rw.Write(out.buf.Bytes())
+		rw.mergeStepHeaders(out)
+	}
+}
+
+// mergeStepHeaders adds headers a step set that the report doesn't set itself, so an
+// http.Error in one check can't change the report's Content-Type, and keeps the first
+// status a step wrote, in step order.
+func (rw *reportWriter) mergeStepHeaders(sw *stepWriter) {
+	rw.mu.Lock()
+	header := rw.Header()
+	for name, values := range sw.header {
+		if _, ok := header[name]; !ok {
+			header[name] = values
+		}
+	}
+	rw.mu.Unlock()
+	if sw.status != 0 {
+		rw.WriteHeader(sw.status)
+	}
+}
@@ -0,0 +1,32 @@
+package gcf
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunStepsKeepsStepHeadersApart(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		rec := httptest.NewRecorder()
+		rw := newReportWriter(rec, DetailNormal)
+		rw.Header().Set("Content-Type", jsonContentType)
+		var steps []diagStep
+		for n := 0; n < 4; n++ {
+			status := http.StatusBadGateway + n
+			steps = append(steps, diagStep{name: fmt.Sprintf("step%d", n), run: func(w http.ResponseWriter) error {
+				http.Error(w, "failed", status)
+				return nil
+			}})
+		}
+		runSteps(rw, steps)
+
+		if got := rw.Header().Get("Content-Type"); got != jsonContentType {
+			t.Fatalf("Content-Type = %q, want the report's own %q", got, jsonContentType)
+		}
+		if rw.status != http.StatusBadGateway {
+			t.Fatalf("status = %d, want the first step's %d", rw.status, http.StatusBadGateway)
+		}
+	}
+}
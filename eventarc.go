@@ -0,0 +1,279 @@
+package gcf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+const (
+	recentEventCount = 50
+	maxEventBytes    = 1 << 20
+)
+
+// EventSummary is the normalized view of a delivered CloudEvent.
+type EventSummary struct {
+	ID         string
+	Source     string
+	Type       string
+	Subject    string
+	Time       string
+	Mode       string
+	ReceivedAt time.Time
+	Details    map[string]string
+	Problems   []string
+}
+
+// CloudEvent is a CloudEvents 1.0 event as Eventarc delivers it, in either mode.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+	DataBase64      string          `json:"data_base64"`
+}
+
+// sdkEvent is e as the CloudEvents SDK represents it, the form ProcessEvent takes.
+func (e CloudEvent) sdkEvent() event.Event {
+	out := event.New()
+	out.SetID(e.ID)
+	out.SetSource(e.Source)
+	out.SetType(e.Type)
+	out.SetSubject(e.Subject)
+	if t, err := time.Parse(time.RFC3339, e.Time); err == nil {
+		out.SetTime(t)
+	}
+	if e.DataContentType != "" {
+		out.SetDataContentType(e.DataContentType)
+	}
+	out.DataEncoded = e.Data
+	return out
+}
+
+// recentEvents keeps the last delivered events for the lifetime of the instance,
+// so GET /events shows whether a trigger has delivered anything at all.
+var recentEvents = struct {
+	sync.Mutex
+	events []EventSummary
+}{}
+
+// isCloudEvent reports whether r is a CloudEvent in binary or structured mode.
+// Eventarc delivers to the function's root path, so DoIt routes on this.
+func isCloudEvent(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	if r.Header.Get("Ce-Specversion") != "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/cloudevents+json"
+}
+
+// eventHandler validates and records a CloudEvent and echoes its normalized summary.
+// Events that fail validation are still recorded, with their problems, and rejected
+// with 400 so Eventarc surfaces the delivery failure. With PROCESS_EVENTS=true valid
+// events are also handed to ProcessEvent.
+func eventHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEventBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read event: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	event, mode, err := parseCloudEvent(r, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid CloudEvent: %v", err), http.StatusBadRequest)
+		return
+	}
+	summary := summarizeEvent(event, mode)
+	saveEvent(summary)
+	log.Printf("Received %s event %s from %s\n", summary.Type, summary.ID, summary.Source)
+
+	w.Header().Set("Content-Type", "text/plain")
+	switch {
+	case len(summary.Problems) > 0:
+		w.WriteHeader(http.StatusBadRequest)
+	case NewGCloudFunctionConfig().ProcessEvents:
+		if err := ProcessEvent(r.Context(), event.sdkEvent()); err != nil {
+			// A 5xx makes Eventarc retry the delivery, when the trigger allows it.
+			w.WriteHeader(http.StatusInternalServerError)
+			summary.Problems = append(summary.Problems, fmt.Sprintf("processing failed: %v", err))
+		}
+	}
+	printEventSummaries(w, []EventSummary{summary})
+}
+
+// recentEventsHandler lists the events received by this instance, newest first.
+func recentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	recentEvents.Lock()
+	events := make([]EventSummary, len(recentEvents.events))
+	for i, e := range recentEvents.events {
+		events[len(events)-1-i] = e
+	}
+	recentEvents.Unlock()
+
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No events received by this instance yet.")
+		return
+	}
+	printEventSummaries(w, events)
+}
+
+func saveEvent(summary EventSummary) {
+	recentEvents.Lock()
+	defer recentEvents.Unlock()
+	recentEvents.events = append(recentEvents.events, summary)
+	if overflow := len(recentEvents.events) - recentEventCount; overflow > 0 {
+		recentEvents.events = append([]EventSummary(nil), recentEvents.events[overflow:]...)
+	}
+}
+
+func parseCloudEvent(r *http.Request, body []byte) (CloudEvent, string, error) {
+	if r.Header.Get("Ce-Specversion") != "" {
+		return CloudEvent{
+			SpecVersion:     r.Header.Get("Ce-Specversion"),
+			ID:              r.Header.Get("Ce-Id"),
+			Source:          r.Header.Get("Ce-Source"),
+			Type:            r.Header.Get("Ce-Type"),
+			Subject:         r.Header.Get("Ce-Subject"),
+			Time:            r.Header.Get("Ce-Time"),
+			DataContentType: r.Header.Get("Content-Type"),
+			Data:            body,
+		}, "binary", nil
+	}
+
+	var event CloudEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return event, "structured", err
+	}
+	if event.DataBase64 != "" {
+		data, err := base64.StdEncoding.DecodeString(event.DataBase64)
+		if err != nil {
+			return event, "structured", fmt.Errorf("invalid data_base64: %v", err)
+		}
+		event.Data = data
+	}
+	return event, "structured", nil
+}
+
+func summarizeEvent(event CloudEvent, mode string) EventSummary {
+	summary := EventSummary{
+		ID:         event.ID,
+		Source:     event.Source,
+		Type:       event.Type,
+		Subject:    event.Subject,
+		Time:       event.Time,
+		Mode:       mode,
+		ReceivedAt: time.Now().UTC(),
+		Details:    map[string]string{},
+	}
+
+	// Required context attributes per the CloudEvents 1.0 spec.
+	if event.SpecVersion != "1.0" {
+		summary.Problems = append(summary.Problems, fmt.Sprintf("unsupported specversion %q", event.SpecVersion))
+	}
+	for _, attr := range [][2]string{{"id", event.ID}, {"source", event.Source}, {"type", event.Type}} {
+		if attr[1] == "" {
+			summary.Problems = append(summary.Problems, "missing required attribute "+attr[0])
+		}
+	}
+	if event.Time != "" {
+		if _, err := time.Parse(time.RFC3339, event.Time); err != nil {
+			summary.Problems = append(summary.Problems, fmt.Sprintf("time %q is not RFC 3339", event.Time))
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(event.Type, "google.cloud.storage.object.v1."):
+		var data struct {
+			Bucket     string `json:"bucket"`
+			Name       string `json:"name"`
+			Generation string `json:"generation"`
+			Size       string `json:"size"`
+		}
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			summary.Problems = append(summary.Problems, fmt.Sprintf("storage event data is not a StorageObjectData: %v", err))
+			break
+		}
+		summary.Details["Bucket"] = data.Bucket
+		summary.Details["Object"] = safeObjectName(data.Name)
+		summary.Details["Generation"] = data.Generation
+		summary.Details["Size"] = data.Size
+
+	case event.Type == "google.cloud.pubsub.topic.v1.messagePublished":
+		var data struct {
+			Message struct {
+				MessageID  string            `json:"messageId"`
+				Data       []byte            `json:"data"`
+				Attributes map[string]string `json:"attributes"`
+			} `json:"message"`
+			Subscription string `json:"subscription"`
+		}
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			summary.Problems = append(summary.Problems, fmt.Sprintf("Pub/Sub event data is not a MessagePublishedData: %v", err))
+			break
+		}
+		summary.Details["Subscription"] = data.Subscription
+		summary.Details["Message ID"] = data.Message.MessageID
+		summary.Details["Message Bytes"] = fmt.Sprint(len(data.Message.Data))
+		summary.Details["Attributes"] = strings.Join(sortedKeys(data.Message.Attributes), ", ")
+
+	case event.Type == "google.cloud.audit.log.v1.written":
+		var data struct {
+			ProtoPayload struct {
+				ServiceName        string `json:"serviceName"`
+				MethodName         string `json:"methodName"`
+				ResourceName       string `json:"resourceName"`
+				AuthenticationInfo struct {
+					PrincipalEmail string `json:"principalEmail"`
+				} `json:"authenticationInfo"`
+			} `json:"protoPayload"`
+		}
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			summary.Problems = append(summary.Problems, fmt.Sprintf("audit log event data is not a LogEntryData: %v", err))
+			break
+		}
+		summary.Details["Service"] = data.ProtoPayload.ServiceName
+		summary.Details["Method"] = data.ProtoPayload.MethodName
+		summary.Details["Resource"] = data.ProtoPayload.ResourceName
+		summary.Details["Principal"] = data.ProtoPayload.AuthenticationInfo.PrincipalEmail
+
+	default:
+		summary.Details["Data Bytes"] = fmt.Sprint(len(event.Data))
+	}
+	return summary
+}
+
+func printEventSummaries(w http.ResponseWriter, events []EventSummary) {
+	for _, e := range events {
+		fmt.Fprintf(w, "Event (%s):\n", e.ID)
+		fmt.Fprintf(w, "| Type: %s\n", e.Type)
+		fmt.Fprintf(w, "| Source: %s\n", e.Source)
+		if e.Subject != "" {
+			fmt.Fprintf(w, "| Subject: %s\n", e.Subject)
+		}
+		fmt.Fprintf(w, "| Mode: %s\n", e.Mode)
+		fmt.Fprintf(w, "| Received: %s (event time %s)\n", e.ReceivedAt.Format(time.RFC3339), e.Time)
+		for _, key := range sortedKeys(e.Details) {
+			fmt.Fprintf(w, "| %s: %s\n", key, e.Details[key])
+		}
+		for _, problem := range e.Problems {
+			fmt.Fprintf(w, "| Problem: %s\n", problem)
+		}
+	}
+}
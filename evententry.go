@@ -0,0 +1,203 @@
+package gcf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+// errNoEventObject is an event that names no object to process. Retrying it can't
+// help, so ProcessEvent logs it and reports success.
+var errNoEventObject = errors.New("event names no object")
+
+// storageEventTypes maps CloudEvent storage types to the notification event types
+// ObjectReference uses.
+var storageEventTypes = map[string]string{
+	"google.cloud.storage.object.v1.finalized":       "OBJECT_FINALIZE",
+	"google.cloud.storage.object.v1.deleted":         "OBJECT_DELETE",
+	"google.cloud.storage.object.v1.archived":        "OBJECT_ARCHIVE",
+	"google.cloud.storage.object.v1.metadataUpdated": "OBJECT_METADATA_UPDATE",
+}
+
+// ProcessEvent is the event-driven entry point: it downloads and verifies the object a
+// GCS event or a Pub/Sub message names, the same way the diagnostics download each
+// listed object, honouring VERIFY_DIGESTS and DOWNLOAD_DESTINATION. It reads the
+// generation the event is about, not whatever is live when it runs. Failures a retry
+// can't fix, such as a 403 or a digest mismatch, are logged and reported as success;
+// only transient ones return an error, so a trigger with retries enabled redelivers
+// just those events. It registers as
+//
+//	functions.CloudEvent("ProcessEvent", gcf.ProcessEvent)
+//
+// and over HTTP, Eventarc deliveries reach it with PROCESS_EVENTS=true and push
+// subscriptions through /push.
+func ProcessEvent(ctx context.Context, e event.Event) error {
+	logger := loggerFrom(ctx).With(slog.String("component", "events"), slog.String("eventId", e.ID()), slog.String("eventType", e.Type()))
+	ref, err := eventObjectReference(e)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Not processing event: %v", err))
+		return nil
+	}
+	if ref.expectsGone() {
+		logger.Info(fmt.Sprintf("Object gs://%s/%s was removed; nothing to process", ref.Bucket, safeObjectName(ref.Name)))
+		return nil
+	}
+
+	cfg := NewGCloudFunctionConfig()
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	// downloadObject reports as it goes; each line of that becomes a log entry here.
+	out := httptest.NewRecorder()
+	opts := downloadOptions{
+		Digests:      cfg.VerifyDigests,
+		Destination:  cfg.DownloadDestination,
+		PathTemplate: cfg.DownloadPathTemplate,
+		RunID:        newRunID(),
+		Generation:   ref.Generation,
+	}
+	var usage DownloadCacheUsage
+	err = retryTransient(ctx, "storage.objects.get", func() error {
+		return downloadObject(ctx, client, ref.Bucket, ref.Name, opts, nil, &usage, out)
+	})
+	logLines(logger, out.Body)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		logger.Warn(fmt.Sprintf("Object gs://%s/%s no longer exists", ref.Bucket, objectLabel(ref)))
+		return nil
+	case err != nil && retryableEventError(err):
+		logger.Error(fmt.Sprintf("Failed to process gs://%s/%s, will retry: %v", ref.Bucket, objectLabel(ref), err))
+		return err
+	case err != nil:
+		logger.Error(fmt.Sprintf("Failed to process gs://%s/%s: %v", ref.Bucket, objectLabel(ref), err))
+		return nil
+	}
+	return nil
+}
+
+// objectLabel names ref's object for logs, with its generation when the event has one.
+func objectLabel(ref *ObjectReference) string {
+	if ref.Generation == 0 {
+		return safeObjectName(ref.Name)
+	}
+	return fmt.Sprintf("%s#%d", safeObjectName(ref.Name), ref.Generation)
+}
+
+// retryableEventError reports whether redelivering an event that failed with err could
+// succeed: rate limits and 5xx that outlasted retryTransient, dropped connections and
+// timeouts. API refusals, digest mismatches and bad configuration fail the same way
+// every time.
+func retryableEventError(err error) bool {
+	var netErr net.Error
+	return isTransient(err) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// eventObjectReference finds the object an event is about: the data of a storage
+// event, or whatever parseObjectReference finds in a published message.
+func eventObjectReference(e event.Event) (*ObjectReference, error) {
+	if eventType, ok := storageEventTypes[e.Type()]; ok {
+		var data struct {
+			Bucket     string `json:"bucket"`
+			Name       string `json:"name"`
+			Generation string `json:"generation"`
+		}
+		if err := json.Unmarshal(e.Data(), &data); err != nil {
+			return nil, fmt.Errorf("storage event data is not a StorageObjectData: %v", err)
+		}
+		if data.Bucket == "" || data.Name == "" {
+			return nil, errNoEventObject
+		}
+		gen, _ := strconv.ParseInt(data.Generation, 10, 64)
+		return &ObjectReference{Bucket: data.Bucket, Name: data.Name, Generation: gen, Source: "cloudevent", EventType: eventType}, nil
+	}
+	if e.Type() == "google.cloud.pubsub.topic.v1.messagePublished" {
+		var data struct {
+			Message struct {
+				Data       []byte            `json:"data"`
+				Attributes map[string]string `json:"attributes"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(e.Data(), &data); err != nil {
+			return nil, fmt.Errorf("Pub/Sub event data is not a MessagePublishedData: %v", err)
+		}
+		ref := parseObjectReference(&pubsub.Message{Data: data.Message.Data, Attributes: data.Message.Attributes})
+		if ref == nil {
+			return nil, errNoEventObject
+		}
+		return ref, nil
+	}
+	return nil, fmt.Errorf("unsupported event type %q", e.Type())
+}
+
+func logLines(logger *slog.Logger, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			logger.Info(line)
+		}
+	}
+}
+
+// pushHandler takes Pub/Sub push deliveries, POST /push with the push subscription's
+// {"message": ..., "subscription": ...} body, and processes them with ProcessEvent.
+// Any non-2xx answer makes Pub/Sub redeliver, so only retryable failures get one.
+func pushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "push deliveries are POSTs", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEventBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read push delivery: %v", err), http.StatusBadRequest)
+		return
+	}
+	var push struct {
+		Message struct {
+			MessageID   string `json:"messageId"`
+			PublishTime string `json:"publishTime"`
+		} `json:"message"`
+		Subscription string `json:"subscription"`
+	}
+	if err := json.Unmarshal(body, &push); err != nil || push.Message.MessageID == "" {
+		// Redelivering a malformed body can't fix it, so it is acknowledged.
+		log.Printf("Ignoring push delivery without a Pub/Sub message: %.200s\n", body)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	event := CloudEvent{
+		SpecVersion: "1.0",
+		ID:          push.Message.MessageID,
+		Source:      "//pubsub.googleapis.com/" + push.Subscription,
+		Type:        "google.cloud.pubsub.topic.v1.messagePublished",
+		Time:        push.Message.PublishTime,
+		Data:        body,
+	}
+	cfg := NewGCloudFunctionConfig()
+	ctx := withLogger(r.Context(), requestLogger(r, traceProject(cfg), newRunID(), nil, false))
+	if err := ProcessEvent(ctx, event.sdkEvent()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package gcf
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+func TestProcessEvent(t *testing.T) {
+	var mu sync.Mutex
+	var generations []string
+	status := http.StatusOK
+	md5Hash := "kAFQmDzST7DWlj99KOF/cg==" // of "abc"
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		generations = append(generations, r.URL.Query().Get("generation"))
+		if status != http.StatusOK {
+			writeFakeJSON(w, status, map[string]any{"error": map[string]any{"code": status, "message": http.StatusText(status)}})
+			return
+		}
+		if r.URL.Query().Get("alt") == "media" || !strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("X-Goog-Generation", "7")
+			w.Write([]byte("abc"))
+			return
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]any{
+			"bucket": "events-bucket", "name": "in/a.csv", "size": "3", "generation": "7", "md5Hash": md5Hash,
+		})
+	})
+	setTestEnv(t, map[string]string{"VERIFY_DIGESTS": "md5"})
+
+	finalized := event.New()
+	finalized.SetID("1")
+	finalized.SetSource("//storage.googleapis.com/projects/_/buckets/events-bucket")
+	finalized.SetType("google.cloud.storage.object.v1.finalized")
+	finalized.SetData(event.ApplicationJSON, map[string]string{"bucket": "events-bucket", "name": "in/a.csv", "generation": "7"})
+
+	tests := []struct {
+		name      string
+		status    int
+		md5Hash   string
+		wantRetry bool
+	}{
+		{name: "verified", status: http.StatusOK, md5Hash: "kAFQmDzST7DWlj99KOF/cg=="},
+		{name: "digest mismatch", status: http.StatusOK, md5Hash: "AQID"},
+		{name: "forbidden", status: http.StatusForbidden},
+		{name: "gone", status: http.StatusNotFound},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantRetry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			status, md5Hash, generations = tt.status, tt.md5Hash, nil
+			mu.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err := ProcessEvent(ctx, finalized)
+			if gotRetry := err != nil; gotRetry != tt.wantRetry {
+				t.Fatalf("ProcessEvent() = %v, want an error only for a retryable failure (%v)", err, tt.wantRetry)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(generations) == 0 {
+				t.Fatal("no requests reached storage")
+			}
+			for _, gen := range generations {
+				if gen != "7" {
+					t.Errorf("read generation %q, want the event's 7", gen)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package gcf
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newFakeGCS points the storage client at handler through STORAGE_EMULATOR_HOST, with
+// service account credentials whose token endpoint is the same server, so handlers
+// under test create their clients exactly as they do when deployed.
+func newFakeGCS(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"test-token","token_type":"Bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/", handler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	creds, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test-project",
+		"private_key_id": "test",
+		"private_key":    string(pemKey),
+		"client_email":   "diag@test-project.iam.gserviceaccount.com",
+		"token_uri":      srv.URL + "/token",
+	})
+	path := filepath.Join(t.TempDir(), "creds.json")
+	if err := os.WriteFile(path, creds, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+	return srv
+}
+
+// setTestEnv sets the variables every configuration needs, and those in extra.
+func setTestEnv(t *testing.T, extra map[string]string) {
+	t.Helper()
+	env := map[string]string{
+		"BUCKET_NAME":            "diag-bucket",
+		"COMPUTE_PROJECT_ID":     "diag-project",
+		"PUBSUB_TOPIC_ID":        "diag-topic",
+		"PUBSUB_SUBSCRIPTION_ID": "diag-sub",
+		"KMS_KEY":                "projects/diag-project/locations/global/keyRings/r/cryptoKeys/k",
+	}
+	for k, v := range extra {
+		env[k] = v
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+}
+
+// setTestProfiles stands in for the profiles CONFIG_FILE would define.
+func setTestProfiles(t *testing.T, profiles map[string]map[string]string) {
+	t.Helper()
+	loadConfigFile()
+	saved := configFile.profiles
+	configFile.profiles = profiles
+	t.Cleanup(func() { configFile.profiles = saved })
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
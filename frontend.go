@@ -0,0 +1,124 @@
+package gcf
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	FrontendModeNone       = ""
+	FrontendModeIAP        = "iap"
+	FrontendModeAPIGateway = "apigateway"
+)
+
+// EndUser is the person a run is attributed to when the function sits behind IAP or API Gateway.
+type EndUser struct {
+	Email   string
+	Subject string
+	Via     string
+}
+
+type endUserKey struct{}
+
+func withEndUser(ctx context.Context, user *EndUser) context.Context {
+	return context.WithValue(ctx, endUserKey{}, user)
+}
+
+func endUserFromContext(ctx context.Context) *EndUser {
+	user, _ := ctx.Value(endUserKey{}).(*EndUser)
+	return user
+}
+
+// authenticateFrontend identifies the end user according to FRONTEND_MODE.
+// A nil user with a nil error means no frontend is configured.
+func authenticateFrontend(ctx context.Context, r *http.Request, cfg *GCloudFunctionConfig) (*EndUser, error) {
+	switch cfg.FrontendMode {
+	case FrontendModeNone:
+		return nil, nil
+	case FrontendModeIAP:
+		return iapEndUser(ctx, r, cfg.IAPAudience)
+	case FrontendModeAPIGateway:
+		return apiGatewayEndUser(r)
+	default:
+		return nil, fmt.Errorf("unknown FRONTEND_MODE %q", cfg.FrontendMode)
+	}
+}
+
+// iapEndUser validates the signed header IAP adds to every request it forwards.
+func iapEndUser(ctx context.Context, r *http.Request, audience string) (*EndUser, error) {
+	assertion := r.Header.Get("X-Goog-IAP-JWT-Assertion")
+	if assertion == "" {
+		return nil, errors.New("missing X-Goog-IAP-JWT-Assertion header")
+	}
+	if audience == "" {
+		return nil, errors.New("IAP_AUDIENCE is not configured")
+	}
+
+	payload, err := idtoken.Validate(ctx, assertion, audience)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IAP assertion: %v", err)
+	}
+	if payload.Issuer != "https://cloud.google.com/iap" {
+		return nil, fmt.Errorf("unexpected IAP assertion issuer %q", payload.Issuer)
+	}
+
+	user := &EndUser{Subject: payload.Subject, Via: FrontendModeIAP}
+	if email, ok := payload.Claims["email"].(string); ok {
+		user.Email = email
+	}
+	return user, nil
+}
+
+// apiGatewayEndUser reads the claims API Gateway forwards after it has validated the caller's JWT.
+func apiGatewayEndUser(r *http.Request) (*EndUser, error) {
+	encoded := r.Header.Get("X-Apigateway-Api-Userinfo")
+	if encoded == "" {
+		return nil, errors.New("missing X-Apigateway-Api-Userinfo header")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid X-Apigateway-Api-Userinfo header: %v", err)
+	}
+	var claims struct {
+		Email   string `json:"email"`
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, fmt.Errorf("invalid X-Apigateway-Api-Userinfo claims: %v", err)
+	}
+	return &EndUser{Email: claims.Email, Subject: claims.Subject, Via: FrontendModeAPIGateway}, nil
+}
+
+func (u *EndUser) String() string {
+	if u.Email != "" {
+		return fmt.Sprintf("%s (via %s)", u.Email, u.Via)
+	}
+	return fmt.Sprintf("%s (via %s)", u.Subject, u.Via)
+}
+
+// requireFrontendAuth rejects requests that did not come through the configured frontend
+// and logs who the run is attributed to.
+func requireFrontendAuth(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	cfg := NewGCloudFunctionConfig()
+	user, err := authenticateFrontend(r.Context(), r, cfg)
+	if err != nil {
+		log.Printf("Rejected request to %s: %v\n", r.URL.Path, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return r, false
+	}
+	if user == nil {
+		return r, true
+	}
+
+	log.Printf("Request to %s attributed to end user %s\n", r.URL.Path, user)
+	return r.WithContext(withEndUser(r.Context(), user)), true
+}
@@ -0,0 +1,118 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+type ServiceAgent struct {
+	Project string
+	Service string
+	Email   string
+	Error   string
+}
+
+type IdentityReport struct {
+	RuntimeServiceAccount string
+	Source                string
+	Error                 string
+	ServiceAgents         []ServiceAgent
+}
+
+// runtimeServiceAccount resolves the identity the function's API calls are made as.
+func runtimeServiceAccount(ctx context.Context) (email, source string, err error) {
+	if metadata.OnGCE() {
+		email, err = metadata.EmailWithContext(ctx, "default")
+		return email, "metadata server", err
+	}
+
+	// Running locally: fall back to the ADC file, which only names an account for service account keys.
+	creds, err := google.FindDefaultCredentials(ctx)
+	if err != nil {
+		return "", "application default credentials", err
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+		Type        string `json:"type"`
+	}
+	if len(creds.JSON) > 0 {
+		_ = json.Unmarshal(creds.JSON, &key)
+	}
+	if key.ClientEmail == "" {
+		return "", "application default credentials", fmt.Errorf("credentials of type %q do not name a service account", key.Type)
+	}
+	return key.ClientEmail, "application default credentials", nil
+}
+
+// discoverIdentity reports the runtime service account and, when includeAgents is set,
+// the GCS and Pub/Sub service agents of each project.
+func discoverIdentity(ctx context.Context, client *storage.Client, projects []string, includeAgents bool) IdentityReport {
+	var report IdentityReport
+	email, source, err := runtimeServiceAccount(ctx)
+	report.RuntimeServiceAccount, report.Source = email, source
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	if !includeAgents {
+		return report
+	}
+
+	seen := map[string]bool{}
+	for _, project := range projects {
+		if project == "" || seen[project] {
+			continue
+		}
+		seen[project] = true
+
+		gcsAgent, err := client.ServiceAccount(ctx, project)
+		if err != nil {
+			report.ServiceAgents = append(report.ServiceAgents, ServiceAgent{Project: project, Service: "storage", Error: err.Error()})
+			continue
+		}
+		report.ServiceAgents = append(report.ServiceAgents, ServiceAgent{Project: project, Service: "storage", Email: gcsAgent})
+
+		// The GCS agent is service-<PROJECT_NUMBER>@gs-project-accounts..., which gives us the
+		// project number needed to derive the Pub/Sub agent.
+		if number := projectNumberFromAgent(gcsAgent); number != "" {
+			report.ServiceAgents = append(report.ServiceAgents, ServiceAgent{
+				Project: project,
+				Service: "pubsub",
+				Email:   fmt.Sprintf("service-%s@gcp-sa-pubsub.iam.gserviceaccount.com", number),
+			})
+		}
+	}
+	return report
+}
+
+func projectNumberFromAgent(email string) string {
+	local, _, _ := strings.Cut(email, "@")
+	number, ok := strings.CutPrefix(local, "service-")
+	if !ok {
+		return ""
+	}
+	return number
+}
+
+func printIdentityReport(w http.ResponseWriter, report IdentityReport) {
+	fmt.Fprintln(w, "Identity:")
+	if report.Error != "" {
+		fmt.Fprintf(w, "| Runtime Service Account: unknown (%s: %s)\n", report.Source, report.Error)
+	} else {
+		fmt.Fprintf(w, "| Runtime Service Account: %s (from %s)\n", report.RuntimeServiceAccount, report.Source)
+	}
+	for _, agent := range report.ServiceAgents {
+		if agent.Error != "" {
+			fmt.Fprintf(w, "| %s service agent for %s: unknown (%s)\n", agent.Service, agent.Project, agent.Error)
+			continue
+		}
+		fmt.Fprintf(w, "| %s service agent for %s: %s\n", agent.Service, agent.Project, agent.Email)
+	}
+}
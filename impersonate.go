@@ -0,0 +1,135 @@
+package gcf
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+	storagev1 "google.golang.org/api/storage/v1"
+)
+
+const (
+	// impersonationLifetime is how long each minted token is valid, the API's default.
+	impersonationLifetime = time.Hour
+	// impersonationRefreshMargin is how long before expiry a token is replaced, so work
+	// started with it, such as a long download, doesn't outlive it.
+	impersonationRefreshMargin = 5 * time.Minute
+	// impersonationTimeout bounds one GenerateAccessToken call. Tokens are shared across
+	// requests, so the call doesn't use any one request's context.
+	impersonationTimeout = 30 * time.Second
+)
+
+// impersonatedSources shares one token source per target account, so requests reuse a
+// token until it is due for refresh rather than minting one each.
+var impersonatedSources sync.Map
+
+type impersonationKey struct{}
+
+// withImpersonation sets the account clients created with ctx impersonate, for a
+// request whose configuration differs from the environment's; "" means none.
+func withImpersonation(ctx context.Context, target string) context.Context {
+	return context.WithValue(ctx, impersonationKey{}, target)
+}
+
+// impersonationTarget is the account clients created with ctx impersonate: the one set
+// with withImpersonation or else the environment's TARGET_SERVICE_ACCOUNT.
+func impersonationTarget(ctx context.Context) string {
+	if target, ok := ctx.Value(impersonationKey{}).(string); ok {
+		return target
+	}
+	return NewGCloudFunctionConfig().TargetServiceAccount
+}
+
+// clientTokenSource is what the storage and Pub/Sub clients authenticate with: the
+// default credentials or, with TARGET_SERVICE_ACCOUNT set, tokens minted for that
+// account with the default credentials.
+func clientTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	target := impersonationTarget(ctx)
+	if target == "" {
+		return google.DefaultTokenSource(ctx, storagev1.CloudPlatformScope)
+	}
+	if ts, ok := impersonatedSources.Load(target); ok {
+		return ts.(oauth2.TokenSource), nil
+	}
+	svc, err := iamcredentials.NewService(context.Background(), option.WithScopes(storagev1.CloudPlatformScope))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IAM credentials client: %v", err)
+	}
+	src := &impersonatedTokenSource{svc: svc, target: target, scopes: []string{storagev1.CloudPlatformScope}}
+	ts, _ := impersonatedSources.LoadOrStore(target, oauth2.ReuseTokenSourceWithExpiry(nil, src, impersonationRefreshMargin))
+	return ts.(oauth2.TokenSource), nil
+}
+
+// impersonatedTokenSource mints access tokens for target with the iamcredentials
+// GenerateAccessToken method, which needs roles/iam.serviceAccountTokenCreator on it.
+type impersonatedTokenSource struct {
+	svc    *iamcredentials.Service
+	target string
+	scopes []string
+}
+
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), impersonationTimeout)
+	defer cancel()
+	name := "projects/-/serviceAccounts/" + s.target
+	resp, err := s.svc.Projects.ServiceAccounts.GenerateAccessToken(name, &iamcredentials.GenerateAccessTokenRequest{
+		Scope:    s.scopes,
+		Lifetime: fmt.Sprintf("%ds", int(impersonationLifetime.Seconds())),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", s.target, err)
+	}
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: bad expiry %q", s.target, resp.ExpireTime)
+	}
+	return &oauth2.Token{AccessToken: resp.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// impersonatedSignBytes signs as target with the iamcredentials SignBlob method, for
+// signed URLs that must carry the impersonated account's access rather than the
+// runtime service account's. Like GenerateAccessToken, it needs
+// roles/iam.serviceAccountTokenCreator on target.
+func impersonatedSignBytes(ctx context.Context, target string) func([]byte) ([]byte, error) {
+	return func(payload []byte) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, impersonationTimeout)
+		defer cancel()
+		svc, err := iamcredentials.NewService(ctx, option.WithScopes(storagev1.CloudPlatformScope))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create IAM credentials client: %v", err)
+		}
+		name := "projects/-/serviceAccounts/" + target
+		resp, err := svc.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
+			Payload: base64.StdEncoding.EncodeToString(payload),
+		}).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign as %s: %w", target, err)
+		}
+		return base64.StdEncoding.DecodeString(resp.SignedBlob)
+	}
+}
+
+// newPubSubClient creates a Pub/Sub client with the same credentials as the storage
+// client.
+func newPubSubClient(ctx context.Context, project string, opts ...option.ClientOption) (*pubsub.Client, error) {
+	ts, err := clientTokenSource(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token source: %v", err)
+	}
+	return pubsub.NewClient(ctx, project, append([]option.ClientOption{option.WithTokenSource(ts)}, opts...)...)
+}
+
+// validServiceAccountEmail is a rough check that TARGET_SERVICE_ACCOUNT is an email,
+// not a display name or a unique ID.
+func validServiceAccountEmail(email string) bool {
+	name, domain, ok := strings.Cut(email, "@")
+	return ok && name != "" && strings.HasSuffix(domain, ".gserviceaccount.com")
+}
@@ -0,0 +1,82 @@
+package gcf
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+const maxItemFailureSamples = 3
+
+type ItemFailure struct {
+	Item     string
+	Category string
+	Error    string
+}
+
+// itemResults collects per-item outcomes of a multi-object operation, so one bad
+// object is reported instead of aborting the rest.
+type itemResults struct {
+	Operation string
+	Total     int
+	Failures  []ItemFailure
+}
+
+// record counts one item and keeps its error, returning whether it succeeded.
+func (r *itemResults) record(item string, err error) bool {
+	r.Total++
+	if err == nil {
+		return true
+	}
+	r.Failures = append(r.Failures, ItemFailure{Item: item, Category: errorCategory(err), Error: err.Error()})
+	return false
+}
+
+// Err summarizes the outcome as an error for the check matrix.
+func (r *itemResults) Err() error {
+	if len(r.Failures) == 0 {
+		return nil
+	}
+	if len(r.Failures) == 1 {
+		return fmt.Errorf("%s failed for %s: %s", r.Operation, safeObjectName(r.Failures[0].Item), r.Failures[0].Error)
+	}
+	return fmt.Errorf("%s failed for %d of %d objects", r.Operation, len(r.Failures), r.Total)
+}
+
+// byCategory groups failures by error category, largest group first.
+func (r *itemResults) byCategory() ([]string, map[string][]ItemFailure) {
+	groups := map[string][]ItemFailure{}
+	for _, f := range r.Failures {
+		groups[f.Category] = append(groups[f.Category], f)
+	}
+	categories := make([]string, 0, len(groups))
+	for c := range groups {
+		categories = append(categories, c)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if len(groups[categories[i]]) != len(groups[categories[j]]) {
+			return len(groups[categories[i]]) > len(groups[categories[j]])
+		}
+		return categories[i] < categories[j]
+	})
+	return categories, groups
+}
+
+func printItemResults(w http.ResponseWriter, r *itemResults) {
+	if r.Total <= 1 && len(r.Failures) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s Summary: %d of %d objects succeeded\n", r.Operation, r.Total-len(r.Failures), r.Total)
+	categories, groups := r.byCategory()
+	for _, category := range categories {
+		failures := groups[category]
+		fmt.Fprintf(w, "| %s: %d\n", category, len(failures))
+		for i, f := range failures {
+			if i == maxItemFailureSamples {
+				fmt.Fprintf(w, "|   ... and %d more\n", len(failures)-i)
+				break
+			}
+			fmt.Fprintf(w, "|   %s: %s\n", safeObjectName(f.Item), f.Error)
+		}
+	}
+}
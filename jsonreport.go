@@ -0,0 +1,268 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const jsonContentType = "application/json"
+
+// maxJSONObjects caps the object list in a JSON report; the listing still covers every
+// object and Truncated says the list was cut short.
+const maxJSONObjects = 1000
+
+// JSONReport is the whole diagnostics run as one document, for callers that parse the
+// outcome rather than read it. Sections are nil when their check did not run.
+type JSONReport struct {
+	mu sync.Mutex
+
+	// SchemaVersion is the version of this document's schema, served at /schema/report.
+	SchemaVersion string            `json:"schemaVersion"`
+	RunID         string            `json:"runId"`
+	Status        string            `json:"status"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Bucket        *BucketSection    `json:"bucket,omitempty"`
+	Objects       *ObjectsSection   `json:"objects,omitempty"`
+	Download      *DownloadSection  `json:"download,omitempty"`
+	PubSub        *PubSubSection    `json:"pubsub,omitempty"`
+	Checks        []JSONCheck       `json:"checks"`
+	Retries       []RetryStat       `json:"retries,omitempty"`
+	// Commands are the gcloud equivalents of the run's API calls, in the commands trace.
+	Commands []string `json:"commands,omitempty"`
+	// Error is set when the run failed as a whole, e.g. on a bad parameter.
+	Error *ReportError `json:"error,omitempty"`
+	// Stop is set when a deadline or the caller cut the run short.
+	Stop *StopCause `json:"stop,omitempty"`
+	// Log is the text narrative, only at detail=verbose.
+	Log []string `json:"log,omitempty"`
+}
+
+// ReportError is an error in a form callers can branch on: Category is decodeError's
+// category, Code the HTTP or gRPC status and Reasons the API's reason codes.
+type ReportError struct {
+	Message  string   `json:"message"`
+	Category string   `json:"category,omitempty"`
+	Code     int      `json:"code,omitempty"`
+	Reasons  []string `json:"reasons,omitempty"`
+	Doc      string   `json:"doc,omitempty"`
+}
+
+type BucketSection struct {
+	Name          string       `json:"name"`
+	Location      string       `json:"location,omitempty"`
+	StorageClass  string       `json:"storageClass,omitempty"`
+	ProjectNumber uint64       `json:"projectNumber,omitempty"`
+	RequesterPays bool         `json:"requesterPays"`
+	Versioning    bool         `json:"versioning"`
+	UniformAccess bool         `json:"uniformBucketLevelAccess"`
+	Created       time.Time    `json:"created,omitempty"`
+	Error         *ReportError `json:"error,omitempty"`
+}
+
+type ObjectsSection struct {
+	Items []ObjectItem `json:"items"`
+	// Prefixes are the "directories" a delimiter listing rolled up.
+	Prefixes      []string `json:"prefixes,omitempty"`
+	Count         int64    `json:"count"`
+	Truncated     bool     `json:"truncated,omitempty"`
+	NextPageToken string   `json:"nextPageToken,omitempty"`
+	// ResumePageToken is where a listing cut short by rate limits or the time budget
+	// can pick up again; every page before it was listed.
+	ResumePageToken string       `json:"resumePageToken,omitempty"`
+	Error           *ReportError `json:"error,omitempty"`
+}
+
+type ObjectItem struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Generation  int64     `json:"generation,omitempty"`
+	Updated     time.Time `json:"updated,omitempty"`
+}
+
+type DownloadSection struct {
+	Items []DownloadItem `json:"items"`
+	Error *ReportError   `json:"error,omitempty"`
+}
+
+type DownloadItem struct {
+	Name  string       `json:"name"`
+	OK    bool         `json:"ok"`
+	Error *ReportError `json:"error,omitempty"`
+}
+
+type PubSubSection struct {
+	Publish *PublishOutcome `json:"publish,omitempty"`
+	Receive *ReceiveOutcome `json:"receive,omitempty"`
+}
+
+type PublishOutcome struct {
+	Topic     string       `json:"topic"`
+	MessageID string       `json:"messageId,omitempty"`
+	Error     *ReportError `json:"error,omitempty"`
+}
+
+type ReceiveOutcome struct {
+	Subscription string       `json:"subscription"`
+	Received     int          `json:"received"`
+	Attempts     int          `json:"attempts"`
+	Drained      bool         `json:"drained,omitempty"`
+	Error        *ReportError `json:"error,omitempty"`
+}
+
+type JSONCheck struct {
+	Name       string       `json:"name"`
+	Status     string       `json:"status"`
+	DurationMs int64        `json:"durationMs"`
+	Error      *ReportError `json:"error,omitempty"`
+	Stop       *StopCause   `json:"stop,omitempty"`
+}
+
+type jsonReportKey struct{}
+
+// wantsJSON reports whether the caller asked for a single JSON document, with
+// ?format=json or an Accept header naming application/json.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), jsonContentType)
+}
+
+// reportJSON switches the report to one JSON document written at finish. Narrative is
+// kept only as the verbose log; steps fill in their sections through record.
+func (rw *reportWriter) reportJSON() {
+	rw.jsonReport = &JSONReport{SchemaVersion: reportSchemaVersion, RunID: rw.runID}
+	rw.Header().Set("Content-Type", jsonContentType)
+}
+
+// record updates the JSON report, if there is one.
+func (rw *reportWriter) record(update func(report *JSONReport)) {
+	if rw.jsonReport == nil {
+		return
+	}
+	rw.jsonReport.mu.Lock()
+	defer rw.jsonReport.mu.Unlock()
+	update(rw.jsonReport)
+}
+
+func withJSONReport(ctx context.Context, report *JSONReport) context.Context {
+	if report == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, jsonReportKey{}, report)
+}
+
+// recordListedObject adds an object from the listing to the JSON report in ctx.
+func recordListedObject(ctx context.Context, attrs *storage.ObjectAttrs) {
+	report, ok := ctx.Value(jsonReportKey{}).(*JSONReport)
+	if !ok {
+		return
+	}
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	if report.Objects == nil {
+		report.Objects = &ObjectsSection{Items: []ObjectItem{}}
+	}
+	if attrs.Prefix != "" {
+		report.Objects.Prefixes = append(report.Objects.Prefixes, attrs.Prefix)
+		return
+	}
+	report.Objects.Count++
+	if len(report.Objects.Items) >= maxJSONObjects {
+		report.Objects.Truncated = true
+		return
+	}
+	report.Objects.Items = append(report.Objects.Items, ObjectItem{
+		Name:        attrs.Name,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		Generation:  attrs.Generation,
+		Updated:     attrs.Updated,
+	})
+}
+
+func reportError(err error) *ReportError {
+	if err == nil {
+		return nil
+	}
+	decoded := decodeError(err)
+	return &ReportError{
+		Message:  err.Error(),
+		Category: decoded.Category,
+		Code:     decoded.Code,
+		Reasons:  decoded.Reasons,
+		Doc:      decoded.Doc(),
+	}
+}
+
+func bucketSection(name string, attrs *storage.BucketAttrs, err error) *BucketSection {
+	section := &BucketSection{Name: name, Error: reportError(err)}
+	if attrs != nil {
+		section.Location = attrs.Location
+		section.StorageClass = attrs.StorageClass
+		section.ProjectNumber = attrs.ProjectNumber
+		section.RequesterPays = attrs.RequesterPays
+		section.Versioning = attrs.VersioningEnabled
+		section.UniformAccess = attrs.UniformBucketLevelAccess.Enabled
+		section.Created = attrs.Created
+	}
+	return section
+}
+
+func (report *JSONReport) pubsub() *PubSubSection {
+	if report.PubSub == nil {
+		report.PubSub = &PubSubSection{}
+	}
+	return report.PubSub
+}
+
+// writeJSON finishes the JSON report with the checks and writes it with the status
+// recorded so far.
+func (rw *reportWriter) writeJSON(status string, checks []CheckResult) {
+	out := rw.ResponseWriter
+	rw.record(func(report *JSONReport) {
+		report.Status = status
+		report.Labels = rw.labels
+		report.Stop = rw.stop
+		report.Checks = make([]JSONCheck, 0, len(checks))
+		for _, c := range checks {
+			check := JSONCheck{Name: c.Name, Status: c.Status, DurationMs: c.Duration.Milliseconds(), Stop: c.Stop}
+			if c.Error != "" {
+				check.Error = &ReportError{Message: c.Error, Category: c.Category, Doc: c.Doc}
+			}
+			report.Checks = append(report.Checks, check)
+		}
+		narrative := strings.TrimSpace(rw.body.String())
+		if rw.status >= http.StatusBadRequest {
+			// http.Error writes its message last.
+			lines := strings.Split(narrative, "\n")
+			report.Error = &ReportError{Message: lines[len(lines)-1], Code: rw.status}
+		}
+		if rw.detail == DetailVerbose && narrative != "" {
+			report.Log = strings.Split(narrative, "\n")
+		}
+		if rw.calls.commands {
+			report.Commands = commandLines(rw.calls.Calls())
+		}
+	})
+
+	data, err := json.MarshalIndent(rw.jsonReport, "", "  ")
+	if err != nil {
+		http.Error(out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// http.Error may have reset it for an early failure.
+	out.Header().Set("Content-Type", jsonContentType)
+	if rw.status != 0 {
+		out.WriteHeader(rw.status)
+	}
+	rw.rendered = append(rw.redactor.apply(data), '\n')
+	out.Write(rw.rendered)
+}
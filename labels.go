@@ -0,0 +1,80 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	runLabelsHeader = "X-Diag-Labels"
+	maxRunLabels    = 16
+)
+
+// Run labels follow the Google Cloud label rules so they can be copied onto resources as-is.
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+type runLabelsKey struct{}
+
+// parseRunLabels collects labels for a run from the X-Diag-Labels header
+// ("team=payments,env=prod") and label.KEY=VALUE query parameters, which win on conflict.
+func parseRunLabels(r *http.Request) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, header := range r.Header.Values(runLabelsHeader) {
+		for _, pair := range splitList(header) {
+			key, value, _ := strings.Cut(pair, "=")
+			labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	for key, values := range r.URL.Query() {
+		if name, ok := strings.CutPrefix(key, "label."); ok && len(values) > 0 {
+			labels[name] = values[0]
+		}
+	}
+
+	if len(labels) > maxRunLabels {
+		return nil, fmt.Errorf("at most %d labels are allowed, got %d", maxRunLabels, len(labels))
+	}
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid label key %q: use lowercase letters, digits, _ and -, starting with a letter", key)
+		}
+		if !labelValuePattern.MatchString(value) {
+			return nil, fmt.Errorf("invalid value for label %q: use lowercase letters, digits, _ and -", key)
+		}
+	}
+	return labels, nil
+}
+
+func withRunLabels(ctx context.Context, labels map[string]string) context.Context {
+	return context.WithValue(ctx, runLabelsKey{}, labels)
+}
+
+func runLabelsFromContext(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(runLabelsKey{}).(map[string]string)
+	return labels
+}
+
+// formatRunLabels renders labels as sorted key=value pairs for logs and headers.
+func formatRunLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, key := range sortedKeys(labels) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func printRunLabels(w http.ResponseWriter, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Labels:")
+	for _, key := range sortedKeys(labels) {
+		fmt.Fprintf(w, "| %s: %s\n", key, labels[key])
+	}
+}
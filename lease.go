@@ -0,0 +1,152 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultLeaseHold  = 90 * time.Second
+	maxLeaseHold      = 9 * time.Minute
+	leaseDeliveryWait = 30 * time.Second
+)
+
+type LeaseDemoResult struct {
+	DemoID             string
+	AckDeadline        time.Duration
+	Hold               time.Duration
+	MaxExtension       time.Duration
+	MaxExtensionPeriod time.Duration
+	MinExtensionPeriod time.Duration
+	Deliveries         []time.Duration
+	AckedAfter         time.Duration
+	Error              string
+}
+
+// leaseDemoHandler shows how automatic lease extension behaves: it publishes a marker
+// message, holds it for longer than the subscription's ack deadline while the client
+// extends the lease, and reports whether Pub/Sub redelivered it in the meantime, e.g.
+// POST /lease-demo?hold=90s&maxExtension=60s. Other messages pulled meanwhile are nacked.
+func leaseDemoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "the lease demo publishes a message and requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	hold := min(queryDuration(r, "hold", defaultLeaseHold), maxLeaseHold)
+	settings := pubsub.DefaultReceiveSettings
+	settings.MaxExtension = queryDuration(r, "maxExtension", cfg.PubSubMaxExtension)
+	settings.MaxExtensionPeriod = queryDuration(r, "maxExtensionPeriod", cfg.PubSubMaxExtensionPeriod)
+	settings.MinExtensionPeriod = queryDuration(r, "minExtensionPeriod", cfg.PubSubMinExtensionPeriod)
+
+	client, err := newPubSubClient(ctx, cfg.ComputeProjectId)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating Pub/Sub client: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	result := runLeaseDemo(ctx, client.Topic(cfg.PubSubTopicId), client.Subscription(cfg.PubSubSubscriptionId), hold, settings)
+	printLeaseDemo(w, result)
+}
+
+func runLeaseDemo(ctx context.Context, topic *pubsub.Topic, sub *pubsub.Subscription, hold time.Duration, settings pubsub.ReceiveSettings) LeaseDemoResult {
+	defer topic.Stop()
+	result := LeaseDemoResult{
+		DemoID:             newRunID(),
+		Hold:               hold,
+		MaxExtension:       settings.MaxExtension,
+		MaxExtensionPeriod: settings.MaxExtensionPeriod,
+		MinExtensionPeriod: settings.MinExtensionPeriod,
+	}
+
+	subCfg, err := sub.Config(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to read subscription config: %v", err)
+		return result
+	}
+	result.AckDeadline = subCfg.AckDeadline
+
+	_, err = topic.Publish(ctx, &pubsub.Message{
+		Data:       []byte("lease demo"),
+		Attributes: map[string]string{"gcf-probe": "lease", "demo-id": result.DemoID},
+	}).Get(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to publish demo message: %v", err)
+		return result
+	}
+
+	start := time.Now()
+	cctx, cancel := context.WithTimeout(ctx, hold+leaseDeliveryWait)
+	defer cancel()
+
+	var mu sync.Mutex
+	sub.ReceiveSettings = settings
+	err = sub.Receive(cctx, func(_ context.Context, msg *pubsub.Message) {
+		if msg.Attributes["demo-id"] != result.DemoID {
+			msg.Nack()
+			return
+		}
+		mu.Lock()
+		result.Deliveries = append(result.Deliveries, time.Since(start))
+		first := len(result.Deliveries) == 1
+		mu.Unlock()
+		if !first {
+			// A redelivery while the first copy is still held: the lease was lost.
+			msg.Ack()
+			return
+		}
+
+		select {
+		case <-time.After(hold):
+		case <-cctx.Done():
+		}
+		msg.Ack()
+		mu.Lock()
+		result.AckedAfter = time.Since(start)
+		mu.Unlock()
+		cancel()
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("receive failed: %v", err)
+	}
+	return result
+}
+
+func printLeaseDemo(w http.ResponseWriter, result LeaseDemoResult) {
+	fmt.Fprintf(w, "Lease Demo (%s):\n", result.DemoID)
+	fmt.Fprintf(w, "| Subscription Ack Deadline: %s\n", result.AckDeadline)
+	fmt.Fprintf(w, "| Hold: %s\n", result.Hold)
+	fmt.Fprintf(w, "| MaxExtension: %s, MaxExtensionPeriod: %s, MinExtensionPeriod: %s\n", result.MaxExtension, result.MaxExtensionPeriod, result.MinExtensionPeriod)
+	for i, d := range result.Deliveries {
+		fmt.Fprintf(w, "| Delivery %d at +%s\n", i+1, d.Round(time.Second))
+	}
+	if result.AckedAfter > 0 {
+		fmt.Fprintf(w, "| Acked at +%s\n", result.AckedAfter.Round(time.Second))
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", result.Error)
+	}
+
+	switch {
+	case len(result.Deliveries) == 0:
+		fmt.Fprintln(w, "Outcome: the demo message was not delivered within the wait; another subscriber may have taken it.")
+	case len(result.Deliveries) > 1:
+		fmt.Fprintln(w, "Outcome: REDELIVERED while held. The lease lapsed, usually because MaxExtension is shorter than the hold.")
+	case result.Hold > result.AckDeadline:
+		fmt.Fprintln(w, "Outcome: held past the ack deadline without redelivery; automatic lease extension kept the message leased.")
+	default:
+		fmt.Fprintln(w, "Outcome: held within the ack deadline; use a longer hold to see lease extension at work.")
+	}
+}
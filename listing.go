@@ -0,0 +1,217 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// ListFieldsNames fetches object names only, the cheapest listing.
+	ListFieldsNames = "names"
+	// ListFieldsDefault fetches every attribute except ACLs, as the client does by default.
+	ListFieldsDefault = "default"
+	// ListFieldsFull also fetches ACLs and owners.
+	ListFieldsFull = "full"
+)
+
+// listQuery builds the listing query for fields: one of the ListFields modes, or a
+// comma-separated list of storage.ObjectAttrs field names such as "Name,Size,Updated".
+func listQuery(fields string) (*storage.Query, error) {
+	query := &storage.Query{}
+	switch fields {
+	case "", ListFieldsDefault:
+		return query, nil
+	case ListFieldsNames:
+		return query, query.SetAttrSelection([]string{"Name"})
+	case ListFieldsFull:
+		query.Projection = storage.ProjectionFull
+		return query, nil
+	}
+
+	attrs := splitList(fields)
+	objectAttrs := reflect.TypeOf(storage.ObjectAttrs{})
+	for _, attr := range attrs {
+		if _, ok := objectAttrs.FieldByName(attr); !ok {
+			return nil, fmt.Errorf("invalid fields %q: %s is not an object attribute; use %s, %s, %s or attribute names like Name,Size,Updated",
+				fields, attr, ListFieldsNames, ListFieldsDefault, ListFieldsFull)
+		}
+	}
+	if !strings.Contains(","+strings.Join(attrs, ",")+",", ",Name,") {
+		attrs = append(attrs, "Name")
+	}
+	return query, query.SetAttrSelection(attrs)
+}
+
+// maxListResults caps ?maxResults=, so a single page still fits in the request's time.
+const maxListResults = 10000
+
+// ListOptions narrow a listing and page through it. Empty fields list everything.
+type ListOptions struct {
+	Prefix      string
+	Delimiter   string
+	StartOffset string
+	EndOffset   string
+	// MaxResults stops the listing after that many objects and prefixes and reports
+	// the token for the next page; zero lists to the end.
+	MaxResults int
+	PageToken  string
+}
+
+// requestListOptions reads ?prefix=, ?delimiter=, ?startOffset=, ?endOffset=,
+// ?maxResults= and ?pageToken=.
+func requestListOptions(r *http.Request) (ListOptions, error) {
+	q := r.URL.Query()
+	opts := ListOptions{
+		Prefix:      q.Get("prefix"),
+		Delimiter:   q.Get("delimiter"),
+		StartOffset: q.Get("startOffset"),
+		EndOffset:   q.Get("endOffset"),
+		PageToken:   q.Get("pageToken"),
+	}
+	if v := q.Get("maxResults"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListResults {
+			return opts, fmt.Errorf("maxResults must be between 1 and %d", maxListResults)
+		}
+		opts.MaxResults = n
+	}
+	if opts.StartOffset != "" && opts.EndOffset != "" && opts.StartOffset >= opts.EndOffset {
+		return opts, errors.New("startOffset must sort before endOffset")
+	}
+	return opts, nil
+}
+
+func (opts ListOptions) apply(query *storage.Query) {
+	query.Prefix = opts.Prefix
+	query.Delimiter = opts.Delimiter
+	query.StartOffset = opts.StartOffset
+	query.EndOffset = opts.EndOffset
+}
+
+// requestListFields reads ?fields=, falling back to LIST_FIELDS, and checks it is valid.
+func requestListFields(r *http.Request, fallback string) (string, error) {
+	fields := r.URL.Query().Get("fields")
+	if fields == "" {
+		fields = fallback
+	}
+	if _, err := listQuery(fields); err != nil {
+		return "", err
+	}
+	return fields, nil
+}
+
+// describeListedObject adds whichever attributes were fetched to the object's line.
+// Names-only and default listings keep the plain name.
+func describeListedObject(attrs *storage.ObjectAttrs, fields, name string) string {
+	if fields == "" || fields == ListFieldsDefault || fields == ListFieldsNames {
+		return name
+	}
+	var parts []string
+	if attrs.Size > 0 {
+		parts = append(parts, fmt.Sprintf("%d bytes", attrs.Size))
+	}
+	if !attrs.Updated.IsZero() {
+		parts = append(parts, "updated "+attrs.Updated.UTC().Format(time.RFC3339))
+	}
+	if attrs.StorageClass != "" {
+		parts = append(parts, attrs.StorageClass)
+	}
+	if len(attrs.ACL) > 0 {
+		parts = append(parts, fmt.Sprintf("%d ACL entries", len(attrs.ACL)))
+	}
+	if len(parts) == 0 {
+		return name
+	}
+	return name + " (" + strings.Join(parts, ", ") + ")"
+}
+
+// listCountCheckpoint is how many objects a count-only listing goes between checkpoints.
+const listCountCheckpoint = 10000
+
+// ObjectCount is the result of a count-only listing.
+type ObjectCount struct {
+	Objects  int64
+	Bytes    int64
+	Duration time.Duration
+	// Sample holds the first DOWNLOAD_SAMPLE names, for the checks that download.
+	Sample []string
+	// ResumePageToken is set when counting stopped on a rate limit or the time budget;
+	// the totals cover every page before it.
+	ResumePageToken string
+}
+
+// resumePageTokenHeader carries the page token a cut-short listing can resume from.
+const resumePageTokenHeader = "X-Diag-Resume-Page-Token"
+
+// resumableListError reports whether a listing that failed with err is worth resuming
+// where it stopped: it was rate limited or ran out of time, rather than refused.
+func resumableListError(ctx context.Context, err error) bool {
+	return isTransient(err) || errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil
+}
+
+// setResumePageToken hands the caller the token to continue a cut-short listing with.
+func setResumePageToken(w http.ResponseWriter, token string) {
+	if token == "" {
+		return
+	}
+	w.Header().Set(resumePageTokenHeader, token)
+	fmt.Fprintf(w, "Resume Page Token: %s (repeat the request with ?pageToken= to continue)\n", token)
+}
+
+// countBucketObjects lists with only names and sizes and keeps running totals instead
+// of printing every name. checkpoint is called every listCountCheckpoint objects.
+func countBucketObjects(ctx context.Context, client *storage.Client, cfg *GCloudFunctionConfig, checkpoint func(ObjectCount)) (ObjectCount, error) {
+	var count ObjectCount
+	start := time.Now()
+	query := &storage.Query{}
+	if err := query.SetAttrSelection([]string{"Name", "Size"}); err != nil {
+		return count, err
+	}
+	cfg.List.apply(query)
+	it := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId).Objects(ctx, query)
+	it.PageInfo().Token = cfg.List.PageToken
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			count.Duration = time.Since(start)
+			if resumableListError(ctx, err) {
+				// A failed page fetch leaves the token at that page.
+				count.ResumePageToken = it.PageInfo().Token
+			}
+			return count, err
+		}
+		if attrs.Prefix != "" {
+			continue
+		}
+		count.Objects++
+		count.Bytes += attrs.Size
+		if len(count.Sample) < cfg.DownloadSample {
+			count.Sample = append(count.Sample, attrs.Name)
+		}
+		if count.Objects%listCountCheckpoint == 0 {
+			count.Duration = time.Since(start)
+			checkpoint(count)
+		}
+	}
+	count.Duration = time.Since(start)
+	return count, nil
+}
+
+func printObjectCount(w http.ResponseWriter, bucket string, count ObjectCount) {
+	fmt.Fprintf(w, "Object Count (gs://%s):\n", bucket)
+	fmt.Fprintf(w, "| Objects: %d\n", count.Objects)
+	fmt.Fprintf(w, "| Total Size: %d bytes\n", count.Bytes)
+	fmt.Fprintf(w, "| Listed In: %s\n", count.Duration.Round(time.Millisecond))
+}
@@ -0,0 +1,309 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	maxLoadTestWorkers = 64
+	maxLoadTestOps     = 10000
+	maxLoadTestSample  = 1000
+)
+
+type LoadTestResult struct {
+	Operation    string
+	Workers      int
+	Adaptive     bool // Workers is the peak concurrency the limiter allowed
+	Operations   int
+	Succeeded    int
+	Duration     time.Duration
+	Throughput   float64
+	ErrorsByCode map[string]int
+	P50          time.Duration
+	P90          time.Duration
+	P99          time.Duration
+	Max          time.Duration
+}
+
+// loadTestHandler runs workers x ops stat or read operations against a sample of
+// the bucket's objects, e.g. /loadtest?workers=8&ops=50&op=read&sample=20. With
+// workers=auto, ops is the total and the concurrency adapts to 429s and latency.
+// baseline=compare reports deltas against a stored run; POST with baseline=save stores
+// this run as the baseline.
+func loadTestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	ctx, quota := withQuotaRecorder(ctx)
+	defer printQuotaReport(w, quota)
+
+	workers := queryInt(r, "workers", 4, maxLoadTestWorkers)
+	ops := queryInt(r, "ops", 25, maxLoadTestOps/workers)
+	sample := queryInt(r, "sample", 10, maxLoadTestSample)
+	op := r.URL.Query().Get("op")
+	if op == "" {
+		op = "stat"
+	}
+	if op != "stat" && op != "read" {
+		http.Error(w, "op must be stat or read", http.StatusBadRequest)
+		return
+	}
+	baseline := r.URL.Query().Get("baseline")
+	switch baseline {
+	case "", BaselineCompare:
+	case BaselineSave:
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "saving a baseline writes to the snapshot bucket and requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+	default:
+		http.Error(w, "baseline must be save or compare", http.StatusBadRequest)
+		return
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating storage client: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId)
+	names, err := sampleObjectNames(ctx, bucket, sample)
+	if err != nil {
+		handleError(ctx, w, err)
+		fmt.Fprintf(w, "Error sampling objects: %v\n", err)
+		return
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(w, "No objects found in the bucket.")
+		return
+	}
+
+	var result LoadTestResult
+	if wantsAdaptive(r, "workers") {
+		total := queryInt(r, "ops", 200, maxLoadTestOps)
+		limiter := newAdaptiveLimiter(4, maxLoadTestWorkers)
+		result = runAdaptiveLoadTest(ctx, bucket, names, op, total, limiter)
+		printLoadTestResult(w, result)
+		printConcurrencyStats(w, limiter.Stats())
+	} else {
+		result = runLoadTest(ctx, bucket, names, op, workers, ops)
+		printLoadTestResult(w, result)
+	}
+
+	if baseline != "" {
+		obj := client.Bucket(cfg.SnapshotBucket).UserProject(cfg.ComputeProjectId).Object(baselineObjectName(cfg, op, r.URL.Query().Get("baselineName")))
+		runBaseline(ctx, w, r, cfg, obj, baseline, newBenchmarkBaseline(cfg.BucketName, result))
+	}
+}
+
+func sampleObjectNames(ctx context.Context, bucket *storage.BucketHandle, limit int) ([]string, error) {
+	query := &storage.Query{}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	it := bucket.Objects(ctx, query)
+	for len(names) < limit {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+	return names, nil
+}
+
+func runLoadTest(ctx context.Context, bucket *storage.BucketHandle, names []string, op string, workers, ops int) LoadTestResult {
+	result := LoadTestResult{
+		Operation:    op,
+		Workers:      workers,
+		Operations:   workers * ops,
+		ErrorsByCode: map[string]int{},
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		latencies = make([]time.Duration, 0, result.Operations)
+	)
+
+	start := time.Now()
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				name := names[(worker*ops+i)%len(names)]
+				opStart := time.Now()
+				err := loadTestOperation(ctx, bucket.Object(name), op)
+				elapsed := time.Since(opStart)
+
+				mu.Lock()
+				if err != nil {
+					result.ErrorsByCode[errorCode(err)]++
+				} else {
+					result.Succeeded++
+					latencies = append(latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	finishLoadTest(&result, latencies, time.Since(start))
+	return result
+}
+
+// runAdaptiveLoadTest runs total operations with as many in flight as limiter allows.
+func runAdaptiveLoadTest(ctx context.Context, bucket *storage.BucketHandle, names []string, op string, total int, limiter *adaptiveLimiter) LoadTestResult {
+	result := LoadTestResult{
+		Operation:    op,
+		Operations:   total,
+		ErrorsByCode: map[string]int{},
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		next      int
+		latencies = make([]time.Duration, 0, total)
+	)
+
+	start := time.Now()
+	for worker := 0; worker < maxLoadTestWorkers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				i := next
+				next++
+				mu.Unlock()
+				if i >= total {
+					return
+				}
+				if err := limiter.acquire(ctx); err != nil {
+					return
+				}
+
+				opStart := time.Now()
+				err := loadTestOperation(ctx, bucket.Object(names[i%len(names)]), op)
+				elapsed := time.Since(opStart)
+				limiter.release(elapsed, err != nil && decodeError(err).Category == "rateLimited")
+
+				mu.Lock()
+				if err != nil {
+					result.ErrorsByCode[errorCode(err)]++
+				} else {
+					result.Succeeded++
+					latencies = append(latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	result.Workers = limiter.Stats().Peak
+	result.Adaptive = true
+	finishLoadTest(&result, latencies, time.Since(start))
+	return result
+}
+
+func finishLoadTest(result *LoadTestResult, latencies []time.Duration, duration time.Duration) {
+	result.Duration = duration
+	if secs := result.Duration.Seconds(); secs > 0 {
+		result.Throughput = float64(result.Succeeded) / secs
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.P50 = percentile(latencies, 0.50)
+	result.P90 = percentile(latencies, 0.90)
+	result.P99 = percentile(latencies, 0.99)
+	if len(latencies) > 0 {
+		result.Max = latencies[len(latencies)-1]
+	}
+}
+
+func loadTestOperation(ctx context.Context, obj *storage.ObjectHandle, op string) error {
+	if op == "stat" {
+		_, err := obj.Attrs(ctx)
+		return err
+	}
+
+	rc, err := obj.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+// errorCode buckets an error by HTTP status for googleapi errors, or by a coarse kind otherwise.
+func errorCode(err error) string {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return strconv.Itoa(gErr.Code)
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return "timeout"
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return "404"
+	}
+	return "other"
+}
+
+// percentile expects sorted input.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx]
+}
+
+func printLoadTestResult(w http.ResponseWriter, result LoadTestResult) {
+	if result.Adaptive {
+		fmt.Fprintf(w, "Load Test (%s): %d ops, up to %d at once\n", result.Operation, result.Operations, result.Workers)
+	} else {
+		fmt.Fprintf(w, "Load Test (%s): %d workers x %d ops\n", result.Operation, result.Workers, result.Operations/result.Workers)
+	}
+	fmt.Fprintf(w, "| Succeeded: %d/%d in %s\n", result.Succeeded, result.Operations, result.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "| Throughput: %.1f ops/s\n", result.Throughput)
+	fmt.Fprintf(w, "| Latency: p50=%s p90=%s p99=%s max=%s\n",
+		result.P50.Round(time.Millisecond), result.P90.Round(time.Millisecond),
+		result.P99.Round(time.Millisecond), result.Max.Round(time.Millisecond))
+
+	codes := make([]string, 0, len(result.ErrorsByCode))
+	for code := range result.ErrorsByCode {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "| Errors (%s): %d\n", code, result.ErrorsByCode[code])
+	}
+}
@@ -0,0 +1,134 @@
+package gcf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// How a download handles a local file that already exists.
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+	ConflictSuffix    = "suffix"
+)
+
+const (
+	// maxPathSegment keeps every file and directory name under the 255-byte limit of
+	// common filesystems, leaving room for a conflict suffix.
+	maxPathSegment = 200
+	// maxPortablePath keeps the relative path short enough that scratch directory plus
+	// file stays under Windows' 260-character MAX_PATH.
+	maxPortablePath = 180
+	// maxConflictSuffix bounds how many numbered names a suffix conflict tries.
+	maxConflictSuffix = 1000
+)
+
+// windowsReserved are device names Windows refuses as file names, with or without an
+// extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// portablePath turns a rendered download name into a relative path that is valid on
+// Linux, macOS and Windows alike. Both / and \ separate directories; each segment has
+// characters Windows rejects replaced, reserved device names and dot segments renamed,
+// and is shortened with a hash when too long. flat keeps only the last segment.
+func portablePath(name string, flat bool) string {
+	segments := strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+	if flat && len(segments) > 1 {
+		segments = segments[len(segments)-1:]
+	}
+	for i, segment := range segments {
+		segments[i] = portableSegment(segment)
+	}
+	if len(segments) == 0 {
+		return "object-" + nameHash(name)
+	}
+	path := strings.Join(segments, string(filepath.Separator))
+	if len(path) > maxPortablePath {
+		// Too deep to keep the directories; the hash keeps distinct names apart.
+		last := segments[len(segments)-1]
+		path = shortenSegment(nameHash(name)+"-"+last, maxPortablePath)
+	}
+	return path
+}
+
+func portableSegment(segment string) string {
+	var b strings.Builder
+	for _, r := range segment {
+		switch {
+		case r < 0x20, strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	s := strings.TrimRight(b.String(), ". ")
+	switch {
+	case s == "":
+		s = "_"
+	case windowsReserved[strings.ToUpper(strings.SplitN(s, ".", 2)[0])]:
+		s = "_" + s
+	}
+	return shortenSegment(s, maxPathSegment)
+}
+
+// shortenSegment cuts s to max bytes on a rune boundary, keeping the extension and
+// adding a hash of the original so shortened names stay distinct.
+func shortenSegment(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	ext := filepath.Ext(s)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	tail := "~" + nameHash(s) + ext
+	cut := max - len(tail)
+	for cut > 0 && !isRuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + tail
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func nameHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:4])
+}
+
+// resolvePathConflict applies DOWNLOAD_CONFLICT to a local path. It returns the path
+// to write and whether the download should be skipped because the file exists.
+func resolvePathConflict(path, strategy string) (string, bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, false, nil
+	}
+	switch strategy {
+	case ConflictSkip:
+		return path, true, nil
+	case ConflictSuffix:
+		ext := filepath.Ext(path)
+		base := strings.TrimSuffix(path, ext)
+		for i := 1; i <= maxConflictSuffix; i++ {
+			candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+			if _, err := os.Stat(candidate); os.IsNotExist(err) {
+				return candidate, false, nil
+			}
+		}
+		return "", false, fmt.Errorf("no free name for %s after %d suffixes", path, maxConflictSuffix)
+	case "", ConflictOverwrite:
+		return path, false, nil
+	}
+	log.Printf("Unknown download conflict strategy %q, overwriting\n", strategy)
+	return path, false, nil
+}
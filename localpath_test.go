@@ -0,0 +1,48 @@
+package gcf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPortablePath(t *testing.T) {
+	tests := []struct {
+		name string
+		flat bool
+		want string
+	}{
+		{name: "logs/2026/a.txt", want: filepath.Join("logs", "2026", "a.txt")},
+		{name: "logs/2026/a.txt", flat: true, want: "a.txt"},
+		{name: `dir\con.txt`, want: filepath.Join("dir", "_con.txt")},
+		{name: "a:b?.txt.", want: "a_b_.txt"},
+		{name: "../../etc/passwd", want: filepath.Join("_", "_", "etc", "passwd")},
+	}
+	for _, tt := range tests {
+		if got := portablePath(tt.name, tt.flat); got != tt.want {
+			t.Errorf("portablePath(%q, %v) = %q, want %q", tt.name, tt.flat, got, tt.want)
+		}
+	}
+}
+
+func TestScratchPathConflicts(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("first"), 0o600)
+
+	tests := []struct {
+		conflict string
+		want     string
+		wantSkip bool
+	}{
+		{conflict: ConflictOverwrite, want: "a.txt"},
+		{conflict: ConflictSkip, want: "a.txt", wantSkip: true},
+		{conflict: ConflictSuffix, want: "a-1.txt"},
+	}
+	for _, tt := range tests {
+		opts := downloadOptions{LocalDir: dir, Flat: true, Conflict: tt.conflict}
+		path, skip, err := scratchPath(opts, "diag-bucket", "other/dir/a.txt")
+		if err != nil || path != filepath.Join(dir, tt.want) || skip != tt.wantSkip {
+			t.Errorf("%s: scratchPath() = %q, %v, %v; want %s, %v", tt.conflict, path, skip, err, tt.want, tt.wantSkip)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package gcf
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Cloud Logging reads these fields from structured log lines written to stderr.
+const (
+	logTraceKey  = "logging.googleapis.com/trace"
+	logSpanKey   = "logging.googleapis.com/spanId"
+	logLabelsKey = "logging.googleapis.com/labels"
+)
+
+// logLevel is the minimum level logged outside verbose runs, from LOG_LEVEL. Setting up
+// logging as a variable rather than in init means it is ready before any init logs.
+var logLevel = setupLogging()
+
+func setupLogging() *slog.LevelVar {
+	level := new(slog.LevelVar)
+	level.Set(parseLogLevel(os.Getenv("LOG_LEVEL")))
+	// The standard logger goes through the default handler too, so log.Printf lines
+	// are structured and still reach support bundles.
+	slog.SetDefault(slog.New(&levelHandler{
+		min:     level,
+		Handler: newCloudLogHandler(io.MultiWriter(os.Stderr, recentLogs), os.Getenv("LOG_FORMAT")),
+	}))
+	return level
+}
+
+func parseLogLevel(s string) slog.Level {
+	switch strings.ToUpper(s) {
+	case "DEBUG":
+		return slog.LevelDebug
+	case "WARN", "WARNING":
+		return slog.LevelWarn
+	case "ERROR":
+		return slog.LevelError
+	}
+	if os.Getenv("DEBUG") == "true" {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// newCloudLogHandler writes one JSON object per line with the field names Cloud Logging
+// expects: severity and message instead of level and msg. LOG_FORMAT=text gives plain
+// key=value lines for running locally. Levels are left to levelHandler.
+func newCloudLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				return slog.String("severity", severity(a.Value.Any().(slog.Level)))
+			case slog.MessageKey:
+				// log.Printf lines keep the newline they were written with.
+				return slog.String("message", strings.TrimSuffix(a.Value.String(), "\n"))
+			}
+			return a
+		},
+	}
+	if format == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+func severity(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+// levelHandler drops records below min, so one request can log at debug while the
+// rest stay at LOG_LEVEL.
+type levelHandler struct {
+	min slog.Leveler
+	slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.min.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{min: h.min, Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{min: h.min, Handler: h.Handler.WithGroup(name)}
+}
+
+type loggerKey struct{}
+
+// withLogger makes handlers log through logger; tests use it to capture a request's logs.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger set with withLogger, or the default one.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// requestLogger is the logger for one run: the injected or default logger, at debug
+// level for verbose runs, tagged with the request's trace so its lines group under the
+// request in Logs Explorer, and with the run's ID and labels.
+func requestLogger(r *http.Request, project, runID string, labels map[string]string, verbose bool) *slog.Logger {
+	logger := loggerFrom(r.Context())
+	if verbose {
+		logger = slog.New(&levelHandler{min: slog.LevelDebug, Handler: unwrapLevel(logger.Handler())})
+	}
+	if trace, span := requestTrace(r); trace != "" && project != "" {
+		logger = logger.With(slog.String(logTraceKey, "projects/"+project+"/traces/"+trace))
+		if span != "" {
+			logger = logger.With(slog.String(logSpanKey, span))
+		}
+	}
+	runLabels := map[string]string{"runId": runID}
+	for k, v := range labels {
+		runLabels[k] = v
+	}
+	return logger.With(slog.Any(logLabelsKey, runLabels))
+}
+
+// unwrapLevel returns the handler under a levelHandler, so a verbose run isn't held
+// back by LOG_LEVEL.
+func unwrapLevel(h slog.Handler) slog.Handler {
+	if lh, ok := h.(*levelHandler); ok {
+		return lh.Handler
+	}
+	return h
+}
+
+// requestTrace reads the trace and span IDs from X-Cloud-Trace-Context
+// ("TRACE/SPAN;o=1") or, failing that, W3C traceparent ("00-TRACE-SPAN-01").
+func requestTrace(r *http.Request) (trace, span string) {
+	if v := r.Header.Get("X-Cloud-Trace-Context"); v != "" {
+		trace, rest, _ := strings.Cut(v, "/")
+		span, _, _ = strings.Cut(rest, ";")
+		return trace, span
+	}
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 {
+		return parts[1], parts[2]
+	}
+	return "", ""
+}
+
+// traceProject is the project traces belong to: the one the function runs in.
+func traceProject(cfg *GCloudFunctionConfig) string {
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return project
+	}
+	return cfg.ComputeProjectId
+}
+
+// loggerFor returns the run's logger for w, or the default one for plain writers.
+func loggerFor(w http.ResponseWriter) *slog.Logger {
+	switch rw := w.(type) {
+	case *reportWriter:
+		if rw.logger != nil {
+			return rw.logger
+		}
+	case *stepWriter:
+		if rw.logger != nil {
+			return rw.logger
+		}
+	}
+	return slog.Default()
+}
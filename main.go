@@ -1,120 +1,643 @@
 package gcf
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
 
 	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
-	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
-	storagev1 "google.golang.org/api/storage/v1"
 )
 
 func DoIt(w http.ResponseWriter, r *http.Request) {
+	// Authenticate first: the configuration errors configBlocked answers with are only
+	// for callers the frontend lets in.
+	r, ok := requireFrontendAuth(w, r)
+	if !ok {
+		return
+	}
+	if configBlocked(w, r) {
+		return
+	}
+	w, finish := compressResponse(w, r, NewGCloudFunctionConfig())
+	defer finish()
+
+	if strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+		pprofHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/schema" || strings.HasPrefix(r.URL.Path, "/schema/") {
+		schemaHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/ui" || strings.HasPrefix(r.URL.Path, "/ui/") {
+		uiHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/runs" || strings.HasPrefix(r.URL.Path, "/runs/") {
+		runsHandler(w, r)
+		return
+	}
+
+	if route, ok := matchCapabilityRoute(r.URL.Path); ok {
+		capabilityHandler(w, r, route)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/support-bundle":
+		supportBundle(w, r)
+		return
+	case "/version":
+		versionHandler(w, r)
+		return
+	case "/loadtest":
+		loadTestHandler(w, r)
+		return
+	case "/stream":
+		streamObjectHandler(w, r)
+		return
+	case "/watch":
+		watchHandler(w, r)
+		return
+	case "/propagation":
+		propagationHandler(w, r)
+		return
+	case "/batch":
+		batchHandler(w, r)
+		return
+	case "/probe":
+		uptimeProbeHandler(w, r)
+		return
+	case "/changes":
+		changesHandler(w, r)
+		return
+	case "/transfer":
+		transferHandler(w, r)
+		return
+	case "/dataflow":
+		dataflowHandler(w, r)
+		return
+	case "/job":
+		runJobHandler(w, r)
+		return
+	case "/events":
+		recentEventsHandler(w, r)
+		return
+	case "/watch-objects":
+		objectWatchHandler(w, r)
+		return
+	case "/pubsub-limits":
+		pubsubLimitsHandler(w, r)
+		return
+	case "/lease-demo":
+		leaseDemoHandler(w, r)
+		return
+	case "/deployment-schema":
+		deploymentSchemaHandler(w, r)
+		return
+	case "/notifications":
+		notificationsHandler(w, r)
+		return
+	case "/soak":
+		soakHandler(w, r)
+		return
+	case "/upload":
+		uploadHandler(w, r)
+		return
+	case "/cleanup":
+		cleanupHandler(w, r)
+		return
+	case "/recheck":
+		recheckHandler(w, r)
+		return
+	case "/signed-url":
+		signedURLHandler(w, r)
+		return
+	case "/routing":
+		routingHandler(w, r)
+		return
+	case "/config":
+		configHandler(w, r)
+		return
+	case "/operation":
+		operationHandler(w, r)
+		return
+	case "/publish":
+		publishHandler(w, r)
+		return
+	case "/pull":
+		pullHandler(w, r)
+		return
+	case "/drift":
+		driftHandler(w, r)
+		return
+	case "/push":
+		pushHandler(w, r)
+		return
+	case "/buckets":
+		bucketsHandler(w, r)
+		return
+	case "/object-attrs":
+		objectHandler(w, r)
+		return
+	}
+
+	if isCloudEvent(r) {
+		eventHandler(w, r)
+		return
+	}
+	if isRunConfig(r) {
+		runConfigHandler(w, r)
+		return
+	}
+
+	cachedDiagnostics(w, r)
+}
+
+// runDiagnosticsWithConfig runs the full suite against cfg. Callers that need the
+// check results afterwards can pass their own *reportWriter.
+func runDiagnosticsWithConfig(w http.ResponseWriter, r *http.Request, cfg *GCloudFunctionConfig) {
+	runDiagnosticsRoute(w, r, cfg, nil)
+}
+
+// runDiagnosticsRoute runs the suite, or only route's part of it when route is set.
+func runDiagnosticsRoute(w http.ResponseWriter, r *http.Request, cfg *GCloudFunctionConfig, route *capabilityRoute) {
 	w.Header().Set("Content-Type", "text/plain")
-	ctx := r.Context()
+	rw, ok := w.(*reportWriter)
+	if !ok {
+		rw = newReportWriter(w, requestDetail(r))
+		if wantsNDJSON(r) {
+			rw.streamLines()
+		} else if wantsJSON(r) {
+			rw.reportJSON()
+		}
+	}
+	if cfg.PersistReports {
+		// Deferred first so it runs last, once finish has written the report.
+		defer persistRun(r, cfg, rw)
+	}
+	defer rw.finish()
+	w = rw
 
-	printEnv(w)
+	ctx, cancelRun := withClientDisconnect(r.Context())
+	defer cancelRun()
+	ctx = withLang(ctx, requestLang(r))
+	ctx = withImpersonation(ctx, cfg.TargetServiceAccount)
+	rw.calls.commands = traceCommands(r, cfg)
+	ctx = withAPICallRecorder(ctx, rw.calls)
+	ctx = withJSONReport(ctx, rw.jsonReport)
+	ctx, quota := withQuotaRecorder(ctx)
+	defer printQuotaReport(w, quota)
+	ctx, retries := withRetryPolicy(ctx, retryPolicyFromConfig(cfg))
+	defer func() {
+		stats := retries.Stats()
+		printRetryReport(w, stats)
+		rw.record(func(report *JSONReport) { report.Retries = stats })
+	}()
+	if cfg.DemoMode || r.URL.Query().Get("demo") == "true" {
+		rw.redactor = newRedactor(cfg)
+		ctx = withRedactor(ctx, rw.redactor)
+	}
+	if cfg.AccessContactsProject != "" {
+		ctx = withAccessContacts(ctx, cfg.AccessContactsProject)
+	}
+	monitor := startResourceMonitor()
+	defer func() { printResourceUsage(w, monitor.stop()) }()
+	if profiler := startRunProfiler(cfg); profiler != nil {
+		defer func() { printProfileUploads(w, cfg.CloudProfilerService, profiler.stop(r.Context())) }()
+	}
 
-	cfg := NewGCloudFunctionConfig()
+	labels, err := parseRunLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.labels = labels
+	ctx = withRunLabels(ctx, labels)
+	rw.logger = requestLogger(r, traceProject(cfg), rw.runID, labels, rw.detail == DetailVerbose).With(slog.String("component", "diagnostics"))
+	ctx = withLogger(ctx, rw.logger)
+
+	cfg.ListFields, err = requestListFields(r, cfg.ListFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.ListCountOnly = cfg.ListCountOnly || r.URL.Query().Get("countOnly") == "true"
+	if cfg.List, err = requestListOptions(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var checks []checkDef
+	if route != nil {
+		checks = route.checks
+	} else if checks, err = selectChecks(r, cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.planned = len(checks)
+
+	timeout, source, err := requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel, rw.budget = withTimeBudget(ctx, timeout, source)
+		defer cancel()
+	}
+
+	policy, err := requestCleanupPolicy(r, cfg.CleanupPolicy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	artifacts := newCleanupManager(rw.runID, policy)
+	ctx = withCleanup(ctx, artifacts)
+	defer func() {
+		printCleanup(w, policy, artifacts.finish(ctx, len(failedCheckNames(rw.Checks())) > 0))
+	}()
+
+	if cfg.ProgressTopic != "" {
+		// Progress outlives the run's deadline so the final event is still sent.
+		progress, err := newProgressPublisher(context.WithoutCancel(ctx), cfg.ComputeProjectId, cfg.ProgressTopic, rw.runID, labels, len(checks))
+		if err != nil {
+			log.Printf("Failed to set up progress events: %v\n", err)
+		}
+		rw.progress = progress
+	}
+
+	fmt.Fprintf(w, "Build: %s\n", currentBuildInfo())
+	fmt.Fprintf(w, "Run: %s\n", rw.runID)
+	printRunLabels(w, labels)
+	printCallerContext(w, describeCaller(r))
+
+	printEnv(w)
 
 	debugLog(w, "Configuration loaded: Bucket=%s, ComputeProjectId=%s\n", cfg.BucketName, cfg.ComputeProjectId)
 
-	// GCS Client Operations
-	gcsClient, err := createStorageClientWithOAuth(ctx)
+	printEndpointProbes(w, probeEndpoints(ctx, cfg.ProbeEndpoints))
+	printEgressReport(w, inspectEgress(ctx, cfg.EgressEchoURL))
+
+	run := &diagRun{ctx: ctx, cfg: cfg, rw: rw, diagState: &diagState{}}
+	defer run.close()
+	if route != nil && route.prepare != nil {
+		route.prepare(run, r)
+	}
+	runSteps(rw, bindSteps(run, checks))
+	rw.stop = runStop(ctx, rw.Checks())
+}
+
+func (run *diagRun) stepServiceUsage(w http.ResponseWriter) error {
+	report := checkServiceUsage(run.ctx, run.cfg)
+	run.rw.check("service_usage", report.Err())
+	printServiceUsage(w, report)
+	return report.Err()
+}
+
+func (run *diagRun) stepBilling(w http.ResponseWriter) error {
+	check := checkBilling(run.ctx, run.cfg.ComputeProjectId)
+	run.rw.check("billing", check.Err())
+	printBillingCheck(w, check)
+	return check.Err()
+}
+
+func (run *diagRun) stepBucketCreate(w http.ResponseWriter) error {
+	probe := probeBucketCreate(run.ctx, run.gcsClient, run.cfg.ComputeProjectId, run.cfg.BucketCreateProbeName)
+	run.rw.check("bucket_create", probe.Err())
+	printBucketCreateProbe(w, probe)
+	return probe.Err()
+}
+
+func (run *diagRun) stepDualWrite(w http.ResponseWriter) error {
+	object := run.cfg.ArtifactPrefix + cleanupFrom(run.ctx).runID + "/dual-write-probe"
+	check := checkDualWrite(run.ctx, run.gcsClient, []string{run.cfg.BucketName, run.cfg.DualWriteBucket}, run.cfg.ComputeProjectId, object)
+	run.rw.check("dual_write", check.Err())
+	printDualWriteCheck(w, check)
+	return check.Err()
+}
+
+func (run *diagRun) stepPreconditionRace(w http.ResponseWriter) error {
+	object := run.cfg.ArtifactPrefix + cleanupFrom(run.ctx).runID + "/precondition-race"
+	race := checkPreconditionRace(run.ctx, run.gcsClient, run.cfg.BucketName, run.cfg.ComputeProjectId, object)
+	run.rw.check("precondition_race", race.Err())
+	printPreconditionRace(w, race)
+	return race.Err()
+}
+
+func (run *diagRun) stepClockSkew(w http.ResponseWriter) error {
+	check := checkClockSkew(run.ctx, run.cfg.ClockSkewThreshold)
+	run.rw.check("clock_skew", check.Err())
+	printClockCheck(w, check)
+	return check.Err()
+}
+
+func (run *diagRun) stepStorageClient(w http.ResponseWriter) error {
+	var err error
+	// The client and its token source outlive this check's context.
+	run.gcsClient, err = createStorageClientWithOAuth(context.WithoutCancel(run.ctx))
+	run.rw.check("storage_client", err)
 	if err != nil {
 		fmt.Fprintf(w, "Error creating storage client: %v\n", err)
-		return
+		return err
 	}
-	defer gcsClient.Close()
 	debugLog(w, "Storage client created successfully.\n")
+	if run.cfg.TargetServiceAccount != "" {
+		fmt.Fprintf(w, "Impersonating: %s\n", run.cfg.TargetServiceAccount)
+	}
+
+	printIdentityReport(w, discoverIdentity(run.ctx, run.gcsClient, []string{run.cfg.ComputeProjectId}, run.cfg.DiscoverServiceAgents))
+	return nil
+}
 
-	if err := checkBucketAccess(ctx, gcsClient, cfg.BucketName, cfg.ComputeProjectId, w); err != nil {
+func (run *diagRun) stepBucketAccess(w http.ResponseWriter) error {
+	bucketAttrs, err := checkBucketAccess(run.ctx, run.gcsClient, run.cfg.BucketName, run.cfg.ComputeProjectId, w)
+	run.rw.check("bucket_access", err)
+	run.rw.record(func(report *JSONReport) {
+		report.Bucket = bucketSection(run.cfg.BucketName, bucketAttrs, err)
+	})
+	if err != nil {
 		fmt.Fprintf(w, "Error checking bucket access: %v\n", err)
-		return
+		return err
 	}
 
-	firstObjectName, err := ListBucketObjects(w, ctx, gcsClient, cfg)
+	projects := resolveProjects(run.ctx, run.cfg.ComputeProjectId, bucketAttrs.ProjectNumber)
+	printProjects(w, projects)
+	printBucketOwnership(w, describeBucketOwnership(bucketAttrs, run.cfg.ComputeProjectId, projects))
+	return nil
+}
+
+func (run *diagRun) stepListObjects(w http.ResponseWriter) error {
+	if run.cfg.ListCountOnly {
+		return run.countObjects(w)
+	}
+	var err error
+	var nextPageToken string
+	run.sampleNames, nextPageToken, err = ListBucketObjects(w, run.ctx, run.gcsClient, run.cfg)
+	run.rw.check("list_objects", err)
+	run.rw.record(func(report *JSONReport) {
+		if report.Objects == nil {
+			report.Objects = &ObjectsSection{Items: []ObjectItem{}}
+		}
+		if err != nil {
+			report.Objects.ResumePageToken = nextPageToken
+		} else {
+			report.Objects.NextPageToken = nextPageToken
+		}
+		report.Objects.Error = reportError(err)
+	})
 	if err != nil {
 		fmt.Fprintf(w, "Error listing bucket objects: %v\n", err)
-		return
+		setResumePageToken(w, nextPageToken)
 	}
+	return err
+}
 
-	debugLog(w, "Preparing to download first object: %s\n", firstObjectName)
-	if err := downloadObject(ctx, gcsClient, cfg.BucketName, firstObjectName, w); err != nil {
-		fmt.Fprintf(w, "Error downloading object: %v\n", err)
-		return
+// countObjects is list_objects for ?countOnly=true: totals instead of every name, with
+// checkpoints in the logs and NDJSON stream so very large buckets show progress.
+func (run *diagRun) countObjects(w http.ResponseWriter) error {
+	count, err := countBucketObjects(run.ctx, run.gcsClient, run.cfg, func(c ObjectCount) {
+		message := fmt.Sprintf("list_objects: %d objects, %d bytes after %s", c.Objects, c.Bytes, c.Duration.Round(time.Millisecond))
+		log.Printf("Run %s %s\n", run.rw.runID, message)
+		run.rw.emitLine(ReportLine{Type: "checkpoint", Message: message})
+	})
+	if err == nil && count.Objects == 0 {
+		err = errors.New("No objects found in the bucket.")
+	}
+	run.rw.check("list_objects", err)
+	run.rw.record(func(report *JSONReport) {
+		report.Objects = &ObjectsSection{Items: []ObjectItem{}, Count: count.Objects, Truncated: true, ResumePageToken: count.ResumePageToken, Error: reportError(err)}
+	})
+	printObjectCount(w, run.cfg.BucketName, count)
+	if err != nil {
+		fmt.Fprintf(w, "Error counting bucket objects: %v\n", err)
+		setResumePageToken(w, count.ResumePageToken)
+		return err
+	}
+	run.sampleNames = count.Sample
+	return nil
+}
+
+// stepDownload downloads the listed sample. A failing object is recorded and the rest of
+// the sample is still downloaded; dependents only need one object to have succeeded.
+func (run *diagRun) stepDownload(w http.ResponseWriter) error {
+	downloads := &itemResults{Operation: "Download"}
+	cache := sharedDownloadCache(run.cfg.DownloadCacheBytes)
+	var usage DownloadCacheUsage
+	section := &DownloadSection{Items: []DownloadItem{}}
+	defer run.rw.record(func(report *JSONReport) { report.Download = section })
+	if len(run.sampleNames) == 0 {
+		run.rw.skip("download", "the listed page holds only prefixes")
+		return errors.New("no object was listed to download")
+	}
+	var localDir string
+	if run.cfg.DownloadDir != "" {
+		dir, err := newScratchDir(run.cfg.DownloadDir, run.rw.runID)
+		if err != nil {
+			return err
+		}
+		localDir = dir
+	}
+	for _, name := range run.sampleNames {
+		debugLog(w, "Preparing to download object: %s\n", safeObjectName(name))
+		opts := downloadOptions{
+			Digests:      run.cfg.VerifyDigests,
+			Range:        run.cfg.DownloadRange,
+			Destination:  run.cfg.DownloadDestination,
+			PathTemplate: run.cfg.DownloadPathTemplate,
+			RunID:        run.rw.runID,
+			LocalDir:     localDir,
+			Flat:         run.cfg.DownloadFlat,
+			Conflict:     run.cfg.DownloadConflict,
+		}
+		err := retryTransient(run.ctx, "storage.objects.get", func() error {
+			return downloadObject(run.ctx, run.gcsClient, run.cfg.BucketName, name, opts, cache, &usage, w)
+		})
+		section.Items = append(section.Items, DownloadItem{Name: name, OK: err == nil, Error: reportError(err)})
+		if !downloads.record(name, err) {
+			fmt.Fprintf(w, "Error downloading object: %v\n", err)
+			continue
+		}
+		debugLog(w, "Successfully downloaded object: %s\n", safeObjectName(name))
+		if run.firstObjectName == "" {
+			run.firstObjectName = name
+		}
+	}
+	run.rw.check("download", downloads.Err())
+	section.Error = reportError(downloads.Err())
+	printItemResults(w, downloads)
+	printDownloadCache(w, cache, usage)
+	if run.firstObjectName == "" {
+		return errors.New("no object could be downloaded")
 	}
-	debugLog(w, "Successfully downloaded object: %s\n", firstObjectName)
+	return nil
+}
+
+func (run *diagRun) stepSignedURL(w http.ResponseWriter) error {
+	bucket := run.gcsClient.Bucket(run.cfg.BucketName).UserProject(run.cfg.ComputeProjectId)
+	result := testSignedURL(run.ctx, bucket, run.firstObjectName, run.cfg.SignedURLProxy)
+	run.rw.check("signed_url", result.Err())
+	printSignedURLTest(w, result)
+	return result.Err()
+}
+
+func (run *diagRun) stepTinkDecrypt(w http.ResponseWriter) error {
+	bucket := run.gcsClient.Bucket(run.cfg.BucketName).UserProject(run.cfg.ComputeProjectId)
+	// Defaults to the object that was just downloaded.
+	tinkObject := run.cfg.TinkObject
+	if tinkObject == "" {
+		tinkObject = run.firstObjectName
+	}
+	result := checkTinkDecrypt(run.ctx, bucket, tinkObject, run.cfg)
+	run.rw.check("tink_decrypt", result.Err())
+	printTinkCheck(w, result)
+	return result.Err()
+}
+
+func (run *diagRun) stepBigQueryExternalTable(w http.ResponseWriter) error {
+	result := checkBigQueryExternalTable(run.ctx, run.cfg.BigQueryTable, run.cfg.ComputeProjectId)
+	run.rw.check("bigquery_external_table", result.Err())
+	printBigQueryCheck(w, result)
+	return result.Err()
+}
 
-	// Pub/Sub Client Operations
-	pubsubClient, err := pubsub.NewClient(ctx, cfg.ComputeProjectId)
+func (run *diagRun) stepPubSubClient(w http.ResponseWriter) error {
+	var err error
+	run.pubsubClient, err = newPubSubClient(context.WithoutCancel(run.ctx), run.cfg.ComputeProjectId, grpcClientOptions(run.rw.calls)...)
+	run.rw.check("pubsub_client", err)
 	if err != nil {
 		log.Printf("Failed to create Pub/Sub client: %v\n", err)
 		http.Error(w, "Failed to create Pub/Sub client", http.StatusInternalServerError)
-		return
 	}
-	defer pubsubClient.Close()
+	return err
+}
 
-	// Publish a message
-	topic := pubsubClient.Topic(cfg.PubSubTopicId)
-	result := topic.Publish(ctx, &pubsub.Message{
-		Data: []byte("Test message from Cloud Function"),
+func (run *diagRun) stepPubSubPublish(w http.ResponseWriter) error {
+	topic := run.pubsubClient.Topic(run.cfg.PubSubTopicId)
+	defer topic.Stop()
+	var id string
+	err := retryTransient(run.ctx, "pubsub.publish", func() error {
+		var err error
+		id, err = topic.Publish(run.ctx, &pubsub.Message{
+			Data:       []byte("Test message from Cloud Function"),
+			Attributes: runLabelsFromContext(run.ctx),
+		}).Get(run.ctx)
+		return err
+	})
+	run.rw.check("pubsub_publish", err)
+	run.rw.record(func(report *JSONReport) {
+		report.pubsub().Publish = &PublishOutcome{Topic: run.cfg.PubSubTopicId, MessageID: id, Error: reportError(err)}
 	})
-	id, err := result.Get(ctx)
 	if err != nil {
 		log.Printf("Failed to publish message: %v\n", err)
 		fmt.Fprintf(w, "Failed to publish message: %v\n", err)
-		return
+		return err
 	}
 	fmt.Fprintf(w, "Published message with ID: %s\n", id)
+	return nil
+}
 
-	// Pull messages from the subscription
-	sub := pubsubClient.Subscription(cfg.PubSubSubscriptionId)
-	cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-
-	messageReceived := false
-	err = sub.Receive(cctx, func(ctx context.Context, msg *pubsub.Message) {
-		messageReceived = true
-		fmt.Fprintf(w, "Received message: %s\n", string(msg.Data))
-		msg.Ack() // Acknowledge the message
+// stepPubSubReceive pulls messages from the subscription. The preflight tells an empty
+// subscription apart from one we can't read.
+func (run *diagRun) stepPubSubReceive(w http.ResponseWriter) error {
+	sub := run.pubsubClient.Subscription(run.cfg.PubSubSubscriptionId)
+	preflight := preflightSubscription(run.ctx, sub)
+	printSubscriptionPreflight(w, preflight)
+	retries := run.cfg.PubSubReceiveRetries
+	if !preflight.CanReceive() {
+		retries = 0
+	}
+	var stats ReceiveStats
+	err := retryTransient(run.ctx, "pubsub.receive", func() error {
+		var err error
+		stats, err = receiveTestMessages(run.ctx, sub, w, run.cfg.PubSubReceiveWindow, retries)
+		return err
+	})
+	received := stats.Acked
+	printReceiveDrain(w, stats)
+	switch {
+	case err == nil && received == 0 && !preflight.Exists:
+		err = fmt.Errorf("subscription %s does not exist", run.cfg.PubSubSubscriptionId)
+	case err == nil && received == 0 && preflight.Detached:
+		err = fmt.Errorf("subscription %s is detached from its topic", run.cfg.PubSubSubscriptionId)
+	case err == nil && received == 0 && len(preflight.MissingPermissions) > 0:
+		err = fmt.Errorf("missing %v on subscription %s", preflight.MissingPermissions, run.cfg.PubSubSubscriptionId)
+	}
+	run.rw.check("pubsub_receive", err)
+	run.rw.record(func(report *JSONReport) {
+		report.pubsub().Receive = &ReceiveOutcome{
+			Subscription: run.cfg.PubSubSubscriptionId,
+			Received:     received,
+			Attempts:     stats.Attempts,
+			Drained:      stats.Drained,
+			Error:        reportError(err),
+		}
 	})
 	if err != nil {
+		recordQuotaError(run.ctx, "pubsub.receive", err)
 		log.Printf("Failed to receive messages: %v\n", err)
-		if !messageReceived {
+		if received == 0 {
 			fmt.Fprintf(w, "No messages received: %v\n", err)
 		}
-	} else if !messageReceived {
-		fmt.Fprintln(w, "No messages were available in the subscription.")
+		return err
+	} else if received == 0 {
+		fmt.Fprintf(w, "No messages were available in the subscription (%d pulls of %s).\n", stats.Attempts, run.cfg.PubSubReceiveWindow)
 	}
 
 	log.Println("Pub/Sub test completed successfully.")
+	return nil
+}
+
+func (run *diagRun) stepMessageObject(w http.ResponseWriter) error {
+	sub := run.pubsubClient.Subscription(run.cfg.MessageObjectSubscription)
+	check := checkMessageObject(run.ctx, run.gcsClient, sub, run.cfg.ComputeProjectId, run.cfg.PubSubReceiveWindow, run.cfg.MessageObjectAck)
+	if check.Reference != nil {
+		noteObjectName(run.ctx, check.Reference.Name, run.cfg.ObjectNameEncoding)
+	}
+	run.rw.check("message_object", check.Err())
+	printMessageObjectCheck(w, check, run.cfg.ObjectNameEncoding)
+	return check.Err()
+}
 
+func (run *diagRun) stepKMSDecrypt(w http.ResponseWriter) error {
 	// Simulate a ciphertext (this would normally come from a real source)
 	ciphertext := simulateEncryptedData()
 
-	// Decrypt using KMS
-	plaintext, err := decryptWithKMS(cfg.KmsKey, ciphertext)
+	var plaintext string
+	err := retryTransient(run.ctx, "kms.decrypt", func() error {
+		var err error
+		plaintext, err = decryptWithKMS(run.ctx, run.cfg.KmsKey, ciphertext, grpcClientOptions(run.rw.calls)...)
+		return err
+	})
+	run.rw.check("kms_decrypt", err)
 	if err != nil {
 		log.Printf("Failed to decrypt data: %v\n", err)
 		http.Error(w, "Failed to decrypt data", http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	fmt.Fprintf(w, "Decrypted data: %s\n", plaintext)
+	return nil
 }
 
 func simulateEncryptedData() string {
@@ -122,9 +645,8 @@ func simulateEncryptedData() string {
 	return "CiQAA...fakeEncryptedData=="
 }
 
-func decryptWithKMS(cryptoKey string, ciphertextBase64 string) (string, error) {
-	ctx := context.Background()
-	client, err := kms.NewKeyManagementClient(ctx)
+func decryptWithKMS(ctx context.Context, cryptoKey string, ciphertextBase64 string, opts ...option.ClientOption) (string, error) {
+	client, err := kms.NewKeyManagementClient(ctx, opts...)
 	if err != nil {
 		return "", fmt.Errorf("failed to create KMS client: %w", err)
 	}
@@ -137,7 +659,7 @@ func decryptWithKMS(cryptoKey string, ciphertextBase64 string) (string, error) {
 	}
 
 	// Prepare the DecryptRequest
-	req := &kms.DecryptRequest{
+	req := &kmspb.DecryptRequest{
 		Name:       cryptoKey,
 		Ciphertext: ciphertext,
 	}
@@ -152,11 +674,14 @@ func decryptWithKMS(cryptoKey string, ciphertextBase64 string) (string, error) {
 	return string(resp.Plaintext), nil
 }
 
-// Debug logger function
+// debugLog logs at debug level through the run's logger, rather than into the report;
+// verbose runs log at debug whatever LOG_LEVEL says.
 func debugLog(w http.ResponseWriter, format string, args ...interface{}) {
-	if os.Getenv("DEBUG") == "true" {
-		fmt.Fprintf(w, format, args...)
+	logger := loggerFor(w)
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
 	}
+	logger.Debug(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
 }
 
 type GCloudFunctionConfig struct {
@@ -166,41 +691,383 @@ type GCloudFunctionConfig struct {
 	PubSubTopicId         string
 	PubSubSubscriptionId  string
 	KmsKey                string
+	ProbeEndpoints        []string
+	EgressEchoURL         string
+	ObjectNameEncoding    string
+	StreamStallTimeout    time.Duration
+	SignedURLSelfTest     bool
+	SignedURLProxy        string
+	DiscoverServiceAgents bool
+	FrontendMode          string
+	IAPAudience           string
+	ProbeCacheTTL         time.Duration
+	SnapshotBucket        string
+	SnapshotPrefix        string
+	VerifyDigests         []string
+	TinkKeysetSecret      string
+	TinkKEK               string
+	TinkObject            string
+	TinkAssociatedData    string
+	BigQueryTable         string
+	DataflowRegion        string
+	DiagnosticsJob        string
+	DownloadSample        int
+	ProgressTopic         string
+	SnapshotNameTemplate  string
+	JobResultsTemplate    string
+	DownloadPathTemplate  string
+	BundleNameTemplate    string
+	PubSubReceiveWindow   time.Duration
+	PubSubReceiveRetries  int
+	// Automatic lease management for subscribers; zero keeps the client defaults.
+	PubSubMaxExtension       time.Duration
+	PubSubMaxExtensionPeriod time.Duration
+	PubSubMinExtensionPeriod time.Duration
+	// Publisher batching and flow control for /publish; see pubsub.PublishSettings.
+	PubSubByteThreshold  int
+	PubSubCountThreshold int
+	PubSubDelayThreshold time.Duration
+	PubSubMaxOutstanding int
+	// DisableGzip turns off response compression for callers that send Accept-Encoding: gzip.
+	DisableGzip bool
+	// ReportCacheTTL caches diagnostics reports for GET requests; zero disables the cache.
+	ReportCacheTTL time.Duration
+	// ListFields chooses which object attributes listings fetch; see listQuery.
+	ListFields string
+	// ListCountOnly reports totals instead of every object name; set by ?countOnly=true.
+	ListCountOnly bool
+	// List narrows and pages the listing; set from the request, see requestListOptions.
+	List ListOptions
+	// AllowConfigOverride lets callers POST a complete run config; see runConfigHandler.
+	AllowConfigOverride bool
+	// DownloadDestination is a gs://bucket/prefix that downloads are copied under;
+	// empty only verifies them.
+	DownloadDestination string
+	// DownloadDir is a local directory each run writes its downloads under, in its own
+	// run-<id> directory; empty keeps them off local disk.
+	DownloadDir string
+	// DownloadFlat drops object directories from local download paths.
+	DownloadFlat bool
+	// DownloadConflict is overwrite, skip or suffix for local files that already exist.
+	DownloadConflict string
+	// DownloadRange limits downloads to one byte range, e.g. bytes=0-1048575.
+	DownloadRange byteRange
+	// EnablePprof serves net/http/pprof under /debug/pprof/.
+	EnablePprof bool
+	// CloudProfilerService uploads CPU and heap profiles of each run to Cloud Profiler
+	// under this service name; empty disables it.
+	CloudProfilerService string
+	// DownloadCacheBytes is the instance's budget for caching downloaded objects in
+	// memory; zero disables the cache.
+	DownloadCacheBytes int64
+	// CheckServiceUsage adds a pre-flight check that the APIs the checks call are enabled.
+	CheckServiceUsage bool
+	// CheckBilling adds a check that COMPUTE_PROJECT_ID has an active billing account.
+	CheckBilling bool
+	// AccessContactsProject is the project whose Essential Contacts or owners are named
+	// as who to ask when a check is denied; empty turns the lookup off.
+	AccessContactsProject string
+	// DemoMode replaces bucket, project, object and other names in reports with stable
+	// pseudonyms, for sharing reports publicly.
+	DemoMode bool
+	// CheckBucketCreate adds a check that the function may create buckets in
+	// COMPUTE_PROJECT_ID, without creating one.
+	CheckBucketCreate bool
+	// BucketCreateProbeName is a bucket name the create check confirms is still free.
+	BucketCreateProbeName string
+	// MessageObjectSubscription is pulled for a storage event whose object is then read,
+	// checking the consumer side of a notification pipeline; empty disables the check.
+	MessageObjectSubscription string
+	// MessageObjectAck acks the pulled message instead of handing it back, for a
+	// subscription used only by this check.
+	MessageObjectAck bool
+	// SoakPrefix is where /soak writes its objects in BUCKET_NAME, under a per-run folder.
+	SoakPrefix string
+	// SoakMaxBytes is the largest object size /soak writes by default.
+	SoakMaxBytes int
+	// CleanupPolicy is when runs delete what they created: always, keep-on-failure or never.
+	CleanupPolicy string
+	// ArtifactPrefix is where runs write temporary objects in BUCKET_NAME.
+	ArtifactPrefix string
+	// AllowUploads enables /upload, which writes request bodies to BUCKET_NAME.
+	AllowUploads bool
+	// UploadChunkSize is the resumable upload chunk size for /upload.
+	UploadChunkSize int
+	// BaselinePrefix is where /loadtest stores baselines in SnapshotBucket.
+	BaselinePrefix string
+	// BaselineLatencyThreshold and BaselineThroughputThreshold are how far, in percent,
+	// latency may rise or throughput fall against a baseline before it is a regression.
+	BaselineLatencyThreshold    float64
+	BaselineThroughputThreshold float64
+	// DualWriteBucket is a second bucket, e.g. a DR copy, that the dual-write check
+	// writes alongside BUCKET_NAME; empty disables the check.
+	DualWriteBucket string
+	// RoutingSubscriptions are the subscriptions /routing pulls from when the request
+	// names none; empty means every subscription on PUBSUB_TOPIC_ID.
+	RoutingSubscriptions []string
+	// RetryMaxAttempts, RetryAttempts, RetryInitialBackoff, RetryMaxBackoff,
+	// RetryMultiplier and RetryDeadline make up the retry policy; see RetryPolicy.
+	RetryMaxAttempts    int
+	RetryAttempts       map[string]int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryMultiplier     float64
+	RetryDeadline       time.Duration
+	// CheckClockSkew adds a check of the local clock and token times against Google's.
+	CheckClockSkew bool
+	// ClockSkewThreshold is how far the clock may drift before the clock check fails.
+	ClockSkewThreshold time.Duration
+	// TraceCommands lists the gcloud equivalent of every API call in each report.
+	TraceCommands bool
+	// CheckPreconditionRace adds a check that racing conditional writes serialize.
+	CheckPreconditionRace bool
+	// TargetServiceAccount, when set, is impersonated by the storage and Pub/Sub clients.
+	TargetServiceAccount string
+	// Profile is the ?profile= the configuration was built with, if any.
+	Profile string
+	// BuildMaxAge is how old a build /drift accepts; MinDependencyVersions are
+	// module@version floors it checks the build against.
+	BuildMaxAge           time.Duration
+	MinDependencyVersions []string
+	// ProcessEvents makes Eventarc deliveries download the object they name, as
+	// ProcessEvent does, rather than only being recorded.
+	ProcessEvents bool
+	// CheckTimeout bounds each check of a run, so one slow check can't use up the
+	// whole time budget; zero leaves checks bounded only by the run.
+	CheckTimeout time.Duration
+	// AllowBucketManagement enables /buckets, which creates, updates and deletes
+	// buckets in COMPUTE_PROJECT_ID.
+	AllowBucketManagement bool
+	// PersistReports stores every diagnostics run in SnapshotBucket under
+	// ReportHistoryPrefix, for /runs to list and fetch.
+	PersistReports      bool
+	ReportHistoryPrefix string
+	// Checks narrows a run to these checks and their dependencies, like ?checks=.
+	Checks []string
 }
 
+// NewGCloudFunctionConfig reads the configuration from the environment and, for
+// variables the environment leaves unset, CONFIG_FILE.
 func NewGCloudFunctionConfig() *GCloudFunctionConfig {
+	return newConfig(defaultConfigSource)
+}
+
+// newConfig reads the configuration from src, which may layer overrides over the
+// environment.
+func newConfig(src configSource) *GCloudFunctionConfig {
 	return &GCloudFunctionConfig{
-		BucketName:            os.Getenv("BUCKET_NAME"),
-		ComputeProjectId:      os.Getenv("COMPUTE_PROJECT_ID"),
-		PubSubTopicId:         os.Getenv("PUBSUB_TOPIC_ID"),
-		PubSubSubscriptionId:  os.Getenv("PUBSUB_SUBSCRIPTION_ID"),
-		KmsKey:                os.Getenv("KMS_KEY"),
-		StorageClientAudience: "https://storage.googleapis.com",
+		BucketName:                  src.get("BUCKET_NAME"),
+		ComputeProjectId:            src.get("COMPUTE_PROJECT_ID"),
+		PubSubTopicId:               src.get("PUBSUB_TOPIC_ID"),
+		PubSubSubscriptionId:        src.get("PUBSUB_SUBSCRIPTION_ID"),
+		KmsKey:                      src.get("KMS_KEY"),
+		StorageClientAudience:       src.str("STORAGE_CLIENT_AUDIENCE", "https://storage.googleapis.com"),
+		ProbeEndpoints:              splitList(src.get("PROBE_ENDPOINTS")),
+		EgressEchoURL:               src.get("EGRESS_ECHO_URL"),
+		ObjectNameEncoding:          src.str("OBJECT_NAME_ENCODING", ObjectNameEncodingEscape),
+		StreamStallTimeout:          src.duration("STREAM_STALL_TIMEOUT", 10*time.Second),
+		SignedURLSelfTest:           src.bool("SIGNED_URL_SELF_TEST"),
+		SignedURLProxy:              src.get("SIGNED_URL_PROXY"),
+		DiscoverServiceAgents:       src.bool("DISCOVER_SERVICE_AGENTS"),
+		FrontendMode:                src.get("FRONTEND_MODE"),
+		IAPAudience:                 src.get("IAP_AUDIENCE"),
+		ProbeCacheTTL:               src.duration("PROBE_CACHE_TTL", 30*time.Second),
+		SnapshotBucket:              src.str("SNAPSHOT_BUCKET", src.get("BUCKET_NAME")),
+		SnapshotPrefix:              src.str("SNAPSHOT_PREFIX", "gcf-list-buckets/snapshots/"),
+		VerifyDigests:               splitList(src.str("VERIFY_DIGESTS", "crc32c,md5")),
+		TinkKeysetSecret:            src.get("TINK_KEYSET_SECRET"),
+		TinkKEK:                     src.get("TINK_KEK"),
+		TinkObject:                  src.get("TINK_OBJECT"),
+		TinkAssociatedData:          src.get("TINK_ASSOCIATED_DATA"),
+		BigQueryTable:               src.get("BIGQUERY_TABLE"),
+		DataflowRegion:              src.str("DATAFLOW_REGION", "us-central1"),
+		DiagnosticsJob:              src.get("DIAGNOSTICS_JOB"),
+		DownloadSample:              src.int("DOWNLOAD_SAMPLE", 1),
+		ProgressTopic:               src.get("PROGRESS_TOPIC"),
+		SnapshotNameTemplate:        src.str("SNAPSHOT_NAME_TEMPLATE", DefaultSnapshotNameTemplate),
+		JobResultsTemplate:          src.str("JOB_RESULTS_TEMPLATE", DefaultJobResultsTemplate),
+		DownloadPathTemplate:        src.str("DOWNLOAD_PATH_TEMPLATE", DefaultDownloadPathTemplate),
+		BundleNameTemplate:          src.str("BUNDLE_NAME_TEMPLATE", DefaultBundleNameTemplate),
+		PubSubReceiveWindow:         src.duration("PUBSUB_RECEIVE_WINDOW", 10*time.Second),
+		PubSubReceiveRetries:        src.int("PUBSUB_RECEIVE_RETRIES", 0),
+		PubSubMaxExtension:          src.duration("PUBSUB_MAX_EXTENSION", pubsub.DefaultReceiveSettings.MaxExtension),
+		PubSubMaxExtensionPeriod:    src.duration("PUBSUB_MAX_EXTENSION_PERIOD", 0),
+		PubSubMinExtensionPeriod:    src.duration("PUBSUB_MIN_EXTENSION_PERIOD", 0),
+		PubSubByteThreshold:         src.int("PUBSUB_BYTE_THRESHOLD", pubsub.DefaultPublishSettings.ByteThreshold),
+		PubSubCountThreshold:        src.int("PUBSUB_COUNT_THRESHOLD", pubsub.DefaultPublishSettings.CountThreshold),
+		PubSubDelayThreshold:        src.duration("PUBSUB_DELAY_THRESHOLD", pubsub.DefaultPublishSettings.DelayThreshold),
+		PubSubMaxOutstanding:        src.int("PUBSUB_MAX_OUTSTANDING", 1000),
+		DisableGzip:                 src.bool("DISABLE_GZIP"),
+		ReportCacheTTL:              src.duration("REPORT_CACHE_TTL", 0),
+		ListFields:                  src.str("LIST_FIELDS", ListFieldsDefault),
+		AllowConfigOverride:         src.bool("ALLOW_CONFIG_OVERRIDE"),
+		DownloadDestination:         src.get("DOWNLOAD_DESTINATION"),
+		DownloadDir:                 src.get("DOWNLOAD_DIR"),
+		DownloadFlat:                src.bool("DOWNLOAD_FLAT"),
+		DownloadConflict:            src.str("DOWNLOAD_CONFLICT", ConflictOverwrite),
+		DownloadRange:               src.byteRange("DOWNLOAD_RANGE"),
+		EnablePprof:                 src.bool("ENABLE_PPROF"),
+		DownloadCacheBytes:          downloadCacheBudget(src),
+		CheckServiceUsage:           src.bool("CHECK_SERVICE_USAGE"),
+		CheckBilling:                src.bool("CHECK_BILLING"),
+		AccessContactsProject:       src.get("ACCESS_CONTACTS_PROJECT"),
+		DemoMode:                    src.bool("DEMO_MODE"),
+		CloudProfilerService:        src.get("CLOUD_PROFILER_SERVICE"),
+		BaselinePrefix:              src.str("BASELINE_PREFIX", "gcf-list-buckets/baselines/"),
+		BaselineLatencyThreshold:    src.float("BASELINE_LATENCY_THRESHOLD", 20),
+		BaselineThroughputThreshold: src.float("BASELINE_THROUGHPUT_THRESHOLD", 20),
+		CheckBucketCreate:           src.bool("CHECK_BUCKET_CREATE"),
+		BucketCreateProbeName:       src.get("BUCKET_CREATE_PROBE_NAME"),
+		MessageObjectSubscription:   src.get("MESSAGE_OBJECT_SUBSCRIPTION"),
+		MessageObjectAck:            src.bool("MESSAGE_OBJECT_ACK"),
+		SoakPrefix:                  src.str("SOAK_PREFIX", "gcf-list-buckets/soak/"),
+		SoakMaxBytes:                src.int("SOAK_MAX_BYTES", 64<<20),
+		CleanupPolicy:               src.str("CLEANUP_POLICY", CleanupAlways),
+		ArtifactPrefix:              src.str("ARTIFACT_PREFIX", "gcf-list-buckets/tmp/"),
+		AllowUploads:                src.bool("ALLOW_UPLOADS"),
+		UploadChunkSize:             src.int("UPLOAD_CHUNK_SIZE", googleapi.DefaultUploadChunkSize),
+		DualWriteBucket:             src.get("DUAL_WRITE_BUCKET"),
+		RoutingSubscriptions:        splitList(src.get("ROUTING_SUBSCRIPTIONS")),
+		CheckClockSkew:              src.bool("CHECK_CLOCK_SKEW"),
+		RetryMaxAttempts:            src.int("RETRY_MAX_ATTEMPTS", 4),
+		RetryAttempts:               parseRetryAttempts(splitList(src.get("RETRY_ATTEMPTS"))),
+		RetryInitialBackoff:         src.duration("RETRY_INITIAL_BACKOFF", time.Second),
+		RetryMaxBackoff:             src.duration("RETRY_MAX_BACKOFF", 30*time.Second),
+		RetryMultiplier:             src.float("RETRY_MULTIPLIER", 2),
+		RetryDeadline:               src.duration("RETRY_DEADLINE", 0),
+		ClockSkewThreshold:          src.duration("CLOCK_SKEW_THRESHOLD", 10*time.Second),
+		TraceCommands:               src.bool("TRACE_COMMANDS"),
+		CheckPreconditionRace:       src.bool("CHECK_PRECONDITION_RACE"),
+		TargetServiceAccount:        src.get("TARGET_SERVICE_ACCOUNT"),
+		BuildMaxAge:                 src.duration("BUILD_MAX_AGE", 90*24*time.Hour),
+		MinDependencyVersions:       splitList(src.get("MIN_DEPENDENCY_VERSIONS")),
+		ProcessEvents:               src.bool("PROCESS_EVENTS"),
+		CheckTimeout:                src.duration("CHECK_TIMEOUT", 0),
+		AllowBucketManagement:       src.bool("ALLOW_BUCKET_MANAGEMENT"),
+		PersistReports:              src.bool("PERSIST_REPORTS"),
+		ReportHistoryPrefix:         src.str("REPORT_HISTORY_PREFIX", "gcf-list-buckets/runs/"),
+	}
+}
+
+// byteRange parses a byte range value such as "bytes=0-1023", reading the whole
+// object when it is unset or invalid.
+func (src configSource) byteRange(key string) byteRange {
+	rng, err := parseByteRange(src(key))
+	if err != nil {
+		log.Printf("Invalid %s, reading whole objects: %v\n", key, err)
+		return fullRange
+	}
+	return rng
+}
+
+// get returns the value for key, or "" when it is unset.
+func (src configSource) get(key string) string {
+	return src(key)
+}
+
+// str returns the value for key, or fallback when it is unset or empty.
+func (src configSource) str(key, fallback string) string {
+	if value := src(key); value != "" {
+		return value
 	}
+	return fallback
+}
+
+// bool reads a flag; only "true" turns it on.
+func (src configSource) bool(key string) bool {
+	return src(key) == "true"
+}
+
+// duration parses a Go duration such as "30s", falling back when unset or invalid.
+func (src configSource) duration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(src(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// int parses a positive integer, falling back when unset or invalid.
+func (src configSource) int(key string, fallback int) int {
+	if n, err := strconv.Atoi(src(key)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// float parses a non-negative number, falling back when unset or invalid.
+func (src configSource) float(key string, fallback float64) float64 {
+	if f, err := strconv.ParseFloat(src(key), 64); err == nil && f >= 0 {
+		return f
+	}
+	return fallback
+}
+
+// queryInt reads a positive integer query parameter, clamped to max.
+func queryInt(r *http.Request, key string, fallback, max int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil || value <= 0 {
+		value = fallback
+	}
+	if value > max {
+		value = max
+	}
+	return value
+}
+
+// queryDuration reads a Go duration query parameter such as "30s".
+func queryDuration(r *http.Request, key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(r.URL.Query().Get(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// splitList parses a comma-separated env value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func createStorageClientWithOAuth(ctx context.Context) (*storage.Client, error) {
-	tokenSource, err := google.DefaultTokenSource(ctx, storagev1.CloudPlatformScope)
+	tokenSource, err := clientTokenSource(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create token source: %v", err)
 	}
-	return storage.NewClient(ctx, option.WithTokenSource(tokenSource))
+	httpClient := &http.Client{
+		Transport: &apiTraceTransport{base: &quotaObservingTransport{base: &oauth2.Transport{Source: tokenSource}}},
+	}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		return nil, err
+	}
+	applyStorageRetry(client, retryStateFrom(ctx).policy)
+	return client, nil
 }
 
-func checkBucketAccess(ctx context.Context, client *storage.Client, bucketName, userProject string, w http.ResponseWriter) error {
+func checkBucketAccess(ctx context.Context, client *storage.Client, bucketName, userProject string, w http.ResponseWriter) (*storage.BucketAttrs, error) {
 	debugLog(w, "Checking bucket access for bucket %s with user project %s\n", bucketName, userProject)
 	bucket := client.Bucket(bucketName).UserProject(userProject)
 
 	// Validate bucket attributes
-	attrs, err := bucket.Attrs(ctx)
+	var attrs *storage.BucketAttrs
+	err := retryTransient(ctx, "storage.buckets.get", func() error {
+		var err error
+		attrs, err = bucket.Attrs(ctx)
+		return err
+	})
 	if err != nil {
-		handleError(w, err)
-		return fmt.Errorf("error fetching bucket attributes: %w", err)
+		handleError(ctx, w, err)
+		return nil, fmt.Errorf("error fetching bucket attributes: %w", err)
 	}
 	fmt.Fprintf(w, "Bucket Name: %s\nBucket Location: %s\nRequester Pays: %t\n", attrs.Name, attrs.Location, attrs.RequesterPays)
 
 	debugLog(w, "Bucket access verified successfully for bucket %s with user project %s.\n", bucketName, userProject)
-	return nil
+	return attrs, nil
 }
 
 func printEnv(w http.ResponseWriter) {
@@ -214,62 +1081,267 @@ func printEnv(w http.ResponseWriter) {
 	debugLog(w, "+---------------------\n")
 }
 
-func ListBucketObjects(w http.ResponseWriter, ctx context.Context, storageClient *storage.Client, cfg *GCloudFunctionConfig) (string, error) {
+// ListBucketObjects prints every object, or one page of them with ?maxResults=, and
+// returns the first DOWNLOAD_SAMPLE names and the token for the next page, if any. When
+// a rate limit or the time budget stops it, the token is the page to resume from.
+func ListBucketObjects(w http.ResponseWriter, ctx context.Context, storageClient *storage.Client, cfg *GCloudFunctionConfig) ([]string, string, error) {
 	debugLog(w, "Listing objects in bucket %s...\n", cfg.BucketName)
 
-	it := storageClient.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId).Objects(ctx, nil)
+	query, err := listQuery(cfg.ListFields)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg.List.apply(query)
+	it := storageClient.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId).Objects(ctx, query)
 
-	var firstObjectName string
-	for {
-		objAttrs, err := it.Next()
-		if err == iterator.Done {
-			debugLog(w, "Reached end of object list.\n")
-			break
+	var sample []string
+	var prefixes int
+	list := func(objAttrs *storage.ObjectAttrs) {
+		recordListedObject(ctx, objAttrs)
+		if objAttrs.Prefix != "" {
+			prefixes++
+			noteObjectName(ctx, objAttrs.Prefix, cfg.ObjectNameEncoding)
+			fmt.Fprintf(w, "Prefix: %s\n", encodeObjectName(objAttrs.Prefix, cfg.ObjectNameEncoding))
+			return
 		}
+		noteObjectName(ctx, objAttrs.Name, cfg.ObjectNameEncoding)
+		fmt.Fprintf(w, "Object: %s\n", describeListedObject(objAttrs, cfg.ListFields, encodeObjectName(objAttrs.Name, cfg.ObjectNameEncoding)))
+		if len(sample) < cfg.DownloadSample {
+			sample = append(sample, objAttrs.Name)
+		}
+	}
+
+	var nextPageToken string
+	if cfg.List.MaxResults > 0 {
+		var page []*storage.ObjectAttrs
+		nextPageToken, err = iterator.NewPager(it, cfg.List.MaxResults, cfg.List.PageToken).NextPage(&page)
 		if err != nil {
 			fmt.Fprintf(w, "Error listing objects: %v\n", err)
-			return "", err
+			if resumableListError(ctx, err) {
+				return nil, cfg.List.PageToken, err
+			}
+			return nil, "", err
+		}
+		for _, objAttrs := range page {
+			list(objAttrs)
 		}
-		fmt.Fprintf(w, "Object: %s\n", objAttrs.Name)
-		if firstObjectName == "" {
-			firstObjectName = objAttrs.Name
+		if nextPageToken != "" {
+			fmt.Fprintf(w, "Next Page Token: %s\n", nextPageToken)
+		}
+	} else {
+		it.PageInfo().Token = cfg.List.PageToken
+		for {
+			objAttrs, err := it.Next()
+			if err == iterator.Done {
+				debugLog(w, "Reached end of object list.\n")
+				break
+			}
+			if err != nil {
+				fmt.Fprintf(w, "Error listing objects: %v\n", err)
+				if resumableListError(ctx, err) {
+					// A failed page fetch leaves the token at that page.
+					return nil, it.PageInfo().Token, err
+				}
+				return nil, "", err
+			}
+			list(objAttrs)
 		}
 	}
 
-	if firstObjectName == "" {
+	if len(sample) == 0 && prefixes > 0 {
+		// With a delimiter, a folder-structured bucket's root lists only prefixes. Listing
+		// worked; there is just nothing on the page to download.
+		fmt.Fprintln(w, "Only prefixes were listed; no objects to download.")
+		return nil, nextPageToken, nil
+	}
+	if len(sample) == 0 {
 		fmt.Fprintln(w, "No objects found in the bucket.")
 		debugLog(w, "No objects found in the bucket.\n")
-		return "", errors.New("No objects found in the bucket.")
+		return nil, nextPageToken, errors.New("No objects found in the bucket.")
 	}
 
-	return firstObjectName, nil
+	return sample, nextPageToken, nil
 }
 
-func downloadObject(ctx context.Context, client *storage.Client, bucketName, objectName string, w http.ResponseWriter) error {
-	debugLog(w, "Starting download for object %s in bucket %s\n", objectName, bucketName)
-	rc, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+// downloadOptions says what part of an object a download reads and where, besides
+// the digests, the bytes go.
+type downloadOptions struct {
+	Digests []string
+	Range   byteRange
+	// Destination is a gs://bucket/prefix the object is copied under, named by
+	// DOWNLOAD_PATH_TEMPLATE; empty only verifies.
+	Destination  string
+	PathTemplate string
+	RunID        string
+	// Generation, when set, is the only generation read; events name the one they
+	// are about.
+	Generation int64
+	// LocalDir is the run's directory under DOWNLOAD_DIR the object is also written
+	// to; empty keeps it off local disk.
+	LocalDir string
+	// Flat and Conflict are DOWNLOAD_FLAT and DOWNLOAD_CONFLICT for the local copy.
+	Flat     bool
+	Conflict string
+}
+
+// downloadObject streams an object through its digests, and into the destination
+// bucket and local directory when they are set, without holding it in memory. Content
+// already in the download cache is served from memory instead. Partial reads can't be
+// checked against the object's digests and are neither verified nor cached.
+func downloadObject(ctx context.Context, client *storage.Client, bucketName, objectName string, opts downloadOptions, cache *downloadCache, usage *DownloadCacheUsage, w http.ResponseWriter) error {
+	debugLog(w, "Starting download for object %s in bucket %s\n", safeObjectName(objectName), bucketName)
+	obj := client.Bucket(bucketName).Object(objectName)
+	if opts.Generation != 0 {
+		obj = obj.Generation(opts.Generation)
+	}
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create reader for object %s: %v", objectName, err)
+		debugLog(w, "Could not fetch object attributes for verification: %v\n", err)
 	}
-	defer rc.Close()
+	partial := !opts.Range.IsFull()
 
-	localFile, err := os.Create(objectName)
+	var (
+		src      io.Reader
+		cacheKey string
+		tee      *bytes.Buffer
+	)
+	if attrs != nil && cache != nil && !partial {
+		cacheKey = downloadCacheKey(bucketName, attrs)
+		if data, ok := cache.get(cacheKey, usage); ok {
+			src = bytes.NewReader(data)
+			fmt.Fprintf(w, "Served object %s from the download cache\n", safeObjectName(objectName))
+		} else if cache.cacheable(attrs.Size) {
+			tee = &bytes.Buffer{}
+		}
+	}
+	if attrs != nil {
+		// Read the generation the attributes describe, even if the object is rewritten meanwhile.
+		obj = obj.Generation(attrs.Generation)
+		// The stored checksums cover the bytes as stored, so gzip-encoded objects are
+		// read without decompressive transcoding.
+		obj = obj.ReadCompressed(attrs.ContentEncoding == "gzip")
+	}
+	if src == nil {
+		rc, err := obj.NewRangeReader(ctx, opts.Range.Offset, opts.Range.Length)
+		if err != nil {
+			return fmt.Errorf("failed to create reader for object %s: %w", safeObjectName(objectName), err)
+		}
+		defer rc.Close()
+		src = rc
+		if tee != nil {
+			src = io.TeeReader(rc, tee)
+		}
+	}
+
+	var digestNames []string
+	if !partial {
+		digestNames = opts.Digests
+	}
+	digestSet := newDigestSet(digestNames)
+	var dst io.Writer = digestSet.Writer()
+	var copyTo *storage.Writer
+	// Cancelling the copy's context is how a failed copy is abandoned.
+	ctx, cancelCopy := context.WithCancel(ctx)
+	defer cancelCopy()
+	if opts.Destination != "" {
+		target, err := downloadDestination(client, opts, bucketName, objectName)
+		if err != nil {
+			return err
+		}
+		copyTo = target.NewWriter(ctx)
+		if attrs != nil && !partial {
+			copyTo.ContentType = attrs.ContentType
+			copyTo.ContentEncoding = attrs.ContentEncoding
+		}
+		dst = io.MultiWriter(copyTo, dst)
+	}
+	var localFile *os.File
+	if opts.LocalDir != "" {
+		localPath, skip, err := scratchPath(opts, bucketName, objectName)
+		if err != nil {
+			return fmt.Errorf("failed to choose local file: %v", err)
+		}
+		if skip {
+			fmt.Fprintf(w, "Kept existing local file %s for object %s\n", localPath, safeObjectName(objectName))
+		} else {
+			localFile, err = os.Create(localPath)
+			if err != nil {
+				return fmt.Errorf("failed to create local file: %v", err)
+			}
+			defer localFile.Close()
+			dst = io.MultiWriter(localFile, dst)
+		}
+	}
+	n, err := io.Copy(dst, src)
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %v", err)
+		if copyTo != nil {
+			cancelCopy()
+			copyTo.Close()
+		}
+		if localFile != nil {
+			// A retry starts the file over rather than leaving a truncated copy.
+			os.Remove(localFile.Name())
+		}
+		return fmt.Errorf("failed to stream object data: %w", err)
+	}
+	if localFile != nil {
+		if err := localFile.Close(); err != nil {
+			return fmt.Errorf("failed to write local file: %v", err)
+		}
+		fmt.Fprintf(w, "Wrote object %s to local file %s\n", safeObjectName(objectName), localFile.Name())
+	}
+	if copyTo != nil {
+		if err := copyTo.Close(); err != nil {
+			return fmt.Errorf("failed to copy object to %s: %w", opts.Destination, err)
+		}
+		fmt.Fprintf(w, "Copied object %s to gs://%s/%s\n", safeObjectName(objectName), copyTo.Bucket, safeObjectName(copyTo.Name))
 	}
-	defer localFile.Close()
 
-	if _, err := io.Copy(localFile, rc); err != nil {
-		return fmt.Errorf("failed to copy object data to local file: %v", err)
+	if partial {
+		fmt.Fprintf(w, "Downloaded %s of object %s (%s); digests are only checked on whole objects\n", opts.Range, safeObjectName(objectName), formatBytes(uint64(n)))
+		return nil
 	}
+	fmt.Fprintf(w, "Downloaded object %s (%s)\n", safeObjectName(objectName), formatBytes(uint64(n)))
+	debugLog(w, "Successfully downloaded object %s\n", safeObjectName(objectName))
 
-	fmt.Fprintf(w, "Downloaded object %s to local file %s\n", objectName, objectName)
-	debugLog(w, "Successfully downloaded object %s\n", objectName)
+	results := digestSet.Results(attrs)
+	printVerification(w, results)
+	for _, d := range results {
+		if !d.Matches() {
+			return fmt.Errorf("%s mismatch for object %s", d.Algorithm, safeObjectName(objectName))
+		}
+	}
+	// Only verified content is cached.
+	if tee != nil {
+		cache.put(cacheKey, tee.Bytes())
+	}
 	return nil
 }
 
+// downloadDestination names the copy of objectName under DOWNLOAD_DESTINATION.
+func downloadDestination(client *storage.Client, opts downloadOptions, bucketName, objectName string) (*storage.ObjectHandle, error) {
+	rest, ok := strings.CutPrefix(opts.Destination, "gs://")
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if !ok || bucket == "" {
+		return nil, fmt.Errorf("download destination %q must be gs://bucket[/prefix]", opts.Destination)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	name := prefix + renderArtifactName("download path", opts.PathTemplate, DefaultDownloadPathTemplate, ArtifactName{
+		RunID:  opts.RunID,
+		Time:   time.Now().UTC(),
+		Bucket: bucketName,
+		Object: objectName,
+	})
+	if len(name) > maxObjectNameBytes {
+		return nil, fmt.Errorf("download destination name for %s is longer than %d bytes", safeObjectName(objectName), maxObjectNameBytes)
+	}
+	return client.Bucket(bucket).Object(name), nil
+}
+
 func publishMessage(w http.ResponseWriter, ctx context.Context, cfg GCloudFunctionConfig) {
-	client, err := pubsub.NewClient(ctx, cfg.ComputeProjectId)
+	client, err := newPubSubClient(ctx, cfg.ComputeProjectId)
 	if err != nil {
 		log.Printf("Failed to create Pub/Sub client: %v\n", err)
 		http.Error(w, "Failed to create Pub/Sub client", http.StatusInternalServerError)
@@ -308,7 +1380,9 @@ func publishMessage(w http.ResponseWriter, ctx context.Context, cfg GCloudFuncti
 	}
 }
 
-func handleError(w http.ResponseWriter, err error) {
+func handleError(ctx context.Context, w http.ResponseWriter, err error) {
+	lang := langFromContext(ctx)
+	decoded := decodeError(err)
 	if gErr, ok := err.(*googleapi.Error); ok {
 		fmt.Fprintf(w, "Error Code: %d\nMessage: %s\nDetails:\n", gErr.Code, gErr.Message)
 		debugLog(w, "Full Error: %+v\n", gErr)
@@ -317,7 +1391,36 @@ func handleError(w http.ResponseWriter, err error) {
 			fmt.Fprintf(w, "Reason: %s, Message: %s\n", detail.Reason, detail.Message)
 		}
 	} else {
-		fmt.Fprintf(w, "Unknown error: %v\n", err)
-		debugLog(w, "Unknown error: %+v\n", err)
+		fmt.Fprintf(w, "Error: %v\n", err)
+		debugLog(w, "Full Error: %+v\n", err)
+	}
+
+	for _, reason := range decoded.Reasons {
+		if _, ok := reasonCatalog[reason]; ok {
+			fmt.Fprintf(w, "%s: %s\n", reason, localize(lang, "reason."+reason))
+		}
+	}
+	fmt.Fprintf(w, "%s\n%s: %s\n", localize(lang, "explain."+decoded.Category), localize(lang, "label.remediation"), localize(lang, "remediation."+decoded.Category))
+	if doc := decoded.Doc(); doc != "" {
+		fmt.Fprintf(w, "%s: %s\n", localize(lang, "label.docs"), doc)
+	}
+	if decoded.Category == "forbidden" {
+		if contacts, ok := accessContactsFrom(ctx); ok {
+			printAccessContacts(w, lang, contacts)
+		}
+	}
+}
+
+func errorCategory(err error) string {
+	return decodeError(err).Category
+}
+
+// sortedKeys returns the keys of m in order, for stable output.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
 }
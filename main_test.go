@@ -0,0 +1,145 @@
+package gcf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadObjectReadsGzipAsStored(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("uploaded with gzip=true"))
+	zw.Close()
+	stored := buf.Bytes()
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("alt") == "media" || !strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("X-Goog-Generation", "1")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(stored)
+			return
+		}
+		sum := md5.Sum(stored)
+		crc := binary.BigEndian.AppendUint32(nil, crc32.Checksum(stored, crc32.MakeTable(crc32.Castagnoli)))
+		writeFakeJSON(w, http.StatusOK, map[string]any{
+			"bucket": "diag-bucket", "name": "a.txt", "generation": "1", "size": fmt.Sprint(len(stored)),
+			"contentEncoding": "gzip",
+			"md5Hash":         base64.StdEncoding.EncodeToString(sum[:]),
+			"crc32c":          base64.StdEncoding.EncodeToString(crc),
+		})
+	})
+	setTestEnv(t, nil)
+
+	ctx := context.Background()
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rec := httptest.NewRecorder()
+	opts := downloadOptions{Digests: []string{"crc32c", "md5"}, Range: fullRange}
+	if err := downloadObject(ctx, client, "diag-bucket", "a.txt", opts, nil, nil, rec); err != nil {
+		t.Fatalf("downloadObject() = %v, want the stored gzip bytes verified; output:\n%s", err, rec.Body)
+	}
+}
+
+func TestListBucketObjectsPrefixOnlyPage(t *testing.T) {
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		writeFakeJSON(w, http.StatusOK, map[string]any{"kind": "storage#objects", "prefixes": []string{"logs/", "raw/"}, "nextPageToken": "page-2"})
+	})
+	setTestEnv(t, nil)
+	cfg := NewGCloudFunctionConfig()
+	cfg.List = ListOptions{Delimiter: "/", MaxResults: 10}
+
+	ctx := context.Background()
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rec := httptest.NewRecorder()
+	sample, next, err := ListBucketObjects(rec, ctx, client, cfg)
+	if err != nil {
+		t.Fatalf("ListBucketObjects() = %v, want a page of prefixes to list fine; output:\n%s", err, rec.Body)
+	}
+	if len(sample) != 0 || next != "page-2" {
+		t.Errorf("sample = %v, next page token = %q; want no sample and page-2", sample, next)
+	}
+}
+
+func TestListBucketObjectsRedactsPrefixesInDemoMode(t *testing.T) {
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		writeFakeJSON(w, http.StatusOK, map[string]any{"kind": "storage#objects", "prefixes": []string{"payroll-2026/"}, "items": []map[string]any{{"name": "payroll-2026.csv", "bucket": "diag-bucket"}}})
+	})
+	setTestEnv(t, nil)
+	cfg := NewGCloudFunctionConfig()
+	cfg.List = ListOptions{Delimiter: "/"}
+
+	redactor := newRedactor(cfg)
+	ctx := withRedactor(context.Background(), redactor)
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rec := httptest.NewRecorder()
+	if _, _, err := ListBucketObjects(rec, ctx, client, cfg); err != nil {
+		t.Fatalf("ListBucketObjects() = %v; output:\n%s", err, rec.Body)
+	}
+	if out := string(redactor.apply(rec.Body.Bytes())); strings.Contains(out, "payroll") {
+		t.Errorf("demo report names the real prefix or object:\n%s", out)
+	}
+}
+
+func TestDownloadObjectWritesEachRunToItsOwnDirectory(t *testing.T) {
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("alt") == "media" || !strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("X-Goog-Generation", "1")
+			w.Write([]byte("object data"))
+			return
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]any{"bucket": "diag-bucket", "name": "logs/a.txt", "generation": "1", "size": "11"})
+	})
+	setTestEnv(t, nil)
+	root := t.TempDir()
+	stale := filepath.Join(root, "run-stale")
+	os.Mkdir(stale, 0o700)
+	old := time.Now().Add(-2 * scratchMaxAge)
+	os.Chtimes(stale, old, old)
+
+	ctx := context.Background()
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, runID := range []string{"one", "two"} {
+		dir, err := newScratchDir(root, runID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		opts := downloadOptions{Range: fullRange, RunID: runID, LocalDir: dir}
+		if err := downloadObject(ctx, client, "diag-bucket", "logs/a.txt", opts, nil, nil, rec); err != nil {
+			t.Fatalf("downloadObject() = %v; output:\n%s", err, rec.Body)
+		}
+		if data, err := os.ReadFile(filepath.Join(root, "run-"+runID, "logs", "a.txt")); err != nil || string(data) != "object data" {
+			t.Errorf("run %s local copy = %q, %v", runID, data, err)
+		}
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale run directory wasn't swept: %v", err)
+	}
+}
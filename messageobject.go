@@ -0,0 +1,213 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+)
+
+var gsURIPattern = regexp.MustCompile(`gs://([a-z0-9][a-z0-9._-]{1,221}[a-z0-9])/([^\s"'<>]+)`)
+
+// ObjectReference is an object named by a message, and where in the message it was found.
+type ObjectReference struct {
+	Bucket     string
+	Name       string
+	Generation int64
+	// Source is "notification attributes", "notification payload", "cloudevent" or
+	// "gs:// URI".
+	Source string
+	// EventType is set for storage notifications; deletes and archives name objects
+	// that are expected to be gone.
+	EventType string
+}
+
+// MessageObjectCheck is the consumer side of a storage-notification pipeline: a message
+// was pulled, an object reference parsed from it, and the object read.
+type MessageObjectCheck struct {
+	Subscription string
+	MessageID    string
+	Reference    *ObjectReference
+	Exists       bool
+	Readable     bool
+	Size         int64
+	Error        string
+}
+
+func (c MessageObjectCheck) Err() error {
+	switch {
+	case c.Error != "":
+		return errors.New(c.Error)
+	case c.MessageID == "":
+		return fmt.Errorf("no message arrived on %s", c.Subscription)
+	case c.Reference == nil:
+		return fmt.Errorf("message %s references no object", c.MessageID)
+	case c.Reference.expectsGone():
+		return nil
+	case !c.Exists:
+		return fmt.Errorf("object gs://%s/%s referenced by message %s does not exist", c.Reference.Bucket, c.Reference.Name, c.MessageID)
+	case !c.Readable:
+		return fmt.Errorf("object gs://%s/%s referenced by message %s is not readable", c.Reference.Bucket, c.Reference.Name, c.MessageID)
+	}
+	return nil
+}
+
+func (ref *ObjectReference) expectsGone() bool {
+	return ref.EventType == "OBJECT_DELETE" || ref.EventType == "OBJECT_ARCHIVE"
+}
+
+// parseObjectReference finds the object a message points at, trying the shapes storage
+// events come in: notification attributes, the JSON_API_V1 payload, CloudEvents
+// attributes, and finally any gs:// URI in the data.
+func parseObjectReference(msg *pubsub.Message) *ObjectReference {
+	attrs := msg.Attributes
+	if attrs["bucketId"] != "" && attrs["objectId"] != "" {
+		gen, _ := strconv.ParseInt(attrs["objectGeneration"], 10, 64)
+		return &ObjectReference{Bucket: attrs["bucketId"], Name: attrs["objectId"], Generation: gen,
+			Source: "notification attributes", EventType: attrs["eventType"]}
+	}
+
+	var payload struct {
+		Kind       string `json:"kind"`
+		Bucket     string `json:"bucket"`
+		Name       string `json:"name"`
+		Generation string `json:"generation"`
+	}
+	if json.Unmarshal(msg.Data, &payload) == nil && payload.Kind == "storage#object" && payload.Bucket != "" && payload.Name != "" {
+		gen, _ := strconv.ParseInt(payload.Generation, 10, 64)
+		return &ObjectReference{Bucket: payload.Bucket, Name: payload.Name, Generation: gen,
+			Source: "notification payload", EventType: attrs["eventType"]}
+	}
+
+	if source, subject := attrs["ce-source"], attrs["ce-subject"]; strings.HasPrefix(subject, "objects/") {
+		if _, bucket, ok := strings.Cut(source, "/buckets/"); ok && bucket != "" {
+			ref := &ObjectReference{Bucket: bucket, Name: strings.TrimPrefix(subject, "objects/"), Source: "cloudevent"}
+			if strings.HasSuffix(attrs["ce-type"], ".deleted") || strings.HasSuffix(attrs["ce-type"], ".archived") {
+				ref.EventType = "OBJECT_DELETE"
+			}
+			return ref
+		}
+	}
+
+	if m := gsURIPattern.FindSubmatch(msg.Data); m != nil {
+		return &ObjectReference{Bucket: string(m[1]), Name: string(m[2]), Source: "gs:// URI"}
+	}
+	return nil
+}
+
+// checkMessageObject pulls one message from sub and verifies the object it references
+// exists and can be read. The message is nacked so the pipeline's real consumer still
+// gets it, unless ack is set for a subscription dedicated to this check.
+func checkMessageObject(ctx context.Context, client *storage.Client, sub *pubsub.Subscription, userProject string, window time.Duration, ack bool) MessageObjectCheck {
+	check := MessageObjectCheck{Subscription: sub.String()}
+
+	var once sync.Once
+	var msg *pubsub.Message
+	cctx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+	sub.ReceiveSettings.MaxOutstandingMessages = 1
+	err := sub.Receive(cctx, func(_ context.Context, m *pubsub.Message) {
+		taken := false
+		once.Do(func() {
+			msg, taken = m, true
+			cancel()
+		})
+		if taken && ack {
+			m.Ack()
+		} else {
+			m.Nack()
+		}
+	})
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		check.Error = fmt.Sprintf("failed to pull: %v", err)
+		return check
+	}
+	if msg == nil {
+		return check
+	}
+	check.MessageID = msg.ID
+
+	ref := parseObjectReference(msg)
+	if ref == nil {
+		return check
+	}
+	check.Reference = ref
+
+	obj := client.Bucket(ref.Bucket).UserProject(userProject).Object(ref.Name)
+	if ref.Generation != 0 {
+		obj = obj.Generation(ref.Generation)
+	}
+	attrs, err := obj.Attrs(ctx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return check
+	case err != nil:
+		check.Error = fmt.Sprintf("failed to read object metadata: %v", err)
+		return check
+	}
+	check.Exists = true
+	check.Size = attrs.Size
+
+	// One byte proves read access without downloading the object.
+	rc, err := obj.NewRangeReader(ctx, 0, 1)
+	if err != nil {
+		check.Error = fmt.Sprintf("failed to read object: %v", err)
+		return check
+	}
+	defer rc.Close()
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		check.Error = fmt.Sprintf("failed to read object: %v", err)
+		return check
+	}
+	check.Readable = true
+	return check
+}
+
+func printMessageObjectCheck(w http.ResponseWriter, check MessageObjectCheck, encoding string) {
+	fmt.Fprintf(w, "Message Object (%s):\n", check.Subscription)
+	if check.MessageID == "" && check.Error == "" {
+		fmt.Fprintln(w, "| No message arrived; publish an event or upload an object to trigger one.")
+		return
+	}
+	if check.MessageID != "" {
+		fmt.Fprintf(w, "| Message: %s\n", check.MessageID)
+	}
+	if ref := check.Reference; ref != nil {
+		fmt.Fprintf(w, "| Object: gs://%s/%s", ref.Bucket, encodeObjectName(ref.Name, encoding))
+		if ref.Generation != 0 {
+			fmt.Fprintf(w, "#%d", ref.Generation)
+		}
+		fmt.Fprintf(w, " (from %s)\n", ref.Source)
+		if ref.EventType != "" {
+			fmt.Fprintf(w, "| Event: %s\n", ref.EventType)
+		}
+	} else if check.MessageID != "" {
+		fmt.Fprintln(w, "| Object: none found in attributes or data")
+	}
+	if check.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", check.Error)
+		return
+	}
+	if check.Reference == nil {
+		return
+	}
+	switch {
+	case check.Reference.expectsGone() && !check.Exists:
+		fmt.Fprintln(w, "| Exists: no, as expected for this event")
+	case !check.Exists:
+		fmt.Fprintln(w, "| Exists: NO, the producer named an object that isn't there")
+	default:
+		fmt.Fprintf(w, "| Exists: yes (%s)\n", formatBytes(uint64(check.Size)))
+		fmt.Fprintf(w, "| Readable: %t\n", check.Readable)
+	}
+}
@@ -0,0 +1,145 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const defaultLang = "en"
+
+// messageCatalogs maps a language tag to its remediation and error-explanation strings.
+// Missing keys fall back to English.
+var (
+	catalogMu       sync.RWMutex
+	messageCatalogs = map[string]map[string]string{
+		"en": {
+			"label.remediation":                "Remediation",
+			"explain.unauthorized":             "The request was not authenticated.",
+			"explain.forbidden":                "The function's identity is not allowed to perform this operation.",
+			"explain.notFound":                 "The requested resource does not exist or is not visible to the caller.",
+			"explain.rateLimited":              "The request was rejected by a rate limit or quota.",
+			"explain.unavailable":              "The service is temporarily unavailable.",
+			"explain.unknown":                  "The error was not recognized.",
+			"explain.userProject":              "The bucket is requester-pays and the request named no usable billing project.",
+			"remediation.unauthorized":         "Check that the function runs with a service account and that its credentials are valid.",
+			"remediation.forbidden":            "Grant the function's service account a role with the missing permission (for reads, roles/storage.objectViewer) on the bucket or its project.",
+			"remediation.notFound":             "Verify the bucket, object, topic or subscription name and the project it belongs to.",
+			"remediation.userProject":          "The bucket is requester-pays: set COMPUTE_PROJECT_ID to a project the service account has serviceusage.services.use on.",
+			"remediation.rateLimited":          "Retry later with backoff, or request a quota increase for the affected API.",
+			"remediation.unavailable":          "Retry the request; if it persists, check the Google Cloud status dashboard.",
+			"remediation.unknown":              "Inspect the error details above and the function logs.",
+			"label.docs":                       "Docs",
+			"label.accessContacts":             "Who to ask for access",
+			"explain.precondition":             "A precondition on the request, such as a generation match, was not met.",
+			"explain.apiDisabled":              "The API is not enabled in the project the request was billed to.",
+			"remediation.precondition":         "Re-read the resource and retry with its current generation or metageneration.",
+			"remediation.apiDisabled":          "Enable the API in COMPUTE_PROJECT_ID, then wait a few minutes for it to take effect.",
+			"reason.userProjectMissing":        "The bucket is requester-pays and the request named no billing project.",
+			"reason.userProjectAccountProblem": "The billing project has no valid billing account.",
+			"reason.retentionPolicyNotMet":     "The object is under a retention policy or hold and can't be deleted or replaced yet.",
+			"reason.objectNotFound":            "The object does not exist, or this generation of it was deleted.",
+			"reason.bucketNotFound":            "The bucket does not exist.",
+			"reason.notFound":                  "The resource does not exist or the caller can't see it.",
+			"reason.forbidden":                 "The caller lacks a permission the operation needs.",
+			"reason.insufficientPermissions":   "The caller lacks a permission the operation needs.",
+			"reason.IAM_PERMISSION_DENIED":     "IAM denied the permission the operation needs.",
+			"reason.conditionNotMet":           "An if-generation-match style precondition failed.",
+			"reason.rateLimitExceeded":         "Too many requests were sent in a short time.",
+			"reason.userRateLimitExceeded":     "Too many requests were sent for this user in a short time.",
+			"reason.quotaExceeded":             "A project quota is used up.",
+			"reason.RATE_LIMIT_EXCEEDED":       "Too many requests were sent in a short time.",
+			"reason.accessNotConfigured":       "The API is disabled in the billing project.",
+			"reason.SERVICE_DISABLED":          "The API is disabled in the billing project.",
+			"reason.accountDisabled":           "The service account is disabled.",
+		},
+		"es": {
+			"label.remediation":        "Solución",
+			"explain.unauthorized":     "La solicitud no estaba autenticada.",
+			"explain.forbidden":        "La identidad de la función no tiene permiso para realizar esta operación.",
+			"explain.notFound":         "El recurso solicitado no existe o no es visible para quien llama.",
+			"explain.rateLimited":      "La solicitud fue rechazada por un límite de frecuencia o una cuota.",
+			"explain.unavailable":      "El servicio no está disponible temporalmente.",
+			"explain.unknown":          "No se reconoció el error.",
+			"explain.userProject":      "El bucket es de pago por el solicitante y la solicitud no indicó un proyecto de facturación válido.",
+			"remediation.unauthorized": "Compruebe que la función se ejecuta con una cuenta de servicio y que sus credenciales son válidas.",
+			"remediation.forbidden":    "Otorgue a la cuenta de servicio de la función un rol con el permiso que falta (para lecturas, roles/storage.objectViewer) en el bucket o su proyecto.",
+			"remediation.notFound":     "Verifique el nombre del bucket, objeto, tema o suscripción y el proyecto al que pertenece.",
+			"remediation.userProject":  "El bucket es de pago por el solicitante: configure COMPUTE_PROJECT_ID con un proyecto en el que la cuenta de servicio tenga serviceusage.services.use.",
+			"remediation.rateLimited":  "Reintente más tarde con espera exponencial o solicite un aumento de cuota para la API afectada.",
+			"remediation.unavailable":  "Reintente la solicitud; si persiste, consulte el panel de estado de Google Cloud.",
+			"remediation.unknown":      "Revise los detalles del error anteriores y los registros de la función.",
+			"label.docs":               "Documentación",
+			"label.accessContacts":     "A quién pedir acceso",
+			"explain.precondition":     "No se cumplió una condición previa de la solicitud, como la coincidencia de generación.",
+			"explain.apiDisabled":      "La API no está habilitada en el proyecto al que se facturó la solicitud.",
+			"remediation.precondition": "Vuelva a leer el recurso y reintente con su generación o metageneración actual.",
+			"remediation.apiDisabled":  "Habilite la API en COMPUTE_PROJECT_ID y espere unos minutos a que surta efecto.",
+		},
+	}
+)
+
+// RegisterMessages adds or overrides catalog entries for lang, letting deployments
+// ship their own translations at build time.
+func RegisterMessages(lang string, messages map[string]string) {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	lang = normalizeLang(lang)
+	if messageCatalogs[lang] == nil {
+		messageCatalogs[lang] = map[string]string{}
+	}
+	for key, value := range messages {
+		messageCatalogs[lang][key] = value
+	}
+}
+
+// localize looks up key in the lang catalog, falling back to English and then to the key itself.
+func localize(lang, key string, args ...interface{}) string {
+	catalogMu.RLock()
+	text, ok := messageCatalogs[normalizeLang(lang)][key]
+	if !ok {
+		text, ok = messageCatalogs[defaultLang][key]
+	}
+	catalogMu.RUnlock()
+
+	if !ok {
+		text = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// normalizeLang reduces tags like "es-MX" to their primary language.
+func normalizeLang(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		lang = lang[:i]
+	}
+	if lang == "" {
+		return defaultLang
+	}
+	return lang
+}
+
+type langKey struct{}
+
+func withLang(ctx context.Context, lang string) context.Context {
+	return context.WithValue(ctx, langKey{}, normalizeLang(lang))
+}
+
+func langFromContext(ctx context.Context) string {
+	if lang, ok := ctx.Value(langKey{}).(string); ok {
+		return lang
+	}
+	return defaultLang
+}
+
+// requestLang reads the `lang` query parameter.
+func requestLang(r *http.Request) string {
+	return normalizeLang(r.URL.Query().Get("lang"))
+}
@@ -0,0 +1,40 @@
+package gcf
+
+import (
+	"encoding/base64"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ObjectNameEncodingEscape = "escape"
+	ObjectNameEncodingBase64 = "base64"
+)
+
+// safeObjectName returns names made of printable UTF-8 unchanged and Go-quotes
+// anything else, so control characters or invalid bytes cannot corrupt the report.
+func safeObjectName(name string) string {
+	if utf8.ValidString(name) {
+		printable := true
+		for _, r := range name {
+			if !unicode.IsPrint(r) {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return name
+		}
+	}
+	return strconv.Quote(name)
+}
+
+// encodeObjectName applies the configured OBJECT_NAME_ENCODING. base64 keeps the
+// exact bytes so names can be round-tripped back into GCS calls.
+func encodeObjectName(name, encoding string) string {
+	if encoding == ObjectNameEncodingBase64 {
+		return "base64:" + base64.StdEncoding.EncodeToString([]byte(name))
+	}
+	return safeObjectName(name)
+}
@@ -0,0 +1,79 @@
+package gcf
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default artifact name templates; each reproduces the name used before templating.
+const (
+	DefaultSnapshotNameTemplate = `{{.Hash}}.json`
+	DefaultJobResultsTemplate   = `{{.Check}}-{{.Time.Unix}}`
+	DefaultDownloadPathTemplate = `{{.Object}}`
+	DefaultBundleNameTemplate   = `support-bundle-{{.Time.Format "20060102T150405Z"}}.tar.gz`
+)
+
+// ArtifactName holds the variables available to artifact name templates.
+type ArtifactName struct {
+	RunID  string
+	Time   time.Time
+	Bucket string
+	Prefix string
+	Check  string
+	Object string
+	// Hash is a short stable digest of the inputs that identify the artifact,
+	// for names that must be the same on every run.
+	Hash string
+}
+
+var artifactNameFuncs = template.FuncMap{
+	"pathEscape": url.PathEscape,
+	"lower":      strings.ToLower,
+	"replace":    strings.ReplaceAll,
+}
+
+// renderArtifactName executes tmpl with data. When the template is invalid or
+// renders to an empty name, the fallback template is used and the problem logged.
+func renderArtifactName(kind, tmpl, fallback string, data ArtifactName) string {
+	name, err := executeArtifactTemplate(tmpl, data)
+	if err == nil && name != "" {
+		return name
+	}
+	if err == nil {
+		err = fmt.Errorf("template rendered an empty name")
+	}
+	log.Printf("Invalid %s name template %q, using default: %v\n", kind, tmpl, err)
+	name, _ = executeArtifactTemplate(fallback, data)
+	return name
+}
+
+func executeArtifactTemplate(tmpl string, data ArtifactName) (string, error) {
+	t, err := template.New("name").Funcs(artifactNameFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// localArtifactPath renders a local file name and keeps it inside dir, since object
+// names are attacker-controlled input to the template. The name is made portable
+// across operating systems; flat drops its directories.
+func localArtifactPath(dir, tmpl string, data ArtifactName, flat bool) string {
+	name := portablePath(renderArtifactName("download path", tmpl, DefaultDownloadPathTemplate, data), flat)
+	if !filepath.IsLocal(name) {
+		log.Printf("Download path %q escapes the download directory, using default\n", name)
+		name, _ = executeArtifactTemplate(DefaultDownloadPathTemplate, data)
+		name = portablePath(name, flat)
+	}
+	return filepath.Join(dir, name)
+}
@@ -0,0 +1,89 @@
+package gcf
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// ReportLine is one line of an NDJSON report: a progress event, a finished check, or
+// the error that stopped the run before any check could start.
+type ReportLine struct {
+	// SchemaVersion is the version of the line's schema, served at /schema/line.
+	SchemaVersion string `json:"schemaVersion"`
+	Type          string `json:"type"`
+	*ProgressEvent
+	Check   *CheckLine `json:"check,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type CheckLine struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Category   string     `json:"category,omitempty"`
+	Doc        string     `json:"doc,omitempty"`
+	DurationMs int64      `json:"durationMs"`
+	Stop       *StopCause `json:"stop,omitempty"`
+}
+
+// wantsNDJSON reports whether the caller asked for JSON Lines, with ?format=ndjson or
+// an Accept header naming application/x-ndjson.
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+}
+
+// streamLines switches the report to NDJSON: narrative is no longer sent, and each
+// progress event and check result is written and flushed as soon as it happens.
+func (rw *reportWriter) streamLines() {
+	rw.ndjson = true
+	rw.Header().Set("Content-Type", ndjsonContentType)
+	rw.Header().Set("X-Diag-Run-Id", rw.runID)
+}
+
+func (rw *reportWriter) emitProgress(event, phase, status string, completed, failed int) {
+	ev := newProgressEvent(rw.runID, event, phase, status, completed, failed, rw.planned, rw.labels)
+	rw.emitLine(ReportLine{Type: "progress", ProgressEvent: &ev})
+}
+
+func (rw *reportWriter) emitCheck(c CheckResult) {
+	rw.emitLine(ReportLine{Type: "check", Check: &CheckLine{
+		Name:       c.Name,
+		Status:     c.Status,
+		Error:      c.Error,
+		Category:   c.Category,
+		Doc:        c.Doc,
+		DurationMs: c.Duration.Milliseconds(),
+		Stop:       c.Stop,
+	}})
+}
+
+// emitLine writes one line and flushes it. The status code recorded so far goes out
+// with the first line, since headers can't change once streaming has begun.
+func (rw *reportWriter) emitLine(line ReportLine) {
+	if !rw.ndjson {
+		return
+	}
+	line.SchemaVersion = reportSchemaVersion
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if !rw.streaming {
+		rw.streaming = true
+		// http.Error may have reset it for an early failure.
+		rw.ResponseWriter.Header().Set("Content-Type", ndjsonContentType)
+		if rw.status != 0 {
+			rw.ResponseWriter.WriteHeader(rw.status)
+		}
+	}
+	rw.ResponseWriter.Write(append(rw.redactor.apply(data), '\n'))
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
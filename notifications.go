@@ -0,0 +1,246 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+)
+
+// notificationEventTypes are the object events a bucket notification can filter on.
+var notificationEventTypes = []string{
+	storage.ObjectFinalizeEvent,
+	storage.ObjectMetadataUpdateEvent,
+	storage.ObjectDeleteEvent,
+	storage.ObjectArchiveEvent,
+}
+
+// NotificationStatus is one notification config and whether its plumbing works.
+type NotificationStatus struct {
+	Notification *storage.Notification
+	TopicExists  bool
+	// AgentCanPublish reports whether the bucket project's Cloud Storage service agent
+	// holds a role that can publish to the topic.
+	AgentCanPublish bool
+	Agent           string
+	Problems        []string
+}
+
+// notificationsHandler manages the bucket's Pub/Sub notification configs:
+//
+//	GET    /notifications lists them and checks each topic and its publisher grant
+//	POST   /notifications?topic=&eventTypes=OBJECT_FINALIZE&prefix=&payload=json|none creates one
+//	DELETE /notifications?id=N deletes one
+//
+// topic defaults to PUBSUB_TOPIC_ID and may be projects/P/topics/T for another project.
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating storage client: %v\n", err)
+		return
+	}
+	defer client.Close()
+	bucket := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId)
+
+	switch r.Method {
+	case http.MethodGet:
+		statuses, err := describeNotifications(ctx, client, bucket, cfg)
+		if err != nil {
+			handleError(ctx, w, err)
+			fmt.Fprintf(w, "Error listing notifications: %v\n", err)
+			return
+		}
+		printNotifications(w, cfg.BucketName, statuses)
+	case http.MethodPost:
+		n, err := notificationFromRequest(r, cfg)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid notification: %v", err), http.StatusBadRequest)
+			return
+		}
+		created, err := bucket.AddNotification(ctx, n)
+		if err != nil {
+			handleError(ctx, w, err)
+			fmt.Fprintf(w, "Error creating notification: %v\n", err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Created notification %s on gs://%s\n", created.ID, cfg.BucketName)
+		printNotification(w, created)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		if err := bucket.DeleteNotification(ctx, id); err != nil {
+			handleError(ctx, w, err)
+			fmt.Fprintf(w, "Error deleting notification %s: %v\n", id, err)
+			return
+		}
+		fmt.Fprintf(w, "Deleted notification %s from gs://%s\n", id, cfg.BucketName)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "notifications are listed with GET, created with POST and deleted with DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// notificationFromRequest builds a notification config from the query, validating the
+// event types and payload format before the API sees them.
+func notificationFromRequest(r *http.Request, cfg *GCloudFunctionConfig) (*storage.Notification, error) {
+	q := r.URL.Query()
+	n := &storage.Notification{
+		TopicProjectID:   cfg.ComputeProjectId,
+		TopicID:          cfg.PubSubTopicId,
+		ObjectNamePrefix: q.Get("prefix"),
+		PayloadFormat:    storage.JSONPayload,
+	}
+	if topic := q.Get("topic"); topic != "" {
+		n.TopicID = topic
+		if parts := strings.Split(topic, "/"); len(parts) == 4 && parts[0] == "projects" && parts[2] == "topics" {
+			n.TopicProjectID, n.TopicID = parts[1], parts[3]
+		} else if strings.Contains(topic, "/") {
+			return nil, fmt.Errorf("topic %q must be a topic ID or projects/PROJECT/topics/TOPIC", topic)
+		}
+	}
+	if n.TopicID == "" {
+		return nil, fmt.Errorf("topic is required when PUBSUB_TOPIC_ID is not set")
+	}
+
+	for _, event := range splitList(q.Get("eventTypes")) {
+		event = strings.ToUpper(event)
+		if !containsString(notificationEventTypes, event) {
+			return nil, fmt.Errorf("unknown event type %q, expected one of %s", event, strings.Join(notificationEventTypes, ", "))
+		}
+		n.EventTypes = append(n.EventTypes, event)
+	}
+
+	switch strings.ToLower(q.Get("payload")) {
+	case "", "json":
+	case "none":
+		n.PayloadFormat = storage.NoPayload
+	default:
+		return nil, fmt.Errorf("payload must be json or none")
+	}
+	return n, nil
+}
+
+// describeNotifications lists the configs and checks each topic exists and that the
+// Cloud Storage service agent may publish to it, the usual reasons events go missing.
+func describeNotifications(ctx context.Context, client *storage.Client, bucket *storage.BucketHandle, cfg *GCloudFunctionConfig) ([]NotificationStatus, error) {
+	notifications, err := bucket.Notifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(notifications))
+	for id := range notifications {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Notifications are published by the agent of the project that owns the bucket.
+	agentProject := cfg.ComputeProjectId
+	if attrs, err := bucket.Attrs(ctx); err == nil && attrs.ProjectNumber != 0 {
+		agentProject = strconv.FormatUint(attrs.ProjectNumber, 10)
+	}
+	agent, agentErr := client.ServiceAccount(ctx, agentProject)
+	clients := map[string]*pubsub.Client{}
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+
+	var statuses []NotificationStatus
+	for _, id := range ids {
+		n := notifications[id]
+		status := NotificationStatus{Notification: n, Agent: agent}
+		if agentErr != nil {
+			status.Problems = append(status.Problems, fmt.Sprintf("could not look up the Cloud Storage service agent: %v", agentErr))
+		}
+
+		psClient, ok := clients[n.TopicProjectID]
+		if !ok {
+			psClient, err = newPubSubClient(ctx, n.TopicProjectID)
+			if err != nil {
+				status.Problems = append(status.Problems, fmt.Sprintf("could not create Pub/Sub client: %v", err))
+				statuses = append(statuses, status)
+				continue
+			}
+			clients[n.TopicProjectID] = psClient
+		}
+		topic := psClient.Topic(n.TopicID)
+		status.TopicExists, err = topic.Exists(ctx)
+		if err != nil {
+			status.Problems = append(status.Problems, fmt.Sprintf("could not check the topic: %v", err))
+		} else if !status.TopicExists {
+			status.Problems = append(status.Problems, "topic does not exist; events are dropped")
+		}
+		if status.TopicExists && agent != "" {
+			policy, err := topic.IAM().Policy(ctx)
+			if err != nil {
+				status.Problems = append(status.Problems, fmt.Sprintf("could not read the topic's IAM policy: %v", err))
+			} else {
+				status.AgentCanPublish = canPublish(policy, "serviceAccount:"+agent)
+				if !status.AgentCanPublish {
+					status.Problems = append(status.Problems, fmt.Sprintf("%s lacks roles/pubsub.publisher on the topic", agent))
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func canPublish(policy *iam.Policy, member string) bool {
+	for _, role := range []iam.RoleName{"roles/pubsub.publisher", "roles/pubsub.editor", "roles/pubsub.admin", iam.Editor, iam.Owner} {
+		if policy.HasRole(member, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func printNotifications(w http.ResponseWriter, bucket string, statuses []NotificationStatus) {
+	fmt.Fprintf(w, "Notifications (gs://%s, %d configs):\n", bucket, len(statuses))
+	for _, s := range statuses {
+		printNotification(w, s.Notification)
+		if len(s.Problems) == 0 {
+			fmt.Fprintf(w, "|   OK: topic exists and %s can publish\n", s.Agent)
+		}
+		for _, problem := range s.Problems {
+			fmt.Fprintf(w, "|   Problem: %s\n", problem)
+		}
+	}
+}
+
+func printNotification(w http.ResponseWriter, n *storage.Notification) {
+	events := "all events"
+	if len(n.EventTypes) > 0 {
+		events = strings.Join(n.EventTypes, ",")
+	}
+	prefix := n.ObjectNamePrefix
+	if prefix == "" {
+		prefix = "(any)"
+	}
+	fmt.Fprintf(w, "| %s: projects/%s/topics/%s, %s, prefix %s, payload %s\n", n.ID, n.TopicProjectID, n.TopicID, events, prefix, n.PayloadFormat)
+	if len(n.CustomAttributes) > 0 {
+		keys := make([]string, 0, len(n.CustomAttributes))
+		for k := range n.CustomAttributes {
+			keys = append(keys, k+"="+n.CustomAttributes[k])
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "|   Attributes: %s\n", strings.Join(keys, ", "))
+	}
+}
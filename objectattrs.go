@@ -0,0 +1,306 @@
+package gcf
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ObjectInspection is what GCS holds for an object besides its content: checksums,
+// generations, encryption, holds, custom metadata and the object's ACL. ACLError is
+// set instead of ACL when the ACL couldn't be read, which on its own is a finding:
+// buckets with uniform bucket-level access have no object ACLs, and reading them
+// needs OWNER on the object or storage.objects.getIamPolicy.
+type ObjectInspection struct {
+	Bucket             string            `json:"bucket"`
+	Name               string            `json:"name"`
+	UserProject        string            `json:"userProject,omitempty"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	StorageClass       string            `json:"storageClass"`
+	Generation         int64             `json:"generation"`
+	Metageneration     int64             `json:"metageneration"`
+	Created            time.Time         `json:"created"`
+	Updated            time.Time         `json:"updated"`
+	CustomTime         *time.Time        `json:"customTime,omitempty"`
+	NoncurrentSince    *time.Time        `json:"noncurrentSince,omitempty"`
+	CRC32C             string            `json:"crc32c"`
+	MD5                string            `json:"md5,omitempty"`
+	ComponentCount     int64             `json:"componentCount,omitempty"`
+	Encryption         string            `json:"encryption"`
+	KMSKeyName         string            `json:"kmsKeyName,omitempty"`
+	CustomerKeySHA256  string            `json:"customerKeySha256,omitempty"`
+	EventBasedHold     bool              `json:"eventBasedHold"`
+	TemporaryHold      bool              `json:"temporaryHold"`
+	RetentionExpires   *time.Time        `json:"retentionExpires,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	ACL                []ObjectACLEntry  `json:"acl,omitempty"`
+	ACLError           string            `json:"aclError,omitempty"`
+	ACLErrorCategory   string            `json:"aclErrorCategory,omitempty"`
+	UniformAccessHint  bool              `json:"uniformAccessHint,omitempty"`
+}
+
+type ObjectACLEntry struct {
+	Entity string `json:"entity"`
+	Role   string `json:"role"`
+	Email  string `json:"email,omitempty"`
+	Domain string `json:"domain,omitempty"`
+}
+
+// objectHandler inspects one object without downloading it, e.g.
+// /object-attrs?name=a/b.csv&bucket=other&generation=1700000000000000&userProject=p.
+// bucket defaults to BUCKET_NAME and userProject, billed for requester-pays buckets,
+// to COMPUTE_PROJECT_ID; userProject=none sends none, to see whether the bucket
+// requires one. A bucket other than BUCKET_NAME needs ALLOW_CONFIG_OVERRIDE=true, as
+// for re-checks.
+func objectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	objectName := q.Get("name")
+	if objectName == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if len(objectName) > maxObjectNameBytes {
+		http.Error(w, fmt.Sprintf("object names are at most %d bytes", maxObjectNameBytes), http.StatusBadRequest)
+		return
+	}
+	bucketName := q.Get("bucket")
+	if bucketName == "" {
+		bucketName = cfg.BucketName
+	}
+	if !bucketNamePattern.MatchString(bucketName) {
+		http.Error(w, "bucket must be a bucket name", http.StatusBadRequest)
+		return
+	}
+	if bucketName != cfg.BucketName && !cfg.AllowConfigOverride {
+		http.Error(w, "inspecting other buckets is disabled; set ALLOW_CONFIG_OVERRIDE=true to allow it", http.StatusForbidden)
+		return
+	}
+	userProject := q.Get("userProject")
+	switch userProject {
+	case "":
+		userProject = cfg.ComputeProjectId
+	case "none":
+		userProject = ""
+	default:
+		if !projectIDPattern.MatchString(userProject) {
+			http.Error(w, "userProject must be a project ID or none", http.StatusBadRequest)
+			return
+		}
+	}
+	var generation int64
+	if v := q.Get("generation"); v != "" {
+		g, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || g <= 0 {
+			http.Error(w, "generation must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		generation = g
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating storage client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	inspection, err := inspectObject(ctx, client, bucketName, objectName, generation, userProject)
+	if err != nil {
+		log.Printf("Failed to inspect gs://%s/%s: %v\n", bucketName, safeObjectName(objectName), err)
+		message := fmt.Sprintf("Failed to inspect gs://%s/%s: %v", bucketName, safeObjectName(objectName), err)
+		if doc := decodeError(err).Doc(); doc != "" {
+			message += "\nSee " + doc
+		}
+		http.Error(w, message, apiErrorStatus(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(inspection)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	printObjectInspection(w, inspection)
+}
+
+// inspectObject reads the object's attributes and then its ACL. Only the attributes
+// failing is an error; a failed ACL read is reported in ACLError.
+func inspectObject(ctx context.Context, client *storage.Client, bucketName, objectName string, generation int64, userProject string) (*ObjectInspection, error) {
+	bucket := client.Bucket(bucketName)
+	if userProject != "" {
+		bucket = bucket.UserProject(userProject)
+	}
+	obj := bucket.Object(objectName)
+	if generation > 0 {
+		obj = obj.Generation(generation)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inspection := objectInspection(attrs)
+	inspection.UserProject = userProject
+
+	rules, err := obj.ACL().List(ctx)
+	if err != nil {
+		decoded := decodeError(err)
+		inspection.ACLError = decoded.Message
+		inspection.ACLErrorCategory = decoded.Category
+		// The API refuses object ACL calls with 400 on buckets with uniform access.
+		inspection.UniformAccessHint = decoded.Code == http.StatusBadRequest
+		return inspection, nil
+	}
+	for _, rule := range rules {
+		inspection.ACL = append(inspection.ACL, ObjectACLEntry{
+			Entity: string(rule.Entity),
+			Role:   string(rule.Role),
+			Email:  rule.Email,
+			Domain: rule.Domain,
+		})
+	}
+	return inspection, nil
+}
+
+func objectInspection(attrs *storage.ObjectAttrs) *ObjectInspection {
+	inspection := &ObjectInspection{
+		Bucket:             attrs.Bucket,
+		Name:               attrs.Name,
+		Size:               attrs.Size,
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentDisposition: attrs.ContentDisposition,
+		CacheControl:       attrs.CacheControl,
+		StorageClass:       attrs.StorageClass,
+		Generation:         attrs.Generation,
+		Metageneration:     attrs.Metageneration,
+		Created:            attrs.Created,
+		Updated:            attrs.Updated,
+		CRC32C:             encodeCRC32C(attrs.CRC32C),
+		ComponentCount:     attrs.ComponentCount,
+		KMSKeyName:         attrs.KMSKeyName,
+		CustomerKeySHA256:  attrs.CustomerKeySHA256,
+		EventBasedHold:     attrs.EventBasedHold,
+		TemporaryHold:      attrs.TemporaryHold,
+		Metadata:           attrs.Metadata,
+		Encryption:         "Google-managed",
+	}
+	// Composite objects have no MD5.
+	if len(attrs.MD5) > 0 {
+		inspection.MD5 = base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+	switch {
+	case attrs.CustomerKeySHA256 != "":
+		inspection.Encryption = "customer-supplied (CSEK)"
+	case attrs.KMSKeyName != "":
+		inspection.Encryption = "customer-managed (CMEK)"
+	}
+	if !attrs.RetentionExpirationTime.IsZero() {
+		inspection.RetentionExpires = &attrs.RetentionExpirationTime
+	}
+	if !attrs.Deleted.IsZero() {
+		inspection.NoncurrentSince = &attrs.Deleted
+	}
+	if !attrs.CustomTime.IsZero() {
+		inspection.CustomTime = &attrs.CustomTime
+	}
+	return inspection
+}
+
+func printObjectInspection(w http.ResponseWriter, o *ObjectInspection) {
+	fmt.Fprintf(w, "Object gs://%s/%s:\n", o.Bucket, safeObjectName(o.Name))
+	if o.UserProject != "" {
+		fmt.Fprintf(w, "| User Project: %s\n", o.UserProject)
+	}
+	fmt.Fprintf(w, "| Size: %d bytes\n", o.Size)
+	if o.ContentType != "" {
+		fmt.Fprintf(w, "| Content Type: %s\n", o.ContentType)
+	}
+	if o.ContentEncoding != "" {
+		fmt.Fprintf(w, "| Content Encoding: %s\n", o.ContentEncoding)
+	}
+	if o.ContentDisposition != "" {
+		fmt.Fprintf(w, "| Content Disposition: %s\n", o.ContentDisposition)
+	}
+	if o.CacheControl != "" {
+		fmt.Fprintf(w, "| Cache Control: %s\n", o.CacheControl)
+	}
+	fmt.Fprintf(w, "| Storage Class: %s\n", o.StorageClass)
+	fmt.Fprintf(w, "| Generation: %d\n", o.Generation)
+	fmt.Fprintf(w, "| Metageneration: %d\n", o.Metageneration)
+	fmt.Fprintf(w, "| Created: %s\n", o.Created.Format(time.RFC3339))
+	fmt.Fprintf(w, "| Updated: %s\n", o.Updated.Format(time.RFC3339))
+	if o.CustomTime != nil {
+		fmt.Fprintf(w, "| Custom Time: %s\n", o.CustomTime.Format(time.RFC3339))
+	}
+	if o.NoncurrentSince != nil {
+		fmt.Fprintf(w, "| Noncurrent Since: %s\n", o.NoncurrentSince.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "| CRC32C: %s\n", o.CRC32C)
+	if o.MD5 != "" {
+		fmt.Fprintf(w, "| MD5: %s\n", o.MD5)
+	} else {
+		fmt.Fprintf(w, "| MD5: none (composite of %d components)\n", o.ComponentCount)
+	}
+
+	fmt.Fprintf(w, "Encryption (%s):\n", o.Encryption)
+	if o.KMSKeyName != "" {
+		fmt.Fprintf(w, "| KMS Key: %s\n", o.KMSKeyName)
+	}
+	if o.CustomerKeySHA256 != "" {
+		fmt.Fprintf(w, "| Customer Key SHA-256: %s\n", o.CustomerKeySHA256)
+		fmt.Fprintf(w, "| Reading the content needs this key\n")
+	}
+
+	fmt.Fprintf(w, "Holds:\n")
+	fmt.Fprintf(w, "| Event-Based Hold: %t\n", o.EventBasedHold)
+	fmt.Fprintf(w, "| Temporary Hold: %t\n", o.TemporaryHold)
+	if o.RetentionExpires != nil {
+		fmt.Fprintf(w, "| Retained Until: %s\n", o.RetentionExpires.Format(time.RFC3339))
+	}
+
+	keys := make([]string, 0, len(o.Metadata))
+	for k := range o.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "Custom Metadata (%d):\n", len(keys))
+	for _, k := range keys {
+		fmt.Fprintf(w, "| %s: %s\n", k, o.Metadata[k])
+	}
+
+	if o.ACLError != "" {
+		fmt.Fprintf(w, "ACL (unavailable):\n")
+		fmt.Fprintf(w, "| %s [%s]\n", o.ACLError, o.ACLErrorCategory)
+		if o.UniformAccessHint {
+			fmt.Fprintf(w, "| The bucket likely has uniform bucket-level access, so IAM alone grants access\n")
+		}
+		return
+	}
+	fmt.Fprintf(w, "ACL (%d):\n", len(o.ACL))
+	for _, entry := range o.ACL {
+		fmt.Fprintf(w, "| %s: %s\n", entry.Entity, entry.Role)
+	}
+}
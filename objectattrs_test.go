@@ -0,0 +1,136 @@
+package gcf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestObjectAttrsHandler(t *testing.T) {
+	type call struct{ path, userProject, generation string }
+	var mu sync.Mutex
+	var calls []call
+	aclStatus := http.StatusOK
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, call{r.URL.Path, r.URL.Query().Get("userProject"), r.URL.Query().Get("generation")})
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/acl"):
+			if aclStatus != http.StatusOK {
+				writeFakeJSON(w, aclStatus, map[string]any{"error": map[string]any{
+					"code":    aclStatus,
+					"message": "Cannot get legacy ACL for an object when uniform bucket-level access is enabled.",
+					"errors":  []map[string]any{{"reason": "invalid", "message": "Cannot get legacy ACL"}},
+				}})
+				return
+			}
+			writeFakeJSON(w, http.StatusOK, map[string]any{"items": []map[string]any{
+				{"entity": "user-owner@example.com", "role": "OWNER", "email": "owner@example.com"},
+				{"entity": "allUsers", "role": "READER"},
+			}})
+		case strings.Contains(r.URL.Path, "/o/"):
+			bucket, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o/")
+			writeFakeJSON(w, http.StatusOK, map[string]any{
+				"bucket":         bucket,
+				"name":           name,
+				"size":           "3",
+				"generation":     "1700000000000000",
+				"metageneration": "2",
+				"crc32c":         "EjRWeA==",
+				"md5Hash":        "AQID",
+				"kmsKeyName":     "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+				"temporaryHold":  true,
+				"metadata":       map[string]string{"team": "data"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	setTestEnv(t, nil)
+	setTestProfiles(t, map[string]map[string]string{"staging": {"BUCKET_NAME": "staging-bucket", "COMPUTE_PROJECT_ID": "staging-project"}})
+
+	tests := []struct {
+		name          string
+		target        string
+		allowOverride bool
+		aclStatus     int
+		wantStatus    int
+		wantBody      []string
+		wantCall      call
+	}{
+		{name: "missing name", target: "/object-attrs", wantStatus: http.StatusBadRequest, wantBody: []string{"name is required"}},
+		{name: "name too long", target: "/object-attrs?name=" + strings.Repeat("a", maxObjectNameBytes+1), wantStatus: http.StatusBadRequest, wantBody: []string{"at most 1024 bytes"}},
+		{name: "invalid bucket", target: "/object-attrs?name=a&bucket=Not_A_Bucket", wantStatus: http.StatusBadRequest, wantBody: []string{"bucket must be a bucket name"}},
+		{name: "invalid userProject", target: "/object-attrs?name=a&userProject=X", wantStatus: http.StatusBadRequest, wantBody: []string{"userProject must be a project ID or none"}},
+		{name: "zero generation", target: "/object-attrs?name=a&generation=0", wantStatus: http.StatusBadRequest, wantBody: []string{"generation must be a positive integer"}},
+		{name: "non-numeric generation", target: "/object-attrs?name=a&generation=latest", wantStatus: http.StatusBadRequest, wantBody: []string{"generation must be a positive integer"}},
+		{name: "unknown profile", target: "/object-attrs?name=a&profile=missing", wantStatus: http.StatusNotFound, wantBody: []string{"no such profile"}},
+		{
+			name: "defaults", target: "/object-attrs?name=a/b.csv", wantStatus: http.StatusOK,
+			wantBody: []string{"Object gs://diag-bucket/a/b.csv:", "| CRC32C: EjRWeA==", "Encryption (customer-managed (CMEK)):", "| Temporary Hold: true", "| team: data", "ACL (2):", "| allUsers: READER"},
+			wantCall: call{"/storage/v1/b/diag-bucket/o/a/b.csv", "diag-project", ""},
+		},
+		{
+			name: "profile", target: "/object-attrs?name=a&profile=staging", wantStatus: http.StatusOK,
+			wantBody: []string{"Object gs://staging-bucket/a:", "| User Project: staging-project"},
+			wantCall: call{"/storage/v1/b/staging-bucket/o/a", "staging-project", ""},
+		},
+		{name: "other bucket refused", target: "/object-attrs?name=a&bucket=other-bucket", wantStatus: http.StatusForbidden, wantBody: []string{"ALLOW_CONFIG_OVERRIDE=true"}},
+		{
+			name: "userProject none and generation", target: "/object-attrs?name=a&bucket=other-bucket&userProject=none&generation=1700000000000000", allowOverride: true, wantStatus: http.StatusOK,
+			wantBody: []string{"Object gs://other-bucket/a:"},
+			wantCall: call{"/storage/v1/b/other-bucket/o/a", "", "1700000000000000"},
+		},
+		{
+			name: "uniform access", target: "/object-attrs?name=a", aclStatus: http.StatusBadRequest, wantStatus: http.StatusOK,
+			wantBody: []string{"ACL (unavailable):", "Cannot get legacy ACL", "uniform bucket-level access"},
+			wantCall: call{"/storage/v1/b/diag-bucket/o/a", "diag-project", ""},
+		},
+		{
+			name: "ACL forbidden", target: "/object-attrs?name=a&format=json", aclStatus: http.StatusForbidden, wantStatus: http.StatusOK,
+			wantBody: []string{`"aclError":`, `"aclErrorCategory":"forbidden"`},
+			wantCall: call{"/storage/v1/b/diag-bucket/o/a", "diag-project", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			calls = nil
+			aclStatus = http.StatusOK
+			if tt.aclStatus != 0 {
+				aclStatus = tt.aclStatus
+			}
+			mu.Unlock()
+			if tt.allowOverride {
+				t.Setenv("ALLOW_CONFIG_OVERRIDE", "true")
+			}
+			w := httptest.NewRecorder()
+			DoIt(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body:\n%s", w.Code, tt.wantStatus, w.Body)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body lacks %q:\n%s", want, w.Body)
+				}
+			}
+			if tt.name == "ACL forbidden" && strings.Contains(w.Body.String(), "uniformAccessHint") {
+				t.Errorf("a 403 on the ACL isn't a uniform access hint:\n%s", w.Body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.wantCall == (call{}) {
+				if len(calls) > 0 {
+					t.Errorf("API calls %v for a refused request", calls)
+				}
+				return
+			}
+			if len(calls) != 2 || calls[0] != tt.wantCall || calls[1].path != tt.wantCall.path+"/acl" {
+				t.Errorf("API calls = %+v, want attrs %+v and then its ACL", calls, tt.wantCall)
+			}
+		})
+	}
+}
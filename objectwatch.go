@@ -0,0 +1,156 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultObjectWatchInterval = 30 * time.Second
+	minObjectWatchInterval     = 5 * time.Second
+)
+
+// ObjectArrived is the message published for each new object generation. Attribute
+// names mirror Cloud Storage notifications so existing subscribers can filter the same way.
+type ObjectArrived struct {
+	Kind       string    `json:"kind"`
+	Bucket     string    `json:"bucket"`
+	Name       string    `json:"name"`
+	Generation int64     `json:"generation"`
+	Size       int64     `json:"size"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// objectWatchHandler polls a prefix for the duration of one invocation and publishes an
+// "object arrived" message per new object to the configured topic, as a stopgap where
+// bucket notifications can't be set up, e.g. /watch-objects?prefix=incoming/&interval=30s&duration=5m.
+// Objects that already exist when the watch starts are not published.
+func objectWatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	ctx = withLang(ctx, requestLang(r))
+	prefix := r.URL.Query().Get("prefix")
+
+	interval := queryDuration(r, "interval", defaultObjectWatchInterval)
+	if interval < minObjectWatchInterval {
+		interval = minObjectWatchInterval
+	}
+	duration := queryDuration(r, "duration", defaultWatchDuration)
+	if duration > maxWatchDuration {
+		duration = maxWatchDuration
+	}
+	labels, err := parseRunLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating storage client: %v\n", err)
+		return
+	}
+	defer client.Close()
+	bucket := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId)
+
+	pubsubClient, err := newPubSubClient(ctx, cfg.ComputeProjectId)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating Pub/Sub client: %v\n", err)
+		return
+	}
+	defer pubsubClient.Close()
+	topic := pubsubClient.Topic(cfg.PubSubTopicId)
+	defer topic.Stop()
+
+	skipPrefix := ""
+	if cfg.SnapshotBucket == cfg.BucketName {
+		skipPrefix = cfg.SnapshotPrefix
+	}
+	previous, err := takeListingSnapshot(ctx, bucket, cfg.BucketName, prefix, skipPrefix)
+	if err != nil {
+		handleError(ctx, w, err)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	fmt.Fprintf(w, "Watching gs://%s/%s every %s for %s (%d existing objects)\n", cfg.BucketName, prefix, interval, duration, len(previous.Objects))
+
+	deadline := time.Now().Add(duration)
+	published, failed := 0, 0
+	for time.Now().Add(interval).Before(deadline) {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		current, err := takeListingSnapshot(ctx, bucket, cfg.BucketName, prefix, skipPrefix)
+		if err != nil {
+			fmt.Fprintf(w, "| %s: listing failed (%v)\n", time.Now().UTC().Format(time.RFC3339), err)
+			continue
+		}
+		for _, arrived := range arrivedObjects(previous, current) {
+			id, err := publishObjectArrived(ctx, topic, arrived, labels)
+			if err != nil {
+				failed++
+				fmt.Fprintf(w, "| %s: %s#%d publish FAILED (%v)\n", arrived.DetectedAt.Format(time.RFC3339), encodeObjectName(arrived.Name, cfg.ObjectNameEncoding), arrived.Generation, err)
+				continue
+			}
+			published++
+			fmt.Fprintf(w, "| %s: %s#%d published as %s\n", arrived.DetectedAt.Format(time.RFC3339), encodeObjectName(arrived.Name, cfg.ObjectNameEncoding), arrived.Generation, id)
+		}
+		previous = current
+	}
+
+	fmt.Fprintf(w, "Watch finished: %d published, %d failed\n", published, failed)
+}
+
+// arrivedObjects returns objects that are new in current or have a new generation,
+// i.e. were created or overwritten; metadata-only updates are ignored.
+func arrivedObjects(previous, current *ListingSnapshot) []ObjectArrived {
+	var arrived []ObjectArrived
+	for name, entry := range current.Objects {
+		if old, ok := previous.Objects[name]; ok && old.Generation == entry.Generation {
+			continue
+		}
+		arrived = append(arrived, ObjectArrived{
+			Kind:       "objectArrived",
+			Bucket:     current.Bucket,
+			Name:       name,
+			Generation: entry.Generation,
+			Size:       entry.Size,
+			DetectedAt: current.TakenAt,
+		})
+	}
+	sort.Slice(arrived, func(i, j int) bool { return arrived[i].Name < arrived[j].Name })
+	return arrived
+}
+
+func publishObjectArrived(ctx context.Context, topic *pubsub.Topic, arrived ObjectArrived, labels map[string]string) (string, error) {
+	data, err := json.Marshal(arrived)
+	if err != nil {
+		return "", err
+	}
+	attributes := map[string]string{}
+	for k, v := range labels {
+		attributes[k] = v
+	}
+	attributes["eventType"] = "OBJECT_FINALIZE"
+	attributes["bucketId"] = arrived.Bucket
+	attributes["objectId"] = arrived.Name
+	attributes["objectGeneration"] = strconv.FormatInt(arrived.Generation, 10)
+
+	return topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attributes}).Get(ctx)
+}
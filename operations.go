@@ -0,0 +1,240 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	storagev1 "google.golang.org/api/storage/v1"
+)
+
+const (
+	operationPollInterval = 5 * time.Second
+	defaultOperationWait  = 5 * time.Minute
+)
+
+// OperationStatus is one look at a bucket long-running operation, such as a bucket
+// relocation, as GCS reports it.
+type OperationStatus struct {
+	Bucket      string
+	OperationID string
+	Type        string
+	Done        bool
+	// Progress is percent complete, or -1 when the operation doesn't report it.
+	Progress              int
+	RequestedCancellation bool
+	Created               time.Time
+	Updated               time.Time
+	Ended                 time.Time
+	// Error is the operation's own failure, as opposed to a failure to poll it.
+	Error string
+}
+
+// OperationPoll is the operation's status each time it was read, until it finished or
+// the wait ran out.
+type OperationPoll struct {
+	Name     string
+	Statuses []OperationStatus
+	Elapsed  time.Duration
+	Error    string
+}
+
+func (p OperationPoll) Err() error {
+	if p.Error != "" {
+		return errors.New(p.Error)
+	}
+	if n := len(p.Statuses); n > 0 && p.Statuses[n-1].Error != "" {
+		return errors.New(p.Statuses[n-1].Error)
+	}
+	return nil
+}
+
+// operationMetadata is the part of an operation's metadata every storage LRO shares,
+// e.g. google.storage.control.v2.RelocateBucketMetadata.
+type operationMetadata struct {
+	Type           string `json:"@type"`
+	CommonMetadata struct {
+		Type                  string    `json:"type"`
+		ProgressPercent       *int      `json:"progressPercent"`
+		RequestedCancellation bool      `json:"requestedCancellation"`
+		CreateTime            time.Time `json:"createTime"`
+		UpdateTime            time.Time `json:"updateTime"`
+		EndTime               time.Time `json:"endTime"`
+	} `json:"commonMetadata"`
+}
+
+// operationHandler reports on a bucket long-running operation started elsewhere, e.g.
+// by gcloud storage buckets relocate: GET /operation?name=projects/_/buckets/B/operations/ID,
+// or ?bucket=B&id=ID. With wait=true it polls until the operation is done or max
+// (default 5m) runs out.
+func operationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	bucket, id, err := parseOperationName(query.Get("name"), query.Get("bucket"), query.Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxWait := time.Duration(0)
+	if query.Get("wait") == "true" {
+		maxWait = queryDuration(r, "max", defaultOperationWait)
+		if maxWait > maxWatchDuration {
+			maxWait = maxWatchDuration
+		}
+	}
+
+	poll := pollBucketOperation(r.Context(), bucket, id, maxWait)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(poll)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	printOperationPoll(w, poll)
+}
+
+// parseOperationName accepts the full name GCS and gcloud print, or the bucket and
+// operation ID separately.
+func parseOperationName(name, bucket, id string) (string, string, error) {
+	if name != "" {
+		rest, ok := strings.CutPrefix(name, "projects/_/buckets/")
+		if ok {
+			bucket, id, ok = strings.Cut(rest, "/operations/")
+		}
+		if !ok || bucket == "" || id == "" || strings.Contains(id, "/") {
+			return "", "", fmt.Errorf("name must look like projects/_/buckets/BUCKET/operations/ID")
+		}
+	}
+	if bucket == "" || id == "" {
+		return "", "", fmt.Errorf("name, or bucket and id, are required")
+	}
+	if !bucketNamePattern.MatchString(bucket) {
+		return "", "", fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	return bucket, id, nil
+}
+
+// pollBucketOperation reads the operation, then keeps reading it every few seconds
+// while it is running and maxWait allows, recording each change.
+func pollBucketOperation(ctx context.Context, bucket, id string, maxWait time.Duration) OperationPoll {
+	poll := OperationPoll{Name: "projects/_/buckets/" + bucket + "/operations/" + id}
+	svc, err := newStorageJSONService(ctx)
+	if err != nil {
+		poll.Error = err.Error()
+		return poll
+	}
+
+	start := time.Now()
+	for {
+		op, err := svc.Operations.Get(bucket, id).Context(ctx).Do()
+		poll.Elapsed = time.Since(start)
+		if err != nil {
+			poll.Error = fmt.Sprintf("failed to get operation: %v", err)
+			return poll
+		}
+		status := operationStatus(bucket, id, op)
+		if n := len(poll.Statuses); n == 0 || !sameOperationStatus(poll.Statuses[n-1], status) {
+			poll.Statuses = append(poll.Statuses, status)
+		}
+		if status.Done || time.Since(start)+operationPollInterval > maxWait {
+			return poll
+		}
+		select {
+		case <-ctx.Done():
+			poll.Error = fmt.Sprintf("stopped polling: %v", ctx.Err())
+			return poll
+		case <-time.After(operationPollInterval):
+		}
+	}
+}
+
+// newStorageJSONService is a client for the parts of the JSON API the storage library
+// doesn't cover, with the same credentials and tracing as createStorageClientWithOAuth.
+func newStorageJSONService(ctx context.Context) (*storagev1.Service, error) {
+	tokenSource, err := clientTokenSource(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token source: %v", err)
+	}
+	httpClient := &http.Client{
+		Transport: &apiTraceTransport{base: &quotaObservingTransport{base: &oauth2.Transport{Source: tokenSource}}},
+	}
+	svc, err := storagev1.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage JSON API client: %v", err)
+	}
+	return svc, nil
+}
+
+func operationStatus(bucket, id string, op *storagev1.GoogleLongrunningOperation) OperationStatus {
+	status := OperationStatus{Bucket: bucket, OperationID: id, Done: op.Done, Progress: -1}
+	var metadata operationMetadata
+	if len(op.Metadata) > 0 && json.Unmarshal(op.Metadata, &metadata) == nil {
+		common := metadata.CommonMetadata
+		status.Type = common.Type
+		if status.Type == "" {
+			status.Type = metadata.Type[strings.LastIndex(metadata.Type, "/")+1:]
+		}
+		if common.ProgressPercent != nil {
+			status.Progress = *common.ProgressPercent
+		}
+		status.RequestedCancellation = common.RequestedCancellation
+		status.Created, status.Updated, status.Ended = common.CreateTime, common.UpdateTime, common.EndTime
+	}
+	if op.Error != nil {
+		status.Error = fmt.Sprintf("%s (code %d)", op.Error.Message, op.Error.Code)
+	}
+	return status
+}
+
+// sameOperationStatus ignores Updated, which some operations bump on every read.
+func sameOperationStatus(a, b OperationStatus) bool {
+	a.Updated, b.Updated = time.Time{}, time.Time{}
+	return a == b
+}
+
+func printOperationPoll(w http.ResponseWriter, poll OperationPoll) {
+	fmt.Fprintf(w, "Operation (%s):\n", poll.Name)
+	for i, status := range poll.Statuses {
+		if i == 0 {
+			if status.Type != "" {
+				fmt.Fprintf(w, "| Type: %s\n", status.Type)
+			}
+			if !status.Created.IsZero() {
+				fmt.Fprintf(w, "| Created: %s\n", status.Created.Format(time.RFC3339))
+			}
+		}
+		state := "running"
+		switch {
+		case status.Done && status.Error != "":
+			state = "FAILED - " + status.Error
+		case status.Done:
+			state = "done"
+		case status.RequestedCancellation:
+			state = "cancelling"
+		}
+		if status.Progress >= 0 {
+			state += fmt.Sprintf(", %d%%", status.Progress)
+		}
+		if !status.Updated.IsZero() {
+			state += ", updated " + status.Updated.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "| Status: %s\n", state)
+		if !status.Ended.IsZero() {
+			fmt.Fprintf(w, "| Ended: %s\n", status.Ended.Format(time.RFC3339))
+		}
+	}
+	fmt.Fprintf(w, "| Polled For: %s\n", poll.Elapsed.Round(time.Second))
+	if poll.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", poll.Error)
+	}
+}
@@ -0,0 +1,81 @@
+package gcf
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+)
+
+type BucketOwnership struct {
+	OwnerProjectNumber string
+	OwnerProjectID     string
+	ComputeProjectID   string
+	CrossProject       bool
+	RequesterPays      bool
+	BilledProject      string
+	Note               string
+}
+
+// describeBucketOwnership works out which project owns the bucket and which one pays
+// for the function's requests. Requests carrying a user project are billed to it;
+// otherwise the owner pays, and requester-pays buckets reject the request.
+func describeBucketOwnership(attrs *storage.BucketAttrs, computeProjectID string, projects []ProjectRef) BucketOwnership {
+	ownership := BucketOwnership{
+		OwnerProjectNumber: strconv.FormatUint(attrs.ProjectNumber, 10),
+		ComputeProjectID:   computeProjectID,
+		RequesterPays:      attrs.RequesterPays,
+	}
+
+	computeNumber := ""
+	for _, ref := range projects {
+		if ref.Number == ownership.OwnerProjectNumber {
+			ownership.OwnerProjectID = ref.ID
+		}
+		if ref.ID == computeProjectID {
+			computeNumber = ref.Number
+		}
+	}
+
+	switch {
+	case computeNumber != "":
+		ownership.CrossProject = computeNumber != ownership.OwnerProjectNumber
+	case ownership.OwnerProjectID != "":
+		ownership.CrossProject = ownership.OwnerProjectID != computeProjectID
+	default:
+		ownership.CrossProject = true
+		ownership.Note = "could not resolve both project numbers; assuming the bucket lives in another project"
+	}
+
+	switch {
+	case computeProjectID != "":
+		ownership.BilledProject = computeProjectID
+	case attrs.RequesterPays:
+		ownership.Note = "bucket is requester-pays but no user project is configured; requests will be rejected"
+	default:
+		ownership.BilledProject = ownership.OwnerProjectID
+		if ownership.BilledProject == "" {
+			ownership.BilledProject = "project number " + ownership.OwnerProjectNumber
+		}
+	}
+	return ownership
+}
+
+func printBucketOwnership(w http.ResponseWriter, o BucketOwnership) {
+	owner := o.OwnerProjectID
+	if owner == "" {
+		owner = "?"
+	}
+	fmt.Fprintln(w, "Bucket Ownership:")
+	fmt.Fprintf(w, "| Owner Project: %s (number %s)\n", owner, o.OwnerProjectNumber)
+	fmt.Fprintf(w, "| Compute Project: %s\n", o.ComputeProjectID)
+	fmt.Fprintf(w, "| Cross-Project Access: %t\n", o.CrossProject)
+	fmt.Fprintf(w, "| Requester Pays: %t\n", o.RequesterPays)
+	if o.BilledProject != "" {
+		fmt.Fprintf(w, "| Billed Project: %s\n", o.BilledProject)
+	}
+	if o.Note != "" {
+		fmt.Fprintf(w, "| Note: %s\n", o.Note)
+	}
+}
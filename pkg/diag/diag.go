@@ -0,0 +1,259 @@
+// Package diag runs the function's core checks from any Go program: bucket access,
+// object listing, download verification and a Pub/Sub round trip. Results are typed
+// values rather than report text, so callers decide how to present them.
+package diag
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// Config names the resources the checks run against. Project is also billed for
+// requester-pays buckets.
+type Config struct {
+	Project      string
+	Bucket       string
+	Topic        string
+	Subscription string
+}
+
+// Client holds the Storage and Pub/Sub clients shared by the checks.
+type Client struct {
+	cfg     Config
+	storage *storage.Client
+	pubsub  *pubsub.Client
+}
+
+// New creates the clients with opts, e.g. option.WithCredentialsFile. The Pub/Sub
+// client is only created when cfg names a topic or subscription.
+func New(ctx context.Context, cfg Config, opts ...option.ClientOption) (*Client, error) {
+	sc, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+	c := &Client{cfg: cfg, storage: sc}
+	if cfg.Topic != "" || cfg.Subscription != "" {
+		c.pubsub, err = pubsub.NewClient(ctx, cfg.Project, opts...)
+		if err != nil {
+			sc.Close()
+			return nil, fmt.Errorf("failed to create Pub/Sub client: %v", err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	err := c.storage.Close()
+	if c.pubsub != nil {
+		err = errors.Join(err, c.pubsub.Close())
+	}
+	return err
+}
+
+func (c *Client) bucket() *storage.BucketHandle {
+	return c.storage.Bucket(c.cfg.Bucket).UserProject(c.cfg.Project)
+}
+
+// AccessResult describes the bucket and which of the probed permissions are held.
+type AccessResult struct {
+	Bucket             string
+	Location           string
+	ProjectNumber      uint64
+	RequesterPays      bool
+	GrantedPermissions []string
+	MissingPermissions []string
+}
+
+// bucketPermissions are what the listing and download checks need.
+var bucketPermissions = []string{"storage.buckets.get", "storage.objects.list", "storage.objects.get"}
+
+// CheckAccess reads the bucket's attributes and tests the caller's permissions on it.
+func (c *Client) CheckAccess(ctx context.Context) (AccessResult, error) {
+	result := AccessResult{Bucket: c.cfg.Bucket}
+	attrs, err := c.bucket().Attrs(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error fetching bucket attributes: %w", err)
+	}
+	result.Location = attrs.Location
+	result.ProjectNumber = attrs.ProjectNumber
+	result.RequesterPays = attrs.RequesterPays
+
+	granted, err := c.bucket().IAM().TestPermissions(ctx, bucketPermissions)
+	if err != nil {
+		return result, fmt.Errorf("failed to test permissions: %w", err)
+	}
+	has := map[string]bool{}
+	for _, perm := range granted {
+		has[perm] = true
+	}
+	for _, perm := range bucketPermissions {
+		if has[perm] {
+			result.GrantedPermissions = append(result.GrantedPermissions, perm)
+		} else {
+			result.MissingPermissions = append(result.MissingPermissions, perm)
+		}
+	}
+	return result, nil
+}
+
+type Object struct {
+	Name       string
+	Size       int64
+	Generation int64
+	Updated    time.Time
+}
+
+// ListResult holds up to the requested number of objects and whether more exist.
+type ListResult struct {
+	Objects   []Object
+	Truncated bool
+}
+
+// ListObjects lists objects under prefix, stopping after limit (0 for all).
+func (c *Client) ListObjects(ctx context.Context, prefix string, limit int) (ListResult, error) {
+	var result ListResult
+	it := c.bucket().Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return result, nil
+		}
+		if err != nil {
+			return result, fmt.Errorf("error listing objects: %w", err)
+		}
+		if limit > 0 && len(result.Objects) == limit {
+			result.Truncated = true
+			return result, nil
+		}
+		result.Objects = append(result.Objects, Object{Name: attrs.Name, Size: attrs.Size, Generation: attrs.Generation, Updated: attrs.Updated})
+	}
+}
+
+// DownloadResult compares what was read with the checksums GCS stored for the object.
+// An empty expected value means GCS has none for that algorithm, e.g. MD5 on composites.
+type DownloadResult struct {
+	Object         string
+	Generation     int64
+	Bytes          int64
+	CRC32C         string
+	ExpectedCRC32C string
+	MD5            string
+	ExpectedMD5    string
+	Duration       time.Duration
+}
+
+func (r DownloadResult) Verified() bool {
+	return (r.ExpectedCRC32C == "" || r.CRC32C == r.ExpectedCRC32C) && (r.ExpectedMD5 == "" || r.MD5 == r.ExpectedMD5)
+}
+
+// VerifyDownload reads the whole object and checks it against its stored checksums.
+// The read is pinned to the generation the checksums belong to, so an overwrite
+// meanwhile can't show up as a mismatch, and gzip-encoded objects are read as stored,
+// since that is what the checksums cover. A mismatch is reported in the result and as
+// an error.
+func (c *Client) VerifyDownload(ctx context.Context, object string) (DownloadResult, error) {
+	result := DownloadResult{Object: object}
+	start := time.Now()
+	obj := c.bucket().Object(object)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to read attributes of %s: %w", object, err)
+	}
+	result.Generation = attrs.Generation
+	rc, err := obj.Generation(attrs.Generation).ReadCompressed(attrs.ContentEncoding == "gzip").NewReader(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to create reader for object %s: %w", object, err)
+	}
+	defer rc.Close()
+
+	digests := NewDigestSet([]string{"crc32c", "md5"})
+	result.Bytes, err = io.Copy(digests.Writer(), rc)
+	result.Duration = time.Since(start)
+	if err != nil {
+		return result, fmt.Errorf("failed to read object %s: %w", object, err)
+	}
+	for _, d := range digests.Results(attrs) {
+		switch d.Algorithm {
+		case "crc32c":
+			result.CRC32C, result.ExpectedCRC32C = d.Value, d.Expected
+		case "md5":
+			result.MD5, result.ExpectedMD5 = d.Value, d.Expected
+		}
+	}
+	if !result.Verified() {
+		return result, fmt.Errorf("checksum mismatch for object %s", object)
+	}
+	return result, nil
+}
+
+// RoundTripResult times a message from publish to its delivery on the subscription.
+type RoundTripResult struct {
+	MessageID    string
+	PublishTime  time.Duration
+	DeliveryTime time.Duration
+	Received     bool
+	// Skipped counts other messages seen meanwhile; they were nacked for redelivery.
+	Skipped int
+}
+
+// PubSubRoundTrip publishes a marked message to the topic and waits up to timeout for
+// it to arrive on the subscription, which must be attached to that topic.
+func (c *Client) PubSubRoundTrip(ctx context.Context, timeout time.Duration) (RoundTripResult, error) {
+	var result RoundTripResult
+	if c.pubsub == nil || c.cfg.Topic == "" || c.cfg.Subscription == "" {
+		return result, errors.New("a topic and a subscription are required for the round trip")
+	}
+	marker := make([]byte, 8)
+	rand.Read(marker)
+	id := hex.EncodeToString(marker)
+
+	topic := c.pubsub.Topic(c.cfg.Topic)
+	defer topic.Stop()
+	start := time.Now()
+	msgID, err := topic.Publish(ctx, &pubsub.Message{
+		Data:       []byte("diag round trip"),
+		Attributes: map[string]string{"gcf-probe": "roundtrip", "roundtrip-id": id},
+	}).Get(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to publish: %w", err)
+	}
+	result.MessageID = msgID
+	result.PublishTime = time.Since(start)
+
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var mu sync.Mutex
+	err = c.pubsub.Subscription(c.cfg.Subscription).Receive(cctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		if msg.Attributes["roundtrip-id"] != id {
+			result.Skipped++
+			msg.Nack()
+			return
+		}
+		msg.Ack()
+		if !result.Received {
+			result.Received = true
+			result.DeliveryTime = time.Since(start)
+		}
+		cancel()
+	})
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		return result, fmt.Errorf("failed to receive: %w", err)
+	}
+	if !result.Received {
+		return result, fmt.Errorf("message %s not received within %s", msgID, timeout)
+	}
+	return result, nil
+}
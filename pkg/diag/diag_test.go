@@ -0,0 +1,90 @@
+package diag
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+func TestVerifyDownloadReadsGzipAsStored(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("uploaded with gzip=true"))
+	zw.Close()
+	stored := buf.Bytes()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("alt") == "media" || !strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("X-Goog-Generation", "1")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(stored)
+			return
+		}
+		sum := md5.Sum(stored)
+		crc := binary.BigEndian.AppendUint32(nil, crc32.Checksum(stored, crc32.MakeTable(crc32.Castagnoli)))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"bucket":"b","name":"o","generation":"1","size":"%d","contentEncoding":"gzip","md5Hash":%q,"crc32c":%q}`,
+			len(stored), base64.StdEncoding.EncodeToString(sum[:]), base64.StdEncoding.EncodeToString(crc))
+	}))
+	defer srv.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+
+	c, err := New(context.Background(), Config{Project: "p", Bucket: "b"}, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	result, err := c.VerifyDownload(context.Background(), "o")
+	if err != nil {
+		t.Fatalf("VerifyDownload() = %v, want the stored gzip bytes verified", err)
+	}
+	if result.Bytes != int64(len(stored)) {
+		t.Errorf("read %d bytes, want the %d stored", result.Bytes, len(stored))
+	}
+}
+
+func TestVerifyDownloadPinsGeneration(t *testing.T) {
+	// Generation 1 was listed; 2 overwrote it before the read.
+	contents := map[string]string{"1": "old contents", "2": "new contents"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gen := r.URL.Query().Get("generation")
+		if r.URL.Query().Get("alt") == "media" || !strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			if gen == "" {
+				gen = "2"
+			}
+			w.Header().Set("X-Goog-Generation", gen)
+			w.Write([]byte(contents[gen]))
+			return
+		}
+		sum := md5.Sum([]byte(contents["1"]))
+		crc := binary.BigEndian.AppendUint32(nil, crc32.Checksum([]byte(contents["1"]), crc32.MakeTable(crc32.Castagnoli)))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"bucket":"b","name":"o","generation":"1","size":"12","md5Hash":%q,"crc32c":%q}`,
+			base64.StdEncoding.EncodeToString(sum[:]), base64.StdEncoding.EncodeToString(crc))
+	}))
+	defer srv.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+
+	c, err := New(context.Background(), Config{Project: "p", Bucket: "b"}, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	result, err := c.VerifyDownload(context.Background(), "o")
+	if err != nil {
+		t.Fatalf("VerifyDownload() = %v, want generation 1 read and verified", err)
+	}
+	if result.Generation != 1 || result.MD5 != result.ExpectedMD5 {
+		t.Errorf("result = %+v, want generation 1 with a matching MD5", result)
+	}
+}
@@ -0,0 +1,118 @@
+package diag
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+var (
+	digestMu        sync.RWMutex
+	digestFactories = map[string]func() hash.Hash{
+		"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+		"md5":    md5.New,
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+)
+
+// RegisterDigest makes another algorithm (e.g. BLAKE3) selectable by name.
+func RegisterDigest(name string, factory func() hash.Hash) {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	digestFactories[name] = factory
+}
+
+type DigestResult struct {
+	Algorithm string
+	Value     string
+	Expected  string
+	Error     string
+}
+
+// Matches is false only when GCS published a value for the algorithm and it differs.
+func (d DigestResult) Matches() bool {
+	return d.Expected == "" || d.Expected == d.Value
+}
+
+// DigestSet computes several digests over one pass of the object data.
+type DigestSet struct {
+	names   []string
+	hashes  map[string]hash.Hash
+	unknown []string
+}
+
+// NewDigestSet computes the named digests; names no algorithm is registered for are
+// reported as unsupported by Results.
+func NewDigestSet(names []string) *DigestSet {
+	digestMu.RLock()
+	defer digestMu.RUnlock()
+
+	set := &DigestSet{hashes: map[string]hash.Hash{}}
+	for _, name := range names {
+		factory, ok := digestFactories[name]
+		if !ok {
+			set.unknown = append(set.unknown, name)
+			continue
+		}
+		if _, dup := set.hashes[name]; !dup {
+			set.names = append(set.names, name)
+			set.hashes[name] = factory()
+		}
+	}
+	return set
+}
+
+func (s *DigestSet) Writer() io.Writer {
+	writers := make([]io.Writer, 0, len(s.hashes))
+	for _, name := range s.names {
+		writers = append(writers, s.hashes[name])
+	}
+	return io.MultiWriter(writers...)
+}
+
+// Results compares the computed digests with those GCS stores for the object, which
+// must be the generation that was read. CRC32C and MD5 use the base64 encoding GCS
+// reports; other digests are hex.
+func (s *DigestSet) Results(attrs *storage.ObjectAttrs) []DigestResult {
+	var results []DigestResult
+	for _, name := range s.names {
+		sum := s.hashes[name].Sum(nil)
+		result := DigestResult{Algorithm: name, Value: hex.EncodeToString(sum)}
+		switch name {
+		case "crc32c":
+			result.Value = base64.StdEncoding.EncodeToString(sum)
+			if attrs != nil {
+				expected := make([]byte, 4)
+				binary.BigEndian.PutUint32(expected, attrs.CRC32C)
+				result.Expected = base64.StdEncoding.EncodeToString(expected)
+			}
+		case "md5":
+			result.Value = base64.StdEncoding.EncodeToString(sum)
+			// Composite objects have no MD5.
+			if attrs != nil && len(attrs.MD5) > 0 {
+				result.Expected = base64.StdEncoding.EncodeToString(attrs.MD5)
+			}
+		}
+		results = append(results, result)
+	}
+
+	unknown := append([]string(nil), s.unknown...)
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		results = append(results, DigestResult{Algorithm: name, Error: "unsupported algorithm"})
+	}
+	return results
+}
@@ -0,0 +1,140 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Check is a custom diagnostic compiled into the function. Register it with
+// RegisterCheck from an init func; it then runs with the built-in checks, shows up in
+// the report, the checks matrix and progress events, and can be selected with ?checks=.
+type Check interface {
+	Name() string
+	Run(ctx context.Context) Result
+}
+
+// DependentCheck is a Check that only makes sense once other checks have passed, e.g.
+// one that reads objects can declare list_objects.
+type DependentCheck interface {
+	Check
+	After() []string
+}
+
+// Result is a custom check's outcome. A non-nil Err fails the check; Details are
+// printed under the check's section of the report.
+type Result struct {
+	Err     error
+	Details []string
+}
+
+var (
+	checkNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+	pluginMu         sync.Mutex
+)
+
+// RegisterCheck adds c to every diagnostics run. It panics when the name is not
+// lowercase snake_case or is already taken, as both are programming errors.
+func RegisterCheck(c Check) {
+	name := c.Name()
+	if !checkNamePattern.MatchString(name) {
+		panic(fmt.Sprintf("gcf: invalid check name %q", name))
+	}
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+	if slices.ContainsFunc(diagChecks, func(def checkDef) bool { return def.name == name }) {
+		panic(fmt.Sprintf("gcf: check %q registered twice", name))
+	}
+
+	var after []string
+	if dc, ok := c.(DependentCheck); ok {
+		after = dc.After()
+	}
+	diagChecks = append(diagChecks, checkDef{name: name, after: after, run: func(run *diagRun, w http.ResponseWriter) error {
+		result := c.Run(run.ctx)
+		run.rw.check(name, result.Err)
+		printPluginResult(w, name, result)
+		return result.Err
+	}})
+	if _, ok := standaloneChecks[name]; !ok {
+		standaloneChecks[name] = func(ctx context.Context, _ *GCloudFunctionConfig) error {
+			return c.Run(ctx).Err
+		}
+	}
+}
+
+// selectChecks returns the enabled checks, narrowed to the comma-separated names in
+// ?checks= (or a posted run config's checks) plus whatever they depend on.
+func selectChecks(r *http.Request, cfg *GCloudFunctionConfig) ([]checkDef, error) {
+	pluginMu.Lock()
+	registered := slices.Clone(diagChecks)
+	pluginMu.Unlock()
+
+	var enabled []checkDef
+	for _, def := range registered {
+		if def.enabled == nil || def.enabled(cfg) {
+			enabled = append(enabled, def)
+		}
+	}
+	requested := splitList(r.URL.Query().Get("checks"))
+	if len(requested) == 0 {
+		requested = cfg.Checks
+	}
+	if len(requested) == 0 {
+		return enabled, nil
+	}
+
+	byName := map[string]checkDef{}
+	var names []string
+	for _, def := range enabled {
+		byName[def.name] = def
+		names = append(names, def.name)
+	}
+	want := map[string]bool{}
+	var add func(name string) error
+	add = func(name string) error {
+		def, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown or disabled check %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+		if want[name] {
+			return nil
+		}
+		want[name] = true
+		for _, dep := range def.after {
+			if err := add(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range requested {
+		if err := add(name); err != nil {
+			return nil, err
+		}
+	}
+
+	var selected []checkDef
+	for _, def := range enabled {
+		if want[def.name] {
+			selected = append(selected, def)
+		}
+	}
+	return selected, nil
+}
+
+func printPluginResult(w http.ResponseWriter, name string, result Result) {
+	fmt.Fprintf(w, "Check %s:\n", name)
+	for _, detail := range result.Details {
+		fmt.Fprintf(w, "| %s\n", detail)
+	}
+	if result.Err != nil {
+		fmt.Fprintf(w, "| Error: %v\n", result.Err)
+	} else {
+		fmt.Fprintln(w, "| OK")
+	}
+}
@@ -0,0 +1,195 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const preconditionProbeBytes = 1 << 10
+
+// RaceWriter is one of the concurrent conditional writes in a round.
+type RaceWriter struct {
+	Generation int64
+	Duration   time.Duration
+	// Rejected is set when GCS refused the write with 412 Precondition Failed.
+	Rejected bool
+	Error    string
+}
+
+// RaceRound is two writers racing on the same precondition: ifGenerationMatch=0 to
+// create the object, then ifGenerationMatch on the generation that won.
+type RaceRound struct {
+	Name           string
+	IfGeneration   int64
+	Writers        [2]RaceWriter
+	Winner         int
+	LiveGeneration int64
+	// Problem says how the round broke the optimistic-concurrency contract, if it did.
+	Problem string
+}
+
+// PreconditionRace is the outcome of both rounds on one probe object.
+type PreconditionRace struct {
+	Object string
+	Rounds []RaceRound
+}
+
+func (c PreconditionRace) Err() error {
+	var problems []string
+	for _, round := range c.Rounds {
+		if round.Problem != "" {
+			problems = append(problems, round.Name+": "+round.Problem)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkPreconditionRace races two conditional writes to the same object, first to
+// create it and then to replace the generation just created. Applications doing
+// read-modify-write with ifGenerationMatch rely on exactly one of them winning, the
+// other getting 412, and the object then holding the winner's bytes.
+func checkPreconditionRace(ctx context.Context, client *storage.Client, bucket, userProject, object string) PreconditionRace {
+	race := PreconditionRace{Object: object}
+	obj := client.Bucket(bucket).UserProject(userProject).Object(object)
+	artifacts := cleanupFrom(ctx)
+	artifacts.trackObject(obj)
+
+	create := raceConditionalWrites(ctx, obj, "create", 0, artifacts.artifactMetadata())
+	race.Rounds = append(race.Rounds, create)
+	if create.Problem != "" || create.Winner < 0 {
+		return race
+	}
+	race.Rounds = append(race.Rounds, raceConditionalWrites(ctx, obj, "update", create.LiveGeneration, artifacts.artifactMetadata()))
+	return race
+}
+
+// raceConditionalWrites starts both writers together, each with its own payload, then
+// reads the object back to see whose bytes it holds.
+func raceConditionalWrites(ctx context.Context, obj *storage.ObjectHandle, name string, generation int64, metadata map[string]string) RaceRound {
+	round := RaceRound{Name: name, IfGeneration: generation, Winner: -1}
+	conds := storage.Conditions{DoesNotExist: true}
+	if generation != 0 {
+		conds = storage.Conditions{GenerationMatch: generation}
+	}
+
+	var payloads [2][]byte
+	for i := range payloads {
+		payloads[i] = make([]byte, preconditionProbeBytes)
+		rand.Read(payloads[i])
+	}
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range round.Writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			round.Writers[i] = conditionalWrite(ctx, obj.If(conds), payloads[i], metadata)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	var winners, rejected []int
+	for i, writer := range round.Writers {
+		switch {
+		case writer.Error == "":
+			winners = append(winners, i)
+		case writer.Rejected:
+			rejected = append(rejected, i)
+		}
+	}
+	switch {
+	case len(winners) == 2:
+		round.Problem = "both writes succeeded; the precondition did not serialize them"
+		return round
+	case len(winners) == 0 && len(rejected) == 2:
+		round.Problem = "both writes were rejected with 412; neither should have been"
+		return round
+	case len(winners) == 0:
+		round.Problem = "no write succeeded"
+		return round
+	case len(rejected) == 0:
+		round.Problem = fmt.Sprintf("the losing write failed with %q instead of 412", round.Writers[1-winners[0]].Error)
+		return round
+	}
+	round.Winner = winners[0]
+
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		round.Problem = fmt.Sprintf("failed to read back: %v", err)
+		return round
+	}
+	round.LiveGeneration = attrs.Generation
+	if attrs.Generation != round.Writers[round.Winner].Generation {
+		round.Problem = fmt.Sprintf("live generation %d is not the winner's %d", attrs.Generation, round.Writers[round.Winner].Generation)
+		return round
+	}
+	rc, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		round.Problem = fmt.Sprintf("failed to read back: %v", err)
+		return round
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	switch {
+	case err != nil:
+		round.Problem = fmt.Sprintf("failed to read back: %v", err)
+	case !bytes.Equal(got, payloads[round.Winner]):
+		round.Problem = "the object holds different bytes than the winning write sent"
+	}
+	return round
+}
+
+func conditionalWrite(ctx context.Context, obj *storage.ObjectHandle, payload []byte, metadata map[string]string) RaceWriter {
+	var writer RaceWriter
+	start := time.Now()
+	wc := obj.NewWriter(ctx)
+	wc.Metadata = metadata
+	_, err := wc.Write(payload)
+	if closeErr := wc.Close(); err == nil {
+		err = closeErr
+	}
+	writer.Duration = time.Since(start)
+	if err != nil {
+		writer.Error = err.Error()
+		writer.Rejected = decodeError(err).Code == http.StatusPreconditionFailed
+		return writer
+	}
+	writer.Generation = wc.Attrs().Generation
+	return writer
+}
+
+func printPreconditionRace(w http.ResponseWriter, race PreconditionRace) {
+	fmt.Fprintf(w, "Precondition Race (%s):\n", race.Object)
+	for _, round := range race.Rounds {
+		for i, writer := range round.Writers {
+			outcome := fmt.Sprintf("won, generation %d", writer.Generation)
+			switch {
+			case writer.Rejected:
+				outcome = "412 Precondition Failed"
+			case writer.Error != "":
+				outcome = "FAILED - " + writer.Error
+			}
+			fmt.Fprintf(w, "| %s (ifGenerationMatch=%d), writer %d: %s in %s\n", round.Name, round.IfGeneration, i+1, outcome, writer.Duration.Round(time.Millisecond))
+		}
+		if round.Problem != "" {
+			fmt.Fprintf(w, "| %s: FAILED - %s\n", round.Name, round.Problem)
+		} else {
+			fmt.Fprintf(w, "| %s: exactly one write won and generation %d holds its bytes\n", round.Name, round.LiveGeneration)
+		}
+	}
+}
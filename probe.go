@@ -0,0 +1,136 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const endpointProbeTimeout = 5 * time.Second
+
+type EndpointProbeResult struct {
+	Target      string
+	Host        string
+	ResolvedIPs []string
+	DNSError    string
+	TCPLatency  time.Duration
+	TCPError    string
+	HTTPStatus  int
+	HTTPError   string
+}
+
+// probeEndpoints checks DNS, TCP and (for URLs) HTTP reachability of each configured endpoint.
+func probeEndpoints(ctx context.Context, endpoints []string) []EndpointProbeResult {
+	results := make([]EndpointProbeResult, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		results = append(results, probeEndpoint(ctx, endpoint))
+	}
+	return results
+}
+
+func probeEndpoint(ctx context.Context, target string) EndpointProbeResult {
+	result := EndpointProbeResult{Target: target}
+
+	host, port, targetURL, err := parseProbeTarget(target)
+	if err != nil {
+		result.DNSError = err.Error()
+		return result
+	}
+	result.Host = host
+
+	ctx, cancel := context.WithTimeout(ctx, endpointProbeTimeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		result.DNSError = err.Error()
+		return result
+	}
+	result.ResolvedIPs = ips
+
+	if port != "" {
+		var dialer net.Dialer
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			result.TCPError = err.Error()
+			return result
+		}
+		result.TCPLatency = time.Since(start)
+		conn.Close()
+	}
+
+	if targetURL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+		if err != nil {
+			result.HTTPError = err.Error()
+			return result
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			result.HTTPError = err.Error()
+			return result
+		}
+		resp.Body.Close()
+		result.HTTPStatus = resp.StatusCode
+	}
+
+	return result
+}
+
+// parseProbeTarget accepts either a URL (http/https) or a bare host[:port].
+func parseProbeTarget(target string) (host, port, targetURL string, err error) {
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", "", "", fmt.Errorf("invalid probe URL %q: %v", target, err)
+		}
+		port = u.Port()
+		if port == "" {
+			switch u.Scheme {
+			case "https":
+				port = "443"
+			case "http":
+				port = "80"
+			}
+		}
+		return u.Hostname(), port, target, nil
+	}
+
+	if h, p, splitErr := net.SplitHostPort(target); splitErr == nil {
+		return h, p, "", nil
+	}
+	return target, "", "", nil
+}
+
+func printEndpointProbes(w http.ResponseWriter, results []EndpointProbeResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "Endpoint Probes:")
+	for _, r := range results {
+		fmt.Fprintf(w, "| %s\n", r.Target)
+		if r.DNSError != "" {
+			fmt.Fprintf(w, "|   DNS: FAILED (%s)\n", r.DNSError)
+			continue
+		}
+		fmt.Fprintf(w, "|   DNS: %s -> %s\n", r.Host, strings.Join(r.ResolvedIPs, ", "))
+		if r.TCPError != "" {
+			fmt.Fprintf(w, "|   TCP: FAILED (%s)\n", r.TCPError)
+			continue
+		}
+		if r.TCPLatency > 0 {
+			fmt.Fprintf(w, "|   TCP: connected in %s\n", r.TCPLatency.Round(time.Millisecond))
+		}
+		if r.HTTPError != "" {
+			fmt.Fprintf(w, "|   HTTP: FAILED (%s)\n", r.HTTPError)
+		} else if r.HTTPStatus != 0 {
+			fmt.Fprintf(w, "|   HTTP: %d %s\n", r.HTTPStatus, http.StatusText(r.HTTPStatus))
+		}
+	}
+}
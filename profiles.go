@@ -0,0 +1,178 @@
+package gcf
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// profileSecretTTL is how long profiles read from Secret Manager are reused, so a new
+// secret version is picked up without a redeploy.
+const profileSecretTTL = 5 * time.Minute
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// unprofiledVars say where configuration comes from or who may change it, so they only
+// make sense for the whole deployment.
+var unprofiledVars = map[string]bool{
+	"CONFIG_FILE":            true,
+	"CONFIG_PROFILES_SECRET": true,
+	"CONFIG_STRICT":          true,
+	"ALLOW_CONFIG_OVERRIDE":  true,
+}
+
+// errUnknownProfile is a ?profile= that neither CONFIG_FILE nor CONFIG_PROFILES_SECRET
+// defines.
+var errUnknownProfile = errors.New("no such profile")
+
+// configProfile is the named set of settings a request selects with ?profile=, e.g.
+// prod-data or staging-logs, layered over the environment so one deployment can check
+// several buckets, projects and topics, each with its own TARGET_SERVICE_ACCOUNT.
+// Profiles come from the "profiles" object in CONFIG_FILE and from the Secret Manager
+// version in CONFIG_PROFILES_SECRET, holding {"name": {"BUCKET_NAME": ...}, ...};
+// the secret wins where both define a name.
+func configProfile(ctx context.Context, name string) (map[string]string, error) {
+	if !profileNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid profile name %q", name)
+	}
+	loadConfigFile()
+	if os.Getenv("CONFIG_PROFILES_SECRET") != "" {
+		secret, err := loadProfileSecret(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if settings, ok := secret[name]; ok {
+			return settings, nil
+		}
+	}
+	if settings, ok := configFile.profiles[name]; ok {
+		if errs := profileProblems(map[string]map[string]string{name: settings}).errors(); len(errs) > 0 {
+			return nil, errs
+		}
+		return settings, nil
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownProfile, name)
+}
+
+// configProfileNames lists every profile a request can select.
+func configProfileNames(ctx context.Context) ([]string, error) {
+	loadConfigFile()
+	seen := map[string]bool{}
+	for name := range configFile.profiles {
+		seen[name] = true
+	}
+	var err error
+	if os.Getenv("CONFIG_PROFILES_SECRET") != "" {
+		var secret map[string]map[string]string
+		secret, err = loadProfileSecret(ctx)
+		for name := range secret {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, err
+}
+
+var profileSecret struct {
+	sync.Mutex
+	profiles map[string]map[string]string
+	loadedAt time.Time
+}
+
+// loadProfileSecret reads CONFIG_PROFILES_SECRET, reusing what it read for
+// profileSecretTTL. Profiles with problems are refused as a whole rather than applied
+// in part.
+func loadProfileSecret(ctx context.Context) (map[string]map[string]string, error) {
+	profileSecret.Lock()
+	defer profileSecret.Unlock()
+	if profileSecret.profiles != nil && time.Since(profileSecret.loadedAt) < profileSecretTTL {
+		return profileSecret.profiles, nil
+	}
+
+	version := os.Getenv("CONFIG_PROFILES_SECRET")
+	svc, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Secret Manager client: %v", err)
+	}
+	resp, err := svc.Projects.Secrets.Versions.Access(version).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to access profiles secret: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode profiles secret: %v", err)
+	}
+	var raw any
+	if err := decodeConfigJSON(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid profiles secret: %v", err)
+	}
+	profiles, err := configProfiles(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid profiles secret: %v", err)
+	}
+	if errs := profileProblems(profiles).errors(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid profiles secret: %v", errs)
+	}
+	profileSecret.profiles, profileSecret.loadedAt = profiles, time.Now()
+	return profiles, nil
+}
+
+// configProfiles parses a {"name": {"VAR": value, ...}, ...} object.
+func configProfiles(raw any) (map[string]map[string]string, error) {
+	object, ok := raw.(map[string]any)
+	if !ok {
+		return nil, errors.New("profiles must be an object of profile names to settings")
+	}
+	profiles := map[string]map[string]string{}
+	for name, settings := range object {
+		if !profileNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid profile name %q", name)
+		}
+		settingsObject, ok := settings.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("profile %s must be an object of settings", name)
+		}
+		values, err := configValues(settingsObject)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		profiles[name] = values
+	}
+	return profiles, nil
+}
+
+// profileProblems checks each profile's settings as they would apply over the
+// environment, the same way a config override is checked.
+func profileProblems(profiles map[string]map[string]string) ConfigErrors {
+	var problems ConfigErrors
+	for name, settings := range profiles {
+		where := "profile " + name + ": "
+		for key, value := range settings {
+			switch {
+			case unprofiledVars[key]:
+				problems = append(problems, ConfigProblem{Var: key, Value: value, Problem: where + "can't be set in a profile"})
+			case deploymentVarFor(key).Kind == "":
+				problems = append(problems, ConfigProblem{Var: key, Problem: where + "is not a known setting", Warning: true})
+			}
+		}
+		for _, p := range validateEnvironment(defaultConfigSource.with(settings)) {
+			if _, ok := settings[p.Var]; ok {
+				p.Problem = where + p.Problem
+				problems = append(problems, p)
+			}
+		}
+	}
+	return problems
+}
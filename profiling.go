@@ -0,0 +1,134 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	httppprof "net/http/pprof"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	cloudprofiler "google.golang.org/api/cloudprofiler/v2"
+)
+
+// profileUploadTimeout bounds uploading a run's profiles, which happens after the run.
+const profileUploadTimeout = 15 * time.Second
+
+// pprofHandler serves net/http/pprof under /debug/pprof/ when ENABLE_PPROF=true, so a
+// slow listing or download can be profiled on the deployed function, e.g.
+// go tool pprof https://FUNCTION/debug/pprof/profile?seconds=20 while a run is going.
+// Check steps carry a "check" label in CPU profiles.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	if !NewGCloudFunctionConfig().EnablePprof {
+		http.NotFound(w, r)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		httppprof.Cmdline(w, r)
+	case "profile":
+		httppprof.Profile(w, r)
+	case "symbol":
+		httppprof.Symbol(w, r)
+	case "trace":
+		httppprof.Trace(w, r)
+	default:
+		httppprof.Index(w, r)
+	}
+}
+
+// runProfiler captures a CPU profile over one diagnostics run and a heap profile at its
+// end, and uploads both to Cloud Profiler as offline profiles of CLOUD_PROFILER_SERVICE.
+type runProfiler struct {
+	project string
+	service string
+	start   time.Time
+	cpu     bytes.Buffer
+	cpuOn   bool
+}
+
+// ProfileUpload is the outcome of uploading one profile.
+type ProfileUpload struct {
+	Type string
+	Name string
+	Err  error
+}
+
+// startRunProfiler returns nil when Cloud Profiler is not configured. Only one CPU
+// profile can run per process, so a run that overlaps another, or a /debug/pprof/profile
+// request, only uploads its heap profile.
+func startRunProfiler(cfg *GCloudFunctionConfig) *runProfiler {
+	if cfg.CloudProfilerService == "" {
+		return nil
+	}
+	p := &runProfiler{project: cfg.ComputeProjectId, service: cfg.CloudProfilerService, start: time.Now()}
+	if err := pprof.StartCPUProfile(&p.cpu); err != nil {
+		log.Printf("Failed to start CPU profile, only the heap will be profiled: %v\n", err)
+	} else {
+		p.cpuOn = true
+	}
+	return p
+}
+
+// stop ends the CPU profile, captures the heap and uploads what was collected.
+func (p *runProfiler) stop(ctx context.Context) []ProfileUpload {
+	duration := time.Since(p.start)
+	if p.cpuOn {
+		pprof.StopCPUProfile()
+	}
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		log.Printf("Failed to write heap profile: %v\n", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), profileUploadTimeout)
+	defer cancel()
+	svc, err := cloudprofiler.NewService(ctx)
+	if err != nil {
+		return []ProfileUpload{{Type: "CPU", Err: err}, {Type: "HEAP", Err: err}}
+	}
+
+	var uploads []ProfileUpload
+	if p.cpuOn {
+		uploads = append(uploads, p.upload(ctx, svc, "CPU", p.cpu.Bytes(), duration))
+	}
+	if heap.Len() > 0 {
+		uploads = append(uploads, p.upload(ctx, svc, "HEAP", heap.Bytes(), 0))
+	}
+	return uploads
+}
+
+func (p *runProfiler) upload(ctx context.Context, svc *cloudprofiler.Service, profileType string, data []byte, duration time.Duration) ProfileUpload {
+	profile := &cloudprofiler.Profile{
+		ProfileType: profileType,
+		Deployment: &cloudprofiler.Deployment{
+			ProjectId: p.project,
+			Target:    p.service,
+		},
+		ProfileBytes: base64.StdEncoding.EncodeToString(data),
+	}
+	if duration > 0 {
+		profile.Duration = fmt.Sprintf("%.3fs", duration.Seconds())
+	}
+	created, err := svc.Projects.Profiles.CreateOffline("projects/"+p.project, profile).Context(ctx).Do()
+	if err != nil {
+		log.Printf("Failed to upload %s profile: %v\n", profileType, err)
+		return ProfileUpload{Type: profileType, Err: err}
+	}
+	return ProfileUpload{Type: profileType, Name: created.Name}
+}
+
+func printProfileUploads(w http.ResponseWriter, service string, uploads []ProfileUpload) {
+	fmt.Fprintf(w, "Cloud Profiler (%s):\n", service)
+	for _, u := range uploads {
+		if u.Err != nil {
+			fmt.Fprintf(w, "| %s: upload failed: %v\n", u.Type, u.Err)
+			continue
+		}
+		fmt.Fprintf(w, "| %s: %s\n", u.Type, u.Name)
+	}
+}
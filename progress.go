@@ -0,0 +1,122 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	ProgressStarted   = "started"
+	ProgressCompleted = "completed"
+	ProgressFinished  = "finished"
+)
+
+// ProgressEvent is published to PROGRESS_TOPIC at each phase boundary of a run, and
+// streamed to NDJSON callers.
+type ProgressEvent struct {
+	RunID     string            `json:"runId"`
+	Event     string            `json:"event"`
+	Phase     string            `json:"phase,omitempty"`
+	Status    string            `json:"status,omitempty"`
+	Completed int               `json:"completed"`
+	Failed    int               `json:"failed"`
+	Planned   int               `json:"planned"`
+	Percent   int               `json:"percent"`
+	Time      time.Time         `json:"time"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+func newProgressEvent(runID, event, phase, status string, completed, failed, planned int, labels map[string]string) ProgressEvent {
+	ev := ProgressEvent{
+		RunID:     runID,
+		Event:     event,
+		Phase:     phase,
+		Status:    status,
+		Completed: completed,
+		Failed:    failed,
+		Planned:   planned,
+		Time:      time.Now().UTC(),
+		Labels:    labels,
+	}
+	if planned > 0 {
+		ev.Percent = min(100, completed*100/planned)
+	}
+	if event == ProgressFinished {
+		ev.Percent = 100
+	}
+	return ev
+}
+
+// progressPublisher sends a run's progress events in order, keyed by run ID. A nil
+// publisher is valid and publishes nothing, so runs without PROGRESS_TOPIC pay nothing.
+type progressPublisher struct {
+	ctx     context.Context
+	client  *pubsub.Client
+	topic   *pubsub.Topic
+	runID   string
+	labels  map[string]string
+	planned int
+
+	mu      sync.Mutex
+	results []*pubsub.PublishResult
+}
+
+func newProgressPublisher(ctx context.Context, project, topicID, runID string, labels map[string]string, planned int) (*progressPublisher, error) {
+	client, err := newPubSubClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client: %v", err)
+	}
+	topic := client.Topic(topicID)
+	topic.EnableMessageOrdering = true
+	return &progressPublisher{ctx: ctx, client: client, topic: topic, runID: runID, labels: labels, planned: planned}, nil
+}
+
+func (p *progressPublisher) publish(event, phase, status string, completed, failed int) {
+	if p == nil {
+		return
+	}
+	ev := newProgressEvent(p.runID, event, phase, status, completed, failed, p.planned, p.labels)
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	result := p.topic.Publish(p.ctx, &pubsub.Message{
+		Data:        data,
+		OrderingKey: p.runID,
+		Attributes:  map[string]string{"runId": p.runID, "event": event},
+	})
+	p.mu.Lock()
+	p.results = append(p.results, result)
+	p.mu.Unlock()
+}
+
+// close waits for outstanding events and logs how many could not be published.
+func (p *progressPublisher) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	results := p.results
+	p.mu.Unlock()
+
+	failed := 0
+	var lastErr error
+	for _, r := range results {
+		if _, err := r.Get(p.ctx); err != nil {
+			failed++
+			lastErr = err
+		}
+	}
+	if failed > 0 {
+		log.Printf("Failed to publish %d of %d progress events for run %s: %v\n", failed, len(results), p.runID, lastErr)
+	}
+	p.topic.Stop()
+	p.client.Close()
+}
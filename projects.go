@@ -0,0 +1,81 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v3"
+)
+
+type ProjectRef struct {
+	Role   string
+	ID     string
+	Number string
+	Error  string
+}
+
+// resolveProject looks up a project by ID or number and returns both, since IAM
+// bindings and service agents use numbers while configuration uses IDs.
+func resolveProject(ctx context.Context, svc *cloudresourcemanager.Service, idOrNumber string) (id, number string, err error) {
+	project, err := svc.Projects.Get("projects/" + idOrNumber).Context(ctx).Do()
+	if err != nil {
+		return "", "", err
+	}
+	return project.ProjectId, strings.TrimPrefix(project.Name, "projects/"), nil
+}
+
+// resolveProjects resolves the compute project (by ID) and the bucket's owning project (by number).
+func resolveProjects(ctx context.Context, computeProjectID string, bucketProjectNumber uint64) []ProjectRef {
+	refs := []ProjectRef{
+		{Role: "Compute project", ID: computeProjectID},
+	}
+	if bucketProjectNumber != 0 {
+		refs = append(refs, ProjectRef{Role: "Bucket project", Number: strconv.FormatUint(bucketProjectNumber, 10)})
+	}
+
+	svc, err := cloudresourcemanager.NewService(ctx)
+	if err != nil {
+		for i := range refs {
+			refs[i].Error = fmt.Sprintf("failed to create Resource Manager client: %v", err)
+		}
+		return refs
+	}
+
+	for i := range refs {
+		key := refs[i].ID
+		if key == "" {
+			key = refs[i].Number
+		}
+		if key == "" {
+			continue
+		}
+		id, number, err := resolveProject(ctx, svc, key)
+		if err != nil {
+			refs[i].Error = err.Error()
+			continue
+		}
+		refs[i].ID, refs[i].Number = id, number
+	}
+	return refs
+}
+
+func printProjects(w http.ResponseWriter, refs []ProjectRef) {
+	fmt.Fprintln(w, "Projects:")
+	for _, ref := range refs {
+		id, number := ref.ID, ref.Number
+		if id == "" {
+			id = "?"
+		}
+		if number == "" {
+			number = "?"
+		}
+		fmt.Fprintf(w, "| %s: %s (number %s)", ref.Role, id, number)
+		if ref.Error != "" {
+			fmt.Fprintf(w, " - lookup failed: %s", ref.Error)
+		}
+		fmt.Fprintln(w)
+	}
+}
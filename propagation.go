@@ -0,0 +1,80 @@
+package gcf
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultPropagationInitial = 2 * time.Second
+	maxPropagationBackoff     = 60 * time.Second
+	defaultPropagationMax     = 10 * time.Minute
+)
+
+// propagationHandler retries a failing check with exponential backoff and reports how
+// long the permission took to start working, e.g.
+// /propagation?check=bucket_access&max=10m&since=2024-01-02T15:04:05Z.
+// since is the time the role was granted; without it timing starts with the request.
+func propagationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	name := r.URL.Query().Get("check")
+	check, ok := standaloneChecks[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("check must be one of %v", standaloneCheckNames()), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	origin := start
+	if since := r.URL.Query().Get("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		origin = parsed
+	}
+
+	backoff := queryDuration(r, "initial", defaultPropagationInitial)
+	maxWait := queryDuration(r, "max", defaultPropagationMax)
+	if maxWait > maxWatchDuration {
+		maxWait = maxWatchDuration
+	}
+	deadline := start.Add(maxWait)
+	flusher, _ := w.(http.Flusher)
+
+	fmt.Fprintf(w, "Timing IAM propagation for %s (up to %s)\n", name, maxWait)
+	for attempt := 1; ; attempt++ {
+		err := check(ctx, cfg)
+		elapsed := time.Since(origin).Round(time.Second)
+		if err == nil {
+			fmt.Fprintf(w, "| Attempt %d at +%s: PASS\n", attempt, elapsed)
+			fmt.Fprintf(w, "Permission effective after %s (%d attempts)\n", elapsed, attempt)
+			return
+		}
+		fmt.Fprintf(w, "| Attempt %d at +%s: FAIL (%v)\n", attempt, elapsed, err)
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			fmt.Fprintf(w, "Permission still failing after %s (%d attempts)\n", time.Since(origin).Round(time.Second), attempt)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxPropagationBackoff {
+			backoff = maxPropagationBackoff
+		}
+	}
+}
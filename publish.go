@@ -0,0 +1,313 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxPublishBytes = 1 << 20
+	// Pub/Sub's own limits on attributes, checked here so the caller gets a 400 rather
+	// than an opaque InvalidArgument from the publish.
+	maxPublishAttributes      = 100
+	maxPublishAttrKeyBytes    = 256
+	maxPublishAttrValueBytes  = 1024
+	maxPublishOrderingKeySize = 1024
+	maxPublishCount           = 10000
+	// publishSeqAttr numbers the messages of a batch, so receivers can tell them apart.
+	publishSeqAttr = "gcf-publish-seq"
+	// maxPrintedMessageIDs keeps the text report of a large batch readable; JSON has
+	// every ID.
+	maxPrintedMessageIDs = 20
+)
+
+// PublishRequest is a message to publish to PUBSUB_TOPIC_ID. Data is sent as is;
+// messages need data, attributes or both. Count publishes that many copies, for
+// load-testing the topic.
+type PublishRequest struct {
+	Data        string            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	OrderingKey string            `json:"orderingKey"`
+	Count       int               `json:"count"`
+}
+
+type PublishResponse struct {
+	Topic       string        `json:"topic"`
+	MessageID   string        `json:"messageId"`
+	OrderingKey string        `json:"orderingKey,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	// Batch is set when more than one message was published; MessageID is then the
+	// first one's.
+	Batch *BatchPublishResult `json:"batch,omitempty"`
+}
+
+// BatchPublishResult is how a batch of publishes went under the topic's batching and
+// flow control settings. Latency is from Publish to the server's ID for each message,
+// so it includes time spent waiting in a batch.
+type BatchPublishResult struct {
+	Messages       int            `json:"messages"`
+	Succeeded      int            `json:"succeeded"`
+	MessageIDs     []string       `json:"messageIds"`
+	ErrorsByCode   map[string]int `json:"errorsByCode,omitempty"`
+	Throughput     float64        `json:"throughput"`
+	P50            time.Duration  `json:"p50"`
+	P90            time.Duration  `json:"p90"`
+	P99            time.Duration  `json:"p99"`
+	Max            time.Duration  `json:"max"`
+	ByteThreshold  int            `json:"byteThreshold"`
+	CountThreshold int            `json:"countThreshold"`
+	DelayThreshold time.Duration  `json:"delayThreshold"`
+	MaxOutstanding int            `json:"maxOutstanding"`
+}
+
+func (b BatchPublishResult) Err() error {
+	if failed := b.Messages - b.Succeeded; failed > 0 {
+		return fmt.Errorf("%d of %d publishes failed", failed, b.Messages)
+	}
+	return nil
+}
+
+// publishHandler publishes the posted message and returns the server-assigned ID, e.g.
+// POST /publish {"data":"hello","attributes":{"kind":"test"},"orderingKey":"user-1"}.
+// An ordering key turns on message ordering for the topic handle; subscribers only see
+// the order if their subscription has ordering enabled too. With "count":N it publishes N
+// copies through the PUBSUB_*_THRESHOLD batching settings and reports every message ID
+// and the latency spread.
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "publishing requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := parsePublishRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid message: %v", err), http.StatusBadRequest)
+		return
+	}
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	client, err := newPubSubClient(ctx, cfg.ComputeProjectId)
+	if err != nil {
+		log.Printf("Failed to create Pub/Sub client: %v\n", err)
+		http.Error(w, "Failed to create Pub/Sub client", http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+	topic := client.Topic(cfg.PubSubTopicId)
+	defer topic.Stop()
+	if req.OrderingKey != "" {
+		topic.EnableMessageOrdering = true
+	}
+
+	if req.Count > 1 {
+		configurePublishBatching(topic, cfg)
+		start := time.Now()
+		batch := publishBatch(ctx, topic, req)
+		resp := PublishResponse{Topic: topic.String(), OrderingKey: req.OrderingKey, Duration: time.Since(start), Batch: &batch}
+		if len(batch.MessageIDs) > 0 {
+			resp.MessageID = batch.MessageIDs[0]
+		}
+		if err := batch.Err(); err != nil {
+			log.Printf("Failed batch publish: %v\n", err)
+		}
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", jsonContentType)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		printBatchPublish(w, resp)
+		return
+	}
+
+	start := time.Now()
+	id, err := topic.Publish(ctx, &pubsub.Message{
+		Data:        []byte(req.Data),
+		Attributes:  req.Attributes,
+		OrderingKey: req.OrderingKey,
+	}).Get(ctx)
+	if err != nil {
+		// A failed ordered publish pauses the key on this handle; the handle is thrown
+		// away here, so there is nothing to resume.
+		log.Printf("Failed to publish message: %v\n", err)
+		http.Error(w, fmt.Sprintf("Failed to publish message: %v", err), http.StatusBadGateway)
+		return
+	}
+	resp := PublishResponse{Topic: topic.String(), MessageID: id, OrderingKey: req.OrderingKey, Duration: time.Since(start)}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Published message with ID: %s\n", resp.MessageID)
+	fmt.Fprintf(w, "| Topic: %s\n", resp.Topic)
+	if resp.OrderingKey != "" {
+		fmt.Fprintf(w, "| Ordering Key: %s\n", resp.OrderingKey)
+	}
+	fmt.Fprintf(w, "| Duration: %s\n", resp.Duration.Round(time.Millisecond))
+}
+
+func parsePublishRequest(r *http.Request) (PublishRequest, error) {
+	var req PublishRequest
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxPublishBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return req, errors.New("body must hold a single JSON object")
+	}
+	if req.Data == "" && len(req.Attributes) == 0 {
+		return req, errors.New("data or attributes are required")
+	}
+	maxAttributes := maxPublishAttributes
+	if req.Count > 1 {
+		maxAttributes-- // for publishSeqAttr
+	}
+	if len(req.Attributes) > maxAttributes {
+		return req, fmt.Errorf("at most %d attributes are allowed", maxAttributes)
+	}
+	for key, value := range req.Attributes {
+		switch {
+		case key == "":
+			return req, errors.New("attribute keys can't be empty")
+		case len(key) > maxPublishAttrKeyBytes:
+			return req, fmt.Errorf("attribute keys are at most %d bytes", maxPublishAttrKeyBytes)
+		case len(value) > maxPublishAttrValueBytes:
+			return req, fmt.Errorf("attribute %s is longer than %d bytes", key, maxPublishAttrValueBytes)
+		}
+	}
+	if _, ok := req.Attributes[publishSeqAttr]; ok {
+		return req, fmt.Errorf("attribute %s is reserved", publishSeqAttr)
+	}
+	if req.Count < 0 || req.Count > maxPublishCount {
+		return req, fmt.Errorf("count must be between 1 and %d", maxPublishCount)
+	}
+	if len(req.OrderingKey) > maxPublishOrderingKeySize {
+		return req, fmt.Errorf("orderingKey is longer than %d bytes", maxPublishOrderingKeySize)
+	}
+	return req, nil
+}
+
+// configurePublishBatching applies the PUBSUB_*_THRESHOLD and PUBSUB_MAX_OUTSTANDING
+// settings. Flow control blocks Publish once MaxOutstanding messages await a result,
+// rather than buffering the whole batch in memory.
+func configurePublishBatching(topic *pubsub.Topic, cfg *GCloudFunctionConfig) {
+	topic.PublishSettings.ByteThreshold = cfg.PubSubByteThreshold
+	topic.PublishSettings.CountThreshold = cfg.PubSubCountThreshold
+	topic.PublishSettings.DelayThreshold = cfg.PubSubDelayThreshold
+	topic.PublishSettings.FlowControlSettings = pubsub.FlowControlSettings{
+		MaxOutstandingMessages: cfg.PubSubMaxOutstanding,
+		LimitExceededBehavior:  pubsub.FlowControlBlock,
+	}
+}
+
+// publishBatch publishes req.Count copies of the message, each tagged with its
+// sequence number, and waits for every result.
+func publishBatch(ctx context.Context, topic *pubsub.Topic, req PublishRequest) BatchPublishResult {
+	settings := topic.PublishSettings
+	batch := BatchPublishResult{
+		Messages:       req.Count,
+		MessageIDs:     make([]string, req.Count),
+		ErrorsByCode:   map[string]int{},
+		ByteThreshold:  settings.ByteThreshold,
+		CountThreshold: settings.CountThreshold,
+		DelayThreshold: settings.DelayThreshold,
+		MaxOutstanding: settings.FlowControlSettings.MaxOutstandingMessages,
+	}
+	latencies := make([]time.Duration, req.Count)
+	errs := make([]error, req.Count)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < req.Count; i++ {
+		attrs := make(map[string]string, len(req.Attributes)+1)
+		for k, v := range req.Attributes {
+			attrs[k] = v
+		}
+		attrs[publishSeqAttr] = strconv.Itoa(i)
+		sent := time.Now()
+		result := topic.Publish(ctx, &pubsub.Message{Data: []byte(req.Data), Attributes: attrs, OrderingKey: req.OrderingKey})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch.MessageIDs[i], errs[i] = result.Get(ctx)
+			latencies[i] = time.Since(sent)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var succeeded []time.Duration
+	for i, err := range errs {
+		if err != nil {
+			batch.ErrorsByCode[status.Code(err).String()]++
+			continue
+		}
+		succeeded = append(succeeded, latencies[i])
+	}
+	batch.Succeeded = len(succeeded)
+	if secs := elapsed.Seconds(); secs > 0 {
+		batch.Throughput = float64(batch.Succeeded) / secs
+	}
+	sort.Slice(succeeded, func(i, j int) bool { return succeeded[i] < succeeded[j] })
+	batch.P50 = percentile(succeeded, 0.50)
+	batch.P90 = percentile(succeeded, 0.90)
+	batch.P99 = percentile(succeeded, 0.99)
+	if len(succeeded) > 0 {
+		batch.Max = succeeded[len(succeeded)-1]
+	}
+	return batch
+}
+
+func printBatchPublish(w http.ResponseWriter, resp PublishResponse) {
+	batch := resp.Batch
+	fmt.Fprintf(w, "Batch Publish (%s): %d messages\n", resp.Topic, batch.Messages)
+	if resp.OrderingKey != "" {
+		fmt.Fprintf(w, "| Ordering Key: %s\n", resp.OrderingKey)
+	}
+	fmt.Fprintf(w, "| Batching: %d bytes, %d messages or %s; up to %d outstanding\n",
+		batch.ByteThreshold, batch.CountThreshold, batch.DelayThreshold, batch.MaxOutstanding)
+	fmt.Fprintf(w, "| Succeeded: %d/%d in %s\n", batch.Succeeded, batch.Messages, resp.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "| Throughput: %.1f msgs/s\n", batch.Throughput)
+	fmt.Fprintf(w, "| Latency: p50=%s p90=%s p99=%s max=%s\n",
+		batch.P50.Round(time.Millisecond), batch.P90.Round(time.Millisecond),
+		batch.P99.Round(time.Millisecond), batch.Max.Round(time.Millisecond))
+	codes := make([]string, 0, len(batch.ErrorsByCode))
+	for code := range batch.ErrorsByCode {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "| Errors (%s): %d\n", code, batch.ErrorsByCode[code])
+	}
+	printed := 0
+	for i, id := range batch.MessageIDs {
+		if id == "" {
+			continue
+		}
+		if printed == maxPrintedMessageIDs {
+			fmt.Fprintf(w, "| ... %d more; ?format=json lists every ID\n", batch.Succeeded-printed)
+			break
+		}
+		fmt.Fprintf(w, "| Message %d: %s\n", i, id)
+		printed++
+	}
+}
@@ -0,0 +1,122 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	limitProbeStartBytes   = 64 << 10
+	limitProbeMaxBytes     = 16 << 20
+	limitProbeMaxAttrs     = 256
+	limitProbeMaxAttrValue = 4096
+	limitProbeRefineSteps  = 6
+)
+
+// LimitProbe is the outcome of growing one dimension of a message until it is rejected.
+type LimitProbe struct {
+	Dimension   string
+	LargestOK   int
+	SmallestBad int
+	Rejection   string
+	Attempts    int
+}
+
+// pubsubLimitsHandler publishes probe messages of increasing payload size, attribute
+// count and attribute value size to PUBSUB_TOPIC_ID and reports where each was rejected.
+// Probe messages carry the attribute gcf-probe=limits so subscribers can drop them.
+func pubsubLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "the limits probe publishes messages and requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	client, err := newPubSubClient(ctx, cfg.ComputeProjectId)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating Pub/Sub client: %v\n", err)
+		return
+	}
+	defer client.Close()
+	topic := client.Topic(cfg.PubSubTopicId)
+	topic.PublishSettings.CountThreshold = 1
+	topic.PublishSettings.ByteThreshold = 1
+	defer topic.Stop()
+
+	probes := []LimitProbe{
+		probeLimit(ctx, "Payload bytes", limitProbeStartBytes, limitProbeMaxBytes, func(n int) *pubsub.Message {
+			return &pubsub.Message{Data: bytes.Repeat([]byte("x"), n)}
+		}, topic),
+		probeLimit(ctx, "Attribute count", 8, limitProbeMaxAttrs, func(n int) *pubsub.Message {
+			// The gcf-probe attribute added by probeLimit makes n in total.
+			attrs := make(map[string]string, n)
+			for i := 0; i < n-1; i++ {
+				attrs[fmt.Sprintf("a%03d", i)] = "v"
+			}
+			return &pubsub.Message{Data: []byte("probe"), Attributes: attrs}
+		}, topic),
+		probeLimit(ctx, "Attribute value bytes", 256, limitProbeMaxAttrValue, func(n int) *pubsub.Message {
+			return &pubsub.Message{Data: []byte("probe"), Attributes: map[string]string{"value": strings.Repeat("v", n)}}
+		}, topic),
+	}
+	printLimitProbes(w, probes)
+}
+
+// probeLimit doubles n from start until a publish fails or max is passed, then bisects
+// between the last success and the first failure for a few steps.
+func probeLimit(ctx context.Context, dimension string, start, max int, build func(int) *pubsub.Message, topic *pubsub.Topic) LimitProbe {
+	probe := LimitProbe{Dimension: dimension}
+	publish := func(n int) error {
+		probe.Attempts++
+		msg := build(n)
+		if msg.Attributes == nil {
+			msg.Attributes = map[string]string{}
+		}
+		msg.Attributes["gcf-probe"] = "limits"
+		_, err := topic.Publish(ctx, msg).Get(ctx)
+		return err
+	}
+
+	for n := start; n <= max; n *= 2 {
+		if err := publish(n); err != nil {
+			probe.SmallestBad, probe.Rejection = n, err.Error()
+			break
+		}
+		probe.LargestOK = n
+	}
+	if probe.SmallestBad == 0 {
+		return probe
+	}
+
+	for step := 0; step < limitProbeRefineSteps && probe.SmallestBad-probe.LargestOK > 1; step++ {
+		mid := probe.LargestOK + (probe.SmallestBad-probe.LargestOK)/2
+		if err := publish(mid); err != nil {
+			probe.SmallestBad, probe.Rejection = mid, err.Error()
+		} else {
+			probe.LargestOK = mid
+		}
+	}
+	return probe
+}
+
+func printLimitProbes(w http.ResponseWriter, probes []LimitProbe) {
+	fmt.Fprintln(w, "Pub/Sub Limits:")
+	for _, p := range probes {
+		if p.SmallestBad == 0 {
+			fmt.Fprintf(w, "| %s: no rejection up to %d (%d publishes)\n", p.Dimension, p.LargestOK, p.Attempts)
+			continue
+		}
+		fmt.Fprintf(w, "| %s: accepted %d, rejected %d (%d publishes)\n", p.Dimension, p.LargestOK, p.SmallestBad, p.Attempts)
+		fmt.Fprintf(w, "|   %s\n", p.Rejection)
+	}
+}
@@ -0,0 +1,192 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// subscriberPermissions are what the receive check needs on the subscription.
+var subscriberPermissions = []string{"pubsub.subscriptions.consume", "pubsub.subscriptions.get"}
+
+const (
+	// receiveDrainMargin is how long before the run deadline pulling stops.
+	receiveDrainMargin = time.Second
+	// receiveDrainGrace is how long buffered messages are still nacked after that.
+	receiveDrainGrace = 500 * time.Millisecond
+)
+
+type SubscriptionPreflight struct {
+	Subscription       string
+	Exists             bool
+	Topic              string
+	Detached           bool
+	MissingPermissions []string
+	Error              string
+}
+
+// CanReceive reports whether an empty pull can be read as an empty subscription.
+func (p SubscriptionPreflight) CanReceive() bool {
+	return p.Exists && !p.Detached && len(p.MissingPermissions) == 0
+}
+
+// preflightSubscription checks the subscription exists and that the caller may consume
+// from it, so an empty pull can be told apart from a missing permission.
+func preflightSubscription(ctx context.Context, sub *pubsub.Subscription) SubscriptionPreflight {
+	p := SubscriptionPreflight{Subscription: sub.String()}
+
+	granted, err := sub.IAM().TestPermissions(ctx, subscriberPermissions)
+	if err != nil {
+		p.Error = fmt.Sprintf("failed to test permissions: %v", err)
+		return p
+	}
+	has := map[string]bool{}
+	for _, perm := range granted {
+		has[perm] = true
+	}
+	for _, perm := range subscriberPermissions {
+		if !has[perm] {
+			p.MissingPermissions = append(p.MissingPermissions, perm)
+		}
+	}
+	if !has["pubsub.subscriptions.get"] {
+		// Existence can't be checked without get; assume it exists and let the pull decide.
+		p.Exists = true
+		return p
+	}
+
+	p.Exists, err = sub.Exists(ctx)
+	if err != nil {
+		p.Error = fmt.Sprintf("failed to check subscription: %v", err)
+		return p
+	}
+	if !p.Exists {
+		return p
+	}
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		p.Error = fmt.Sprintf("failed to read subscription config: %v", err)
+		return p
+	}
+	p.Detached = cfg.Detached
+	if cfg.Topic != nil {
+		p.Topic = cfg.Topic.String()
+	}
+	return p
+}
+
+// ReceiveStats counts what happened to each message the receive check was handed.
+type ReceiveStats struct {
+	Attempts int
+	Acked    int
+	// Nacked were delivered after the drain began and handed back explicitly.
+	Nacked int
+	// Returned arrived after Receive stopped and were left for the client to return.
+	Returned int
+	Drained  bool
+}
+
+// receiveTestMessages pulls for window at a time, retrying up to retries more times
+// while the subscription stays empty. When ctx has a deadline, pulling stops
+// receiveDrainMargin before it and messages still being delivered are nacked, so they
+// are redelivered at once instead of waiting out their lease.
+func receiveTestMessages(ctx context.Context, sub *pubsub.Subscription, w http.ResponseWriter, window time.Duration, retries int) (ReceiveStats, error) {
+	var stats ReceiveStats
+	var acked, nacked, returned atomic.Int32
+	counted := func() ReceiveStats {
+		stats.Acked, stats.Nacked, stats.Returned = int(acked.Load()), int(nacked.Load()), int(returned.Load())
+		return stats
+	}
+
+	// Receive runs on a context detached from the run's deadline, so the drain phase
+	// can still nack after the budget is spent; the drain context ends pulling first.
+	runCtx := context.WithoutCancel(ctx)
+	drainCtx, stopDrain := context.WithCancel(ctx)
+	defer stopDrain()
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		drainCtx, cancel = context.WithDeadline(drainCtx, deadline.Add(-receiveDrainMargin))
+		defer cancel()
+	}
+
+	for stats.Attempts <= retries {
+		stats.Attempts++
+		cctx, cancel := context.WithTimeout(runCtx, window)
+		stop := context.AfterFunc(drainCtx, func() {
+			// Give buffered messages a moment to reach the handler and be nacked.
+			time.AfterFunc(receiveDrainGrace, cancel)
+		})
+		err := sub.Receive(cctx, func(_ context.Context, msg *pubsub.Message) {
+			switch {
+			case cctx.Err() != nil:
+				returned.Add(1)
+				msg.Nack()
+			case drainCtx.Err() != nil:
+				nacked.Add(1)
+				msg.Nack()
+			default:
+				acked.Add(1)
+				fmt.Fprintf(w, "Received message: %s\n", string(msg.Data))
+				msg.Ack()
+			}
+		})
+		stop()
+		cancel()
+		if drainCtx.Err() != nil && ctx.Err() != context.Canceled {
+			stats.Drained = true
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+			return counted(), err
+		}
+		if acked.Load() > 0 || stats.Drained || ctx.Err() != nil {
+			break
+		}
+		if stats.Attempts <= retries {
+			log.Printf("No messages on receive attempt %d, retrying\n", stats.Attempts)
+		}
+	}
+	if stats.Drained {
+		return counted(), fmt.Errorf("receive drained at the time budget: %w", context.DeadlineExceeded)
+	}
+	return counted(), nil
+}
+
+func printReceiveDrain(w http.ResponseWriter, stats ReceiveStats) {
+	if !stats.Drained {
+		return
+	}
+	fmt.Fprintln(w, "Receive Drain:")
+	fmt.Fprintf(w, "| Acked: %d\n", stats.Acked)
+	fmt.Fprintf(w, "| Nacked During Drain: %d\n", stats.Nacked)
+	fmt.Fprintf(w, "| Returned After Stop: %d\n", stats.Returned)
+}
+
+func printSubscriptionPreflight(w http.ResponseWriter, p SubscriptionPreflight) {
+	fmt.Fprintf(w, "Subscription (%s):\n", p.Subscription)
+	switch {
+	case p.Error != "":
+		fmt.Fprintf(w, "| Preflight: FAILED (%s)\n", p.Error)
+		return
+	case !p.Exists:
+		fmt.Fprintln(w, "| Exists: NO, check PUBSUB_SUBSCRIPTION_ID and the project")
+		return
+	}
+	fmt.Fprintln(w, "| Exists: yes")
+	if p.Topic != "" {
+		fmt.Fprintf(w, "| Topic: %s\n", p.Topic)
+	}
+	if p.Detached {
+		fmt.Fprintln(w, "| Detached: YES, the subscription no longer receives messages from its topic")
+	}
+	if len(p.MissingPermissions) > 0 {
+		fmt.Fprintf(w, "| Missing Permissions: %v (grant roles/pubsub.subscriber)\n", p.MissingPermissions)
+	} else {
+		fmt.Fprintln(w, "| Permissions: OK")
+	}
+}
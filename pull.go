@@ -0,0 +1,157 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultPullMax = 10
+	maxPullMax     = 1000
+	maxPullWorkers = 16
+)
+
+// PulledMessage is a message as /pull returns it. DeliveryAttempt is only set on
+// subscriptions with a dead-letter policy.
+type PulledMessage struct {
+	ID              string            `json:"id"`
+	Data            []byte            `json:"data"`
+	Attributes      map[string]string `json:"attributes,omitempty"`
+	OrderingKey     string            `json:"orderingKey,omitempty"`
+	PublishTime     time.Time         `json:"publishTime"`
+	DeliveryAttempt *int              `json:"deliveryAttempt,omitempty"`
+}
+
+// PullResult is what one /pull call received and did with it. Extra counts messages
+// the client delivered beyond Max, which are always nacked.
+type PullResult struct {
+	Subscription string          `json:"subscription"`
+	Action       string          `json:"action"`
+	Max          int             `json:"max"`
+	Timeout      time.Duration   `json:"timeout"`
+	MaxExtension time.Duration   `json:"maxExtension"`
+	Messages     []PulledMessage `json:"messages"`
+	Extra        int             `json:"extra"`
+	Elapsed      time.Duration   `json:"elapsed"`
+	Error        string          `json:"error,omitempty"`
+}
+
+// pullHandler pulls up to max messages from PUBSUB_SUBSCRIPTION_ID, or ?subscription=,
+// and returns them as JSON, e.g. POST /pull?max=5&timeout=20s&action=nack. action is
+// ack (the default), nack to hand them straight back, or none to leave them for
+// redelivery once their ack deadline passes. Until the pull ends the client extends
+// each message's lease, for up to maxExtension (default PUBSUB_MAX_EXTENSION). Pulling
+// stops at max messages or timeout (default PUBSUB_RECEIVE_WINDOW); workers sets the
+// client's NumGoroutines.
+func pullHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "pulling acknowledges messages and requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	action := query.Get("action")
+	if action == "" {
+		action = "ack"
+	}
+	if action != "ack" && action != "nack" && action != "none" {
+		http.Error(w, "action must be ack, nack or none", http.StatusBadRequest)
+		return
+	}
+	subID := query.Get("subscription")
+	if subID == "" {
+		subID = cfg.PubSubSubscriptionId
+	}
+	if !pubsubIDPattern.MatchString(subID) {
+		http.Error(w, "invalid subscription ID", http.StatusBadRequest)
+		return
+	}
+	timeout := min(queryDuration(r, "timeout", cfg.PubSubReceiveWindow), maxWatchDuration)
+	settings := pubsub.DefaultReceiveSettings
+	settings.MaxOutstandingMessages = queryInt(r, "max", defaultPullMax, maxPullMax)
+	settings.NumGoroutines = queryInt(r, "workers", 1, maxPullWorkers)
+	settings.MaxExtension = queryDuration(r, "maxExtension", cfg.PubSubMaxExtension)
+	settings.MaxExtensionPeriod = cfg.PubSubMaxExtensionPeriod
+	settings.MinExtensionPeriod = cfg.PubSubMinExtensionPeriod
+
+	client, err := newPubSubClient(ctx, cfg.ComputeProjectId)
+	if err != nil {
+		log.Printf("Failed to create Pub/Sub client: %v\n", err)
+		http.Error(w, "Failed to create Pub/Sub client", http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	result := pullMessages(ctx, client.Subscription(subID), action, timeout, settings)
+	w.Header().Set("Content-Type", jsonContentType)
+	if result.Error != "" {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// pullMessages receives until it has settings.MaxOutstandingMessages messages or
+// timeout passes. Holding each message unacked until the end would stall the client
+// at MaxOutstandingMessages anyway, so messages are settled as they arrive.
+func pullMessages(ctx context.Context, sub *pubsub.Subscription, action string, timeout time.Duration, settings pubsub.ReceiveSettings) PullResult {
+	result := PullResult{
+		Subscription: sub.String(),
+		Action:       action,
+		Max:          settings.MaxOutstandingMessages,
+		Timeout:      timeout,
+		MaxExtension: settings.MaxExtension,
+		Messages:     []PulledMessage{},
+	}
+	sub.ReceiveSettings = settings
+
+	start := time.Now()
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var mu sync.Mutex
+	err := sub.Receive(cctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		full := len(result.Messages) >= result.Max
+		if full {
+			result.Extra++
+		} else {
+			result.Messages = append(result.Messages, PulledMessage{
+				ID:              msg.ID,
+				Data:            msg.Data,
+				Attributes:      msg.Attributes,
+				OrderingKey:     msg.OrderingKey,
+				PublishTime:     msg.PublishTime,
+				DeliveryAttempt: msg.DeliveryAttempt,
+			})
+		}
+		reachedMax := len(result.Messages) >= result.Max
+		mu.Unlock()
+
+		switch {
+		case full || action == "nack":
+			msg.Nack()
+		case action == "ack":
+			msg.Ack()
+		}
+		if reachedMax {
+			cancel()
+		}
+	})
+	result.Elapsed = time.Since(start)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		result.Error = fmt.Sprintf("receive failed: %v", err)
+	}
+	return result
+}
@@ -0,0 +1,230 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var rateLimitReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+	"RATE_LIMIT_EXCEEDED":   true,
+}
+
+type QuotaEvent struct {
+	Time       time.Time
+	Operation  string
+	Quota      string
+	RetryAfter string
+	Message    string
+}
+
+// quotaRecorder collects rate-limit responses seen during one request, and how long
+// the request slept waiting them out.
+type quotaRecorder struct {
+	mu     sync.Mutex
+	events []QuotaEvent
+	start  time.Time
+	waited time.Duration
+}
+
+func (q *quotaRecorder) addWait(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waited += d
+}
+
+func (q *quotaRecorder) Waited() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waited
+}
+
+func (q *quotaRecorder) add(event QuotaEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.events = append(q.events, event)
+}
+
+func (q *quotaRecorder) Events() []QuotaEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]QuotaEvent(nil), q.events...)
+}
+
+type quotaRecorderKey struct{}
+
+func withQuotaRecorder(ctx context.Context) (context.Context, *quotaRecorder) {
+	recorder := &quotaRecorder{start: time.Now()}
+	return context.WithValue(ctx, quotaRecorderKey{}, recorder), recorder
+}
+
+func quotaRecorderFrom(ctx context.Context) *quotaRecorder {
+	recorder, _ := ctx.Value(quotaRecorderKey{}).(*quotaRecorder)
+	return recorder
+}
+
+// recordQuotaError notes err in the request's quota report if it is a rate-limit
+// or quota error, and reports whether it was one.
+func recordQuotaError(ctx context.Context, operation string, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	event := QuotaEvent{Time: time.Now().UTC(), Operation: operation, Message: err.Error()}
+	var gErr *googleapi.Error
+	switch {
+	case errors.As(err, &gErr):
+		quota := ""
+		for _, detail := range gErr.Errors {
+			if rateLimitReasons[detail.Reason] {
+				quota = detail.Reason
+			}
+		}
+		if gErr.Code != http.StatusTooManyRequests && quota == "" {
+			return false
+		}
+		if quota == "" {
+			quota = "rateLimitExceeded"
+		}
+		event.Quota = quota
+		event.Message = gErr.Message
+		event.RetryAfter = gErr.Header.Get("Retry-After")
+	case status.Code(err) == codes.ResourceExhausted:
+		event.Quota = "RESOURCE_EXHAUSTED"
+		event.Message = status.Convert(err).Message()
+		if d, ok := retryAfter(err); ok {
+			event.RetryAfter = d.String()
+		}
+	default:
+		return false
+	}
+
+	if recorder := quotaRecorderFrom(ctx); recorder != nil {
+		recorder.add(event)
+	}
+	return true
+}
+
+// quotaObservingTransport records rate-limited HTTP responses, including ones the
+// client library retries internally and that would otherwise never surface.
+type quotaObservingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *quotaObservingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusForbidden) {
+		return resp, err
+	}
+
+	recorder := quotaRecorderFrom(req.Context())
+	if recorder == nil {
+		return resp, err
+	}
+
+	body, readErr := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if readErr != nil {
+		return resp, err
+	}
+
+	var payload struct {
+		Error struct {
+			Message string `json:"message"`
+			Errors  []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &payload)
+
+	quota := ""
+	for _, detail := range payload.Error.Errors {
+		if rateLimitReasons[detail.Reason] {
+			quota = detail.Reason
+		}
+	}
+	if resp.StatusCode == http.StatusForbidden && quota == "" {
+		return resp, err
+	}
+	if quota == "" {
+		quota = "rateLimitExceeded"
+	}
+
+	recorder.add(QuotaEvent{
+		Time:       time.Now().UTC(),
+		Operation:  req.Method + " " + req.URL.Path,
+		Quota:      quota,
+		RetryAfter: resp.Header.Get("Retry-After"),
+		Message:    payload.Error.Message,
+	})
+	return resp, err
+}
+
+// retryAfter reads how long the server asked the caller to back off: the Retry-After
+// header of a googleapi error (seconds or an HTTP date) or gRPC RetryInfo details.
+func retryAfter(err error) (time.Duration, bool) {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return parseRetryAfter(gErr.Header.Get("Retry-After"), time.Now())
+	}
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+func printQuotaReport(w http.ResponseWriter, recorder *quotaRecorder) {
+	events := recorder.Events()
+	if len(events) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Quota / Rate Limits (%d events):\n", len(events))
+	for _, e := range events {
+		fmt.Fprintf(w, "| %s %s: %s", e.Time.Format(time.RFC3339), e.Operation, e.Quota)
+		if e.RetryAfter != "" {
+			fmt.Fprintf(w, " (retry after %s)", e.RetryAfter)
+		}
+		if e.Message != "" {
+			fmt.Fprintf(w, " - %s", e.Message)
+		}
+		fmt.Fprintln(w)
+	}
+	if waited := recorder.Waited(); waited > 0 {
+		elapsed := time.Since(recorder.start)
+		fmt.Fprintf(w, "| Waiting on rate limits: %s, other work: %s (%d%% of the run spent waiting)\n",
+			waited.Round(time.Millisecond), max(elapsed-waited, 0).Round(time.Millisecond), budgetShare(waited, elapsed))
+	}
+}
@@ -0,0 +1,122 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// recheckTimeout bounds a re-check; alerting webhooks usually give up within seconds.
+const recheckTimeout = 15 * time.Second
+
+const maxRecheckBytes = 4 << 10
+
+// RecheckRequest names one standalone check and, optionally, the resources to run it
+// against, e.g. {"check":"bucket_access","bucket":"x"}.
+type RecheckRequest struct {
+	Check   string `json:"check"`
+	Bucket  string `json:"bucket"`
+	Project string `json:"project"`
+	Topic   string `json:"topic"`
+	KmsKey  string `json:"kmsKey"`
+}
+
+// RecheckVerdict is the whole response: whether the condition holds right now.
+type RecheckVerdict struct {
+	Check      string       `json:"check"`
+	Status     string       `json:"status"`
+	DurationMs int64        `json:"durationMs"`
+	CheckedAt  time.Time    `json:"checkedAt"`
+	Error      *ReportError `json:"error,omitempty"`
+}
+
+// recheckHandler runs one check for an alerting system confirming that a failure has
+// recovered. It answers 200 when the check passes and 503 when it still fails, so
+// callers can act on the status alone. Naming resources other than the deployment's
+// needs ALLOW_CONFIG_OVERRIDE=true, as for posted run configs.
+func recheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := parseRecheckRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid re-check: %v", err), http.StatusBadRequest)
+		return
+	}
+	check, ok := standaloneChecks[req.Check]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown check %q, expected one of %s", req.Check, strings.Join(standaloneCheckNames(), ", ")), http.StatusBadRequest)
+		return
+	}
+	rc := RunConfig{Bucket: req.Bucket, Project: req.Project, Topic: req.Topic, KmsKey: req.KmsKey}
+	if err := rc.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid re-check: %v", err), http.StatusBadRequest)
+		return
+	}
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	if overridesConfig(rc, cfg) && !cfg.AllowConfigOverride {
+		http.Error(w, "re-checking other resources is disabled; set ALLOW_CONFIG_OVERRIDE=true to allow it", http.StatusForbidden)
+		return
+	}
+	rc.apply(cfg)
+
+	ctx, cancel := context.WithTimeout(ctx, recheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err = check(ctx, cfg)
+	verdict := RecheckVerdict{
+		Check:      req.Check,
+		Status:     "pass",
+		DurationMs: time.Since(start).Milliseconds(),
+		CheckedAt:  start.UTC(),
+	}
+	status := http.StatusOK
+	if err != nil {
+		verdict.Status = "fail"
+		verdict.Error = reportError(err)
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Diag-Status", verdict.Status)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(verdict)
+}
+
+func parseRecheckRequest(r *http.Request) (RecheckRequest, error) {
+	var req RecheckRequest
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRecheckBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return req, errors.New("body must hold a single JSON object")
+	}
+	if req.Check == "" {
+		return req, errors.New("check is required")
+	}
+	return req, nil
+}
+
+// overridesConfig reports whether rc names a resource other than the deployment's.
+func overridesConfig(rc RunConfig, cfg *GCloudFunctionConfig) bool {
+	differs := func(value, current string) bool { return value != "" && value != current }
+	return differs(rc.Bucket, cfg.BucketName) ||
+		differs(rc.Project, cfg.ComputeProjectId) ||
+		differs(rc.Topic, cfg.PubSubTopicId) ||
+		differs(rc.Subscription, cfg.PubSubSubscriptionId) ||
+		differs(rc.KmsKey, cfg.KmsKey)
+}
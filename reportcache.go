@@ -0,0 +1,158 @@
+package gcf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedReports bounds the report cache. Keys include the caller, so every new
+// client would otherwise add an entry for the instance's lifetime.
+const maxCachedReports = 256
+
+type cachedReport struct {
+	header   http.Header
+	status   int
+	body     []byte
+	etag     string
+	storedAt time.Time
+}
+
+// reportCache holds recent diagnostics reports by request, for REPORT_CACHE_TTL.
+var reportCache struct {
+	sync.Mutex
+	entries map[string]*cachedReport
+}
+
+// cachedDiagnostics serves the diagnostics report from the cache when REPORT_CACHE_TTL
+// is set, with an ETag so pollers sending If-None-Match get a 304 instead of the body.
+// Reports for anything but plain GETs, and streamed NDJSON reports, are never cached.
+func cachedDiagnostics(w http.ResponseWriter, r *http.Request) {
+	cfg, _, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	if cfg.ReportCacheTTL <= 0 || r.Method != http.MethodGet || wantsNDJSON(r) {
+		runDiagnosticsWithConfig(w, r, cfg)
+		return
+	}
+
+	key := reportCacheKey(r)
+	entry, hit := lookupReport(key, cfg.ReportCacheTTL)
+	if !hit {
+		rec := httptest.NewRecorder()
+		runDiagnosticsWithConfig(rec, r, cfg)
+		entry = &cachedReport{header: rec.Header().Clone(), status: rec.Code, body: rec.Body.Bytes(), storedAt: time.Now()}
+		sum := sha256.Sum256(entry.body)
+		entry.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		if entry.status == http.StatusOK {
+			storeReport(key, entry, cfg.ReportCacheTTL)
+		}
+	}
+
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	age := time.Since(entry.storedAt)
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int((cfg.ReportCacheTTL-age).Seconds())))
+	w.Header().Set("Age", fmt.Sprintf("%d", int(age.Seconds())))
+	if hit {
+		w.Header().Set("X-Diag-Cache", "hit")
+	} else {
+		w.Header().Set("X-Diag-Cache", "miss")
+	}
+
+	if entry.status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), entry.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// reportCacheKey covers everything that changes the report's content.
+func reportCacheKey(r *http.Request) string {
+	return strings.Join([]string{
+		r.URL.Path,
+		r.URL.Query().Encode(),
+		r.Header.Get("Accept-Language"),
+		// Accept chooses between the text and JSON reports.
+		r.Header.Get("Accept"),
+		r.Header.Get(runLabelsHeader),
+		r.Header.Get(requestTimeoutHeader),
+		callerCacheKey(r),
+	}, "|")
+}
+
+// callerCacheKey digests who the report's caller section describes: the token's
+// subject, the end user the frontend vouched for, the source address and forwarding
+// headers. One caller's identity and IP are then never served to another. The port is
+// left out, as it changes with every connection.
+func callerCacheKey(r *http.Request) string {
+	caller := describeCaller(r)
+	if host, _, err := net.SplitHostPort(caller.RemoteAddr); err == nil {
+		caller.RemoteAddr = host
+	}
+	data, _ := json.Marshal(caller)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func lookupReport(key string, ttl time.Duration) (*cachedReport, bool) {
+	reportCache.Lock()
+	defer reportCache.Unlock()
+	entry, ok := reportCache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(entry.storedAt) >= ttl {
+		delete(reportCache.entries, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// storeReport caches entry under key, first dropping expired entries and then, while
+// the cache is full, the oldest.
+func storeReport(key string, entry *cachedReport, ttl time.Duration) {
+	reportCache.Lock()
+	defer reportCache.Unlock()
+	if reportCache.entries == nil {
+		reportCache.entries = map[string]*cachedReport{}
+	}
+	for k, e := range reportCache.entries {
+		if time.Since(e.storedAt) >= ttl {
+			delete(reportCache.entries, k)
+		}
+	}
+	delete(reportCache.entries, key)
+	for len(reportCache.entries) >= maxCachedReports {
+		var oldest string
+		for k, e := range reportCache.entries {
+			if oldest == "" || e.storedAt.Before(reportCache.entries[oldest].storedAt) {
+				oldest = k
+			}
+		}
+		delete(reportCache.entries, oldest)
+	}
+	reportCache.entries[key] = entry
+}
+
+// etagMatches applies If-None-Match's weak comparison against etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package gcf
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReportCacheKeyCoversCaller(t *testing.T) {
+	newRequest := func(remote string, headers map[string]string, user *EndUser) string {
+		r := httptest.NewRequest("GET", "/?checks=storage", nil)
+		r.RemoteAddr = remote
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		if user != nil {
+			r = r.WithContext(withEndUser(r.Context(), user))
+		}
+		return reportCacheKey(r)
+	}
+
+	base := newRequest("192.0.2.1:1234", nil, nil)
+	if got := newRequest("192.0.2.1:5678", nil, nil); got != base {
+		t.Errorf("a new connection from the same caller changed the key")
+	}
+	differ := map[string]string{
+		"remote address": newRequest("192.0.2.2:1234", nil, nil),
+		"forwarded for":  newRequest("192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, nil),
+		"user agent":     newRequest("192.0.2.1:1234", map[string]string{"User-Agent": "other"}, nil),
+		"end user":       newRequest("192.0.2.1:1234", nil, &EndUser{Email: "alice@example.com", Subject: "1", Via: "iap"}),
+	}
+	for name, key := range differ {
+		if key == base {
+			t.Errorf("%s is not part of the key: another caller would be served this report", name)
+		}
+	}
+	if differ["end user"] == newRequest("192.0.2.1:1234", nil, &EndUser{Email: "bob@example.com", Subject: "2", Via: "iap"}) {
+		t.Errorf("two end users share a key")
+	}
+}
+
+func TestStoreReportBoundsEntries(t *testing.T) {
+	reportCache.Lock()
+	saved := reportCache.entries
+	reportCache.entries = nil
+	reportCache.Unlock()
+	t.Cleanup(func() {
+		reportCache.Lock()
+		reportCache.entries = saved
+		reportCache.Unlock()
+	})
+
+	const ttl = time.Minute
+	start := time.Now()
+	storeReport("expired", &cachedReport{storedAt: start.Add(-2 * ttl)}, ttl)
+	for i := 0; i < maxCachedReports+10; i++ {
+		storeReport(fmt.Sprint(i), &cachedReport{storedAt: start.Add(time.Duration(i) * time.Millisecond)}, ttl)
+	}
+
+	reportCache.Lock()
+	defer reportCache.Unlock()
+	if n := len(reportCache.entries); n != maxCachedReports {
+		t.Errorf("cache holds %d entries, want at most %d", n, maxCachedReports)
+	}
+	if _, ok := reportCache.entries["expired"]; ok {
+		t.Errorf("an expired entry survived a store")
+	}
+	if _, ok := reportCache.entries["0"]; ok {
+		t.Errorf("the oldest entry wasn't evicted")
+	}
+	if _, ok := reportCache.entries[fmt.Sprint(maxCachedReports+9)]; !ok {
+		t.Errorf("the newest entry is missing")
+	}
+}
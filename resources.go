@@ -0,0 +1,180 @@
+package gcf
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resourceSampleInterval is how often the monitor samples memory for the run's peak.
+const resourceSampleInterval = 250 * time.Millisecond
+
+// ResourceUsage is what the function itself consumed during a run.
+type ResourceUsage struct {
+	Duration       time.Duration
+	HeapAlloc      uint64
+	PeakHeapInuse  uint64
+	Sys            uint64
+	TotalAlloc     uint64 // bytes allocated during the run
+	NumGC          uint32 // collections during the run
+	GCPauseTotal   time.Duration
+	GCPauseMax     time.Duration
+	GoroutinesPeak int
+	Goroutines     int
+	CPUUser        time.Duration
+	CPUGC          time.Duration
+	// MemoryLimit is GOMEMLIMIT or the container's cgroup limit, whichever is lower;
+	// zero when neither is set.
+	MemoryLimit uint64
+}
+
+// resourceMonitor samples the process from a run's start until stop.
+type resourceMonitor struct {
+	start       time.Time
+	startMem    runtime.MemStats
+	startCPU    cpuTimes
+	done        chan struct{}
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+	peakHeap    uint64
+	peakRoutine int
+}
+
+type cpuTimes struct {
+	user, gc float64
+}
+
+func startResourceMonitor() *resourceMonitor {
+	m := &resourceMonitor{start: time.Now(), done: make(chan struct{})}
+	runtime.ReadMemStats(&m.startMem)
+	m.startCPU = readCPUTimes()
+	m.peakHeap = m.startMem.HeapInuse
+	m.peakRoutine = runtime.NumGoroutine()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(resourceSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+				m.sample()
+			}
+		}
+	}()
+	return m
+}
+
+func (m *resourceMonitor) sample() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	routines := runtime.NumGoroutine()
+	m.mu.Lock()
+	m.peakHeap = max(m.peakHeap, mem.HeapInuse)
+	m.peakRoutine = max(m.peakRoutine, routines)
+	m.mu.Unlock()
+}
+
+// stop ends sampling and returns the usage since startResourceMonitor.
+func (m *resourceMonitor) stop() ResourceUsage {
+	close(m.done)
+	m.wg.Wait()
+	m.sample()
+
+	var end runtime.MemStats
+	runtime.ReadMemStats(&end)
+	cpu := readCPUTimes()
+	usage := ResourceUsage{
+		Duration:       time.Since(m.start),
+		HeapAlloc:      end.HeapAlloc,
+		PeakHeapInuse:  m.peakHeap,
+		Sys:            end.Sys,
+		TotalAlloc:     end.TotalAlloc - m.startMem.TotalAlloc,
+		NumGC:          end.NumGC - m.startMem.NumGC,
+		GCPauseTotal:   time.Duration(end.PauseTotalNs - m.startMem.PauseTotalNs),
+		GoroutinesPeak: m.peakRoutine,
+		Goroutines:     runtime.NumGoroutine(),
+		CPUUser:        secondsDuration(cpu.user - m.startCPU.user),
+		CPUGC:          secondsDuration(cpu.gc - m.startCPU.gc),
+		MemoryLimit:    memoryLimit(),
+	}
+	// PauseNs is a ring buffer of the last 256 pauses; older ones in a long run are lost.
+	for i := uint32(0); i < usage.NumGC && i < uint32(len(end.PauseNs)); i++ {
+		pause := time.Duration(end.PauseNs[(end.NumGC-1-i)%uint32(len(end.PauseNs))])
+		usage.GCPauseMax = max(usage.GCPauseMax, pause)
+	}
+	return usage
+}
+
+// readCPUTimes reads the runtime's CPU estimates, which are portable unlike rusage.
+func readCPUTimes() cpuTimes {
+	samples := []metrics.Sample{
+		{Name: "/cpu/classes/user:cpu-seconds"},
+		{Name: "/cpu/classes/gc/total:cpu-seconds"},
+	}
+	metrics.Read(samples)
+	var times cpuTimes
+	if samples[0].Value.Kind() == metrics.KindFloat64 {
+		times.user = samples[0].Value.Float64()
+	}
+	if samples[1].Value.Kind() == metrics.KindFloat64 {
+		times.gc = samples[1].Value.Float64()
+	}
+	return times
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func memoryLimit() uint64 {
+	var limit uint64
+	if goLimit := debug.SetMemoryLimit(-1); goLimit > 0 && goLimit < math.MaxInt64 {
+		limit = uint64(goLimit)
+	}
+	if data, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		if cgroup, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil && (limit == 0 || cgroup < limit) {
+			limit = cgroup
+		}
+	}
+	return limit
+}
+
+func printResourceUsage(w http.ResponseWriter, usage ResourceUsage) {
+	fmt.Fprintln(w, "Resource Usage:")
+	fmt.Fprintf(w, "| Heap: %s in use at peak, %s allocated now, %s from the OS\n",
+		formatBytes(usage.PeakHeapInuse), formatBytes(usage.HeapAlloc), formatBytes(usage.Sys))
+	if usage.MemoryLimit > 0 {
+		fmt.Fprintf(w, "| Memory Limit: %s (peak heap is %d%%)\n", formatBytes(usage.MemoryLimit), usage.PeakHeapInuse*100/usage.MemoryLimit)
+	}
+	fmt.Fprintf(w, "| Allocated During Run: %s\n", formatBytes(usage.TotalAlloc))
+	fmt.Fprintf(w, "| GC: %d collections, %s paused in total, longest pause %s\n",
+		usage.NumGC, usage.GCPauseTotal.Round(time.Microsecond), usage.GCPauseMax.Round(time.Microsecond))
+	fmt.Fprintf(w, "| Goroutines: %d at peak, %d now\n", usage.GoroutinesPeak, usage.Goroutines)
+	fmt.Fprintf(w, "| CPU Time: %s user, %s GC over %s wall\n",
+		usage.CPUUser.Round(time.Millisecond), usage.CPUGC.Round(time.Millisecond), usage.Duration.Round(time.Millisecond))
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
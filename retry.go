@@ -0,0 +1,269 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy is how transient failures (429s, 5xx and their gRPC equivalents) are
+// retried: exponential backoff with jitter, a number of attempts per operation, and
+// an overall limit on how long a request may keep retrying.
+type RetryPolicy struct {
+	MaxAttempts int
+	// Attempts overrides MaxAttempts for single operations, such as pubsub.publish.
+	Attempts       map[string]int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Deadline bounds how long after the request starts a failure is still retried;
+	// zero leaves it to the request's own deadline.
+	Deadline time.Duration
+}
+
+// retryPolicyFromConfig reads the RETRY_* settings.
+func retryPolicyFromConfig(cfg *GCloudFunctionConfig) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    cfg.RetryMaxAttempts,
+		Attempts:       cfg.RetryAttempts,
+		InitialBackoff: cfg.RetryInitialBackoff,
+		MaxBackoff:     cfg.RetryMaxBackoff,
+		Multiplier:     cfg.RetryMultiplier,
+		Deadline:       cfg.RetryDeadline,
+	}
+}
+
+func (p RetryPolicy) attempts(operation string) int {
+	if n, ok := p.Attempts[operation]; ok {
+		return max(n, 1)
+	}
+	return max(p.MaxAttempts, 1)
+}
+
+// backoff is the wait before retry n (from 0): the exponential step, capped, with
+// "equal jitter" so concurrent callers spread out but never retry immediately.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 0; i < n && d < float64(p.MaxBackoff); i++ {
+		d *= p.Multiplier
+	}
+	step := min(time.Duration(d), p.MaxBackoff)
+	if step <= 0 {
+		return 0
+	}
+	return step/2 + time.Duration(rand.Int63n(int64(step/2)+1))
+}
+
+// parseRetryAttempts reads RETRY_ATTEMPTS, e.g. "pubsub.publish=5,storage=2".
+func parseRetryAttempts(items []string) map[string]int {
+	attempts := map[string]int{}
+	for _, item := range items {
+		op, value, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || n < 1 {
+			continue
+		}
+		attempts[strings.TrimSpace(op)] = n
+	}
+	return attempts
+}
+
+// retryState is a request's policy, the time its retry deadline passes, and what was
+// retried so far.
+type retryState struct {
+	policy RetryPolicy
+	until  time.Time
+
+	mu    sync.Mutex
+	stats map[string]*RetryStat
+}
+
+// RetryStat is what retrying one operation took over a request.
+type RetryStat struct {
+	Operation string        `json:"operation"`
+	Calls     int           `json:"calls"`
+	Retries   int           `json:"retries"`
+	Waited    time.Duration `json:"waitedNs"`
+	// Failed counts calls that still failed after their last attempt.
+	Failed    int    `json:"failed,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type retryStateKey struct{}
+
+func withRetryPolicy(ctx context.Context, policy RetryPolicy) (context.Context, *retryState) {
+	state := &retryState{policy: policy, stats: map[string]*RetryStat{}}
+	if policy.Deadline > 0 {
+		state.until = time.Now().Add(policy.Deadline)
+	}
+	return context.WithValue(ctx, retryStateKey{}, state), state
+}
+
+// retryStateFrom returns the request's retry state, or one from the environment for
+// callers outside a run.
+func retryStateFrom(ctx context.Context) *retryState {
+	if state, ok := ctx.Value(retryStateKey{}).(*retryState); ok {
+		return state
+	}
+	_, state := withRetryPolicy(ctx, retryPolicyFromConfig(NewGCloudFunctionConfig()))
+	return state
+}
+
+func (s *retryState) stat(operation string) *RetryStat {
+	st, ok := s.stats[operation]
+	if !ok {
+		st = &RetryStat{Operation: operation}
+		s.stats[operation] = st
+	}
+	return st
+}
+
+func (s *retryState) record(operation string, f func(*RetryStat)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.stat(operation))
+}
+
+// Stats returns the operations that were retried or failed, by name.
+func (s *retryState) Stats() []RetryStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stats []RetryStat
+	for _, st := range s.stats {
+		if st.Retries > 0 || st.Failed > 0 {
+			stats = append(stats, *st)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Operation < stats[j].Operation })
+	return stats
+}
+
+// isTransient reports whether err is worth retrying: rate limits, quota exhaustion and
+// server errors that are expected to clear.
+func isTransient(err error) bool {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		switch gErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		for _, detail := range gErr.Errors {
+			if rateLimitReasons[detail.Reason] {
+				return true
+			}
+		}
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// retryTransient runs fn, and while it fails with a transient error waits for the
+// server's Retry-After, or the policy's backoff, and tries again, up to the policy's
+// attempts for operation. It gives up early rather than wait past ctx's deadline or the
+// policy's, so waiting never eats the time budget the report needs.
+func retryTransient(ctx context.Context, operation string, fn func() error) error {
+	state := retryStateFrom(ctx)
+	attempts := state.policy.attempts(operation)
+	state.record(operation, func(st *RetryStat) { st.Calls++ })
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		// Rate limits also go in the quota report, whether or not they are retried.
+		recordQuotaError(ctx, operation, err)
+		if err == nil {
+			return nil
+		}
+		fail := func(err error) error {
+			state.record(operation, func(st *RetryStat) {
+				st.Failed++
+				st.LastError = err.Error()
+			})
+			return err
+		}
+		if !isTransient(err) {
+			return fail(err)
+		}
+		if attempt >= attempts {
+			return fail(fmt.Errorf("%w (gave up after %d attempts)", err, attempt))
+		}
+		wait, ok := retryAfter(err)
+		if !ok {
+			wait = state.policy.backoff(attempt - 1)
+		}
+		wait = min(wait, state.policy.MaxBackoff)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return fail(fmt.Errorf("%w (not retried: waiting %s would pass the deadline)", err, wait))
+		}
+		if !state.until.IsZero() && time.Until(state.until) < wait {
+			return fail(fmt.Errorf("%w (not retried: waiting %s would pass RETRY_DEADLINE)", err, wait))
+		}
+
+		start := time.Now()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		waited := time.Since(start)
+		state.record(operation, func(st *RetryStat) {
+			st.Retries++
+			st.Waited += waited
+			st.LastError = err.Error()
+		})
+		if recorder := quotaRecorderFrom(ctx); recorder != nil {
+			recorder.addWait(waited)
+		}
+		if ctx.Err() != nil {
+			return fail(err)
+		}
+	}
+}
+
+// applyStorageRetry makes the storage client's own retries, which cover listing pages
+// and reads the wrappers above can't restart, follow the same policy.
+func applyStorageRetry(client *storage.Client, policy RetryPolicy) {
+	client.SetRetry(
+		storage.WithBackoff(gax.Backoff{
+			Initial:    policy.InitialBackoff,
+			Max:        policy.MaxBackoff,
+			Multiplier: policy.Multiplier,
+		}),
+		storage.WithMaxAttempts(policy.attempts("storage")),
+	)
+}
+
+func printRetryReport(w http.ResponseWriter, stats []RetryStat) {
+	if len(stats) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Retries:")
+	for _, st := range stats {
+		fmt.Fprintf(w, "| %s: %d retries over %d calls, waited %s", st.Operation, st.Retries, st.Calls, st.Waited.Round(time.Millisecond))
+		if st.Failed > 0 {
+			fmt.Fprintf(w, ", %d failed", st.Failed)
+		}
+		if st.LastError != "" {
+			fmt.Fprintf(w, " - last error: %s", st.LastError)
+		}
+		fmt.Fprintln(w)
+	}
+}
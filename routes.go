@@ -0,0 +1,88 @@
+package gcf
+
+import (
+	"net/http"
+	"strings"
+)
+
+// objectRoutePrefix serves /objects/{name}; the rest of the path is the object name,
+// slashes included.
+const objectRoutePrefix = "/objects/"
+
+// capabilityRoute runs one capability of the diagnostics on its own, with the same
+// report, formats and headers as the full run at /. checks are run in order; prepare,
+// when set, seeds the run with what the skipped checks would have found.
+type capabilityRoute struct {
+	// method is the required method, or empty for any; routes that publish or
+	// consume messages need POST.
+	method  string
+	checks  []checkDef
+	prepare func(run *diagRun, r *http.Request)
+}
+
+// matchCapabilityRoute maps /checks/buckets, /objects, /objects/{name},
+// /pubsub/publish and /pubsub/pull to their checks. The bucket checks sit under
+// /checks because /buckets itself lists and manages buckets.
+func matchCapabilityRoute(path string) (*capabilityRoute, bool) {
+	switch path {
+	case "/checks/buckets":
+		return &capabilityRoute{checks: []checkDef{
+			routeCheck("storage_client"),
+			routeCheck("bucket_access", "storage_client"),
+		}}, true
+	case "/objects":
+		return &capabilityRoute{checks: []checkDef{
+			routeCheck("storage_client"),
+			routeCheck("list_objects", "storage_client"),
+		}}, true
+	case "/pubsub/publish":
+		return &capabilityRoute{method: http.MethodPost, checks: []checkDef{
+			routeCheck("pubsub_client"),
+			routeCheck("pubsub_publish", "pubsub_client"),
+		}}, true
+	case "/pubsub/pull":
+		return &capabilityRoute{method: http.MethodPost, checks: []checkDef{
+			routeCheck("pubsub_client"),
+			routeCheck("pubsub_receive", "pubsub_client"),
+		}}, true
+	}
+	if name, ok := strings.CutPrefix(path, objectRoutePrefix); ok && name != "" {
+		return &capabilityRoute{
+			checks: []checkDef{
+				routeCheck("storage_client"),
+				routeCheck("download", "storage_client"),
+			},
+			prepare: func(run *diagRun, r *http.Request) {
+				noteObjectName(run.ctx, name, run.cfg.ObjectNameEncoding)
+				run.sampleNames = []string{name}
+			},
+		}, true
+	}
+	return nil, false
+}
+
+// routeCheck is the registered check name, run after the given checks instead of its
+// usual dependencies.
+func routeCheck(name string, after ...string) checkDef {
+	for _, def := range diagChecks {
+		if def.name == name {
+			def.after = after
+			def.enabled = nil
+			return def
+		}
+	}
+	panic("unknown check " + name)
+}
+
+func capabilityHandler(w http.ResponseWriter, r *http.Request, route *capabilityRoute) {
+	if route.method != "" && r.Method != route.method {
+		w.Header().Set("Allow", route.method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, _, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	runDiagnosticsRoute(w, r, cfg, route)
+}
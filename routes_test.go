@@ -0,0 +1,107 @@
+package gcf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestCapabilityRouteUsesProfile(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/")
+		writeFakeJSON(w, http.StatusOK, map[string]any{"name": name, "location": "EU"})
+	})
+	setTestEnv(t, nil)
+	setTestProfiles(t, map[string]map[string]string{"staging": {"BUCKET_NAME": "staging-bucket"}})
+
+	tests := []struct {
+		target, wantPath string
+		wantStatus       int
+	}{
+		{"/checks/buckets", "/storage/v1/b/diag-bucket", http.StatusOK},
+		{"/checks/buckets?profile=staging", "/storage/v1/b/staging-bucket", http.StatusOK},
+		{"/checks/buckets?profile=missing", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			mu.Lock()
+			paths = nil
+			mu.Unlock()
+			w := httptest.NewRecorder()
+			DoIt(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body:\n%s", w.Code, tt.wantStatus, w.Body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.wantPath == "" {
+				if len(paths) > 0 {
+					t.Errorf("API calls %v for a refused request", paths)
+				}
+				return
+			}
+			if len(paths) == 0 || paths[0] != tt.wantPath {
+				t.Errorf("API calls = %v, want %s", paths, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestHandlerImpersonatesProfileTarget(t *testing.T) {
+	const target = "prod-data@diag-project.iam.gserviceaccount.com"
+	impersonatedSources.Store(target, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "prod-data-token", TokenType: "Bearer"}))
+	t.Cleanup(func() { impersonatedSources.Delete(target) })
+
+	var mu sync.Mutex
+	var auths []string
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auths = append(auths, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/acl") {
+			writeFakeJSON(w, http.StatusOK, map[string]any{"items": []map[string]any{}})
+			return
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]any{"bucket": "diag-bucket", "name": "a", "size": "1", "generation": "1"})
+	})
+	setTestEnv(t, nil)
+	setTestProfiles(t, map[string]map[string]string{"prod-data": {"TARGET_SERVICE_ACCOUNT": target}})
+
+	tests := []struct {
+		target, wantAuth string
+	}{
+		{"/object-attrs?name=a", "Bearer test-token"},
+		{"/object-attrs?name=a&profile=prod-data", "Bearer prod-data-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			mu.Lock()
+			auths = nil
+			mu.Unlock()
+			w := httptest.NewRecorder()
+			DoIt(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d; body:\n%s", w.Code, http.StatusOK, w.Body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(auths) == 0 {
+				t.Fatal("no API calls")
+			}
+			for _, auth := range auths {
+				if auth != tt.wantAuth {
+					t.Errorf("Authorization = %q, want %q", auth, tt.wantAuth)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	maxRoutingCases         = 64
+	maxRoutingSubscriptions = 10
+	maxRoutingBytes         = 16 << 10
+	// routingRunAttr and routingCaseAttr tag each test message, so receivers can tell the
+	// run's messages from real traffic and which case each one is.
+	routingRunAttr  = "gcf-routing-run"
+	routingCaseAttr = "gcf-routing-case"
+)
+
+// RoutingRequest is the attribute matrix to publish. Attributes lists the values to try
+// for each key, "" meaning the attribute is left off, and every combination is sent;
+// Cases adds combinations as they are. Subscriptions defaults to ROUTING_SUBSCRIPTIONS,
+// then to every subscription on the topic.
+type RoutingRequest struct {
+	Subscriptions []string            `json:"subscriptions"`
+	Attributes    map[string][]string `json:"attributes"`
+	Cases         []map[string]string `json:"cases"`
+}
+
+type RoutingSubscription struct {
+	Name   string `json:"name"`
+	Filter string `json:"filter"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RoutingCase is one published message and which subscriptions, by index, received it.
+type RoutingCase struct {
+	Attributes map[string]string `json:"attributes"`
+	MessageID  string            `json:"messageId,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	ReceivedBy []bool            `json:"receivedBy"`
+}
+
+// RoutingTable is the truth table of a routing test.
+type RoutingTable struct {
+	Topic         string                `json:"topic"`
+	RunID         string                `json:"runId"`
+	Window        string                `json:"window"`
+	Subscriptions []RoutingSubscription `json:"subscriptions"`
+	Cases         []RoutingCase         `json:"cases"`
+}
+
+// routingHandler publishes a matrix of attribute combinations to PUBSUB_TOPIC_ID and
+// pulls from every subscription for the receive window (?window=, default
+// PUBSUB_RECEIVE_WINDOW), reporting which subscription got which combination, e.g.
+// POST /routing {"attributes":{"region":["us","eu"],"priority":["high",""]}}.
+// The run's messages are acked; anything else pulled meanwhile is nacked straight back,
+// so live subscriptions see it again almost at once.
+func routingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "the routing test publishes messages and requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := parseRoutingRequest(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid routing test: %v", err), http.StatusBadRequest)
+		return
+	}
+	cases, err := routingCases(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid routing test: %v", err), http.StatusBadRequest)
+		return
+	}
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	client, err := newPubSubClient(ctx, cfg.ComputeProjectId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating Pub/Sub client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+	topic := client.Topic(cfg.PubSubTopicId)
+	defer topic.Stop()
+
+	names := req.Subscriptions
+	if len(names) == 0 {
+		names = cfg.RoutingSubscriptions
+	}
+	subs, err := routingSubscriptions(ctx, client, topic, names)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list subscriptions of %s: %v", cfg.PubSubTopicId, err), http.StatusBadGateway)
+		return
+	}
+	if len(subs) == 0 {
+		http.Error(w, fmt.Sprintf("topic %s has no subscriptions to test", cfg.PubSubTopicId), http.StatusBadRequest)
+		return
+	}
+	if len(subs) > maxRoutingSubscriptions {
+		http.Error(w, fmt.Sprintf("at most %d subscriptions can be tested at once", maxRoutingSubscriptions), http.StatusBadRequest)
+		return
+	}
+
+	window := queryDuration(r, "window", cfg.PubSubReceiveWindow)
+	table := RoutingTable{Topic: topic.String(), RunID: newRunID(), Window: window.String()}
+	for _, sub := range subs {
+		table.Subscriptions = append(table.Subscriptions, describeRoutingSubscription(ctx, sub, topic))
+	}
+	for _, attrs := range cases {
+		table.Cases = append(table.Cases, RoutingCase{Attributes: attrs, ReceivedBy: make([]bool, len(subs))})
+	}
+
+	publishRoutingCases(ctx, topic, &table)
+	receiveRoutingCases(ctx, subs, &table, window)
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(table)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	printRoutingTable(w, table)
+}
+
+func parseRoutingRequest(r *http.Request) (RoutingRequest, error) {
+	var req RoutingRequest
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRoutingBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return req, errors.New("body must hold a single JSON object")
+	}
+	return req, nil
+}
+
+// routingCases expands the attribute matrix, keys in sorted order so the table reads
+// the same each time, and appends the explicit cases.
+func routingCases(req RoutingRequest) ([]map[string]string, error) {
+	keys := make([]string, 0, len(req.Attributes))
+	for key := range req.Attributes {
+		if strings.HasPrefix(key, "gcf-routing-") {
+			return nil, fmt.Errorf("attribute %s is reserved", key)
+		}
+		if len(req.Attributes[key]) == 0 {
+			return nil, fmt.Errorf("attribute %s has no values", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var cases []map[string]string
+	if len(keys) > 0 {
+		cases = []map[string]string{{}}
+		for _, key := range keys {
+			var next []map[string]string
+			for _, c := range cases {
+				for _, value := range req.Attributes[key] {
+					attrs := make(map[string]string, len(c)+1)
+					for k, v := range c {
+						attrs[k] = v
+					}
+					if value != "" {
+						attrs[key] = value
+					}
+					next = append(next, attrs)
+				}
+			}
+			if len(next) > maxRoutingCases {
+				return nil, fmt.Errorf("the matrix has more than %d combinations", maxRoutingCases)
+			}
+			cases = next
+		}
+	}
+	for _, c := range req.Cases {
+		for key := range c {
+			if strings.HasPrefix(key, "gcf-routing-") {
+				return nil, fmt.Errorf("attribute %s is reserved", key)
+			}
+		}
+		cases = append(cases, c)
+	}
+	if len(cases) == 0 {
+		return nil, errors.New("attributes or cases are required")
+	}
+	if len(cases) > maxRoutingCases {
+		return nil, fmt.Errorf("at most %d cases can be published at once", maxRoutingCases)
+	}
+	return cases, nil
+}
+
+// routingSubscriptions resolves names, short IDs in the compute project or full
+// resource names, falling back to the topic's own subscriptions when there are none.
+func routingSubscriptions(ctx context.Context, client *pubsub.Client, topic *pubsub.Topic, names []string) ([]*pubsub.Subscription, error) {
+	var subs []*pubsub.Subscription
+	if len(names) > 0 {
+		for _, name := range uniqueStrings(names) {
+			if parts := strings.Split(name, "/"); len(parts) == 4 && parts[0] == "projects" && parts[2] == "subscriptions" {
+				subs = append(subs, client.SubscriptionInProject(parts[3], parts[1]))
+				continue
+			}
+			subs = append(subs, client.Subscription(name))
+		}
+		return subs, nil
+	}
+	it := topic.Subscriptions(ctx)
+	for {
+		sub, err := it.Next()
+		if err == iterator.Done {
+			return subs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+}
+
+func describeRoutingSubscription(ctx context.Context, sub *pubsub.Subscription, topic *pubsub.Topic) RoutingSubscription {
+	desc := RoutingSubscription{Name: sub.String()}
+	config, err := sub.Config(ctx)
+	if err != nil {
+		desc.Error = fmt.Sprintf("failed to read subscription: %v", err)
+		return desc
+	}
+	desc.Filter = config.Filter
+	if config.Topic == nil || config.Topic.String() != topic.String() {
+		desc.Error = "not attached to " + topic.String()
+	}
+	return desc
+}
+
+func publishRoutingCases(ctx context.Context, topic *pubsub.Topic, table *RoutingTable) {
+	results := make([]*pubsub.PublishResult, len(table.Cases))
+	for i, c := range table.Cases {
+		attrs := map[string]string{routingRunAttr: table.RunID, routingCaseAttr: strconv.Itoa(i)}
+		for k, v := range c.Attributes {
+			attrs[k] = v
+		}
+		results[i] = topic.Publish(ctx, &pubsub.Message{Data: []byte("routing test"), Attributes: attrs})
+	}
+	for i, res := range results {
+		id, err := res.Get(ctx)
+		if err != nil {
+			table.Cases[i].Error = err.Error()
+			continue
+		}
+		table.Cases[i].MessageID = id
+	}
+}
+
+// receiveRoutingCases pulls from every subscription side by side for window, acking the
+// run's messages and marking which case reached which subscription.
+func receiveRoutingCases(ctx context.Context, subs []*pubsub.Subscription, table *RoutingTable, window time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, sub := range subs {
+		if table.Subscriptions[i].Error != "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sub.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+				n, err := strconv.Atoi(msg.Attributes[routingCaseAttr])
+				if msg.Attributes[routingRunAttr] != table.RunID || err != nil || n < 0 || n >= len(table.Cases) {
+					msg.Nack()
+					return
+				}
+				msg.Ack()
+				mu.Lock()
+				table.Cases[n].ReceivedBy[i] = true
+				mu.Unlock()
+			})
+			if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+				mu.Lock()
+				table.Subscriptions[i].Error = fmt.Sprintf("receive failed: %v", err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func printRoutingTable(w http.ResponseWriter, table RoutingTable) {
+	fmt.Fprintf(w, "Routing Truth Table (%s, run %s, window %s):\n", table.Topic, table.RunID, table.Window)
+	for i, s := range table.Subscriptions {
+		filter := s.Filter
+		if filter == "" {
+			filter = "(no filter)"
+		}
+		fmt.Fprintf(w, "| [%d] %s: %s", i+1, s.Name, filter)
+		if s.Error != "" {
+			fmt.Fprintf(w, " FAILED - %s", s.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprint(w, "| Case")
+	for i := range table.Subscriptions {
+		fmt.Fprintf(w, " %4s", fmt.Sprintf("[%d]", i+1))
+	}
+	fmt.Fprintln(w, "  Attributes")
+	for n, c := range table.Cases {
+		fmt.Fprintf(w, "| %4d", n+1)
+		for i, got := range c.ReceivedBy {
+			cell := "."
+			switch {
+			case table.Subscriptions[i].Error != "" || c.Error != "":
+				cell = "?"
+			case got:
+				cell = "X"
+			}
+			fmt.Fprintf(w, " %4s", cell)
+		}
+		fmt.Fprintf(w, "  %s", formatRoutingAttributes(c.Attributes))
+		if c.Error != "" {
+			fmt.Fprintf(w, " (publish FAILED - %s)", c.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "| X received, . not received within the window, ? not tested.")
+}
+
+func formatRoutingAttributes(attrs map[string]string) string {
+	if len(attrs) == 0 {
+		return "(none)"
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + attrs[k]
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,201 @@
+package gcf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxRunConfigBytes = 64 << 10
+
+var (
+	bucketNamePattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,220}[a-z0-9]$`)
+	projectIDPattern    = regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+	pubsubIDPattern     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._~+%-]{2,254}$`)
+	cryptoKeyPattern    = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+	runConfigAuthModes  = []string{"", "default"}
+	runConfigFormFields = []string{"bucket", "project", "topic", "subscription", "kmsKey", "auth", "checks", "progressTopic", "downloadSample", "listFields", "countOnly"}
+)
+
+// RunConfig is a complete configuration for one run, posted instead of relying on the
+// deployment's env vars. Empty fields keep the deployment's value.
+type RunConfig struct {
+	Bucket         string   `json:"bucket"`
+	Project        string   `json:"project"`
+	Topic          string   `json:"topic"`
+	Subscription   string   `json:"subscription"`
+	KmsKey         string   `json:"kmsKey"`
+	Auth           string   `json:"auth"`
+	Checks         []string `json:"checks"`
+	Sinks          RunSinks `json:"sinks"`
+	DownloadSample int      `json:"downloadSample"`
+	ListFields     string   `json:"listFields"`
+	CountOnly      bool     `json:"countOnly"`
+}
+
+// RunSinks are where a run's results go besides the response.
+type RunSinks struct {
+	ProgressTopic string `json:"progressTopic"`
+}
+
+// isRunConfig reports whether r posts a run config: a JSON or form body sent to the
+// diagnostics path. Other POSTs keep running with the deployment's config.
+func isRunConfig(r *http.Request) bool {
+	if r.Method != http.MethodPost || r.URL.Path != "/" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json", "application/x-www-form-urlencoded", "multipart/form-data":
+		return true
+	}
+	return false
+}
+
+// runConfigHandler runs the diagnostics with a configuration posted as JSON or as a
+// form. It is refused unless ALLOW_CONFIG_OVERRIDE=true, since it points the
+// function's identity at whatever resources the caller names.
+func runConfigHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, _, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.AllowConfigOverride {
+		http.Error(w, "posting a run config is disabled; set ALLOW_CONFIG_OVERRIDE=true to allow it", http.StatusForbidden)
+		return
+	}
+
+	rc, err := parseRunConfig(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid run config: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := rc.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid run config: %v", err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Running with a posted config for bucket %q, topic %q, subscription %q\n", rc.Bucket, rc.Topic, rc.Subscription)
+	rc.apply(cfg)
+	runDiagnosticsWithConfig(w, r, cfg)
+}
+
+// parseRunConfig reads a JSON body strictly, rejecting unknown fields, or a form body
+// with the same field names and checks as a comma-separated list.
+func parseRunConfig(r *http.Request) (RunConfig, error) {
+	var rc RunConfig
+	r.Body = http.MaxBytesReader(nil, r.Body, maxRunConfigBytes)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/json":
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rc); err != nil {
+			return rc, err
+		}
+		if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+			return rc, errors.New("body must hold a single JSON object")
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(maxRunConfigBytes); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return rc, err
+		}
+		for key := range r.PostForm {
+			if !containsString(runConfigFormFields, key) {
+				return rc, fmt.Errorf("unknown field %q", key)
+			}
+		}
+		form := r.PostForm
+		rc = RunConfig{
+			Bucket:       form.Get("bucket"),
+			Project:      form.Get("project"),
+			Topic:        form.Get("topic"),
+			Subscription: form.Get("subscription"),
+			KmsKey:       form.Get("kmsKey"),
+			Auth:         form.Get("auth"),
+			Checks:       splitList(form.Get("checks")),
+			Sinks:        RunSinks{ProgressTopic: form.Get("progressTopic")},
+			ListFields:   form.Get("listFields"),
+			CountOnly:    form.Get("countOnly") == "true",
+		}
+		if v := form.Get("downloadSample"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return rc, fmt.Errorf("downloadSample %q is not a number", v)
+			}
+			rc.DownloadSample = n
+		}
+	}
+	return rc, nil
+}
+
+func (rc RunConfig) validate() error {
+	var problems []string
+	check := func(value string, pattern *regexp.Regexp, field string) {
+		if value != "" && !pattern.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("%s %q is not valid", field, value))
+		}
+	}
+	check(rc.Bucket, bucketNamePattern, "bucket")
+	check(rc.Project, projectIDPattern, "project")
+	check(rc.Topic, pubsubIDPattern, "topic")
+	check(rc.Subscription, pubsubIDPattern, "subscription")
+	check(rc.Sinks.ProgressTopic, pubsubIDPattern, "sinks.progressTopic")
+	check(rc.KmsKey, cryptoKeyPattern, "kmsKey")
+	if !containsString(runConfigAuthModes, rc.Auth) {
+		problems = append(problems, fmt.Sprintf("auth %q is not supported, only the function's default credentials are", rc.Auth))
+	}
+	if rc.DownloadSample < 0 {
+		problems = append(problems, "downloadSample must not be negative")
+	}
+	if rc.ListFields != "" {
+		if _, err := listQuery(rc.ListFields); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, name := range rc.Checks {
+		if !checkNamePattern.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("check %q is not a check name", name))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (rc RunConfig) apply(cfg *GCloudFunctionConfig) {
+	set := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	set(&cfg.BucketName, rc.Bucket)
+	set(&cfg.ComputeProjectId, rc.Project)
+	set(&cfg.PubSubTopicId, rc.Topic)
+	set(&cfg.PubSubSubscriptionId, rc.Subscription)
+	set(&cfg.KmsKey, rc.KmsKey)
+	set(&cfg.ProgressTopic, rc.Sinks.ProgressTopic)
+	set(&cfg.ListFields, rc.ListFields)
+	if rc.DownloadSample > 0 {
+		cfg.DownloadSample = rc.DownloadSample
+	}
+	cfg.ListCountOnly = rc.CountOnly
+	cfg.Checks = rc.Checks
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
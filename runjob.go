@@ -0,0 +1,134 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	run "google.golang.org/api/run/v2"
+)
+
+const defaultJobResultsPrefix = "gcf-list-buckets/jobs/"
+
+type JobLaunchResult struct {
+	Job        string
+	Scenario   string
+	Args       []string
+	Execution  string
+	LogURI     string
+	ResultsURI string
+	Error      string
+}
+
+// runJobHandler hands a diagnostic scenario that would outlive the function's timeout
+// (such as a multi-hour bucket walk) to a Cloud Run job, e.g.
+// POST /job?scenario=bucket-walk&arg=--prefix=logs/. The job receives the scenario as
+// arguments and DIAG_RESULTS_URI as the place to write its report.
+func runJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "launching a Cloud Run job requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	if cfg.DiagnosticsJob == "" {
+		http.Error(w, "DIAGNOSTICS_JOB is not configured", http.StatusNotImplemented)
+		return
+	}
+	scenario := r.URL.Query().Get("scenario")
+	if scenario == "" {
+		http.Error(w, "scenario parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	runName := renderArtifactName("job results", cfg.JobResultsTemplate, DefaultJobResultsTemplate, ArtifactName{
+		RunID:  newRunID(),
+		Time:   time.Now().UTC(),
+		Bucket: cfg.BucketName,
+		Check:  scenario,
+	})
+	resultsURI := fmt.Sprintf("gs://%s/%s%s/", cfg.SnapshotBucket, defaultJobResultsPrefix, runName)
+	args := append([]string{"--scenario=" + scenario}, r.URL.Query()["arg"]...)
+
+	result := launchDiagnosticsJob(ctx, cfg.DiagnosticsJob, args, resultsURI)
+	result.Scenario = scenario
+	printJobLaunch(w, result)
+}
+
+func launchDiagnosticsJob(ctx context.Context, job string, args []string, resultsURI string) JobLaunchResult {
+	result := JobLaunchResult{Job: job, Args: args, ResultsURI: resultsURI}
+
+	svc, err := run.NewService(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create Cloud Run client: %v", err)
+		return result
+	}
+	op, err := svc.Projects.Locations.Jobs.Run(job, &run.GoogleCloudRunV2RunJobRequest{
+		Overrides: &run.GoogleCloudRunV2Overrides{
+			ContainerOverrides: []*run.GoogleCloudRunV2ContainerOverride{{
+				Args: args,
+				Env: []*run.GoogleCloudRunV2EnvVar{
+					{Name: "DIAG_RESULTS_URI", Value: resultsURI},
+				},
+			}},
+		},
+	}).Context(ctx).Do()
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to run job: %v", err)
+		return result
+	}
+
+	// The operation's metadata is the execution that was just created.
+	var execution run.GoogleCloudRunV2Execution
+	if err := json.Unmarshal(op.Metadata, &execution); err != nil || execution.Name == "" {
+		result.Execution = op.Name
+		return result
+	}
+	result.Execution = execution.Name
+	result.LogURI = execution.LogUri
+	return result
+}
+
+// jobLocation splits projects/P/locations/L/jobs/J into its region and short names.
+func jobLocation(name string) (region, short string) {
+	parts := strings.Split(name, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		switch parts[i] {
+		case "locations":
+			region = parts[i+1]
+		case "jobs", "executions":
+			short = parts[i+1]
+		}
+	}
+	return region, short
+}
+
+func printJobLaunch(w http.ResponseWriter, result JobLaunchResult) {
+	fmt.Fprintf(w, "Cloud Run Job (%s):\n", result.Job)
+	fmt.Fprintf(w, "| Scenario: %s\n", result.Scenario)
+	fmt.Fprintf(w, "| Args: %s\n", strings.Join(result.Args, " "))
+	if result.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", result.Error)
+		return
+	}
+	fmt.Fprintf(w, "| Execution: %s\n", result.Execution)
+	if result.LogURI != "" {
+		fmt.Fprintf(w, "| Logs: %s\n", result.LogURI)
+	}
+	fmt.Fprintf(w, "| Results: %s\n", result.ResultsURI)
+
+	region, execution := jobLocation(result.Execution)
+	fmt.Fprintln(w, "Fetching Results:")
+	if execution != "" {
+		fmt.Fprintf(w, "| gcloud run jobs executions describe %s --region %s\n", execution, region)
+	}
+	fmt.Fprintf(w, "| gcloud storage cat %s**\n", result.ResultsURI)
+}
@@ -0,0 +1,450 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	runHistoryTimeout  = 10 * time.Second
+	runListWindow      = time.Hour
+	defaultRunsLimit   = 50
+	maxRunsLimit       = 1000
+	maxRunRecordBytes  = 32 << 20
+	runIDTimeLayout    = "20060102T150405"
+	runLabelMetaPrefix = "label."
+)
+
+var runIDPattern = regexp.MustCompile(`^\d{8}T\d{6}(-[0-9a-f]{12}|\.\d{9})$`)
+
+// RunRecord is a finished run as PERSIST_REPORTS stores it, one object per run in
+// SNAPSHOT_BUCKET under REPORT_HISTORY_PREFIX. Report is the JSON document a
+// format=json run returned; Text is the text report otherwise. NDJSON runs keep only
+// their checks.
+type RunRecord struct {
+	RunSummary
+	Checks []JSONCheck     `json:"checks"`
+	Report json.RawMessage `json:"report,omitempty"`
+	Text   string          `json:"text,omitempty"`
+}
+
+// RunSummary is what /runs lists for each run. It is kept in the object's metadata,
+// so listing needs no reads.
+type RunSummary struct {
+	RunID        string            `json:"runId"`
+	Status       string            `json:"status"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Profile      string            `json:"profile,omitempty"`
+	EndUser      string            `json:"endUser,omitempty"`
+	Caller       string            `json:"caller,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	FailedChecks []string          `json:"failedChecks,omitempty"`
+	StopCause    string            `json:"stopCause,omitempty"`
+}
+
+func runObjectName(cfg *GCloudFunctionConfig, runID string) string {
+	return cfg.ReportHistoryPrefix + runID + ".json"
+}
+
+// persistRun stores the finished run for /runs, with who asked for it: the end user
+// the frontend vouched for and the identity in the request's token. It runs after the
+// report has been written, so a failure here is only logged.
+func persistRun(r *http.Request, cfg *GCloudFunctionConfig, rw *reportWriter) {
+	checks := rw.Checks()
+	failed := failedCheckNames(checks)
+	caller := describeCaller(r)
+	record := RunRecord{
+		RunSummary: RunSummary{
+			RunID:        rw.runID,
+			Status:       diagStatus(ranChecks(checks), len(failed)),
+			Started:      rw.startedAt.UTC(),
+			Finished:     time.Now().UTC(),
+			Profile:      cfg.Profile,
+			EndUser:      caller.EndUser,
+			Caller:       caller.Identity,
+			Labels:       rw.labels,
+			FailedChecks: failed,
+		},
+		Checks: make([]JSONCheck, 0, len(checks)),
+	}
+	if rw.stop != nil {
+		record.StopCause = rw.stop.Cause
+	}
+	for _, c := range checks {
+		check := JSONCheck{Name: c.Name, Status: c.Status, DurationMs: c.Duration.Milliseconds(), Stop: c.Stop}
+		if c.Error != "" {
+			check.Error = &ReportError{Message: c.Error, Category: c.Category, Doc: c.Doc}
+		}
+		record.Checks = append(record.Checks, check)
+	}
+	switch {
+	case rw.jsonReport != nil && json.Valid(rw.rendered):
+		record.Report = json.RawMessage(rw.rendered)
+	case !rw.ndjson:
+		record.Text = string(rw.rendered)
+	}
+
+	ctx, cancel := context.WithTimeout(withImpersonation(context.WithoutCancel(r.Context()), cfg.TargetServiceAccount), runHistoryTimeout)
+	defer cancel()
+	if err := writeRunRecord(ctx, cfg, record); err != nil {
+		log.Printf("Failed to store run %s: %v\n", rw.runID, err)
+	}
+}
+
+func writeRunRecord(ctx context.Context, cfg *GCloudFunctionConfig, record RunRecord) error {
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	metadata := map[string]string{
+		"status":   record.Status,
+		"started":  record.Started.Format(time.RFC3339Nano),
+		"finished": record.Finished.Format(time.RFC3339Nano),
+	}
+	if record.Profile != "" {
+		metadata["profile"] = record.Profile
+	}
+	if record.EndUser != "" {
+		metadata["end-user"] = record.EndUser
+	}
+	if record.Caller != "" {
+		metadata["caller"] = record.Caller
+	}
+	if len(record.FailedChecks) > 0 {
+		metadata["failed-checks"] = strings.Join(record.FailedChecks, ",")
+	}
+	if record.StopCause != "" {
+		metadata["stop-cause"] = record.StopCause
+	}
+	for key, value := range record.Labels {
+		metadata[runLabelMetaPrefix+key] = value
+	}
+
+	obj := client.Bucket(cfg.SnapshotBucket).UserProject(cfg.ComputeProjectId).Object(runObjectName(cfg, record.RunID))
+	w := obj.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	w.ContentType = jsonContentType
+	w.Metadata = metadata
+	if err := json.NewEncoder(w).Encode(record); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// runSummaryFromAttrs reads a RunSummary back from a run object's metadata.
+func runSummaryFromAttrs(cfg *GCloudFunctionConfig, attrs *storage.ObjectAttrs) RunSummary {
+	summary := RunSummary{
+		RunID:     strings.TrimSuffix(strings.TrimPrefix(attrs.Name, cfg.ReportHistoryPrefix), ".json"),
+		Status:    attrs.Metadata["status"],
+		Profile:   attrs.Metadata["profile"],
+		EndUser:   attrs.Metadata["end-user"],
+		Caller:    attrs.Metadata["caller"],
+		StopCause: attrs.Metadata["stop-cause"],
+	}
+	summary.Started, _ = time.Parse(time.RFC3339Nano, attrs.Metadata["started"])
+	summary.Finished, _ = time.Parse(time.RFC3339Nano, attrs.Metadata["finished"])
+	if summary.Started.IsZero() {
+		summary.Started = attrs.Created
+	}
+	if failed := attrs.Metadata["failed-checks"]; failed != "" {
+		summary.FailedChecks = strings.Split(failed, ",")
+	}
+	for key, value := range attrs.Metadata {
+		if label, ok := strings.CutPrefix(key, runLabelMetaPrefix); ok {
+			if summary.Labels == nil {
+				summary.Labels = map[string]string{}
+			}
+			summary.Labels[label] = value
+		}
+	}
+	return summary
+}
+
+// runFilter narrows /runs. Since and Until bound the run's start; run IDs begin with
+// it, so they also bound the listing itself.
+type runFilter struct {
+	Status  string
+	Profile string
+	Since   time.Time
+	Until   time.Time
+	Labels  map[string]string
+	Limit   int
+}
+
+func (f runFilter) matches(s RunSummary) bool {
+	if f.Status != "" && s.Status != f.Status {
+		return false
+	}
+	if f.Profile != "" && s.Profile != f.Profile {
+		return false
+	}
+	if !f.Since.IsZero() && s.Started.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !s.Started.Before(f.Until) {
+		return false
+	}
+	for key, value := range f.Labels {
+		if s.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRunFilter reads ?status=pass|fail|partial, ?profile=, ?since= and ?until=
+// (RFC 3339 timestamps, or durations such as 24h meaning that long ago), label.KEY=VALUE
+// and ?limit=.
+func parseRunFilter(r *http.Request, now time.Time) (runFilter, error) {
+	q := r.URL.Query()
+	filter := runFilter{
+		Status:  q.Get("status"),
+		Profile: q.Get("profile"),
+		Labels:  map[string]string{},
+		Limit:   queryInt(r, "limit", defaultRunsLimit, maxRunsLimit),
+	}
+	if filter.Status != "" && filter.Status != "pass" && filter.Status != "fail" && filter.Status != "partial" {
+		return filter, errors.New("status must be pass, fail or partial")
+	}
+	for _, bound := range []struct {
+		key string
+		t   *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := q.Get(bound.key)
+		if value == "" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			*bound.t = t
+		} else if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			*bound.t = now.Add(-d)
+		} else {
+			return filter, fmt.Errorf("%s must be an RFC 3339 timestamp or a duration such as 24h", bound.key)
+		}
+	}
+	for key, values := range q {
+		if label, ok := strings.CutPrefix(key, "label."); ok && len(values) > 0 {
+			filter.Labels[label] = values[0]
+		}
+	}
+	return filter, nil
+}
+
+// listRuns returns the newest runs that match, newest first. Names sort oldest first
+// and GCS only lists forwards, so rather than read the whole history it lists windows
+// of run IDs backwards from the until bound, doubling the window each time, and stops
+// once it has Limit runs or has reached the since bound or the oldest stored run.
+func listRuns(ctx context.Context, client *storage.Client, cfg *GCloudFunctionConfig, filter runFilter) ([]RunSummary, error) {
+	bucket := client.Bucket(cfg.SnapshotBucket).UserProject(cfg.ComputeProjectId)
+	floor, err := oldestRunStart(ctx, bucket, cfg)
+	if err != nil || floor.IsZero() {
+		return nil, err
+	}
+	if filter.Since.After(floor) {
+		floor = filter.Since
+	}
+	runKey := func(t time.Time) string { return cfg.ReportHistoryPrefix + t.UTC().Format(runIDTimeLayout) }
+
+	// The layout drops fractions of a second, so the upper bound is the next second.
+	upper, endOffset := time.Now(), ""
+	if !filter.Until.IsZero() {
+		upper = filter.Until.Add(time.Second)
+		endOffset = runKey(upper)
+	}
+	var runs []RunSummary
+	for window := runListWindow; len(runs) < filter.Limit; window *= 2 {
+		lower := upper.Add(-window)
+		last := !lower.After(floor)
+		if last {
+			lower = floor
+		}
+		query := &storage.Query{Prefix: cfg.ReportHistoryPrefix, StartOffset: runKey(lower), EndOffset: endOffset}
+		if err := query.SetAttrSelection([]string{"Name", "Created", "Metadata"}); err != nil {
+			return nil, err
+		}
+		var batch []RunSummary
+		it := bucket.Objects(ctx, query)
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			summary := runSummaryFromAttrs(cfg, attrs)
+			if runIDPattern.MatchString(summary.RunID) && filter.matches(summary) {
+				batch = append(batch, summary)
+			}
+		}
+		sort.SliceStable(batch, func(i, j int) bool { return batch[i].RunID > batch[j].RunID })
+		runs = append(runs, batch...)
+		if last {
+			break
+		}
+		upper, endOffset = lower, query.StartOffset
+	}
+	if len(runs) > filter.Limit {
+		runs = runs[:filter.Limit]
+	}
+	return runs, nil
+}
+
+// oldestRunStart is when the oldest stored run started, or zero when there are none.
+func oldestRunStart(ctx context.Context, bucket *storage.BucketHandle, cfg *GCloudFunctionConfig) (time.Time, error) {
+	query := &storage.Query{Prefix: cfg.ReportHistoryPrefix}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return time.Time{}, err
+	}
+	it := bucket.Objects(ctx, query)
+	// Only the first name is wanted, not a full page of them.
+	it.PageInfo().MaxSize = 1
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return time.Time{}, nil
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(attrs.Name, cfg.ReportHistoryPrefix), ".json")
+		if !runIDPattern.MatchString(id) {
+			continue
+		}
+		return time.Parse(runIDTimeLayout, id[:len(runIDTimeLayout)])
+	}
+}
+
+// runsHandler browses the runs PERSIST_REPORTS stored: GET /runs lists them, newest
+// first, e.g. /runs?status=fail&since=24h&label.team=payments, and GET /runs/{id}
+// returns one run's RunRecord, or with ?format=text the report it printed.
+func runsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.PersistReports {
+		http.Error(w, "run history is disabled; set PERSIST_REPORTS=true to store runs", http.StatusNotImplemented)
+		return
+	}
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating storage client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	if id, ok := strings.CutPrefix(r.URL.Path, "/runs/"); ok {
+		getRun(w, r, client, cfg, id)
+		return
+	}
+
+	filter, err := parseRunFilter(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	runs, err := listRuns(ctx, client, cfg, filter)
+	if err != nil {
+		log.Printf("Failed to list runs: %v\n", err)
+		http.Error(w, fmt.Sprintf("Failed to list runs: %v", err), http.StatusBadGateway)
+		return
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(struct {
+			Runs []RunSummary `json:"runs"`
+		}{append([]RunSummary{}, runs...)})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	printRuns(w, runs)
+}
+
+func getRun(w http.ResponseWriter, r *http.Request, client *storage.Client, cfg *GCloudFunctionConfig, id string) {
+	if !runIDPattern.MatchString(id) {
+		http.Error(w, "invalid run ID", http.StatusBadRequest)
+		return
+	}
+	reader, err := client.Bucket(cfg.SnapshotBucket).UserProject(cfg.ComputeProjectId).Object(runObjectName(cfg, id)).NewReader(r.Context())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		http.Error(w, fmt.Sprintf("no stored run %s", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read run %s: %v", id, err), http.StatusBadGateway)
+		return
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxRunRecordBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read run %s: %v", id, err), http.StatusBadGateway)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		var record RunRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			http.Error(w, fmt.Sprintf("Run %s is not a stored run: %v", id, err), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if record.Text == "" {
+			printRuns(w, []RunSummary{record.RunSummary})
+			return
+		}
+		io.WriteString(w, record.Text)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Write(data)
+}
+
+func printRuns(w io.Writer, runs []RunSummary) {
+	fmt.Fprintf(w, "Runs (%d):\n", len(runs))
+	for _, run := range runs {
+		line := fmt.Sprintf("| %s %-7s %s", run.RunID, run.Status, run.Started.Format(time.RFC3339))
+		if !run.Finished.IsZero() {
+			line += fmt.Sprintf(" (%s)", run.Finished.Sub(run.Started).Round(time.Millisecond))
+		}
+		if run.Profile != "" {
+			line += " profile=" + run.Profile
+		}
+		switch {
+		case run.EndUser != "":
+			line += " by " + run.EndUser
+		case run.Caller != "":
+			line += " by " + run.Caller
+		}
+		if len(run.Labels) > 0 {
+			line += " [" + formatRunLabels(run.Labels) + "]"
+		}
+		if len(run.FailedChecks) > 0 {
+			line += " failed: " + strings.Join(run.FailedChecks, ",")
+		}
+		if run.StopCause != "" {
+			line += " stopped: " + run.StopCause
+		}
+		fmt.Fprintln(w, line)
+	}
+}
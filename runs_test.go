@@ -0,0 +1,81 @@
+package gcf
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunsHandlerPagesHistory(t *testing.T) {
+	const prefix = "gcf-list-buckets/runs/"
+	now := time.Now().UTC()
+	var names []string
+	for i := 0; i < 500; i++ {
+		names = append(names, prefix+now.Add(-time.Duration(i)*3*time.Hour).Format(runIDTimeLayout)+fmt.Sprintf("-%012x.json", i))
+	}
+	names = append(names, prefix+"README.txt")
+	sort.Strings(names)
+
+	var mu sync.Mutex
+	listed := 0
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		maxResults, _ := strconv.Atoi(q.Get("maxResults"))
+		start, _ := strconv.Atoi(q.Get("pageToken"))
+		var items []map[string]any
+		next := ""
+		for i, name := range names[start:] {
+			if !strings.HasPrefix(name, q.Get("prefix")) || name < q.Get("startOffset") || (q.Get("endOffset") != "" && name >= q.Get("endOffset")) {
+				continue
+			}
+			if maxResults > 0 && len(items) == maxResults {
+				next = strconv.Itoa(start + i)
+				break
+			}
+			metadata := map[string]string{"status": "pass"}
+			if strings.HasSuffix(name, "-000000000000.json") {
+				metadata["end-user"] = "alice@example.com (via iap)"
+			}
+			items = append(items, map[string]any{"name": name, "metadata": metadata})
+		}
+		mu.Lock()
+		listed += len(items)
+		mu.Unlock()
+		writeFakeJSON(w, http.StatusOK, map[string]any{"items": items, "nextPageToken": next})
+	})
+	setTestEnv(t, map[string]string{"PERSIST_REPORTS": "true", "REPORT_HISTORY_PREFIX": prefix})
+
+	rec := httptest.NewRecorder()
+	runsHandler(rec, httptest.NewRequest(http.MethodGet, "/runs?limit=5", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body:\n%s", rec.Code, rec.Body)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if lines[0] != "Runs (5):" {
+		t.Fatalf("got %q, want 5 runs:\n%s", lines[0], rec.Body)
+	}
+	for i, line := range lines[1:] {
+		if want := fmt.Sprintf("-%012x ", i); !strings.Contains(line, want) {
+			t.Errorf("run %d = %q, want the %d-th newest", i, line, i)
+		}
+	}
+	if !strings.Contains(lines[1], " by alice@example.com (via iap)") {
+		t.Errorf("newest run %q doesn't show who ran it", lines[1])
+	}
+	// One object for the oldest run, and windows back from now until five runs are found.
+	if listed > 20 {
+		t.Errorf("listed %d objects to show 5 runs of %d", listed, len(names))
+	}
+
+	rec = httptest.NewRecorder()
+	runsHandler(rec, httptest.NewRequest(http.MethodGet, "/runs?limit=1000", nil))
+	if !strings.HasPrefix(rec.Body.String(), "Runs (500):") {
+		t.Errorf("a limit past the history should list every run, got:\n%.200s", rec.Body)
+	}
+}
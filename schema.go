@@ -0,0 +1,209 @@
+package gcf
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportSchemaVersion is the version of the JSON report, NDJSON lines and check
+// payloads, sent as schemaVersion. Adding a field or a check bumps the minor version;
+// removing, renaming or retyping one bumps the major. Parsers should ignore fields
+// they don't know, which every schema allows.
+const reportSchemaVersion = "1.1.0"
+
+const schemaContentType = "application/schema+json"
+
+// checkPayloads are the report sections each check fills in, by where they sit in the
+// JSON report. Checks not listed only have their entry in checks.
+var checkPayloads = map[string]struct {
+	path string
+	typ  reflect.Type
+}{
+	"bucket_access":  {"bucket", reflect.TypeOf(BucketSection{})},
+	"list_objects":   {"objects", reflect.TypeOf(ObjectsSection{})},
+	"download":       {"download", reflect.TypeOf(DownloadSection{})},
+	"pubsub_publish": {"pubsub.publish", reflect.TypeOf(PublishOutcome{})},
+	"pubsub_receive": {"pubsub.receive", reflect.TypeOf(ReceiveOutcome{})},
+}
+
+// schemaHandler serves the schemas: GET /schema lists them, /schema/report is the
+// ?format=json document, /schema/line one ?format=ndjson line, and
+// /schema/checks/NAME a check's entry in checks and the section it fills in.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schema"), "/")
+	var schema map[string]any
+	switch {
+	case name == "":
+		w.Header().Set("Content-Type", jsonContentType)
+		writeIndentedJSON(w, schemaIndex())
+		return
+	case name == "report":
+		schema = typeSchema("report", reflect.TypeOf(JSONReport{}))
+	case name == "line":
+		schema = typeSchema("line", reflect.TypeOf(ReportLine{}))
+	case strings.HasPrefix(name, "checks/"):
+		var ok bool
+		if schema, ok = checkSchema(strings.TrimPrefix(name, "checks/")); !ok {
+			http.Error(w, "no such check", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "no such schema; GET /schema lists them", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", schemaContentType)
+	writeIndentedJSON(w, schema)
+}
+
+func writeIndentedJSON(w http.ResponseWriter, v any) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func schemaIndex() map[string]any {
+	checks := map[string]string{}
+	for _, def := range diagChecks {
+		checks[def.name] = "/schema/checks/" + def.name
+	}
+	return map[string]any{
+		"schemaVersion": reportSchemaVersion,
+		"report":        "/schema/report",
+		"line":          "/schema/line",
+		"checks":        checks,
+	}
+}
+
+func checkSchema(name string) (map[string]any, bool) {
+	found := false
+	for _, def := range diagChecks {
+		found = found || def.name == name
+	}
+	if !found {
+		return nil, false
+	}
+	gen := &schemaGen{defs: map[string]any{}}
+	properties := map[string]any{"check": gen.schema(reflect.TypeOf(JSONCheck{}))}
+	schema := map[string]any{
+		"description": "The " + name + " check's entry in the report's checks.",
+	}
+	if payload, ok := checkPayloads[name]; ok {
+		properties["payload"] = gen.schema(payload.typ)
+		schema["description"] = "The " + name + " check's entry in the report's checks, and the section it fills in at " + payload.path + "."
+		schema["x-report-path"] = payload.path
+	}
+	schema["type"] = "object"
+	schema["properties"] = properties
+	return gen.document("checks/"+name, schema), true
+}
+
+// typeSchema is the schema of t as encoding/json writes it.
+func typeSchema(name string, t reflect.Type) map[string]any {
+	gen := &schemaGen{defs: map[string]any{}}
+	return gen.document(name, gen.inline(t))
+}
+
+// schemaGen builds JSON Schemas from Go types, putting each named struct in $defs once.
+type schemaGen struct {
+	defs map[string]any
+}
+
+func (g *schemaGen) document(name string, schema map[string]any) map[string]any {
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = "gcf-list-buckets/schema/" + reportSchemaVersion + "/" + name
+	schema["x-schema-version"] = reportSchemaVersion
+	if len(g.defs) > 0 {
+		schema["$defs"] = g.defs
+	}
+	return schema
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]any{"type": "integer", "description": "Nanoseconds."}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := g.defs[t.Name()]; !ok {
+			g.defs[t.Name()] = true // placeholder, for types that refer to themselves
+			g.defs[t.Name()] = g.inline(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// inline is the object schema of struct t. Fields without omitempty are required, and
+// embedded structs are flattened as encoding/json does.
+func (g *schemaGen) inline(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	var walk func(t reflect.Type, optional bool)
+	walk = func(t reflect.Type, optional bool) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" {
+				// Fields of a nil embedded pointer are left out.
+				embedded := field.Type
+				for embedded.Kind() == reflect.Pointer {
+					embedded = embedded.Elem()
+				}
+				walk(embedded, optional || field.Type.Kind() == reflect.Pointer)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = g.schema(field.Type)
+			if !optional && !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t, false)
+	sort.Strings(required)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,99 @@
+package gcf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	scratchMaxAge    = time.Hour
+	instanceLockWait = 5 * time.Second
+	staleLockAge     = time.Minute
+)
+
+// newScratchDir creates the run's own directory under DOWNLOAD_DIR, so concurrent
+// requests on one instance never share local filenames. It is kept after the run for
+// the copies to be collected, and swept once it is older than scratchMaxAge.
+func newScratchDir(root, runID string) (string, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create download directory: %v", err)
+	}
+	sweepScratchDirs(root)
+
+	dir := filepath.Join(root, "run-"+runID)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create run directory: %v", err)
+	}
+	return dir, nil
+}
+
+// sweepScratchDirs removes run directories left behind by earlier runs. It holds the
+// instance lock so two requests don't sweep at once, and only touches run-* entries.
+func sweepScratchDirs(root string) {
+	unlock, err := lockInstance(filepath.Join(root, ".lock"))
+	if err != nil {
+		log.Printf("Skipping download directory sweep: %v\n", err)
+		return
+	}
+	defer unlock()
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "run-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < scratchMaxAge {
+			continue
+		}
+		os.RemoveAll(filepath.Join(root, entry.Name()))
+	}
+}
+
+// lockInstance guards instance-level files with an exclusive lock file. A lock older
+// than staleLockAge is assumed to belong to a request that died and is taken over.
+func lockInstance(path string) (func(), error) {
+	deadline := time.Now().Add(instanceLockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file: %v", err)
+		}
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// scratchPath maps an object name to a file in the run's directory, named by
+// DOWNLOAD_PATH_TEMPLATE. Missing parent directories are created. skip reports that
+// the file exists and DOWNLOAD_CONFLICT says to keep it.
+func scratchPath(opts downloadOptions, bucketName, objectName string) (path string, skip bool, err error) {
+	path = localArtifactPath(opts.LocalDir, opts.PathTemplate, ArtifactName{
+		RunID:  opts.RunID,
+		Time:   time.Now().UTC(),
+		Bucket: bucketName,
+		Object: objectName,
+	}, opts.Flat)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", false, err
+	}
+	return resolvePathConflict(path, opts.Conflict)
+}
@@ -0,0 +1,122 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/serviceusage/v1"
+)
+
+// ServiceState is whether one API is enabled on one project.
+type ServiceState struct {
+	Project string
+	Service string
+	State   string
+}
+
+func (s ServiceState) Enabled() bool {
+	return s.State == "ENABLED"
+}
+
+// ServiceUsageReport covers every project the run's APIs are consumed in.
+type ServiceUsageReport struct {
+	States []ServiceState
+	Errors []ProjectError
+}
+
+// ProjectError is a project whose services could not be read.
+type ProjectError struct {
+	Project string
+	Err     error
+}
+
+// Disabled returns the services that are not enabled, so a failing report names them.
+func (r ServiceUsageReport) Disabled() []ServiceState {
+	var disabled []ServiceState
+	for _, s := range r.States {
+		if !s.Enabled() {
+			disabled = append(disabled, s)
+		}
+	}
+	return disabled
+}
+
+func (r ServiceUsageReport) Err() error {
+	if disabled := r.Disabled(); len(disabled) > 0 {
+		names := make([]string, len(disabled))
+		for i, s := range disabled {
+			names[i] = s.Service + " on " + s.Project
+		}
+		return fmt.Errorf("services not enabled: %s", strings.Join(names, ", "))
+	}
+	if len(r.Errors) > 0 {
+		return fmt.Errorf("could not read services of %s: %w", r.Errors[0].Project, r.Errors[0].Err)
+	}
+	return nil
+}
+
+// requiredServices maps each project to the APIs the checks call in it. Requests are
+// billed to and gated on COMPUTE_PROJECT_ID; the KMS key's project must also have the
+// KMS API enabled.
+func requiredServices(cfg *GCloudFunctionConfig) map[string][]string {
+	required := map[string][]string{
+		cfg.ComputeProjectId: {"storage.googleapis.com", "pubsub.googleapis.com", "iamcredentials.googleapis.com"},
+	}
+	if cfg.KmsKey != "" {
+		required[cfg.ComputeProjectId] = append(required[cfg.ComputeProjectId], "cloudkms.googleapis.com")
+		if parts := strings.Split(cfg.KmsKey, "/"); len(parts) > 1 && parts[0] == "projects" && parts[1] != cfg.ComputeProjectId {
+			required[parts[1]] = append(required[parts[1]], "cloudkms.googleapis.com")
+		}
+	}
+	return required
+}
+
+// checkServiceUsage asks the Service Usage API which required services are enabled.
+func checkServiceUsage(ctx context.Context, cfg *GCloudFunctionConfig) ServiceUsageReport {
+	var report ServiceUsageReport
+	svc, err := serviceusage.NewService(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, ProjectError{Project: cfg.ComputeProjectId, Err: err})
+		return report
+	}
+
+	required := requiredServices(cfg)
+	projects := make([]string, 0, len(required))
+	for project := range required {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+
+	for _, project := range projects {
+		names := make([]string, len(required[project]))
+		for i, service := range required[project] {
+			names[i] = fmt.Sprintf("projects/%s/services/%s", project, service)
+		}
+		resp, err := svc.Services.BatchGet("projects/" + project).Names(names...).Context(ctx).Do()
+		if err != nil {
+			report.Errors = append(report.Errors, ProjectError{Project: project, Err: err})
+			continue
+		}
+		for _, s := range resp.Services {
+			report.States = append(report.States, ServiceState{Project: project, Service: path.Base(s.Name), State: s.State})
+		}
+	}
+	return report
+}
+
+func printServiceUsage(w http.ResponseWriter, report ServiceUsageReport) {
+	fmt.Fprintln(w, "Required Services:")
+	for _, s := range report.States {
+		fmt.Fprintf(w, "| %s %s: %s\n", s.Project, s.Service, s.State)
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintf(w, "| %s: could not read services: %v\n", e.Project, e.Err)
+	}
+	for _, s := range report.Disabled() {
+		fmt.Fprintf(w, "| Enable: gcloud services enable %s --project=%s\n", s.Service, s.Project)
+	}
+}
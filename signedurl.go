@@ -0,0 +1,217 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const signedURLSelfTestTTL = 5 * time.Minute
+
+const (
+	defaultSignedURLTTL = 15 * time.Minute
+	// maxSignedURLTTL is the longest expiry V4 signing allows.
+	maxSignedURLTTL = 7 * 24 * time.Hour
+)
+
+// signedObjectURL creates a V4 signed URL. On Cloud Functions the library signs
+// through the IAM Credentials API using the runtime service account, or, when ctx
+// impersonates TARGET_SERVICE_ACCOUNT, the URL is signed as that account so it grants
+// the target's access.
+func signedObjectURL(ctx context.Context, bucket *storage.BucketHandle, objectName, method string, ttl time.Duration) (string, error) {
+	return signObjectURL(ctx, bucket, objectName, method, "", time.Now().Add(ttl))
+}
+
+// signObjectURL is signedObjectURL with a content type, which becomes part of the
+// signature so uploads with any other Content-Type are refused.
+func signObjectURL(ctx context.Context, bucket *storage.BucketHandle, objectName, method, contentType string, expires time.Time) (string, error) {
+	opts := &storage.SignedURLOptions{
+		Method:      method,
+		ContentType: contentType,
+		Expires:     expires,
+		Scheme:      storage.SigningSchemeV4,
+	}
+	if target := impersonationTarget(ctx); target != "" {
+		opts.GoogleAccessID = target
+		opts.SignBytes = impersonatedSignBytes(ctx, target)
+	}
+	return bucket.SignedURL(objectName, opts)
+}
+
+// SignedURL is a URL a client without GCS credentials can use once, with the headers
+// it must send alongside.
+type SignedURL struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Bucket  string            `json:"bucket"`
+	Object  string            `json:"object"`
+	Expires time.Time         `json:"expires"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// signedURLHandler hands out V4 signed URLs for objects in BUCKET_NAME, e.g.
+// /signed-url?object=a/b.csv&method=PUT&expires=1h&contentType=text/csv. GET is the
+// default method; PUT URLs let the holder write, so they need ALLOW_UPLOADS=true like
+// /upload. expires defaults to 15m and is capped at 7 days.
+func signedURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	objectName := q.Get("object")
+	if objectName == "" {
+		http.Error(w, "object is required", http.StatusBadRequest)
+		return
+	}
+	if len(objectName) > maxObjectNameBytes {
+		http.Error(w, fmt.Sprintf("object names are at most %d bytes", maxObjectNameBytes), http.StatusBadRequest)
+		return
+	}
+	method := q.Get("method")
+	if method == "" {
+		method = http.MethodGet
+	}
+	switch method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !cfg.AllowUploads {
+			http.Error(w, "signing uploads is disabled; set ALLOW_UPLOADS=true to allow it", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "method must be GET or PUT", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultSignedURLTTL
+	if v := q.Get("expires"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxSignedURLTTL {
+			http.Error(w, fmt.Sprintf("expires must be a duration up to %s", maxSignedURLTTL), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	contentType := q.Get("contentType")
+	if contentType != "" && method != http.MethodPut {
+		http.Error(w, "contentType only applies to PUT", http.StatusBadRequest)
+		return
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating storage client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	signed := SignedURL{
+		Method:  method,
+		Bucket:  cfg.BucketName,
+		Object:  objectName,
+		Expires: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+	signed.URL, err = signObjectURL(ctx, client.Bucket(cfg.BucketName), objectName, method, contentType, signed.Expires)
+	if err != nil {
+		log.Printf("Failed to sign URL for %s: %v\n", safeObjectName(objectName), err)
+		http.Error(w, fmt.Sprintf("Failed to sign URL: %v", err), http.StatusBadGateway)
+		return
+	}
+	if contentType != "" {
+		signed.Headers = map[string]string{"Content-Type": contentType}
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(signed)
+}
+
+type SignedURLTestResult struct {
+	Object     string
+	ViaProxy   string
+	StatusCode int
+	Error      string
+}
+
+// Err summarizes the outcome as an error for the check matrix.
+func (r SignedURLTestResult) Err() error {
+	if r.Error != "" {
+		return errors.New(r.Error)
+	}
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected HTTP status %d", r.StatusCode)
+	}
+	return nil
+}
+
+// testSignedURL signs a GET for objectName and fetches its first byte without any
+// credentials, optionally through proxyURL to exercise the public internet path.
+func testSignedURL(ctx context.Context, bucket *storage.BucketHandle, objectName, proxyURL string) SignedURLTestResult {
+	result := SignedURLTestResult{Object: objectName, ViaProxy: redactURLCredentials(proxyURL)}
+
+	signed, err := signedObjectURL(ctx, bucket, objectName, http.MethodGet, signedURLSelfTestTTL)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to sign URL: %v", err)
+		return result
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil {
+			// url.Error quotes the raw URL, credentials and all; keep only the cause.
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			result.Error = fmt.Sprintf("invalid proxy URL: %v", err)
+			return result
+		}
+		client.Transport = &http.Transport{Proxy: http.ProxyURL(proxy)}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, signed, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = fmt.Sprintf("GET failed: %v", err)
+		return result
+	}
+	resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	return result
+}
+
+func printSignedURLTest(w http.ResponseWriter, result SignedURLTestResult) {
+	fmt.Fprintf(w, "Signed URL Self Test (%s):\n", safeObjectName(result.Object))
+	if result.ViaProxy != "" {
+		fmt.Fprintf(w, "| Via Proxy: %s\n", result.ViaProxy)
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "| Result: FAILED (%s)\n", result.Error)
+		return
+	}
+	verdict := "OK"
+	if result.StatusCode != http.StatusOK && result.StatusCode != http.StatusPartialContent {
+		verdict = "FAILED"
+	}
+	fmt.Fprintf(w, "| Result: %s (HTTP %d)\n", verdict, result.StatusCode)
+}
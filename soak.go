@@ -0,0 +1,158 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	minSoakBytes = 1 << 10
+	// maxSoakBytes is the largest size /soak will ever write, whatever SOAK_MAX_BYTES says.
+	maxSoakBytes = 1 << 30
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SoakSize is the write and read-back of one object size.
+type SoakSize struct {
+	Size      int64
+	Write     time.Duration
+	FirstByte time.Duration
+	Read      time.Duration
+	Verified  bool
+	Skipped   bool
+	Error     string
+}
+
+func (s SoakSize) writeMBps() float64 { return mbps(s.Size, s.Write) }
+func (s SoakSize) readMBps() float64  { return mbps(s.Size, s.Read) }
+
+func mbps(size int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(size) / (1 << 20) / d.Seconds()
+}
+
+// soakHandler writes objects of every power-of-two size from 1KiB up to max, reads
+// each back, checks its CRC32C both ways and deletes it, giving a throughput curve by
+// size, e.g. POST /soak?max=67108864. Sizes that don't fit in the request's time are
+// reported as skipped; ?cleanup=keep-on-failure keeps objects that failed to verify.
+func soakHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "soak writes to the bucket and requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	maxSize := int64(queryInt(r, "max", cfg.SoakMaxBytes, maxSoakBytes))
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "Error creating storage client: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	policy, err := requestCleanupPolicy(r, cfg.CleanupPolicy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	runID := newRunID()
+	artifacts := newCleanupManager(runID, policy)
+
+	bucket := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId)
+	prefix := cfg.SoakPrefix + runID + "/"
+	var results []SoakSize
+	for size := int64(minSoakBytes); size <= maxSize; size *= 2 {
+		if ctx.Err() != nil {
+			results = append(results, SoakSize{Size: size, Skipped: true})
+			continue
+		}
+		results = append(results, soakOnce(ctx, artifacts, bucket.Object(fmt.Sprintf("%s%d", prefix, size)), size))
+	}
+	printSoakResults(w, cfg.BucketName, prefix, results)
+	printCleanup(w, policy, artifacts.finish(ctx, false))
+}
+
+// soakOnce writes size bytes of seeded random data, reads them back and hands the
+// object to the cleanup manager straight away, so large sizes don't pile up.
+func soakOnce(ctx context.Context, artifacts *cleanupManager, obj *storage.ObjectHandle, size int64) (result SoakSize) {
+	result.Size = size
+	artifact := artifacts.trackObject(obj)
+	defer func() { artifacts.settle(ctx, artifact, result.Error != "") }()
+
+	want := crc32.New(crc32cTable)
+	start := time.Now()
+	wc := obj.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	wc.Metadata = artifacts.artifactMetadata()
+	if _, err := io.CopyN(io.MultiWriter(wc, want), rand.New(rand.NewSource(size)), size); err != nil {
+		wc.Close()
+		result.Error = fmt.Sprintf("write: %v", err)
+		return result
+	}
+	if err := wc.Close(); err != nil {
+		result.Error = fmt.Sprintf("write: %v", err)
+		return result
+	}
+	result.Write = time.Since(start)
+	if wc.Attrs().CRC32C != want.Sum32() {
+		result.Error = "stored CRC32C does not match what was written"
+		return result
+	}
+
+	start = time.Now()
+	rc, err := obj.NewReader(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("read: %v", err)
+		return result
+	}
+	defer rc.Close()
+	got := crc32.New(crc32cTable)
+	// NewReader returns once the response headers are in, which is as close to the first
+	// byte as the client gets.
+	result.FirstByte = time.Since(start)
+	n, err := io.Copy(got, rc)
+	result.Read = time.Since(start)
+	switch {
+	case err != nil:
+		result.Error = fmt.Sprintf("read: %v", err)
+	case n != size:
+		result.Error = fmt.Sprintf("read %d of %d bytes", n, size)
+	case got.Sum32() != want.Sum32():
+		result.Error = "read-back CRC32C does not match what was written"
+	default:
+		result.Verified = true
+	}
+	return result
+}
+
+func printSoakResults(w http.ResponseWriter, bucket, prefix string, results []SoakSize) {
+	fmt.Fprintf(w, "Soak (gs://%s/%s):\n", bucket, prefix)
+	for _, s := range results {
+		fmt.Fprintf(w, "| %9s: ", formatBytes(uint64(s.Size)))
+		if s.Skipped {
+			fmt.Fprintln(w, "SKIPPED (out of time)")
+			continue
+		}
+		if s.Error != "" {
+			fmt.Fprintf(w, "FAIL - %s\n", s.Error)
+			continue
+		}
+		fmt.Fprintf(w, "write %s (%.1f MiB/s), read %s (%.1f MiB/s, first byte %s), verified\n",
+			s.Write.Round(time.Millisecond), s.writeMBps(),
+			s.Read.Round(time.Millisecond), s.readMBps(), s.FirstByte.Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,148 @@
+package gcf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Stop causes, as StopCause.Cause reports them. A bare "context deadline exceeded"
+// looks the same whichever layer set the deadline, so each layer that can stop a run
+// sets its own cause.
+const (
+	// StopBudget is the run's time budget, from X-Request-Timeout or ?timeout=.
+	StopBudget = "budget"
+	// StopCheckTimeout is CHECK_TIMEOUT, or a timeout a check sets on one of its calls.
+	StopCheckTimeout = "checkTimeout"
+	// StopClientDisconnect is the caller closing the connection before the report.
+	StopClientDisconnect = "clientDisconnect"
+	// StopServerDeadline is the API giving up on its own deadline while the run still
+	// had time.
+	StopServerDeadline = "serverDeadline"
+)
+
+var (
+	errBudgetExhausted = errors.New("the run's time budget ran out")
+	errCheckTimedOut   = errors.New("the check ran longer than CHECK_TIMEOUT")
+	errClientGone      = errors.New("the caller disconnected")
+)
+
+// StopCause says what cut a check or run short, and in which phase: the checks that
+// were running, or outside the checks when none was.
+type StopCause struct {
+	Cause   string `json:"cause"`
+	Phase   string `json:"phase,omitempty"`
+	Message string `json:"message"`
+}
+
+func (s *StopCause) String() string {
+	if s.Phase == "" {
+		return s.Message
+	}
+	return fmt.Sprintf("%s (phase: %s)", s.Message, s.Phase)
+}
+
+type phaseKey struct{}
+
+// withPhase names the part of the run ctx is used for, so a stop can be placed.
+func withPhase(ctx context.Context, phase string) context.Context {
+	return context.WithValue(ctx, phaseKey{}, phase)
+}
+
+func phaseFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	phase, _ := ctx.Value(phaseKey{}).(string)
+	return phase
+}
+
+// withClientDisconnect detaches ctx from the request's own cancellation and cancels it
+// with errClientGone instead once the caller goes away, so the cause survives into
+// every context derived from it.
+func withClientDisconnect(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() { cancel(errClientGone) })
+	return detached, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
+// withCheckTimeout bounds one check by CHECK_TIMEOUT and names it as the phase.
+func withCheckTimeout(ctx context.Context, name string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx = withPhase(ctx, name)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w (%s)", errCheckTimedOut, timeout))
+}
+
+// classifyStop explains err when it, or ctx ending, stopped the work: the cause set on
+// ctx when ctx is done, a context error from a timeout inside the check, or the
+// server's own deadline. Other errors, and nil, aren't stops.
+func classifyStop(ctx context.Context, err error) *StopCause {
+	if err == nil {
+		return nil
+	}
+	phase := phaseFrom(ctx)
+	if ctx != nil && ctx.Err() != nil {
+		cause := context.Cause(ctx)
+		switch {
+		case errors.Is(cause, errBudgetExhausted):
+			return &StopCause{Cause: StopBudget, Phase: phase, Message: cause.Error()}
+		case errors.Is(cause, errCheckTimedOut):
+			return &StopCause{Cause: StopCheckTimeout, Phase: phase, Message: cause.Error()}
+		case errors.Is(cause, errClientGone):
+			return &StopCause{Cause: StopClientDisconnect, Phase: phase, Message: cause.Error()}
+		}
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &StopCause{Cause: StopCheckTimeout, Phase: phase, Message: "a timeout the check sets on its own calls ran out"}
+	case serverDeadline(err):
+		return &StopCause{Cause: StopServerDeadline, Phase: phase, Message: "the API's own deadline passed: " + decodeError(err).Message}
+	}
+	return nil
+}
+
+// serverDeadline reports whether the API, not this function, gave up: a 504 from a
+// JSON API or a gRPC DEADLINE_EXCEEDED while the caller's context was still live.
+func serverDeadline(err error) bool {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return gErr.Code == http.StatusGatewayTimeout
+	}
+	if st, ok := status.FromError(err); ok {
+		// The client reports its own context's deadline with the same code.
+		return st.Code() == codes.DeadlineExceeded && st.Message() != context.DeadlineExceeded.Error()
+	}
+	return false
+}
+
+// runStop explains why the whole run stopped short, if it did: the run context's
+// cause, placed in the checks it cut short.
+func runStop(ctx context.Context, checks []CheckResult) *StopCause {
+	stop := classifyStop(ctx, ctx.Err())
+	if stop == nil {
+		return nil
+	}
+	var phases []string
+	for _, c := range checks {
+		if c.Stop != nil && c.Stop.Cause == stop.Cause {
+			phases = append(phases, c.Name)
+		}
+	}
+	stop.Phase = "outside the checks"
+	if len(phases) > 0 {
+		stop.Phase = strings.Join(phases, ", ")
+	}
+	return stop
+}
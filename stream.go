@@ -0,0 +1,327 @@
+package gcf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	streamChunkSize      = 256 << 10
+	streamBufferSize     = 1 << 20
+	signedURLFallbackTTL = 15 * time.Minute
+	// streamProgressTTL is how long a stopped stream can be resumed.
+	streamProgressTTL = time.Hour
+	// maxStreamProgress bounds how many streams are remembered at once.
+	maxStreamProgress = 1024
+)
+
+var errSlowClient = errors.New("client is not reading fast enough")
+
+// byteRange is one HTTP byte range as storage range readers take it: Offset from the
+// start, or from the end when negative, and Length bytes, -1 meaning to the end.
+type byteRange struct {
+	Offset int64
+	Length int64
+}
+
+var fullRange = byteRange{Length: -1}
+
+func (br byteRange) IsFull() bool { return br == fullRange }
+
+func (br byteRange) String() string {
+	switch {
+	case br.Offset < 0:
+		return fmt.Sprintf("bytes=%d", br.Offset)
+	case br.Length < 0:
+		return fmt.Sprintf("bytes=%d-", br.Offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", br.Offset, br.Offset+br.Length-1)
+}
+
+// parseByteRange reads a single range such as "bytes=0-1023", "bytes=1024-" or
+// "bytes=-1024" (the last 1KiB); the "bytes=" unit is optional and "" is the whole object.
+func parseByteRange(spec string) (byteRange, error) {
+	spec = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(spec), "bytes="))
+	if spec == "" {
+		return fullRange, nil
+	}
+	if strings.Contains(spec, ",") {
+		return fullRange, errors.New("only a single byte range is supported")
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return fullRange, fmt.Errorf("invalid byte range %q", spec)
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return fullRange, fmt.Errorf("invalid byte range %q", spec)
+		}
+		return byteRange{Offset: -n, Length: -1}, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return fullRange, fmt.Errorf("invalid byte range %q", spec)
+	}
+	if last == "" {
+		return byteRange{Offset: start, Length: -1}, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return fullRange, fmt.Errorf("invalid byte range %q", spec)
+	}
+	return byteRange{Offset: start, Length: end - start + 1}, nil
+}
+
+type StreamProgress struct {
+	Bucket     string
+	Object     string
+	Generation int64
+	Offset     int64
+	Size       int64
+	Stalled    bool
+	UpdatedAt  time.Time
+}
+
+// streamKey is whose stream of which object a StreamProgress is, so one caller never
+// resumes from another's offset, nor from another bucket's object of the same name.
+type streamKey struct {
+	bucket, object, caller string
+}
+
+// streamProgress remembers how far each caller's stream of an object got, for up to
+// streamProgressTTL, so a stalled download can be resumed with ?resume=true. Finished
+// streams are forgotten.
+var streamProgress = struct {
+	sync.Mutex
+	byStream map[streamKey]StreamProgress
+}{byStream: map[streamKey]StreamProgress{}}
+
+func loadStreamProgress(key streamKey) (StreamProgress, bool) {
+	streamProgress.Lock()
+	defer streamProgress.Unlock()
+	p, ok := streamProgress.byStream[key]
+	if ok && time.Since(p.UpdatedAt) >= streamProgressTTL {
+		delete(streamProgress.byStream, key)
+		return StreamProgress{}, false
+	}
+	return p, ok
+}
+
+// saveStreamProgress records p under key, first dropping expired progress and then,
+// while the map is full, the oldest.
+func saveStreamProgress(key streamKey, p StreamProgress) {
+	streamProgress.Lock()
+	defer streamProgress.Unlock()
+	p.UpdatedAt = time.Now().UTC()
+	for k, old := range streamProgress.byStream {
+		if time.Since(old.UpdatedAt) >= streamProgressTTL {
+			delete(streamProgress.byStream, k)
+		}
+	}
+	delete(streamProgress.byStream, key)
+	for len(streamProgress.byStream) >= maxStreamProgress {
+		var oldest streamKey
+		var oldestAt time.Time
+		for k, old := range streamProgress.byStream {
+			if oldestAt.IsZero() || old.UpdatedAt.Before(oldestAt) {
+				oldest, oldestAt = k, old.UpdatedAt
+			}
+		}
+		delete(streamProgress.byStream, oldest)
+	}
+	streamProgress.byStream[key] = p
+}
+
+func dropStreamProgress(key streamKey) {
+	streamProgress.Lock()
+	defer streamProgress.Unlock()
+	delete(streamProgress.byStream, key)
+}
+
+// backpressureWriter buffers writes to the client and gives up when a single
+// flush to the client takes longer than stallTimeout.
+type backpressureWriter struct {
+	rc           *http.ResponseController
+	buf          *bufio.Writer
+	stallTimeout time.Duration
+	written      int64
+}
+
+func newBackpressureWriter(w http.ResponseWriter, stallTimeout time.Duration) *backpressureWriter {
+	bw := &backpressureWriter{rc: http.NewResponseController(w), stallTimeout: stallTimeout}
+	bw.buf = bufio.NewWriterSize(deadlineWriter{bw: bw, w: w}, streamBufferSize)
+	return bw
+}
+
+func (bw *backpressureWriter) Write(p []byte) (int, error) {
+	n, err := bw.buf.Write(p)
+	bw.written += int64(n)
+	return n, err
+}
+
+func (bw *backpressureWriter) Flush() error {
+	if err := bw.buf.Flush(); err != nil {
+		return err
+	}
+	return bw.rc.Flush()
+}
+
+type deadlineWriter struct {
+	bw *backpressureWriter
+	w  io.Writer
+}
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	// Not every ResponseWriter supports deadlines; in that case the write simply blocks.
+	deadlineSet := d.bw.rc.SetWriteDeadline(time.Now().Add(d.bw.stallTimeout)) == nil
+	start := time.Now()
+	n, err := d.w.Write(p)
+	if deadlineSet {
+		_ = d.bw.rc.SetWriteDeadline(time.Time{})
+	}
+	if err != nil && time.Since(start) >= d.bw.stallTimeout {
+		return n, errSlowClient
+	}
+	return n, err
+}
+
+// rangeNotSatisfiable reports whether err is GCS refusing a range that lies past the
+// end of the object: a 416 (InvalidRange) over JSON/XML, OutOfRange over gRPC.
+func rangeNotSatisfiable(err error) bool {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return gErr.Code == http.StatusRequestedRangeNotSatisfiable
+	}
+	return status.Code(err) == codes.OutOfRange
+}
+
+// streamObjectHandler streams an object to the caller, e.g. /stream?object=NAME.
+// With fallback=signed-url, an object whose previous stream stalled is served as a
+// redirect to a signed URL instead of being streamed again. A Range header or
+// ?range=bytes=0-1023 serves part of the object as a 206. With resume=true the caller's
+// last stream of the object continues where it stopped, from the same generation.
+func streamObjectHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	ctx = withLang(ctx, requestLang(r))
+	query := r.URL.Query()
+
+	objectName := query.Get("object")
+	if objectName == "" {
+		http.Error(w, "object parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating storage client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+	bucket := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId)
+
+	key := streamKey{bucket: cfg.BucketName, object: objectName, caller: callerCacheKey(r)}
+	progress, known := loadStreamProgress(key)
+	if known && progress.Stalled && query.Get("fallback") == "signed-url" {
+		url, err := signedObjectURL(ctx, bucket, objectName, http.MethodGet, signedURLFallbackTTL)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error signing URL: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Client stalled on %s before; redirecting to signed URL\n", safeObjectName(objectName))
+		http.Redirect(w, r, url, http.StatusSeeOther)
+		return
+	}
+
+	// An invalid Range header is ignored and the whole object served, as RFC 9110
+	// requires; only an explicit ?range= is refused. Ranges the object can't satisfy
+	// are answered with 416 once GCS says so.
+	rng := fullRange
+	if spec := query.Get("range"); spec != "" {
+		if rng, err = parseByteRange(spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if header, err := parseByteRange(r.Header.Get("Range")); err == nil {
+		rng = header
+	}
+	obj := bucket.Object(objectName)
+	resume := query.Get("resume") == "true" && known
+	if resume {
+		if !rng.IsFull() {
+			http.Error(w, "resume and range can't be combined", http.StatusBadRequest)
+			return
+		}
+		rng.Offset = progress.Offset
+		// Continuing from another generation would splice two versions of the object.
+		obj = obj.Generation(progress.Generation)
+	}
+
+	rc, err := obj.NewRangeReader(ctx, rng.Offset, rng.Length)
+	if err != nil {
+		if resume && errors.Is(err, storage.ErrObjectNotExist) {
+			dropStreamProgress(key)
+			http.Error(w, fmt.Sprintf("Generation %d of %s was replaced or deleted; stream it again without resume", progress.Generation, safeObjectName(objectName)), http.StatusPreconditionFailed)
+			return
+		}
+		if rangeNotSatisfiable(err) {
+			http.Error(w, fmt.Sprintf("Range %s not satisfiable: %v", rng, err), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		log.Printf("Failed to stream %s: %v\n", safeObjectName(objectName), err)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(apiErrorStatus(err))
+		handleError(ctx, w, err)
+		return
+	}
+	defer rc.Close()
+
+	offset := rc.Attrs.StartOffset
+	size := rc.Attrs.Size
+	w.Header().Set("Content-Type", rc.Attrs.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(rc.Remain(), 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("X-Stream-Offset", strconv.FormatInt(offset, 10))
+	if !rng.IsFull() {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+rc.Remain()-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	bw := newBackpressureWriter(w, cfg.StreamStallTimeout)
+	_, copyErr := io.CopyBuffer(bw, rc, make([]byte, streamChunkSize))
+	if copyErr == nil {
+		copyErr = bw.Flush()
+	}
+
+	// Bytes still sitting in the buffer never reached the client.
+	sent := bw.written - int64(bw.buf.Buffered())
+	if copyErr == nil {
+		dropStreamProgress(key)
+		return
+	}
+	saveStreamProgress(key, StreamProgress{
+		Bucket:     cfg.BucketName,
+		Object:     objectName,
+		Generation: rc.Attrs.Generation,
+		Offset:     offset + sent,
+		Size:       size,
+		Stalled:    errors.Is(copyErr, errSlowClient),
+	})
+	log.Printf("Stream of %s stopped at %d/%d bytes: %v\n", safeObjectName(objectName), offset+sent, size, copyErr)
+}
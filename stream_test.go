@@ -0,0 +1,107 @@
+package gcf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStreamObjectHandlerStatus(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusOK
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status != http.StatusOK {
+			writeFakeJSON(w, status, map[string]any{"error": map[string]any{"code": status, "message": http.StatusText(status)}})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Range", "bytes 0-1/3")
+		w.Header().Set("X-Goog-Generation", "1")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("ab"))
+	})
+	setTestEnv(t, nil)
+
+	tests := []struct {
+		name       string
+		target     string
+		header     string
+		status     int
+		wantStatus int
+	}{
+		{name: "range", target: "/stream?object=a&range=bytes=0-1", status: http.StatusOK, wantStatus: http.StatusPartialContent},
+		{name: "malformed range", target: "/stream?object=a&range=bytes=5-1", wantStatus: http.StatusBadRequest},
+		{name: "malformed Range header", target: "/stream?object=a", header: "bytes=5-1", status: http.StatusOK, wantStatus: http.StatusOK},
+		{name: "Range header", target: "/stream?object=a", header: "bytes=0-1", status: http.StatusOK, wantStatus: http.StatusPartialContent},
+		{name: "range past the end", target: "/stream?object=a&range=bytes=10-", status: http.StatusRequestedRangeNotSatisfiable, wantStatus: http.StatusRequestedRangeNotSatisfiable},
+		{name: "forbidden range", target: "/stream?object=a&range=bytes=0-1", status: http.StatusForbidden, wantStatus: http.StatusForbidden},
+		{name: "missing object", target: "/stream?object=a&range=bytes=0-1", status: http.StatusNotFound, wantStatus: http.StatusNotFound},
+		{name: "unavailable range", target: "/stream?object=a&range=bytes=0-1", status: http.StatusServiceUnavailable, wantStatus: http.StatusBadGateway},
+		{name: "forbidden whole object", target: "/stream?object=a", status: http.StatusForbidden, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			status = tt.status
+			mu.Unlock()
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("Range", tt.header)
+			}
+			streamObjectHandler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d; body:\n%s", rec.Code, tt.wantStatus, strings.TrimSpace(rec.Body.String()))
+			}
+		})
+	}
+}
+
+func TestStreamResumeIsPerCallerAndGeneration(t *testing.T) {
+	var mu sync.Mutex
+	var generation, rangeHeader string
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		generation, rangeHeader = r.URL.Query().Get("generation"), r.Header.Get("Range")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Goog-Generation", "7")
+		if rangeHeader != "" {
+			w.Header().Set("Content-Range", "bytes 2-2/3")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("c"))
+			return
+		}
+		w.Write([]byte("abc"))
+	})
+	setTestEnv(t, nil)
+
+	owner := httptest.NewRequest(http.MethodGet, "/stream?object=a&resume=true", nil)
+	key := streamKey{bucket: "diag-bucket", object: "a", caller: callerCacheKey(owner)}
+	saveStreamProgress(key, StreamProgress{Bucket: "diag-bucket", Object: "a", Generation: 7, Offset: 2, Size: 3})
+	t.Cleanup(func() { dropStreamProgress(key) })
+
+	other := httptest.NewRequest(http.MethodGet, "/stream?object=a&resume=true", nil)
+	other.RemoteAddr = "198.51.100.9:1234"
+	streamObjectHandler(httptest.NewRecorder(), other)
+	mu.Lock()
+	if generation != "" || rangeHeader != "" {
+		t.Errorf("another caller resumed: generation=%q Range=%q", generation, rangeHeader)
+	}
+	mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	streamObjectHandler(rec, owner)
+	mu.Lock()
+	defer mu.Unlock()
+	if generation != "7" || !strings.HasPrefix(rangeHeader, "bytes=2-") {
+		t.Errorf("resume read generation=%q Range=%q, want generation 7 from byte 2", generation, rangeHeader)
+	}
+	if _, ok := loadStreamProgress(key); ok {
+		t.Errorf("progress kept after the stream completed")
+	}
+}
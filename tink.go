@@ -0,0 +1,211 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"github.com/tink-crypto/tink-go-gcpkms/v2/integration/gcpkms"
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/core/cryptofmt"
+	"github.com/tink-crypto/tink-go/v2/core/registry"
+	"github.com/tink-crypto/tink-go/v2/keyset"
+	tinkpb "github.com/tink-crypto/tink-go/v2/proto/tink_go_proto"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// maxTinkObjectBytes caps the ciphertext checkTinkDecrypt holds in memory; tink's AEAD
+// decrypts whole messages, so larger objects are refused rather than cut short.
+const maxTinkObjectBytes = 64 << 20
+
+type TinkCheckResult struct {
+	Object         string
+	PrimaryKeyID   uint32
+	Keys           int
+	KeyTypes       []string
+	DecryptedBy    uint32
+	PlaintextBytes int
+	PlaintextKind  string
+	Error          string
+}
+
+// Err summarizes the outcome as an error for the check matrix.
+func (r TinkCheckResult) Err() error {
+	if r.Error != "" {
+		return errors.New(r.Error)
+	}
+	return nil
+}
+
+// tinkKMS is the KMS client tink unwraps keysets with and resolves the KEKs of KMS
+// envelope keys through. It is registered once, on first use.
+var tinkKMS struct {
+	sync.Mutex
+	client registry.KMSClient
+}
+
+func tinkKMSClient(ctx context.Context) (registry.KMSClient, error) {
+	tinkKMS.Lock()
+	defer tinkKMS.Unlock()
+	if tinkKMS.client != nil {
+		return tinkKMS.client, nil
+	}
+	client, err := gcpkms.NewClientWithOptions(ctx, "gcp-kms://")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS client: %v", err)
+	}
+	registry.RegisterKMSClient(client)
+	tinkKMS.client = client
+	return client, nil
+}
+
+// checkTinkDecrypt fetches a KMS-wrapped Tink keyset from Secret Manager, unwraps it
+// with the KEK and decrypts objectName with it, proving the whole client-side
+// decryption path works from the function's identity. Any AEAD key tink supports
+// works, KMS envelope keys included.
+func checkTinkDecrypt(ctx context.Context, bucket *storage.BucketHandle, objectName string, cfg *GCloudFunctionConfig) TinkCheckResult {
+	result := TinkCheckResult{Object: objectName}
+
+	reader, err := fetchTinkKeyset(ctx, cfg.TinkKeysetSecret)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	kms, err := tinkKMSClient(ctx)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	kek, err := kms.GetAEAD("gcp-kms://" + strings.TrimPrefix(cfg.TinkKEK, "gcp-kms://"))
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to use KEK: %v", err)
+		return result
+	}
+	handle, err := keyset.Read(reader, kek)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to unwrap keyset: %v", err)
+		return result
+	}
+	info := handle.KeysetInfo()
+	result.PrimaryKeyID, result.Keys = info.GetPrimaryKeyId(), len(info.GetKeyInfo())
+	for _, key := range info.GetKeyInfo() {
+		result.KeyTypes = append(result.KeyTypes, strings.TrimPrefix(key.GetTypeUrl(), "type.googleapis.com/google.crypto.tink."))
+	}
+	primitive, err := aead.New(handle)
+	if err != nil {
+		result.Error = fmt.Sprintf("keyset is not an AEAD keyset: %v", err)
+		return result
+	}
+
+	ciphertext, err := readTinkObject(ctx, bucket.Object(objectName))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	plaintext, err := primitive.Decrypt(ciphertext, []byte(cfg.TinkAssociatedData))
+	if err != nil {
+		result.Error = fmt.Sprintf("no key in the keyset could decrypt the object: %v", err)
+		return result
+	}
+	result.DecryptedBy = tinkCiphertextKeyID(info, ciphertext)
+	result.PlaintextBytes = len(plaintext)
+	result.PlaintextKind = describePlaintext(plaintext)
+	return result
+}
+
+// readTinkObject reads the whole ciphertext, refusing objects over maxTinkObjectBytes.
+func readTinkObject(ctx context.Context, obj *storage.ObjectHandle) ([]byte, error) {
+	tooLarge := func(size int64) error {
+		return fmt.Errorf("object is %s, over the %s Tink decryption limit", formatBytes(uint64(size)), formatBytes(maxTinkObjectBytes))
+	}
+	rc, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	defer rc.Close()
+	if rc.Attrs.Size > maxTinkObjectBytes {
+		return nil, tooLarge(rc.Attrs.Size)
+	}
+	// The size can be unknown, e.g. when GCS decompresses on the fly.
+	ciphertext, err := io.ReadAll(io.LimitReader(rc, maxTinkObjectBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	if len(ciphertext) > maxTinkObjectBytes {
+		return nil, tooLarge(int64(len(ciphertext)))
+	}
+	return ciphertext, nil
+}
+
+// tinkCiphertextKeyID is the key named by the ciphertext's output prefix, or 0 when
+// a RAW key, which has no prefix, decrypted it.
+func tinkCiphertextKeyID(info *tinkpb.KeysetInfo, ciphertext []byte) uint32 {
+	if len(ciphertext) < cryptofmt.NonRawPrefixSize {
+		return 0
+	}
+	id := binary.BigEndian.Uint32(ciphertext[1:cryptofmt.NonRawPrefixSize])
+	for _, key := range info.GetKeyInfo() {
+		if key.GetKeyId() == id && key.GetOutputPrefixType() != tinkpb.OutputPrefixType_RAW {
+			return id
+		}
+	}
+	return 0
+}
+
+// fetchTinkKeyset reads the encrypted keyset secret, in either Tink's JSON format or
+// as a binary EncryptedKeyset proto.
+func fetchTinkKeyset(ctx context.Context, secretVersion string) (keyset.Reader, error) {
+	svc, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Secret Manager client: %v", err)
+	}
+	resp, err := svc.Projects.Secrets.Versions.Access(secretVersion).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to access keyset secret: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keyset secret: %v", err)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return keyset.NewJSONReader(bytes.NewReader(trimmed)), nil
+	}
+	return keyset.NewBinaryReader(bytes.NewReader(data)), nil
+}
+
+func describePlaintext(plaintext []byte) string {
+	switch {
+	case json.Valid(plaintext):
+		return "JSON"
+	case utf8.Valid(plaintext):
+		return "UTF-8 text"
+	default:
+		return "binary"
+	}
+}
+
+func printTinkCheck(w http.ResponseWriter, result TinkCheckResult) {
+	fmt.Fprintf(w, "Tink Decryption (%s):\n", safeObjectName(result.Object))
+	if result.Keys > 0 {
+		fmt.Fprintf(w, "| Keyset: %d keys (%s), primary %d\n", result.Keys, strings.Join(result.KeyTypes, ", "), result.PrimaryKeyID)
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "| Result: FAILED (%s)\n", result.Error)
+		return
+	}
+	by := "a RAW key"
+	if result.DecryptedBy != 0 {
+		by = fmt.Sprintf("key %d", result.DecryptedBy)
+	}
+	fmt.Fprintf(w, "| Result: OK, decrypted with %s (%d bytes, %s)\n", by, result.PlaintextBytes, result.PlaintextKind)
+}
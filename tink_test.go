@@ -0,0 +1,85 @@
+package gcf
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/keyset"
+	tinkpb "github.com/tink-crypto/tink-go/v2/proto/tink_go_proto"
+)
+
+func TestTinkCiphertextKeyID(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		template *tinkpb.KeyTemplate
+		wantID   bool
+	}{
+		{name: "tink prefix", template: aead.AES256GCMKeyTemplate(), wantID: true},
+		{name: "raw", template: aead.AES256GCMNoPrefixKeyTemplate()},
+		{name: "chacha20", template: aead.XChaCha20Poly1305KeyTemplate(), wantID: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, err := keyset.NewHandle(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			primitive, err := aead.New(handle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciphertext, err := primitive.Encrypt([]byte(`{"ok":true}`), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := handle.KeysetInfo()
+			want := uint32(0)
+			if tt.wantID {
+				want = info.GetPrimaryKeyId()
+			}
+			if got := tinkCiphertextKeyID(info, ciphertext); got != want {
+				t.Errorf("tinkCiphertextKeyID() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestReadTinkObjectRefusesLargeObjects(t *testing.T) {
+	size := 0
+	newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Header().Set("X-Goog-Generation", "1")
+		w.Write(bytes.Repeat([]byte{'x'}, size))
+	})
+	setTestEnv(t, nil)
+	client, err := createStorageClientWithOAuth(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	obj := client.Bucket("diag-bucket").Object("sealed")
+
+	for _, tt := range []struct {
+		size    int
+		wantErr string
+	}{
+		{size: 16},
+		{size: maxTinkObjectBytes},
+		{size: maxTinkObjectBytes + 1, wantErr: "over the 64.0 MiB Tink decryption limit"},
+	} {
+		size = tt.size
+		got, err := readTinkObject(context.Background(), obj)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("size %d: readTinkObject() = %v", tt.size, err)
+		case tt.wantErr == "" && len(got) != tt.size:
+			t.Errorf("size %d: read %d bytes", tt.size, len(got))
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("size %d: readTinkObject() = %v, want %q", tt.size, err, tt.wantErr)
+		}
+	}
+}
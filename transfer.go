@@ -0,0 +1,277 @@
+package gcf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	storagetransfer "google.golang.org/api/storagetransfer/v1"
+)
+
+const (
+	defaultTransferOperations = 5
+	maxTransferOperations     = 50
+)
+
+// transferReadRoles are the predefined roles that let the transfer service agent read
+// and write objects in a bucket; custom roles are listed but not judged.
+var transferReadRoles = map[string]bool{
+	"roles/storage.admin":              true,
+	"roles/storage.objectAdmin":        true,
+	"roles/storage.objectViewer":       true,
+	"roles/storage.objectUser":         true,
+	"roles/storage.legacyBucketReader": true,
+	"roles/storage.legacyBucketWriter": true,
+	"roles/storage.legacyBucketOwner":  true,
+}
+
+type TransferOperationSummary struct {
+	Name        string
+	Status      string
+	StartTime   string
+	EndTime     string
+	ObjectsDone int64
+	BytesDone   int64
+	Failed      int64
+	Errors      []TransferErrorBreakdown
+}
+
+type TransferErrorBreakdown struct {
+	Code    string
+	Count   int64
+	Samples []string
+}
+
+type TransferJobReport struct {
+	Job          string
+	Project      string
+	Status       string
+	Description  string
+	Source       string
+	Sink         string
+	Operations   []TransferOperationSummary
+	ServiceAgent string
+	Bucket       string
+	AgentRoles   []string
+	AgentAccess  bool
+	Error        string
+	AccessError  string
+}
+
+// transferHandler reports the state of a Storage Transfer Service job, e.g.
+// /transfer?job=transferJobs/123&operations=5. The job's service agent is checked
+// against the configured bucket's IAM policy, since migrations fail on that hop too.
+func transferHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+
+	job := r.URL.Query().Get("job")
+	if job == "" {
+		http.Error(w, "job parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(job, "transferJobs/") {
+		job = "transferJobs/" + job
+	}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		project = cfg.ComputeProjectId
+	}
+	limit := queryInt(r, "operations", defaultTransferOperations, maxTransferOperations)
+
+	report := describeTransferJob(ctx, project, job, limit)
+	report.Bucket = cfg.BucketName
+	if report.ServiceAgent != "" && report.Bucket != "" {
+		report.AgentRoles, report.AccessError = bucketRolesFor(ctx, cfg.BucketName, "serviceAccount:"+report.ServiceAgent)
+		for _, role := range report.AgentRoles {
+			if transferReadRoles[role] {
+				report.AgentAccess = true
+			}
+		}
+	}
+	printTransferJobReport(w, report)
+}
+
+func describeTransferJob(ctx context.Context, project, job string, limit int) TransferJobReport {
+	report := TransferJobReport{Job: job, Project: project}
+
+	svc, err := storagetransfer.NewService(ctx)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to create Storage Transfer client: %v", err)
+		return report
+	}
+
+	transferJob, err := svc.TransferJobs.Get(job, project).Context(ctx).Do()
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to get transfer job: %v", err)
+		return report
+	}
+	report.Status = transferJob.Status
+	report.Description = transferJob.Description
+	if spec := transferJob.TransferSpec; spec != nil {
+		report.Source, report.Sink = describeTransferSpec(spec)
+	}
+
+	if agent, err := svc.GoogleServiceAccounts.Get(project).Context(ctx).Do(); err == nil {
+		report.ServiceAgent = agent.AccountEmail
+	} else {
+		report.AccessError = fmt.Sprintf("failed to look up the transfer service agent: %v", err)
+	}
+
+	filter, _ := json.Marshal(map[string]interface{}{
+		"projectId": project,
+		"jobNames":  []string{job},
+	})
+	resp, err := svc.TransferOperations.List("transferOperations", string(filter)).PageSize(int64(limit)).Context(ctx).Do()
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to list transfer operations: %v", err)
+		return report
+	}
+	for _, op := range resp.Operations {
+		report.Operations = append(report.Operations, summarizeTransferOperation(op))
+	}
+	// Newest first; RFC 3339 timestamps sort lexically.
+	sort.Slice(report.Operations, func(i, j int) bool {
+		return report.Operations[i].StartTime > report.Operations[j].StartTime
+	})
+	if len(report.Operations) > limit {
+		report.Operations = report.Operations[:limit]
+	}
+	return report
+}
+
+func summarizeTransferOperation(op *storagetransfer.Operation) TransferOperationSummary {
+	summary := TransferOperationSummary{Name: op.Name}
+	var metadata storagetransfer.TransferOperation
+	if err := json.Unmarshal(op.Metadata, &metadata); err != nil {
+		summary.Status = "UNKNOWN"
+		return summary
+	}
+	summary.Status = metadata.Status
+	summary.StartTime, summary.EndTime = metadata.StartTime, metadata.EndTime
+	if c := metadata.Counters; c != nil {
+		summary.ObjectsDone = c.ObjectsCopiedToSink
+		summary.BytesDone = c.BytesCopiedToSink
+		summary.Failed = c.ObjectsFromSourceFailed
+	}
+	for _, breakdown := range metadata.ErrorBreakdowns {
+		errs := TransferErrorBreakdown{Code: breakdown.ErrorCode, Count: breakdown.ErrorCount}
+		for _, entry := range breakdown.ErrorLogEntries {
+			sample := entry.Url
+			if len(entry.ErrorDetails) > 0 {
+				sample += ": " + entry.ErrorDetails[0]
+			}
+			errs.Samples = append(errs.Samples, sample)
+		}
+		summary.Errors = append(summary.Errors, errs)
+	}
+	return summary
+}
+
+func describeTransferSpec(spec *storagetransfer.TransferSpec) (source, sink string) {
+	switch {
+	case spec.GcsDataSource != nil:
+		source = "gs://" + spec.GcsDataSource.BucketName + "/" + spec.GcsDataSource.Path
+	case spec.AwsS3DataSource != nil:
+		source = "s3://" + spec.AwsS3DataSource.BucketName + "/" + spec.AwsS3DataSource.Path
+	case spec.AzureBlobStorageDataSource != nil:
+		source = "azure://" + spec.AzureBlobStorageDataSource.StorageAccount + "/" + spec.AzureBlobStorageDataSource.Container
+	case spec.HttpDataSource != nil:
+		source = spec.HttpDataSource.ListUrl
+	case spec.PosixDataSource != nil:
+		source = "posix://" + spec.PosixDataSource.RootDirectory
+	default:
+		source = "other"
+	}
+	switch {
+	case spec.GcsDataSink != nil:
+		sink = "gs://" + spec.GcsDataSink.BucketName + "/" + spec.GcsDataSink.Path
+	case spec.PosixDataSink != nil:
+		sink = "posix://" + spec.PosixDataSink.RootDirectory
+	default:
+		sink = "other"
+	}
+	return source, sink
+}
+
+// bucketRolesFor lists the roles bound directly to member on the bucket. Grants via
+// groups or at the project level are not visible here.
+func bucketRolesFor(ctx context.Context, bucketName, member string) ([]string, string) {
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		return nil, fmt.Sprintf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	policy, err := client.Bucket(bucketName).IAM().V3().Policy(ctx)
+	if err != nil {
+		return nil, fmt.Sprintf("failed to read bucket IAM policy: %v", err)
+	}
+	var roles []string
+	for _, binding := range policy.Bindings {
+		for _, m := range binding.GetMembers() {
+			if m == member {
+				roles = append(roles, binding.GetRole())
+			}
+		}
+	}
+	return roles, ""
+}
+
+func printTransferJobReport(w http.ResponseWriter, report TransferJobReport) {
+	fmt.Fprintf(w, "Transfer Job (%s):\n", report.Job)
+	if report.Error != "" && report.Status == "" {
+		fmt.Fprintf(w, "| Error: %s\n", report.Error)
+		return
+	}
+	fmt.Fprintf(w, "| Status: %s\n", report.Status)
+	if report.Description != "" {
+		fmt.Fprintf(w, "| Description: %s\n", report.Description)
+	}
+	fmt.Fprintf(w, "| Source: %s\n", report.Source)
+	fmt.Fprintf(w, "| Sink: %s\n", report.Sink)
+	if report.Error != "" {
+		fmt.Fprintf(w, "| Error: %s\n", report.Error)
+	}
+
+	fmt.Fprintln(w, "Transfer Operations:")
+	if len(report.Operations) == 0 && report.Error == "" {
+		fmt.Fprintln(w, "| (none)")
+	}
+	for _, op := range report.Operations {
+		fmt.Fprintf(w, "| %s: %s (started %s", op.Name, op.Status, op.StartTime)
+		if op.EndTime != "" {
+			fmt.Fprintf(w, ", ended %s", op.EndTime)
+		}
+		fmt.Fprintf(w, ") %d objects, %d bytes copied, %d failed\n", op.ObjectsDone, op.BytesDone, op.Failed)
+		for _, e := range op.Errors {
+			fmt.Fprintf(w, "|   %s x%d\n", e.Code, e.Count)
+			for _, sample := range e.Samples {
+				fmt.Fprintf(w, "|     %s\n", sample)
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "Transfer Service Agent:")
+	if report.ServiceAgent != "" {
+		fmt.Fprintf(w, "| Account: %s\n", report.ServiceAgent)
+	}
+	switch {
+	case report.AccessError != "":
+		fmt.Fprintf(w, "| Access to %s: unknown (%s)\n", report.Bucket, report.AccessError)
+	case report.Bucket == "":
+		return
+	case report.AgentAccess:
+		fmt.Fprintf(w, "| Access to %s: OK (%s)\n", report.Bucket, strings.Join(report.AgentRoles, ", "))
+	case len(report.AgentRoles) > 0:
+		fmt.Fprintf(w, "| Access to %s: UNCERTAIN, only custom roles (%s)\n", report.Bucket, strings.Join(report.AgentRoles, ", "))
+	default:
+		fmt.Fprintf(w, "| Access to %s: MISSING, no bucket-level role is bound to the agent\n", report.Bucket)
+	}
+}
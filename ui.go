@@ -0,0 +1,103 @@
+package gcf
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// uiFiles is the single-page UI at /ui. It only calls the endpoints a CLI user would,
+// so it needs nothing the function doesn't already serve, and sits behind the same
+// FRONTEND_MODE authentication.
+//
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+// UIOptions is what the UI offers to choose from: the registered checks, whether each
+// is enabled under the selected profile, and the settings a run may change.
+type UIOptions struct {
+	Checks              []UICheck `json:"checks"`
+	Profiles            []string  `json:"profiles"`
+	Profile             string    `json:"profile,omitempty"`
+	Bucket              string    `json:"bucket"`
+	AllowConfigOverride bool      `json:"allowConfigOverride"`
+	DetailLevels        []string  `json:"detailLevels"`
+	DefaultDetail       string    `json:"defaultDetail"`
+	Error               string    `json:"error,omitempty"`
+}
+
+type UICheck struct {
+	Name    string   `json:"name"`
+	After   []string `json:"after,omitempty"`
+	Enabled bool     `json:"enabled"`
+}
+
+// uiHandler serves the UI at /ui and what it is filled in with at /ui/options, which
+// takes ?profile= like a run does.
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/ui", "/ui/":
+		page, err := uiFiles.ReadFile("ui/index.html")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("UI is missing from the build: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Write(page)
+	case "/ui/options":
+		options := uiOptions(r)
+		w.Header().Set("Content-Type", jsonContentType)
+		if options.Error != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(options)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func uiOptions(r *http.Request) UIOptions {
+	options := UIOptions{
+		AllowConfigOverride: defaultConfigSource.bool("ALLOW_CONFIG_OVERRIDE"),
+		DetailLevels:        []string{DetailSummary, DetailNormal, DetailVerbose},
+		DefaultDetail:       defaultDetail(),
+		Profile:             r.URL.Query().Get("profile"),
+		Checks:              []UICheck{},
+	}
+	profiles, err := configProfileNames(r.Context())
+	options.Profiles = profiles
+	if err != nil {
+		options.Error = err.Error()
+	}
+
+	cfg, err := requestConfig(r)
+	if err != nil {
+		if errors.Is(err, errUnknownProfile) || options.Error == "" {
+			options.Error = err.Error()
+		}
+		cfg = NewGCloudFunctionConfig()
+	}
+	options.Bucket = cfg.BucketName
+
+	pluginMu.Lock()
+	registered := slices.Clone(diagChecks)
+	pluginMu.Unlock()
+	for _, def := range registered {
+		options.Checks = append(options.Checks, UICheck{
+			Name:    def.name,
+			After:   def.after,
+			Enabled: def.enabled == nil || def.enabled(cfg),
+		})
+	}
+	return options
+}
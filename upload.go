@@ -0,0 +1,257 @@
+package gcf
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// uploadChunkAlign is the granularity resumable upload chunks must have.
+const uploadChunkAlign = 256 << 10
+
+const maxUploadFieldBytes = 4 << 10
+
+const maxObjectNameBytes = 1024
+
+// UploadResult is the stored object, as returned to the uploader.
+type UploadResult struct {
+	Bucket          string    `json:"bucket"`
+	Name            string    `json:"name"`
+	Size            int64     `json:"size"`
+	ContentType     string    `json:"contentType"`
+	ContentEncoding string    `json:"contentEncoding,omitempty"`
+	Generation      int64     `json:"generation"`
+	Metageneration  int64     `json:"metageneration"`
+	StorageClass    string    `json:"storageClass"`
+	CRC32C          string    `json:"crc32c"`
+	MD5             string    `json:"md5,omitempty"`
+	Created         time.Time `json:"created"`
+	// Temporary is set for uploads without a name, written under ARTIFACT_PREFIX and
+	// removed by /cleanup.
+	Temporary bool `json:"temporary,omitempty"`
+}
+
+// uploadRequest is what to write, from the query and, for multipart bodies, the form
+// fields that come before the file.
+type uploadRequest struct {
+	name        string
+	contentType string
+	gzip        bool
+	overwrite   bool
+	chunkSize   int
+}
+
+// uploadHandler writes the request body to the bucket with a storage.Writer, streaming
+// rather than buffering it. The body is either raw, e.g.
+// POST /upload?name=a/b.csv&gzip=true, or multipart/form-data whose first file part is
+// stored, with name and contentType allowed as form fields before it. Existing objects
+// are only replaced with ?overwrite=true. Uploads need ALLOW_UPLOADS=true.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.AllowUploads {
+		http.Error(w, "uploads are disabled; set ALLOW_UPLOADS=true to allow them", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	req := uploadRequest{
+		name:        q.Get("name"),
+		contentType: q.Get("contentType"),
+		gzip:        q.Get("gzip") == "true",
+		overwrite:   q.Get("overwrite") == "true",
+		chunkSize:   cfg.UploadChunkSize,
+	}
+	if v := q.Get("chunkSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n%uploadChunkAlign != 0 {
+			http.Error(w, fmt.Sprintf("chunkSize must be 0 (single request) or a multiple of %d", uploadChunkAlign), http.StatusBadRequest)
+			return
+		}
+		req.chunkSize = n
+	}
+
+	body, filename, err := uploadBody(r, &req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.name) > maxObjectNameBytes {
+		http.Error(w, fmt.Sprintf("Invalid upload: object names are at most %d bytes", maxObjectNameBytes), http.StatusBadRequest)
+		return
+	}
+
+	result := UploadResult{Bucket: cfg.BucketName}
+	var metadata map[string]string
+	if req.name == "" {
+		artifacts := cleanupFrom(ctx)
+		if filename == "" {
+			filename = "upload"
+		}
+		req.name = cfg.ArtifactPrefix + artifacts.runID + "/" + path.Base(filename)
+		metadata = artifacts.artifactMetadata()
+		result.Temporary = true
+	}
+
+	client, err := createStorageClientWithOAuth(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating storage client: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	obj := client.Bucket(cfg.BucketName).UserProject(cfg.ComputeProjectId).Object(req.name)
+	if !req.overwrite {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+	attrs, err := writeUpload(ctx, obj, body, req, metadata)
+	if err != nil {
+		status := http.StatusBadGateway
+		if decodeError(err).Category == "precondition" {
+			status = http.StatusConflict
+			err = fmt.Errorf("object %s already exists; add overwrite=true to replace it", safeObjectName(req.name))
+		}
+		http.Error(w, fmt.Sprintf("Upload failed: %v", err), status)
+		return
+	}
+
+	result.Name = attrs.Name
+	result.Size = attrs.Size
+	result.ContentType = attrs.ContentType
+	result.ContentEncoding = attrs.ContentEncoding
+	result.Generation = attrs.Generation
+	result.Metageneration = attrs.Metageneration
+	result.StorageClass = attrs.StorageClass
+	result.CRC32C = encodeCRC32C(attrs.CRC32C)
+	if len(attrs.MD5) > 0 {
+		result.MD5 = base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+	result.Created = attrs.Created
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Location", fmt.Sprintf("gs://%s/%s", result.Bucket, result.Name))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// uploadBody returns the bytes to store: the raw body, or the first file part of a
+// multipart form. It fills in req from the form fields and the part's headers.
+func uploadBody(r *http.Request, req *uploadRequest) (io.Reader, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if req.contentType == "" && mediaType != "" && mediaType != "application/octet-stream" {
+			req.contentType = r.Header.Get("Content-Type")
+		}
+		return r.Body, "", nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", errors.New("no file part in the form")
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldBytes))
+			if err != nil {
+				return nil, "", err
+			}
+			switch part.FormName() {
+			case "name":
+				if req.name == "" {
+					req.name = string(value)
+				}
+			case "contentType":
+				if req.contentType == "" {
+					req.contentType = string(value)
+				}
+			}
+			continue
+		}
+		if ct := part.Header.Get("Content-Type"); req.contentType == "" && ct != "" && ct != "application/octet-stream" {
+			req.contentType = ct
+		}
+		return part, part.FileName(), nil
+	}
+}
+
+// writeUpload streams body to obj. Without a content type from the caller it is
+// guessed from the object name's extension, then sniffed from the first bytes. With
+// gzip, the data is compressed on the way and stored with Content-Encoding: gzip, so
+// GCS serves it decompressed to clients that don't accept gzip.
+func writeUpload(ctx context.Context, obj *storage.ObjectHandle, body io.Reader, req uploadRequest, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	br := bufio.NewReaderSize(body, 512)
+	contentType := req.contentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(req.name))
+	}
+	if contentType == "" {
+		head, _ := br.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+
+	// Cancelling the writer's context is how a failed upload is abandoned.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := obj.NewWriter(ctx)
+	wc.ChunkSize = req.chunkSize
+	wc.ContentType = contentType
+	wc.Metadata = metadata
+
+	var dst io.Writer = wc
+	var gz *gzip.Writer
+	if req.gzip {
+		wc.ContentEncoding = "gzip"
+		gz = gzip.NewWriter(wc)
+		dst = gz
+	}
+	if _, err := io.Copy(dst, br); err != nil {
+		cancel()
+		wc.Close()
+		return nil, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			cancel()
+			wc.Close()
+			return nil, err
+		}
+	}
+	if err := wc.Close(); err != nil {
+		return nil, err
+	}
+	return wc.Attrs(), nil
+}
+
+// encodeCRC32C formats a CRC32C as GCS does: base64 of the big-endian bytes.
+func encodeCRC32C(crc uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], crc)
+	return base64.StdEncoding.EncodeToString(b[:])
+}
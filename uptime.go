@@ -0,0 +1,113 @@
+package gcf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const probeTimeout = 10 * time.Second
+
+// probeCheckNames are cheap enough to run on every uptime check: a metadata read
+// and a single-object list page.
+var probeCheckNames = []string{"bucket_access", "list_objects"}
+
+type probeOutcome struct {
+	checkedAt time.Time
+	failures  []string
+}
+
+// probeKey is what a probe's outcome depends on, so a profile or override probing
+// other resources, or as another identity, gets its own cached outcome.
+type probeKey struct {
+	bucket, project, target string
+}
+
+func probeKeyFor(cfg *GCloudFunctionConfig) probeKey {
+	return probeKey{bucket: cfg.BucketName, project: cfg.ComputeProjectId, target: cfg.TargetServiceAccount}
+}
+
+var probeCache struct {
+	sync.Mutex
+	outcomes map[probeKey]*probeOutcome
+}
+
+// uptimeProbeHandler is meant for Cloud Monitoring uptime checks: it answers within
+// probeTimeout with 200 or 500 and a one-line body, reusing a recent result for the
+// same bucket, project and identity when PROBE_CACHE_TTL allows.
+func uptimeProbeHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	key := probeKeyFor(cfg)
+	outcome := cachedProbeOutcome(key, cfg.ProbeCacheTTL)
+	if outcome == nil {
+		outcome = runProbeChecks(ctx, cfg)
+		storeProbeOutcome(key, outcome, cfg.ProbeCacheTTL)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	if len(outcome.failures) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "FAIL %s\n", strings.Join(outcome.failures, "; "))
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+func cachedProbeOutcome(key probeKey, ttl time.Duration) *probeOutcome {
+	probeCache.Lock()
+	defer probeCache.Unlock()
+	if last := probeCache.outcomes[key]; last != nil && time.Since(last.checkedAt) < ttl {
+		return last
+	}
+	return nil
+}
+
+// storeProbeOutcome caches outcome for key, dropping outcomes that have expired so
+// probes of many configurations don't accumulate.
+func storeProbeOutcome(key probeKey, outcome *probeOutcome, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	probeCache.Lock()
+	defer probeCache.Unlock()
+	if probeCache.outcomes == nil {
+		probeCache.outcomes = map[probeKey]*probeOutcome{}
+	}
+	for k, last := range probeCache.outcomes {
+		if time.Since(last.checkedAt) >= ttl {
+			delete(probeCache.outcomes, k)
+		}
+	}
+	probeCache.outcomes[key] = outcome
+}
+
+func runProbeChecks(ctx context.Context, cfg *GCloudFunctionConfig) *probeOutcome {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	outcome := &probeOutcome{checkedAt: time.Now()}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, name := range probeCheckNames {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := standaloneChecks[name](ctx, cfg); err != nil {
+				mu.Lock()
+				outcome.failures = append(outcome.failures, fmt.Sprintf("%s: %v", name, err))
+				mu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+	return outcome
+}
@@ -0,0 +1,109 @@
+package gcf
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set at build time, e.g.
+// go build -ldflags "-X github.com/andrew-woosnam/gcf-list-buckets.version=v1.2.3 -X github.com/andrew-woosnam/gcf-list-buckets.gitSHA=$(git rev-parse HEAD)"
+var (
+	version   = ""
+	gitSHA    = ""
+	buildTime = ""
+)
+
+// keyDependencies are the modules whose versions most often explain behavior differences.
+var keyDependencies = []string{
+	"cloud.google.com/go/storage",
+	"cloud.google.com/go/pubsub",
+	"cloud.google.com/go/kms",
+	"google.golang.org/api",
+	"golang.org/x/oauth2",
+}
+
+type BuildInfo struct {
+	Version      string            `json:"version"`
+	GitSHA       string            `json:"gitSha"`
+	BuildTime    string            `json:"buildTime"`
+	GoVersion    string            `json:"goVersion"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("version=%s commit=%s built=%s go=%s", b.Version, b.GitSHA, b.BuildTime, b.GoVersion)
+}
+
+// currentBuildInfo combines ldflags values with what the Go toolchain embedded in the binary.
+func currentBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:      version,
+		GitSHA:       gitSHA,
+		BuildTime:    buildTime,
+		GoVersion:    runtime.Version(),
+		Dependencies: map[string]string{},
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.GitSHA == "" {
+					info.GitSHA = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = setting.Value
+				}
+			}
+		}
+		for _, dep := range bi.Deps {
+			for _, key := range keyDependencies {
+				if dep.Path == key {
+					info.Dependencies[dep.Path] = dep.Version
+				}
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	if info.GitSHA == "" {
+		info.GitSHA = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentBuildInfo()); err != nil {
+		log.Printf("Failed to encode build info: %v\n", err)
+	}
+}
+
+// buildVersions lists every module compiled into the binary.
+func buildVersions() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "build info unavailable\n"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", currentBuildInfo())
+	for _, dep := range bi.Deps {
+		fmt.Fprintf(&b, "%s %s\n", dep.Path, dep.Version)
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+package gcf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultWatchInterval = 10 * time.Second
+	minWatchInterval     = 2 * time.Second
+	defaultWatchDuration = 5 * time.Minute
+	maxWatchDuration     = 55 * time.Minute
+)
+
+type WatchEvent struct {
+	Attempt  int       `json:"attempt"`
+	Check    string    `json:"check"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+}
+
+// watchHandler re-runs one check on an interval and streams each result as a
+// Server-Sent Event, e.g. /watch?check=bucket_access&interval=10s&duration=5m.
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, ctx, ok := handlerConfig(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+
+	name := query.Get("check")
+	check, ok := standaloneChecks[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("check must be one of %v", standaloneCheckNames()), http.StatusBadRequest)
+		return
+	}
+
+	interval := queryDuration(r, "interval", defaultWatchInterval)
+	if interval < minWatchInterval {
+		interval = minWatchInterval
+	}
+	duration := queryDuration(r, "duration", defaultWatchDuration)
+	if duration > maxWatchDuration {
+		duration = maxWatchDuration
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	deadline := time.Now().Add(duration)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := check(ctx, cfg)
+		event := WatchEvent{
+			Attempt:  attempt,
+			Check:    name,
+			Status:   CheckPass,
+			Time:     start.UTC(),
+			Duration: time.Since(start).Round(time.Millisecond).String(),
+		}
+		if err != nil {
+			event.Status = CheckFail
+			event.Error = err.Error()
+		}
+		writeSSE(w, "result", event)
+		flusher.Flush()
+
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	writeSSE(w, "done", map[string]string{"check": name})
+	flusher.Flush()
+}
+
+func writeSSE(w http.ResponseWriter, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		payload = []byte(fmt.Sprintf("%q", err.Error()))
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}